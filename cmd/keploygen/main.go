@@ -0,0 +1,381 @@
+// Command keploygen generates record/replay wrappers for Go interfaces.
+//
+// For every interface named on the command line it emits a Keploy<Interface>
+// type implementing the interface on top of another implementation. Every
+// method call goes through keploy.Call: in MODE_RECORD the call reaches the
+// wrapped implementation and its arguments and results are recorded in the
+// stubs file, in MODE_TEST the recorded results are returned instead.
+//
+// It is meant to be used with go:generate, like mockgen in source mode:
+//
+//	//go:generate keploygen -source=$GOFILE -destination=store_keploy.go UserStore PaymentClient
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const keployImport = "github.com/keploy/go-sdk/v2/keploy"
+
+var (
+	source        = flag.String("source", "", "Go source file declaring the interfaces.")
+	destination   = flag.String("destination", "", "Output file; defaults to stdout.")
+	packageName   = flag.String("package", "", "Package of the generated code; defaults to the package of the source file.")
+	sourceImport  = flag.String("source_package", "", "Import path of the source package, required when -package differs from it.")
+	wrapperPrefix = flag.String("prefix", "Keploy", "Prefix of the generated type names.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: keploygen -source=file.go [flags] Interface...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *source == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := generate(*source, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "keploygen:", err)
+		os.Exit(1)
+	}
+	if *destination == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*destination, src, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, "keploygen:", err)
+		os.Exit(1)
+	}
+}
+
+// generator holds the state of the generation of a single file.
+type generator struct {
+	fset   *token.FileSet
+	ifaces map[string]*ast.InterfaceType
+	// qualifier prefixes the identifiers declared in the source package when
+	// the generated code lives in another package.
+	qualifier string
+	imports   map[string]string // package name to import path
+	aliases   map[string]string // import path to the name given by the source file
+	used      map[string]bool   // import paths used by the generated code
+	buf       bytes.Buffer
+}
+
+func generate(file string, names []string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	g := &generator{
+		fset:    fset,
+		ifaces:  map[string]*ast.InterfaceType{},
+		imports: map[string]string{},
+		aliases: map[string]string{},
+		used:    map[string]bool{keployImport: true},
+	}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if it, ok := ts.Type.(*ast.InterfaceType); ok && ts.TypeParams == nil {
+				g.ifaces[ts.Name.Name] = it
+			}
+		}
+	}
+	for _, imp := range f.Imports {
+		p, _ := strconv.Unquote(imp.Path.Value)
+		if imp.Name != nil {
+			g.imports[imp.Name.Name] = p
+			g.aliases[p] = imp.Name.Name
+			continue
+		}
+		g.imports[importName(p, filepath.Dir(file))] = p
+	}
+
+	pkg := f.Name.Name
+	if *packageName != "" && *packageName != pkg {
+		if *sourceImport == "" {
+			return nil, errors.New("-source_package is required when -package differs from the package of the source file")
+		}
+		g.qualifier = pkg
+		g.imports[pkg] = *sourceImport
+		g.used[*sourceImport] = true
+		pkg = *packageName
+	}
+
+	for _, name := range names {
+		if err := g.wrapper(name); err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by keploygen. DO NOT EDIT.\n// Source: %s\n\n", path.Base(file))
+	fmt.Fprintf(&out, "package %s\n\nimport (\n", pkg)
+	var paths []string
+	for p := range g.used {
+		paths = append(paths, p)
+	}
+	// standard library imports first, as goimports would group them
+	sort.Slice(paths, func(i, j int) bool {
+		if std := isStd(paths[i]); std != isStd(paths[j]) {
+			return std
+		}
+		return paths[i] < paths[j]
+	})
+	for i, p := range paths {
+		if i > 0 && isStd(paths[i-1]) && !isStd(p) {
+			out.WriteString("\n")
+		}
+		name := ""
+		if alias, ok := g.aliases[p]; ok {
+			name = alias + " "
+		}
+		fmt.Fprintf(&out, "\t%s%q\n", name, p)
+	}
+	out.WriteString(")\n")
+	out.Write(g.buf.Bytes())
+	return format.Source(out.Bytes())
+}
+
+// method is a method of an interface, with its embedded interfaces expanded.
+type method struct {
+	name string
+	typ  *ast.FuncType
+}
+
+func (g *generator) methods(name string, seen map[string]bool) ([]method, error) {
+	it, ok := g.ifaces[name]
+	if !ok {
+		return nil, fmt.Errorf("interface %s not found in %s", name, *source)
+	}
+	if seen[name] {
+		return nil, nil
+	}
+	seen[name] = true
+	var methods []method
+	for _, field := range it.Methods.List {
+		switch t := field.Type.(type) {
+		case *ast.FuncType:
+			for _, n := range field.Names {
+				methods = append(methods, method{name: n.Name, typ: t})
+			}
+		case *ast.Ident:
+			embedded, err := g.methods(t.Name, seen)
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, embedded...)
+		default:
+			return nil, fmt.Errorf("interface %s embeds %s, only interfaces of the same file can be embedded", name, g.expr(field.Type))
+		}
+	}
+	return methods, nil
+}
+
+func (g *generator) wrapper(name string) error {
+	methods, err := g.methods(name, map[string]bool{})
+	if err != nil {
+		return err
+	}
+	iface := name
+	if g.qualifier != "" {
+		iface = g.qualifier + "." + name
+	}
+	typ := *wrapperPrefix + name
+	g.printf("\n// %s records and replays the calls made to a %s with keploy.\n", typ, name)
+	g.printf("type %s struct {\n\tnext %s\n}\n\n", typ, iface)
+	g.printf("// New%s wraps next, which is only called in MODE_RECORD and MODE_OFF.\n", typ)
+	g.printf("func New%s(next %s) *%s {\n\treturn &%s{next: next}\n}\n", typ, iface, typ, typ)
+	for _, m := range methods {
+		g.method(name, typ, m)
+	}
+	return nil
+}
+
+func (g *generator) method(iface, typ string, m method) {
+	var (
+		params   []string // declarations
+		callArgs []string // arguments passed to the wrapped method
+		recorded []string // arguments recorded by keploy.Call
+	)
+	if m.typ.Params != nil {
+		i := 0
+		for _, field := range m.typ.Params.List {
+			names := field.Names
+			if len(names) == 0 {
+				names = []*ast.Ident{nil}
+			}
+			for range names {
+				p := fmt.Sprintf("a%d", i)
+				i++
+				params = append(params, p+" "+g.expr(field.Type))
+				if _, ok := field.Type.(*ast.Ellipsis); ok {
+					callArgs = append(callArgs, p+"...")
+				} else {
+					callArgs = append(callArgs, p)
+				}
+				if !isContext(field.Type) {
+					recorded = append(recorded, p)
+				}
+			}
+		}
+	}
+	var results, resultPtrs, resultNames []string
+	if m.typ.Results != nil {
+		i := 0
+		for _, field := range m.typ.Results.List {
+			n := len(field.Names)
+			if n == 0 {
+				n = 1
+			}
+			for j := 0; j < n; j++ {
+				r := fmt.Sprintf("r%d", i)
+				i++
+				results = append(results, r+" "+g.expr(field.Type))
+				resultPtrs = append(resultPtrs, "&"+r)
+				resultNames = append(resultNames, r)
+			}
+		}
+	}
+
+	g.printf("\n// %s implements %s.\n", m.name, iface)
+	g.printf("func (w *%s) %s(%s) (%s) {\n", typ, m.name, strings.Join(params, ", "), strings.Join(results, ", "))
+	g.printf("\tkeploy.Call(%q, []interface{}{%s}, []interface{}{%s}, func() {\n", iface+"."+m.name, strings.Join(recorded, ", "), strings.Join(resultPtrs, ", "))
+	if len(resultNames) > 0 {
+		g.printf("\t\t%s = w.next.%s(%s)\n", strings.Join(resultNames, ", "), m.name, strings.Join(callArgs, ", "))
+	} else {
+		g.printf("\t\tw.next.%s(%s)\n", m.name, strings.Join(callArgs, ", "))
+	}
+	g.printf("\t})\n")
+	if len(resultNames) > 0 {
+		g.printf("\treturn %s\n", strings.Join(resultNames, ", "))
+	}
+	g.printf("}\n")
+}
+
+// importName returns the name of the package imported from importPath by the
+// source files of dir: the name its files declare, or the one conventionally
+// derived from its path when it cannot be loaded, without the major version
+// of paths like github.com/jackc/pgx/v5 or gopkg.in/yaml.v3.
+func importName(importPath, dir string) string {
+	ctxt := build.Default
+	ctxt.Dir = dir // where go list resolves the modules
+	if pkg, err := ctxt.Import(importPath, dir, 0); err == nil && pkg.Name != "" {
+		return pkg.Name
+	}
+	name := path.Base(importPath)
+	if isMajorVersion(name) && path.Dir(importPath) != "." {
+		name = path.Base(path.Dir(importPath))
+	}
+	if i := strings.LastIndex(name, "."); i > 0 && isMajorVersion(name[i+1:]) {
+		name = name[:i]
+	}
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "go-"), "-go")
+	return strings.ReplaceAll(name, "-", "")
+}
+
+// isMajorVersion reports whether s is a major version suffix, like v2.
+func isMajorVersion(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	_, err := strconv.Atoi(s[1:])
+	return err == nil
+}
+
+func isStd(importPath string) bool {
+	return !strings.Contains(strings.Split(importPath, "/")[0], ".")
+}
+
+func isContext(expr ast.Expr) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	return ok && x.Name == "context" && sel.Sel.Name == "Context"
+}
+
+// expr prints a type expression, qualifying the identifiers of the source
+// package and noting the imports it relies on.
+func (g *generator) expr(expr ast.Expr) string {
+	var b bytes.Buffer
+	printer.Fprint(&b, g.fset, g.qualify(expr))
+	return b.String()
+}
+
+func (g *generator) qualify(expr ast.Expr) ast.Expr {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if g.qualifier != "" && ast.IsExported(t.Name) {
+			return &ast.SelectorExpr{X: ast.NewIdent(g.qualifier), Sel: t}
+		}
+		return t
+	case *ast.SelectorExpr:
+		if x, ok := t.X.(*ast.Ident); ok {
+			if p, ok := g.imports[x.Name]; ok {
+				g.used[p] = true
+			}
+		}
+		return t
+	case *ast.StarExpr:
+		return &ast.StarExpr{X: g.qualify(t.X)}
+	case *ast.Ellipsis:
+		return &ast.Ellipsis{Elt: g.qualify(t.Elt)}
+	case *ast.ArrayType:
+		return &ast.ArrayType{Len: t.Len, Elt: g.qualify(t.Elt)}
+	case *ast.MapType:
+		return &ast.MapType{Key: g.qualify(t.Key), Value: g.qualify(t.Value)}
+	case *ast.ChanType:
+		return &ast.ChanType{Dir: t.Dir, Value: g.qualify(t.Value)}
+	case *ast.IndexExpr:
+		return &ast.IndexExpr{X: g.qualify(t.X), Index: g.qualify(t.Index)}
+	case *ast.IndexListExpr:
+		indices := make([]ast.Expr, len(t.Indices))
+		for i, index := range t.Indices {
+			indices[i] = g.qualify(index)
+		}
+		return &ast.IndexListExpr{X: g.qualify(t.X), Indices: indices}
+	case *ast.FuncType:
+		return &ast.FuncType{Params: g.qualifyFields(t.Params), Results: g.qualifyFields(t.Results)}
+	}
+	return expr
+}
+
+func (g *generator) qualifyFields(fields *ast.FieldList) *ast.FieldList {
+	if fields == nil {
+		return nil
+	}
+	out := &ast.FieldList{}
+	for _, f := range fields.List {
+		out.List = append(out.List, &ast.Field{Names: f.Names, Type: g.qualify(f.Type)})
+	}
+	return out
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
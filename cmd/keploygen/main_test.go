@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const storeSource = `package app
+
+import (
+	"context"
+
+	"example.com/lib.v1"
+	"example.com/store/v2"
+	"example.com/weird-name"
+	"gopkg.in/yaml.v3"
+)
+
+type Store interface {
+	Get(ctx context.Context, id string) (*store.Item, error)
+	Put(item lib.Item, node *yaml.Node) error
+	Odd(things ...weird.Thing) weird.Thing
+}
+`
+
+// writeModule writes the files of a module to dir.
+func writeModule(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGeneratedWrapperBuilds(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not installed")
+	}
+	root, err := filepath.Abs("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeModule(t, dir, map[string]string{
+		"go.mod": `module example.com/app
+
+go 1.18
+
+require (
+	example.com/lib.v1 v1.0.0
+	example.com/store/v2 v2.0.0
+	example.com/weird-name v1.0.0
+	github.com/keploy/go-sdk/v2 v2.0.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+replace (
+	example.com/lib.v1 => ./lib
+	example.com/store/v2 => ./store
+	example.com/weird-name => ./weird
+	github.com/keploy/go-sdk/v2 => ` + root + `
+)
+`,
+		"go.sum":         string(sum),
+		"store.go":       storeSource,
+		"lib/go.mod":     "module example.com/lib.v1\n",
+		"lib/lib.go":     "package lib\n\ntype Item struct{ ID string }\n",
+		"store/go.mod":   "module example.com/store/v2\n",
+		"store/store.go": "package store\n\ntype Item struct{ ID string }\n",
+		"weird/go.mod":   "module example.com/weird-name\n",
+		"weird/weird.go": "package weird\n\ntype Thing int\n",
+	})
+
+	// the package names are resolved in the test module, which is not vendored
+	t.Setenv("GOFLAGS", "-mod=mod")
+	t.Setenv("GOWORK", "off")
+	src, err := generate(filepath.Join(dir, "store.go"), []string{"Store"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imp := range []string{`"example.com/lib.v1"`, `"example.com/store/v2"`, `"example.com/weird-name"`, `"gopkg.in/yaml.v3"`} {
+		if !strings.Contains(string(src), "\t"+imp+"\n") {
+			t.Errorf("generated code does not import %s without an alias\n%s", imp, src)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "store_keploy.go"), src, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	build := exec.Command(goTool, "build", "./...")
+	build.Dir = dir
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build failed %v\n%s\n%s", err, out, src)
+	}
+}
+
+func TestImportName(t *testing.T) {
+	dir := t.TempDir()
+	for path, want := range map[string]string{
+		"context":                        "context",
+		"github.com/jackc/pgx/v5":        "pgx",
+		"gopkg.in/yaml.v3":               "yaml",
+		"github.com/rabbitmq/amqp091-go": "amqp091",
+		"github.com/go-redis/redis/v8":   "redis",
+		"example.com/go-kit":             "kit",
+	} {
+		if got := importName(path, dir); got != want {
+			t.Errorf("importName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
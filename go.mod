@@ -1,10 +1,13 @@
 module github.com/keploy/go-sdk/v2
 
-go 1.16
+go 1.18
 
 //replace go.keploy.io/server => ../keploy
 
-require go.uber.org/zap v1.22.0
+require (
+	go.uber.org/zap v1.22.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/pkg/errors v0.9.1 // indirect
@@ -0,0 +1,110 @@
+package integration
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keploy/go-sdk/v2/keploy"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestAMQPDriver(t *testing.T) {
+	startSession(t, keploy.MODE_TEST, ".", "amqp")
+	a, err := keploy.StartAMQPStandIn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	ctx := context.Background()
+
+	conn, err := amqp.Dial(a.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("orders", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ch.QueueDeclare("work", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Messages != 2 {
+		t.Errorf("declared queue with %d messages, want the 2 recorded deliveries", q.Messages)
+	}
+	if err := ch.QueueBind("work", "order.*", "orders", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, err := ch.Consume("work", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`{"id":1}`, `{"id":2}`} {
+		select {
+		case d := <-deliveries:
+			if string(d.Body) != want || d.Exchange != "orders" || d.RoutingKey != "order.created" {
+				t.Fatalf("got %s from %q with %q, want %s", d.Body, d.Exchange, d.RoutingKey, want)
+			}
+			if want == `{"id":1}` && (d.ContentType != "application/json" || d.MessageId != "m-1" || d.Headers["attempt"] == nil || !d.Timestamp.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))) {
+				t.Errorf("got properties %+v", d)
+			}
+			if err := d.Ack(false); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no delivery of %s", want)
+		}
+	}
+
+	// the server-named queues match the recorded ones
+	reply, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok, err := ch.Get(reply.Name, true); err != nil || !ok || string(d.Body) != "reply" {
+		t.Fatalf("got %q %v %v, want the recorded reply", d.Body, ok, err)
+	}
+	if _, ok, err := ch.Get(reply.Name, true); err != nil || ok {
+		t.Fatalf("got %v %v, want an empty queue", ok, err)
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	// larger than a frame
+	big := strings.Repeat("x", 300000)
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, "orders", "order.shipped", false, false, amqp.Publishing{
+		ContentType: "text/plain",
+		Headers:     amqp.Table{"attempt": int32(3)},
+		Body:        []byte(big),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !confirm.Wait() {
+		t.Fatal("the publishing was not acknowledged")
+	}
+	if err := ch.PublishWithContext(ctx, "orders", "order.paid", false, false, amqp.Publishing{Body: []byte("paid 42")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keploy.Published(t).Count(2)
+	m := keploy.Published(t).ToExchange("orders").WithRoutingKey("order.shipped").WithHeader("attempt", 3).Count(1).First()
+	if m.Body != big || m.Properties.ContentType != "text/plain" {
+		t.Errorf("got a message of %d bytes with %+v", len(m.Body), m.Properties)
+	}
+	keploy.Published(t).Containing("42").Count(1)
+}
@@ -0,0 +1,5 @@
+// Package integration tests the stand-ins and the in-process helpers of the
+// SDK against the real client libraries, replaying the stubs files under
+// stubs. It is a separate module so that the client libraries are not
+// dependencies of the SDK.
+package integration
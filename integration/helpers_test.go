@@ -0,0 +1,17 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/keploy/go-sdk/v2/keploy"
+)
+
+// startSession starts an in-process session recording into or replaying the
+// stubs file named name under dir, and turns it off at the end of the test.
+func startSession(t *testing.T, mode keploy.Mode, dir, name string) {
+	t.Helper()
+	if err := keploy.New(keploy.Config{Mode: mode, Name: name, Path: dir, InProcess: true}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = keploy.New(keploy.Config{Mode: keploy.MODE_OFF, InProcess: true}) })
+}
@@ -0,0 +1,146 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keploy/go-sdk/v2/keploy"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// consumeOrders consumes the two records of the orders topic in the group g1,
+// commits them and produces an event. It returns the consumed values.
+func consumeOrders(t *testing.T, addr string, opts ...kgo.Opt) []string {
+	t.Helper()
+	opts = append(opts, kgo.SeedBrokers(addr), kgo.ConsumerGroup("g1"), kgo.ConsumeTopics("orders"), kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+	cl, err := kgo.NewClient(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var values []string
+	for len(values) < 2 {
+		fetches := cl.PollFetches(ctx)
+		if errs := fetches.Errors(); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+		fetches.EachRecord(func(r *kgo.Record) {
+			values = append(values, fmt.Sprintf("%d %s=%s", r.Offset, r.Key, r.Value))
+		})
+	}
+	if err := cl.CommitUncommittedOffsets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.ProduceSync(ctx, &kgo.Record{Topic: "events", Key: []byte("o-1"), Value: []byte("shipped"), Headers: []kgo.RecordHeader{{Key: "trace", Value: []byte("abc")}}}).FirstErr(); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestKafkaFranz(t *testing.T) {
+	startSession(t, keploy.MODE_TEST, ".", "kafka")
+	k, err := keploy.StartKafkaStandIn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+
+	got := consumeOrders(t, k.Addr())
+	if want := []string{`41 o-1={"id":1}`, `42 ={"id":2}`}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("consumed %q, want %q", got, want)
+	}
+	r := keploy.Produced(t).ToTopic("events").WithKey("o-1").WithHeader("trace", "abc").Count(1).First()
+	if r.Value != "shipped" {
+		t.Fatalf("produced %+v", r)
+	}
+
+	// a member joining the group resumes from the committed offset
+	cl, err := kgo.NewClient(kgo.SeedBrokers(k.Addr()), kgo.ConsumerGroup("g1"), kgo.ConsumeTopics("orders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cl.PollFetches(ctx).EachRecord(func(r *kgo.Record) {
+		t.Errorf("consumed %d %s again", r.Offset, r.Value)
+	})
+}
+
+// TestKafkaUpstream serves stubs/kafka.yaml as the upstream cluster of
+// TestKafkaFranzRecord, which runs it in a process of its own. It prints the
+// address of the broker and serves until its standard input is closed.
+func TestKafkaUpstream(t *testing.T) {
+	if os.Getenv("KEPLOY_KAFKA_UPSTREAM") == "" {
+		t.Skip("only run by TestKafkaFranzRecord")
+	}
+	startSession(t, keploy.MODE_TEST, ".", "kafka")
+	k, err := keploy.StartKafkaStandIn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	fmt.Println(k.Addr())
+	io.Copy(io.Discard, os.Stdin)
+}
+
+func TestKafkaFranzRecord(t *testing.T) {
+	upstream := exec.Command(os.Args[0], "-test.run=^TestKafkaUpstream$")
+	upstream.Env = append(os.Environ(), "KEPLOY_KAFKA_UPSTREAM=1")
+	stdin, err := upstream.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := upstream.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Wait()
+	defer stdin.Close()
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = strings.TrimSpace(addr)
+	dir := t.TempDir()
+
+	startSession(t, keploy.MODE_RECORD, dir, "kafka")
+	k, err := keploy.StartKafkaStandIn(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := consumeOrders(t, k.Addr(), kgo.ProducerBatchCompression(kgo.GzipCompression()))
+	k.Close()
+	keploy.Produced(t).Count(1)
+	b, err := os.ReadFile(filepath.Join(dir, "stubs", "kafka.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched, produced := strings.Count(string(b), "type: fetch"), strings.Count(string(b), "type: produce"); fetched != 2 || produced != 1 {
+		t.Fatalf("recorded %d fetched and %d produced records\n%s", fetched, produced, b)
+	}
+
+	startSession(t, keploy.MODE_TEST, dir, "kafka")
+	k, err = keploy.StartKafkaStandIn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if replayed := consumeOrders(t, k.Addr()); strings.Join(replayed, "|") != strings.Join(recorded, "|") {
+		t.Fatalf("replayed %q, want %q", replayed, recorded)
+	}
+}
@@ -0,0 +1,62 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/keploy/go-sdk/v2/keploy"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMongoDriver(t *testing.T) {
+	s, err := keploy.StartMongoStandIn(".", "mongo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(s.URI()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	urls := client.Database("keploy").Collection("urls")
+
+	// the insert mock has no request, so it answers any insert
+	for _, id := range []string{"Lw8fMw", "Qx9gNx"} {
+		if _, err := urls.InsertOne(ctx, bson.M{"_id": id, "url": "https://example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var url struct {
+		ID      string    `bson:"_id"`
+		URL     string    `bson:"url"`
+		Hits    int64     `bson:"hits"`
+		Created time.Time `bson:"created"`
+	}
+	if err := urls.FindOne(ctx, bson.M{"_id": "Lw8fMw"}).Decode(&url); err != nil {
+		t.Fatal(err)
+	}
+	if url.ID != "Lw8fMw" || url.URL != "https://example.com" || url.Hits != 3 || !url.Created.Equal(time.UnixMilli(1700000000000)) {
+		t.Fatalf("got %+v", url)
+	}
+
+	var cmdErr mongo.CommandError
+	err = urls.FindOne(ctx, bson.M{"_id": "OTHER"}).Decode(&url)
+	if !errors.As(err, &cmdErr) || cmdErr.Name != "KeployMockNotFound" {
+		t.Fatalf("a find with another filter got %v, want KeployMockNotFound", err)
+	}
+	if _, err := urls.DeleteOne(ctx, bson.M{"_id": "Lw8fMw"}); !errors.As(err, &cmdErr) || cmdErr.Name != "KeployMockNotFound" {
+		t.Fatalf("an unrecorded delete got %v, want KeployMockNotFound", err)
+	}
+}
@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/keploy/go-sdk/v2/keploy"
+)
+
+func TestMySQLDriver(t *testing.T) {
+	s, err := keploy.StartMySQLStandIn(".", "mysql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for name, params := range map[string]string{
+		"prepared":     "?parseTime=true",
+		"interpolated": "?parseTime=true&interpolateParams=true",
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := sql.Open("mysql", s.DSN()+params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			var (
+				id      int64
+				user    string
+				created time.Time
+				score   float64
+				note    sql.NullString
+			)
+			err = db.QueryRow("SELECT id, name, created, score, note FROM users WHERE id = ?", 1).Scan(&id, &user, &created, &score, &note)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC); id != 1 || user != "alice" || !created.Equal(want) || score != 1.5 || note.Valid {
+				t.Fatalf("got %d %q %v %v %v", id, user, created, score, note)
+			}
+
+			var mysqlErr *mysql.MySQLError
+			err = db.QueryRow("SELECT id, name, created, score, note FROM users WHERE id = ?", 2).Scan(&id)
+			if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1146 {
+				t.Fatalf("got %v, want the recorded 1146 error", err)
+			}
+
+			res, err := db.Exec("INSERT INTO users (name) VALUES (?)", "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last, _ := res.LastInsertId(); last != 42 {
+				t.Fatalf("got last insert id %d, want 42", last)
+			}
+			if rows, _ := res.RowsAffected(); rows != 1 {
+				t.Fatalf("got %d affected rows, want 1", rows)
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec("INSERT INTO users (name) VALUES (?)", "bob"); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := db.Exec("DELETE FROM users WHERE id = ?", 1); err == nil {
+				t.Fatal("an unrecorded query succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/keploy/go-sdk/v2/keploy"
+)
+
+func TestPostgresPgx(t *testing.T) {
+	p, err := keploy.StartPostgresStandIn(".", "postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ctx := context.Background()
+
+	for _, mode := range []pgx.QueryExecMode{
+		pgx.QueryExecModeCacheStatement,
+		pgx.QueryExecModeCacheDescribe,
+		pgx.QueryExecModeDescribeExec,
+		pgx.QueryExecModeExec,
+		pgx.QueryExecModeSimpleProtocol,
+	} {
+		t.Run(mode.String(), func(t *testing.T) {
+			cfg, err := pgx.ParseConfig(p.DSN())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.DefaultQueryExecMode = mode
+			conn, err := pgx.ConnectConfig(ctx, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(ctx)
+
+			var (
+				id      int
+				name    string
+				created time.Time
+			)
+			if err := conn.QueryRow(ctx, "SELECT id, name, created FROM users WHERE id = $1", 1).Scan(&id, &name, &created); err != nil {
+				t.Fatal(err)
+			}
+			if want := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC); id != 1 || name != "alice" || !created.Equal(want) {
+				t.Fatalf("got %d %q %v", id, name, created)
+			}
+
+			var pgErr *pgconn.PgError
+			err = conn.QueryRow(ctx, "SELECT id, name, created FROM users WHERE id = $1", 2).Scan(&id, &name, &created)
+			if !errors.As(err, &pgErr) || pgErr.Code != "P0002" {
+				t.Fatalf("got %v, want the recorded P0002 error", err)
+			}
+
+			tag, err := conn.Exec(ctx, "UPDATE users SET name = $1 WHERE id = $2", "bob", 1)
+			if err != nil || !tag.Update() || tag.RowsAffected() != 1 {
+				t.Fatalf("got %q %v", tag, err)
+			}
+
+			rows, err := conn.Query(ctx, "INSERT INTO users (name) VALUES ($1) RETURNING id", "carol")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+			if err != nil || len(ids) != 1 || ids[0] != 3 {
+				t.Fatalf("got %v %v", ids, err)
+			}
+			if tag := rows.CommandTag(); !tag.Insert() || tag.RowsAffected() != 1 {
+				t.Fatalf("got command tag %q, want INSERT 0 1", tag)
+			}
+
+			tx, err := conn.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec(ctx, "UPDATE users SET name = $1 WHERE id = $2", "bob", 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = conn.Exec(ctx, "DELETE FROM users")
+			if !errors.As(err, &pgErr) || pgErr.Code != "XX000" {
+				t.Fatalf("got %v, want no recorded mock", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/keploy/go-sdk/v2/keploy"
+)
+
+// startEchoServer starts a WebSocket server greeting the user named in the
+// query and echoing the messages of the client.
+func startEchoServer(t *testing.T) string {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"chat"}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if err := c.WriteMessage(websocket.TextMessage, []byte("welcome "+r.URL.Query().Get("user"))); err != nil {
+			return
+		}
+		for {
+			typ, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+			if err := c.WriteMessage(typ, append([]byte("echo:"), msg...)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// chat runs a conversation over a connection to url and returns the messages
+// of the server.
+func chat(t *testing.T, url string) []string {
+	t.Helper()
+	d := websocket.Dialer{Subprotocols: []string{"chat"}, HandshakeTimeout: 5 * time.Second}
+	c, _, err := d.Dial(url+"/chat?user=bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if c.Subprotocol() != "chat" {
+		t.Fatalf("negotiated %q, want chat", c.Subprotocol())
+	}
+
+	var got []string
+	read := func() {
+		typ, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ == websocket.BinaryMessage {
+			got = append(got, "binary "+string(msg))
+			return
+		}
+		got = append(got, string(msg))
+	}
+	read()
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	read()
+	if err := c.WriteMessage(websocket.BinaryMessage, []byte("bin")); err != nil {
+		t.Fatal(err)
+	}
+	read()
+
+	// the close frame was already sent, do not answer the echo
+	c.SetCloseHandler(func(int, string) error { return nil })
+	if err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("got %v, want the close frame to be echoed", err)
+	}
+	return got
+}
+
+func TestWebSocketGorilla(t *testing.T) {
+	dir := t.TempDir()
+	upstream := startEchoServer(t)
+
+	startSession(t, keploy.MODE_RECORD, dir, "websocket")
+	w, err := keploy.StartWebSocketStandIn(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := chat(t, w.URL())
+	if want := []string{"welcome bob", "echo:hi", "binary echo:bin"}; strings.Join(recorded, "|") != strings.Join(want, "|") {
+		t.Fatalf("recorded %q, want %q", recorded, want)
+	}
+	// the connection is recorded once both sides are closed
+	time.Sleep(100 * time.Millisecond)
+	w.Close()
+
+	startSession(t, keploy.MODE_TEST, dir, "websocket")
+	w, err = keploy.StartWebSocketStandIn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Timing = true
+	start := time.Now()
+	replayed := chat(t, w.URL())
+	if strings.Join(replayed, "|") != strings.Join(recorded, "|") {
+		t.Fatalf("replayed %q, want %q", replayed, recorded)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("replayed in %v, want the recorded delays to be played", elapsed)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(w.URL()+"/other", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got %v, want the connection without a recording to be refused", err)
+	}
+}
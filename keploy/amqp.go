@@ -0,0 +1,1143 @@
+package keploy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// amqpKind is the kind of the mocks recorded by the AMQP stand-in.
+const amqpKind = "AMQP"
+
+// amqpSpec is the spec of an AMQP mock, a message published by the
+// application or delivered to it.
+type amqpSpec struct {
+	Metadata    map[string]string `yaml:"metadata,omitempty"`
+	Type        string            `yaml:"type"` // publish or deliver
+	AMQPMessage `yaml:",inline"`
+}
+
+// AMQPMessage is a message published to or delivered by the AMQP stand-in.
+type AMQPMessage struct {
+	Exchange   string `yaml:"exchange"`
+	RoutingKey string `yaml:"routing_key"`
+	// Queue is the queue a delivered message was consumed from.
+	Queue      string         `yaml:"queue,omitempty"`
+	Properties AMQPProperties `yaml:"properties,omitempty"`
+	Body       string         `yaml:"body"`
+}
+
+// AMQPProperties are the basic properties of a message.
+type AMQPProperties struct {
+	ContentType     string                 `yaml:"content_type,omitempty"`
+	ContentEncoding string                 `yaml:"content_encoding,omitempty"`
+	Headers         map[string]interface{} `yaml:"headers,omitempty"`
+	DeliveryMode    uint8                  `yaml:"delivery_mode,omitempty"`
+	Priority        uint8                  `yaml:"priority,omitempty"`
+	CorrelationID   string                 `yaml:"correlation_id,omitempty"`
+	ReplyTo         string                 `yaml:"reply_to,omitempty"`
+	Expiration      string                 `yaml:"expiration,omitempty"`
+	MessageID       string                 `yaml:"message_id,omitempty"`
+	Timestamp       time.Time              `yaml:"timestamp,omitempty"`
+	Type            string                 `yaml:"type,omitempty"`
+	UserID          string                 `yaml:"user_id,omitempty"`
+	AppID           string                 `yaml:"app_id,omitempty"`
+}
+
+// frame types and end marker of AMQP 0-9-1
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+)
+
+// class and method ids, as class<<16 | method
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelFlow       = 20<<16 | 20
+	amqpChannelFlowOk     = 20<<16 | 21
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpExchangeDeclare   = 40<<16 | 10
+	amqpExchangeDeclareOk = 40<<16 | 11
+	amqpExchangeDelete    = 40<<16 | 20
+	amqpExchangeDeleteOk  = 40<<16 | 21
+	amqpExchangeBind      = 40<<16 | 30
+	amqpExchangeBindOk    = 40<<16 | 31
+	amqpExchangeUnbind    = 40<<16 | 40
+	amqpExchangeUnbindOk  = 40<<16 | 51
+	amqpQueueDeclare      = 50<<16 | 10
+	amqpQueueDeclareOk    = 50<<16 | 11
+	amqpQueueBind         = 50<<16 | 20
+	amqpQueueBindOk       = 50<<16 | 21
+	amqpQueuePurge        = 50<<16 | 30
+	amqpQueuePurgeOk      = 50<<16 | 31
+	amqpQueueDelete       = 50<<16 | 40
+	amqpQueueDeleteOk     = 50<<16 | 41
+	amqpQueueUnbind       = 50<<16 | 50
+	amqpQueueUnbindOk     = 50<<16 | 51
+	amqpBasicQos          = 60<<16 | 10
+	amqpBasicQosOk        = 60<<16 | 11
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicCancel       = 60<<16 | 30
+	amqpBasicCancelOk     = 60<<16 | 31
+	amqpBasicPublish      = 60<<16 | 40
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicGet          = 60<<16 | 70
+	amqpBasicGetOk        = 60<<16 | 71
+	amqpBasicGetEmpty     = 60<<16 | 72
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicReject       = 60<<16 | 90
+	amqpBasicRecoverAsync = 60<<16 | 100
+	amqpBasicRecover      = 60<<16 | 110
+	amqpBasicRecoverOk    = 60<<16 | 111
+	amqpBasicNack         = 60<<16 | 120
+	amqpConfirmSelect     = 85<<16 | 10
+	amqpConfirmSelectOk   = 85<<16 | 11
+	amqpTxSelect          = 90<<16 | 10
+	amqpTxSelectOk        = 90<<16 | 11
+	amqpTxCommit          = 90<<16 | 20
+	amqpTxCommitOk        = 90<<16 | 21
+	amqpTxRollback        = 90<<16 | 30
+	amqpTxRollbackOk      = 90<<16 | 31
+)
+
+const (
+	amqpFrameMax            = 131072
+	amqpChannelMax          = 2047
+	amqpServerNamedPrefix   = "amq.gen-"
+	amqpConsumerTagPrefix   = "amq.ctag-"
+	amqpCloseReplySuccess   = 200
+	amqpCloseNotImplemented = 540
+)
+
+var amqpProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// AMQPStandIn is a localhost AMQP 0-9-1 broker following the mode of the last
+// call to New. In MODE_RECORD it proxies the connections to the upstream
+// broker and records the messages published by the application and the ones
+// delivered to it. In MODE_TEST it answers the declarations itself, delivers
+// the recorded messages of a queue to its consumers, in order, and keeps the
+// published messages for the assertions of Published without routing them.
+// In MODE_OFF it only proxies, as it does in every mode when the upstream
+// broker is left out by Config.Filters.
+type AMQPStandIn struct {
+	*standIn
+	upstream *url.URL
+
+	mu      sync.Mutex
+	counter int // names the server-named queues and consumer tags
+}
+
+// StartAMQPStandIn starts an AMQP stand-in of the upstream broker, an amqp://
+// or amqps:// URL which is only used in MODE_RECORD and MODE_OFF, on a random
+// localhost port.
+func StartAMQPStandIn(upstream string) (*AMQPStandIn, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the upstream url %w", err)
+	}
+	if upstream != "" && u.Scheme != "amqp" && u.Scheme != "amqps" {
+		return nil, fmt.Errorf("unsupported scheme of the upstream url %s", upstream)
+	}
+	a := &AMQPStandIn{upstream: u}
+	a.standIn, err = listenStandIn(a.serveConn)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// URL returns an amqp:// URL pointing at the stand-in. The credentials and the
+// virtual host of the upstream URL are kept, as they are forwarded upstream.
+func (a *AMQPStandIn) URL() string {
+	u := url.URL{Scheme: "amqp", Host: a.Addr(), User: a.upstream.User, Path: a.upstream.Path}
+	if u.User == nil {
+		u.User = url.UserPassword("guest", "guest")
+	}
+	return u.String()
+}
+
+func (a *AMQPStandIn) name(prefix string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.counter++
+	return fmt.Sprintf("%skeploy-%d", prefix, a.counter)
+}
+
+func (a *AMQPStandIn) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	header := make([]byte, len(amqpProtocolHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	if !bytes.Equal(header, amqpProtocolHeader) {
+		conn.Write(amqpProtocolHeader)
+		return
+	}
+	s := activeSession()
+	mode := s.modeFor(urlTarget(a.upstream))
+	if mode == MODE_TEST {
+		c := &amqpConn{a: a, s: s, conn: conn, r: r, frameMax: amqpFrameMax, channels: map[uint16]*amqpChannel{}}
+		c.serve()
+		return
+	}
+	if err := a.proxy(s, mode, conn, r); err != nil {
+		logger.Error(fmt.Sprintf("failed to proxy the amqp connection to %s", a.upstream.Host), zap.Error(err))
+	}
+}
+
+func (a *AMQPStandIn) dialUpstream() (net.Conn, error) {
+	if a.upstream.Host == "" {
+		return nil, errors.New("keploy: no upstream amqp broker")
+	}
+	secure := a.upstream.Scheme == "amqps"
+	addr := a.upstream.Host
+	if a.upstream.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(a.upstream.Hostname(), "5671")
+		} else {
+			addr = net.JoinHostPort(a.upstream.Hostname(), "5672")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil || !secure {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: a.upstream.Hostname()})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (a *AMQPStandIn) proxy(s *session, mode Mode, conn net.Conn, r *bufio.Reader) error {
+	up, err := a.dialUpstream()
+	if err != nil {
+		return err
+	}
+	defer up.Close()
+	if _, err := up.Write(amqpProtocolHeader); err != nil {
+		return err
+	}
+
+	rec := &amqpRecorder{
+		s:         s,
+		mode:      mode,
+		lastQueue: map[uint16]string{},
+		consuming: map[uint16]string{},
+		getting:   map[uint16]string{},
+		consumers: map[string]string{},
+	}
+	var wg sync.WaitGroup
+	pump := func(fromClient bool, src *bufio.Reader, dst net.Conn) {
+		defer wg.Done()
+		// unblock the other direction once this one is over
+		defer conn.Close()
+		defer up.Close()
+		contents := map[uint16]*amqpContent{}
+		for {
+			f, err := readAMQPFrame(src)
+			if err != nil {
+				return
+			}
+			if _, err := dst.Write(f.raw); err != nil {
+				return
+			}
+			rec.frame(fromClient, f, contents)
+		}
+	}
+	wg.Add(2)
+	go pump(true, r, up)
+	go pump(false, bufio.NewReader(up), conn)
+	wg.Wait()
+	return nil
+}
+
+// amqpRecorder follows the frames of a proxied connection to name the queues
+// of the delivered messages, and captures the messages.
+type amqpRecorder struct {
+	s    *session
+	mode Mode
+
+	mu        sync.Mutex
+	lastQueue map[uint16]string // the last queue declared on each channel
+	consuming map[uint16]string // the queue of the pending Basic.Consume of each channel
+	getting   map[uint16]string // the queue of the pending Basic.Get of each channel
+	consumers map[string]string // queue by consumer tag
+}
+
+// amqpContent is a message being received, a method followed by a content
+// header and body frames.
+type amqpContent struct {
+	typ   string
+	msg   AMQPMessage
+	size  uint64
+	body  []byte
+	ready bool // the header was received
+}
+
+func (rec *amqpRecorder) frame(fromClient bool, f *amqpFrame, contents map[uint16]*amqpContent) {
+	switch f.typ {
+	case amqpFrameMethod:
+		r := &amqpReader{buf: f.payload}
+		method := r.uint32()
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		switch {
+		case fromClient && method == amqpQueueDeclare:
+			r.uint16()
+			rec.lastQueue[f.channel] = r.shortStr()
+		case !fromClient && method == amqpQueueDeclareOk:
+			rec.lastQueue[f.channel] = r.shortStr()
+		case fromClient && method == amqpBasicConsume:
+			r.uint16()
+			rec.consuming[f.channel] = rec.queue(f.channel, r.shortStr())
+		case !fromClient && method == amqpBasicConsumeOk:
+			rec.consumers[r.shortStr()] = rec.consuming[f.channel]
+		case fromClient && method == amqpBasicGet:
+			r.uint16()
+			rec.getting[f.channel] = rec.queue(f.channel, r.shortStr())
+		case fromClient && method == amqpBasicPublish:
+			r.uint16()
+			c := &amqpContent{typ: "publish"}
+			c.msg.Exchange, c.msg.RoutingKey = r.shortStr(), r.shortStr()
+			contents[f.channel] = c
+		case !fromClient && method == amqpBasicDeliver:
+			c := &amqpContent{typ: "deliver"}
+			c.msg.Queue = rec.consumers[r.shortStr()]
+			r.uint64()
+			r.byte()
+			c.msg.Exchange, c.msg.RoutingKey = r.shortStr(), r.shortStr()
+			contents[f.channel] = c
+		case !fromClient && method == amqpBasicGetOk:
+			c := &amqpContent{typ: "deliver"}
+			c.msg.Queue = rec.getting[f.channel]
+			r.uint64()
+			r.byte()
+			c.msg.Exchange, c.msg.RoutingKey = r.shortStr(), r.shortStr()
+			contents[f.channel] = c
+		}
+	case amqpFrameHeader:
+		c, ok := contents[f.channel]
+		if !ok {
+			return
+		}
+		r := &amqpReader{buf: f.payload}
+		r.uint16() // class
+		r.uint16() // weight
+		c.size = r.uint64()
+		c.msg.Properties = r.properties()
+		if r.err != nil {
+			delete(contents, f.channel)
+			return
+		}
+		c.ready = true
+		if c.size == 0 {
+			rec.done(c)
+			delete(contents, f.channel)
+		}
+	case amqpFrameBody:
+		c, ok := contents[f.channel]
+		if !ok || !c.ready {
+			return
+		}
+		c.body = append(c.body, f.payload...)
+		if uint64(len(c.body)) >= c.size {
+			rec.done(c)
+			delete(contents, f.channel)
+		}
+	}
+}
+
+// queue returns the queue named by a method, the last declared queue of the
+// channel when the name is empty.
+func (rec *amqpRecorder) queue(channel uint16, name string) string {
+	if name == "" {
+		return rec.lastQueue[channel]
+	}
+	return name
+}
+
+func (rec *amqpRecorder) done(c *amqpContent) {
+	c.msg.Body = string(c.body)
+	if c.typ == "publish" {
+		rec.s.capture(amqpKind, c.msg)
+	}
+	if rec.mode != MODE_RECORD {
+		return
+	}
+	if err := rec.s.record(amqpKind, amqpSpec{Type: c.typ, AMQPMessage: c.msg}); err != nil {
+		logger.Error("failed to record the amqp message", zap.Error(err))
+	}
+}
+
+// amqpConn is a connection served in MODE_TEST.
+type amqpConn struct {
+	a        *AMQPStandIn
+	s        *session
+	conn     net.Conn
+	r        *bufio.Reader
+	frameMax uint32
+	channels map[uint16]*amqpChannel
+}
+
+type amqpChannel struct {
+	confirm     bool
+	published   uint64 // sequence number of the publisher confirms
+	deliveryTag uint64
+	lastQueue   string
+	content     *amqpContent
+}
+
+func (c *amqpConn) serve() {
+	start := amqpMethod(amqpConnectionStart)
+	start = append(start, 0, 9)
+	start = amqpTable(start, map[string]interface{}{
+		"product":  "keploy",
+		"platform": "Go",
+		"capabilities": map[string]interface{}{
+			"publisher_confirms":           true,
+			"basic.nack":                   true,
+			"consumer_cancel_notify":       true,
+			"exchange_exchange_bindings":   true,
+			"connection.blocked":           false,
+			"authentication_failure_close": true,
+		},
+	})
+	start = amqpLongStr(start, "PLAIN AMQPLAIN")
+	start = amqpLongStr(start, "en_US")
+	if c.write(amqpFrameMethod, 0, start) != nil {
+		return
+	}
+	for {
+		f, err := readAMQPFrame(c.r)
+		if err != nil {
+			return
+		}
+		if err := c.handle(f); err != nil {
+			if err != io.EOF {
+				logger.Error("failed to serve the amqp connection", zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+func (c *amqpConn) write(typ byte, channel uint16, payload []byte) error {
+	_, err := c.conn.Write(amqpFrameBytes(typ, channel, payload))
+	return err
+}
+
+func (c *amqpConn) channel(id uint16) *amqpChannel {
+	ch, ok := c.channels[id]
+	if !ok {
+		ch = &amqpChannel{}
+		c.channels[id] = ch
+	}
+	return ch
+}
+
+// handle answers a frame of the client. io.EOF is returned once the
+// connection is closed.
+func (c *amqpConn) handle(f *amqpFrame) error {
+	switch f.typ {
+	case amqpFrameHeartbeat:
+		return c.write(amqpFrameHeartbeat, 0, nil)
+	case amqpFrameHeader, amqpFrameBody:
+		return c.content(f)
+	case amqpFrameMethod:
+	default:
+		return nil
+	}
+	r := &amqpReader{buf: f.payload}
+	method := r.uint32()
+	ch := c.channel(f.channel)
+	reply := func(method uint32, args ...[]byte) error {
+		payload := amqpMethod(method)
+		for _, arg := range args {
+			payload = append(payload, arg...)
+		}
+		return c.write(amqpFrameMethod, f.channel, payload)
+	}
+	// the methods with a no-wait bit are answered unless it is set
+	replyUnlessNoWait := func(noWait bool, method uint32, args ...[]byte) error {
+		if noWait {
+			return nil
+		}
+		return reply(method, args...)
+	}
+
+	switch method {
+	case amqpConnectionStartOk:
+		tune := appendUint16(nil, amqpChannelMax)
+		tune = appendUint32(tune, amqpFrameMax)
+		tune = appendUint16(tune, 0) // heartbeats are echoed but never required
+		return reply(amqpConnectionTune, tune)
+	case amqpConnectionTuneOk:
+		r.uint16()
+		if frameMax := r.uint32(); frameMax > 0 && frameMax < c.frameMax {
+			c.frameMax = frameMax
+		}
+		return nil
+	case amqpConnectionOpen:
+		return reply(amqpConnectionOpenOk, amqpShortStr(nil, ""))
+	case amqpConnectionClose:
+		reply(amqpConnectionCloseOk)
+		return io.EOF
+	case amqpConnectionCloseOk:
+		return io.EOF
+	case amqpChannelOpen:
+		c.channels[f.channel] = &amqpChannel{}
+		return reply(amqpChannelOpenOk, amqpLongStr(nil, ""))
+	case amqpChannelFlow:
+		return reply(amqpChannelFlowOk, []byte{r.byte()})
+	case amqpChannelClose:
+		delete(c.channels, f.channel)
+		return reply(amqpChannelCloseOk)
+	case amqpChannelCloseOk:
+		delete(c.channels, f.channel)
+		return nil
+	case amqpExchangeDeclare:
+		r.uint16()
+		r.shortStr()
+		r.shortStr()
+		return replyUnlessNoWait(r.byte()&0x10 != 0, amqpExchangeDeclareOk)
+	case amqpExchangeDelete:
+		r.uint16()
+		r.shortStr()
+		return replyUnlessNoWait(r.byte()&0x02 != 0, amqpExchangeDeleteOk)
+	case amqpExchangeBind, amqpExchangeUnbind:
+		r.uint16()
+		r.shortStr()
+		r.shortStr()
+		r.shortStr()
+		ok := uint32(amqpExchangeBindOk)
+		if method == amqpExchangeUnbind {
+			ok = amqpExchangeUnbindOk
+		}
+		return replyUnlessNoWait(r.byte()&0x01 != 0, ok)
+	case amqpQueueDeclare:
+		r.uint16()
+		name := r.shortStr()
+		if name == "" {
+			name = c.a.name(amqpServerNamedPrefix)
+		}
+		ch.lastQueue = name
+		noWait := r.byte()&0x10 != 0
+		return replyUnlessNoWait(noWait, amqpQueueDeclareOk, amqpShortStr(nil, name), appendUint32(nil, uint32(c.pending(name))), appendUint32(nil, 0))
+	case amqpQueueBind:
+		r.uint16()
+		r.shortStr()
+		r.shortStr()
+		r.shortStr()
+		return replyUnlessNoWait(r.byte()&0x01 != 0, amqpQueueBindOk)
+	case amqpQueueUnbind:
+		return reply(amqpQueueUnbindOk)
+	case amqpQueuePurge:
+		r.uint16()
+		r.shortStr()
+		return replyUnlessNoWait(r.byte()&0x01 != 0, amqpQueuePurgeOk, appendUint32(nil, 0))
+	case amqpQueueDelete:
+		r.uint16()
+		r.shortStr()
+		return replyUnlessNoWait(r.byte()&0x04 != 0, amqpQueueDeleteOk, appendUint32(nil, 0))
+	case amqpBasicQos:
+		return reply(amqpBasicQosOk)
+	case amqpBasicConsume:
+		r.uint16()
+		queue := r.shortStr()
+		if queue == "" {
+			queue = ch.lastQueue
+		}
+		tag := r.shortStr()
+		if tag == "" {
+			tag = c.a.name(amqpConsumerTagPrefix)
+		}
+		if err := replyUnlessNoWait(r.byte()&0x08 != 0, amqpBasicConsumeOk, amqpShortStr(nil, tag)); err != nil {
+			return err
+		}
+		for {
+			msg, ok := c.next(queue)
+			if !ok {
+				return nil
+			}
+			ch.deliveryTag++
+			deliver := amqpShortStr(nil, tag)
+			deliver = appendUint64(deliver, ch.deliveryTag)
+			deliver = append(deliver, 0) // redelivered
+			deliver = amqpShortStr(deliver, msg.Exchange)
+			deliver = amqpShortStr(deliver, msg.RoutingKey)
+			if err := c.deliver(f.channel, amqpBasicDeliver, deliver, msg); err != nil {
+				return err
+			}
+		}
+	case amqpBasicCancel:
+		tag := r.shortStr()
+		return replyUnlessNoWait(r.byte()&0x01 != 0, amqpBasicCancelOk, amqpShortStr(nil, tag))
+	case amqpBasicGet:
+		r.uint16()
+		queue := r.shortStr()
+		if queue == "" {
+			queue = ch.lastQueue
+		}
+		msg, ok := c.next(queue)
+		if !ok {
+			return reply(amqpBasicGetEmpty, amqpShortStr(nil, ""))
+		}
+		ch.deliveryTag++
+		getOk := appendUint64(nil, ch.deliveryTag)
+		getOk = append(getOk, 0) // redelivered
+		getOk = amqpShortStr(getOk, msg.Exchange)
+		getOk = amqpShortStr(getOk, msg.RoutingKey)
+		getOk = appendUint32(getOk, uint32(c.pending(queue)))
+		return c.deliver(f.channel, amqpBasicGetOk, getOk, msg)
+	case amqpBasicPublish:
+		r.uint16()
+		content := &amqpContent{typ: "publish"}
+		content.msg.Exchange, content.msg.RoutingKey = r.shortStr(), r.shortStr()
+		ch.content = content
+		return nil
+	case amqpBasicAck, amqpBasicNack, amqpBasicReject, amqpBasicRecoverAsync:
+		return nil
+	case amqpBasicRecover:
+		return reply(amqpBasicRecoverOk)
+	case amqpConfirmSelect:
+		ch.confirm = true
+		return replyUnlessNoWait(r.byte()&0x01 != 0, amqpConfirmSelectOk)
+	case amqpTxSelect:
+		return reply(amqpTxSelectOk)
+	case amqpTxCommit:
+		return reply(amqpTxCommitOk)
+	case amqpTxRollback:
+		return reply(amqpTxRollbackOk)
+	}
+	closeArgs := appendUint16(nil, amqpCloseNotImplemented)
+	closeArgs = amqpShortStr(closeArgs, fmt.Sprintf("keploy: method %d.%d is not supported by the stand-in", method>>16, method&0xffff))
+	closeArgs = appendUint32(closeArgs, uint32(method))
+	reply(amqpConnectionClose, closeArgs)
+	return fmt.Errorf("amqp method %d.%d is not supported", method>>16, method&0xffff)
+}
+
+// content collects the header and the body of a published message.
+func (c *amqpConn) content(f *amqpFrame) error {
+	ch := c.channel(f.channel)
+	p := ch.content
+	if p == nil {
+		return nil
+	}
+	if f.typ == amqpFrameHeader {
+		r := &amqpReader{buf: f.payload}
+		r.uint16()
+		r.uint16()
+		p.size = r.uint64()
+		p.msg.Properties = r.properties()
+		if r.err != nil {
+			return r.err
+		}
+		p.ready = true
+	} else if p.ready {
+		p.body = append(p.body, f.payload...)
+	}
+	if !p.ready || uint64(len(p.body)) < p.size {
+		return nil
+	}
+	ch.content = nil
+	p.msg.Body = string(p.body)
+	c.s.capture(amqpKind, p.msg)
+	if !ch.confirm {
+		return nil
+	}
+	ch.published++
+	ack := appendUint64(amqpMethod(amqpBasicAck), ch.published)
+	return c.write(amqpFrameMethod, f.channel, append(ack, 0))
+}
+
+// next returns the next recorded delivery of the queue. The server-named
+// queues get other names in MODE_TEST, so they match each other.
+func (c *amqpConn) next(queue string) (AMQPMessage, bool) {
+	set, err := c.s.mocks(amqpKind)
+	if err != nil {
+		c.s.warnOnce("failed to read the amqp mocks", zap.Error(err))
+		return AMQPMessage{}, false
+	}
+	m, ok := set.next(func(m *Mock) bool {
+		recorded := &amqpSpec{}
+		return m.decode(recorded) == nil && recorded.Type == "deliver" && amqpSameQueue(recorded.Queue, queue)
+	})
+	if !ok {
+		return AMQPMessage{}, false
+	}
+	spec := &amqpSpec{}
+	if err := m.decode(spec); err != nil {
+		c.s.warnOnce("failed to read the amqp mocks", zap.Error(err))
+		return AMQPMessage{}, false
+	}
+	return spec.AMQPMessage, true
+}
+
+// pending returns the number of recorded deliveries of the queue left.
+func (c *amqpConn) pending(queue string) int {
+	set, err := c.s.mocks(amqpKind)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for _, m := range set.mocks {
+		spec := &amqpSpec{}
+		if !set.used[m] && m.decode(spec) == nil && spec.Type == "deliver" && amqpSameQueue(spec.Queue, queue) {
+			n++
+		}
+	}
+	return n
+}
+
+func amqpSameQueue(recorded, queue string) bool {
+	if strings.HasPrefix(recorded, amqpServerNamedPrefix) && strings.HasPrefix(queue, amqpServerNamedPrefix) {
+		return true
+	}
+	return recorded == queue
+}
+
+// deliver sends a method carrying a message, followed by its content.
+func (c *amqpConn) deliver(channel uint16, method uint32, args []byte, msg AMQPMessage) error {
+	if err := c.write(amqpFrameMethod, channel, append(amqpMethod(method), args...)); err != nil {
+		return err
+	}
+	header := appendUint16(nil, 60)
+	header = appendUint16(header, 0)
+	header = appendUint64(header, uint64(len(msg.Body)))
+	header = amqpPropertiesBytes(header, msg.Properties)
+	if err := c.write(amqpFrameHeader, channel, header); err != nil {
+		return err
+	}
+	body := []byte(msg.Body)
+	for max := int(c.frameMax) - 8; len(body) > 0; {
+		n := len(body)
+		if n > max {
+			n = max
+		}
+		if err := c.write(amqpFrameBody, channel, body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	return nil
+}
+
+type amqpFrame struct {
+	typ     byte
+	channel uint16
+	payload []byte
+	raw     []byte
+}
+
+func readAMQPFrame(r *bufio.Reader) (*amqpFrame, error) {
+	head := make([]byte, 7)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[3:])
+	if size > 64<<20 {
+		return nil, fmt.Errorf("amqp frame of %d bytes is too large", size)
+	}
+	raw := make([]byte, 7+int(size)+1)
+	copy(raw, head)
+	if _, err := io.ReadFull(r, raw[7:]); err != nil {
+		return nil, err
+	}
+	if raw[len(raw)-1] != amqpFrameEnd {
+		return nil, errors.New("malformed amqp frame")
+	}
+	return &amqpFrame{typ: head[0], channel: binary.BigEndian.Uint16(head[1:]), payload: raw[7 : 7+size], raw: raw}, nil
+}
+
+func amqpFrameBytes(typ byte, channel uint16, payload []byte) []byte {
+	b := append([]byte{typ}, byte(channel>>8), byte(channel))
+	b = appendUint32(b, uint32(len(payload)))
+	return append(append(b, payload...), amqpFrameEnd)
+}
+
+func amqpMethod(method uint32) []byte {
+	return appendUint32(nil, uint32(method))
+}
+
+func amqpShortStr(b []byte, s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return append(append(b, byte(len(s))), s...)
+}
+
+func amqpLongStr(b []byte, s string) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
+
+// amqpTable encodes a field table, with the field types understood by
+// RabbitMQ and the common clients.
+func amqpTable(b []byte, table map[string]interface{}) []byte {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var fields []byte
+	for _, k := range keys {
+		fields = amqpShortStr(fields, k)
+		fields = amqpFieldValue(fields, table[k])
+	}
+	return append(appendUint32(b, uint32(len(fields))), fields...)
+}
+
+func amqpFieldValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 'V')
+	case bool:
+		if v {
+			return append(b, 't', 1)
+		}
+		return append(b, 't', 0)
+	case int:
+		return appendUint64(append(b, 'l'), uint64(v))
+	case int8:
+		return append(b, 'b', byte(v))
+	case uint8:
+		return append(b, 'B', v)
+	case int16:
+		return appendUint16(append(b, 's'), uint16(v))
+	case int32:
+		return appendUint32(append(b, 'I'), uint32(v))
+	case int64:
+		return appendUint64(append(b, 'l'), uint64(v))
+	case uint64:
+		return appendUint64(append(b, 'l'), v)
+	case float32:
+		return appendUint32(append(b, 'f'), math.Float32bits(v))
+	case float64:
+		return appendUint64(append(b, 'd'), math.Float64bits(v))
+	case string:
+		return amqpLongStr(append(b, 'S'), v)
+	case []byte:
+		return amqpLongStr(append(b, 'x'), string(v))
+	case time.Time:
+		return appendUint64(append(b, 'T'), uint64(v.Unix()))
+	case map[string]interface{}:
+		return amqpTable(append(b, 'F'), v)
+	case []interface{}:
+		var items []byte
+		for _, item := range v {
+			items = amqpFieldValue(items, item)
+		}
+		return append(appendUint32(append(b, 'A'), uint32(len(items))), items...)
+	}
+	return amqpLongStr(append(b, 'S'), fmt.Sprint(v))
+}
+
+// amqpPropertiesBytes encodes the property flags and the properties of a
+// content header.
+func amqpPropertiesBytes(b []byte, p AMQPProperties) []byte {
+	var flags uint16
+	var props []byte
+	shortStr := func(bit uint16, s string) {
+		if s != "" {
+			flags |= bit
+			props = amqpShortStr(props, s)
+		}
+	}
+	shortStr(1<<15, p.ContentType)
+	shortStr(1<<14, p.ContentEncoding)
+	if p.Headers != nil {
+		flags |= 1 << 13
+		props = amqpTable(props, p.Headers)
+	}
+	if p.DeliveryMode != 0 {
+		flags |= 1 << 12
+		props = append(props, p.DeliveryMode)
+	}
+	if p.Priority != 0 {
+		flags |= 1 << 11
+		props = append(props, p.Priority)
+	}
+	shortStr(1<<10, p.CorrelationID)
+	shortStr(1<<9, p.ReplyTo)
+	shortStr(1<<8, p.Expiration)
+	shortStr(1<<7, p.MessageID)
+	if !p.Timestamp.IsZero() {
+		flags |= 1 << 6
+		props = appendUint64(props, uint64(p.Timestamp.Unix()))
+	}
+	shortStr(1<<5, p.Type)
+	shortStr(1<<4, p.UserID)
+	shortStr(1<<3, p.AppID)
+	return append(appendUint16(b, uint16(flags)), props...)
+}
+
+// amqpReader decodes the fields of a frame. The first decoding error is kept
+// in err and every later read returns a zero value.
+type amqpReader struct {
+	buf []byte
+	err error
+}
+
+func (r *amqpReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.buf) < n {
+		if r.err == nil {
+			r.err = errors.New("malformed amqp frame")
+		}
+		r.buf = nil
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *amqpReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *amqpReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) shortStr() string {
+	return string(r.next(int(r.byte())))
+}
+
+func (r *amqpReader) longStr() string {
+	return string(r.next(int(r.uint32())))
+}
+
+func (r *amqpReader) table() map[string]interface{} {
+	sub := &amqpReader{buf: r.next(int(r.uint32()))}
+	table := map[string]interface{}{}
+	for len(sub.buf) > 0 && sub.err == nil {
+		k := sub.shortStr()
+		table[k] = sub.value()
+	}
+	if sub.err != nil && r.err == nil {
+		r.err = sub.err
+	}
+	return table
+}
+
+func (r *amqpReader) value() interface{} {
+	switch t := r.byte(); t {
+	case 't':
+		return r.byte() != 0
+	case 'b':
+		return int64(int8(r.byte()))
+	case 'B':
+		return int64(r.byte())
+	case 's':
+		return int64(int16(r.uint16()))
+	case 'u':
+		return int64(r.uint16())
+	case 'I':
+		return int64(int32(r.uint32()))
+	case 'i':
+		return int64(r.uint32())
+	case 'l':
+		return int64(r.uint64())
+	case 'f':
+		return float64(math.Float32frombits(r.uint32()))
+	case 'd':
+		return math.Float64frombits(r.uint64())
+	case 'D':
+		scale := r.byte()
+		return float64(int32(r.uint32())) / math.Pow10(int(scale))
+	case 'S':
+		return r.longStr()
+	case 'x':
+		return []byte(r.longStr())
+	case 'T':
+		return time.Unix(int64(r.uint64()), 0).UTC()
+	case 'F':
+		return r.table()
+	case 'A':
+		sub := &amqpReader{buf: r.next(int(r.uint32()))}
+		items := []interface{}{}
+		for len(sub.buf) > 0 && sub.err == nil {
+			items = append(items, sub.value())
+		}
+		return items
+	case 'V':
+		return nil
+	default:
+		r.err = fmt.Errorf("unknown amqp field type %q", t)
+		r.buf = nil
+		return nil
+	}
+}
+
+func (r *amqpReader) properties() AMQPProperties {
+	var p AMQPProperties
+	flags := r.uint16()
+	for f := flags; f&1 != 0; {
+		f = r.uint16() // continuation flags, unused by 0-9-1
+	}
+	if flags&(1<<15) != 0 {
+		p.ContentType = r.shortStr()
+	}
+	if flags&(1<<14) != 0 {
+		p.ContentEncoding = r.shortStr()
+	}
+	if flags&(1<<13) != 0 {
+		p.Headers = r.table()
+	}
+	if flags&(1<<12) != 0 {
+		p.DeliveryMode = r.byte()
+	}
+	if flags&(1<<11) != 0 {
+		p.Priority = r.byte()
+	}
+	if flags&(1<<10) != 0 {
+		p.CorrelationID = r.shortStr()
+	}
+	if flags&(1<<9) != 0 {
+		p.ReplyTo = r.shortStr()
+	}
+	if flags&(1<<8) != 0 {
+		p.Expiration = r.shortStr()
+	}
+	if flags&(1<<7) != 0 {
+		p.MessageID = r.shortStr()
+	}
+	if flags&(1<<6) != 0 {
+		p.Timestamp = time.Unix(int64(r.uint64()), 0).UTC()
+	}
+	if flags&(1<<5) != 0 {
+		p.Type = r.shortStr()
+	}
+	if flags&(1<<4) != 0 {
+		p.UserID = r.shortStr()
+	}
+	if flags&(1<<3) != 0 {
+		p.AppID = r.shortStr()
+	}
+	if flags&(1<<2) != 0 {
+		r.shortStr() // cluster id
+	}
+	return p
+}
+
+// PublishedMessages is the list of AMQP messages checked by a test. The
+// filters return the matching messages, and the assertions fail the test when
+// they do not hold.
+type PublishedMessages struct {
+	list checkList[AMQPMessage]
+}
+
+// Published returns the messages published through the AMQP stand-ins since
+// the last call to New, in the order they were published.
+func Published(t testing.TB) *PublishedMessages {
+	t.Helper()
+	var messages []AMQPMessage
+	for _, v := range activeSession().captured(amqpKind) {
+		messages = append(messages, v.(AMQPMessage))
+	}
+	return &PublishedMessages{list: checkList[AMQPMessage]{
+		t:     t,
+		items: messages,
+		what:  "messages were published",
+		none:  "no message was published",
+		format: func(m AMQPMessage) string {
+			return fmt.Sprintf("to %q with routing key %q: %q", m.Exchange, m.RoutingKey, m.Body)
+		},
+	}}
+}
+
+// All returns the messages.
+func (p *PublishedMessages) All() []AMQPMessage {
+	return p.list.items
+}
+
+// ToExchange returns the messages published to the exchange.
+func (p *PublishedMessages) ToExchange(exchange string) *PublishedMessages {
+	return p.filter(func(m AMQPMessage) bool { return m.Exchange == exchange })
+}
+
+// WithRoutingKey returns the messages published with the routing key.
+func (p *PublishedMessages) WithRoutingKey(key string) *PublishedMessages {
+	return p.filter(func(m AMQPMessage) bool { return m.RoutingKey == key })
+}
+
+// WithHeader returns the messages with the header set to value.
+func (p *PublishedMessages) WithHeader(name string, value interface{}) *PublishedMessages {
+	return p.filter(func(m AMQPMessage) bool {
+		v, ok := m.Properties.Headers[name]
+		return ok && fmt.Sprint(v) == fmt.Sprint(value)
+	})
+}
+
+// Containing returns the messages whose body contains s.
+func (p *PublishedMessages) Containing(s string) *PublishedMessages {
+	return p.filter(func(m AMQPMessage) bool { return strings.Contains(m.Body, s) })
+}
+
+func (p *PublishedMessages) filter(match func(AMQPMessage) bool) *PublishedMessages {
+	return &PublishedMessages{list: p.list.filter(match)}
+}
+
+// Count asserts that there are n messages.
+func (p *PublishedMessages) Count(n int) *PublishedMessages {
+	p.list.t.Helper()
+	p.list.count(n)
+	return p
+}
+
+// First asserts that there is at least one message and returns the first one.
+func (p *PublishedMessages) First() AMQPMessage {
+	p.list.t.Helper()
+	return p.list.first()
+}
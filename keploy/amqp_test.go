@@ -0,0 +1,37 @@
+package keploy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAMQPPropertiesRoundTrip(t *testing.T) {
+	want := AMQPProperties{
+		ContentType: "application/json",
+		Headers: map[string]interface{}{
+			"retries": int64(-3),
+			"short":   int64(-2),
+			"ratio":   0.5,
+			"tags":    []interface{}{"a", int64(1)},
+		},
+		DeliveryMode: 2,
+		MessageID:    "m-1",
+		Timestamp:    time.Unix(1700000000, 0).UTC(),
+	}
+	b := amqpPropertiesBytes(nil, want)
+	r := &amqpReader{buf: b}
+	got := r.properties()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// the signed field values keep their sign
+	r = &amqpReader{buf: amqpFieldValue(amqpFieldValue(nil, int16(-2)), int32(-70000))}
+	if s, i := r.value(), r.value(); r.err != nil || s != int64(-2) || i != int64(-70000) {
+		t.Fatalf("got %v %v, %v", s, i, r.err)
+	}
+}
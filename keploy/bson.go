@@ -0,0 +1,772 @@
+package keploy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bsonDoc is a BSON document which keeps the order of its keys, as the first
+// key of a command document is significant.
+type bsonDoc []bsonElem
+
+type bsonElem struct {
+	Key   string
+	Value interface{}
+}
+
+// lookup returns the value of key in the document.
+func (d bsonDoc) lookup(key string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// without returns a copy of the document without the given keys.
+func (d bsonDoc) without(keys ...string) bsonDoc {
+	out := make(bsonDoc, 0, len(d))
+	for _, e := range d {
+		skip := false
+		for _, k := range keys {
+			if e.Key == k {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// The BSON values which have no natural Go representation. Doubles, strings,
+// booleans, int32, int64 and null are kept as float64, string, bool, int32,
+// int64 and nil.
+type (
+	bsonArray     []interface{}
+	bsonObjectID  [12]byte
+	bsonDateTime  int64
+	bsonUndefined struct{}
+	bsonMinKey    struct{}
+	bsonMaxKey    struct{}
+	bsonSymbol    string
+	bsonCode      string
+
+	bsonBinary struct {
+		Subtype byte
+		Data    []byte
+	}
+	bsonRegex struct {
+		Pattern string
+		Options string
+	}
+	bsonDBPointer struct {
+		Ref string
+		ID  bsonObjectID
+	}
+	bsonCodeWithScope struct {
+		Code  string
+		Scope bsonDoc
+	}
+	bsonTimestamp struct {
+		T uint32
+		I uint32
+	}
+	bsonDecimal128 struct {
+		High uint64
+		Low  uint64
+	}
+)
+
+// decodeBSON decodes the document at the start of b and returns it along with
+// the number of bytes it took.
+func decodeBSON(b []byte) (bsonDoc, int, error) {
+	if len(b) < 5 {
+		return nil, 0, errors.New("bson document is too short")
+	}
+	size := int(int32(binary.LittleEndian.Uint32(b)))
+	if size < 5 || size > len(b) || b[size-1] != 0 {
+		return nil, 0, errors.New("invalid bson document length")
+	}
+	r := &bsonReader{buf: b[4 : size-1]}
+	doc := bsonDoc{}
+	for len(r.buf) > 0 && r.err == nil {
+		typ := r.byte()
+		key := r.cstring()
+		doc = append(doc, bsonElem{Key: key, Value: r.value(typ)})
+	}
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	return doc, size, nil
+}
+
+type bsonReader struct {
+	buf []byte
+	err error
+}
+
+func (r *bsonReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+	r.buf = nil
+}
+
+func (r *bsonReader) next(n int) []byte {
+	if n < 0 || len(r.buf) < n {
+		r.fail("unexpected end of bson document")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *bsonReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *bsonReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.LittleEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *bsonReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *bsonReader) cstring() string {
+	i := bytes.IndexByte(r.buf, 0)
+	if i < 0 {
+		r.fail("unterminated bson cstring")
+		return ""
+	}
+	s := string(r.buf[:i])
+	r.buf = r.buf[i+1:]
+	return s
+}
+
+func (r *bsonReader) string() string {
+	size := int(r.int32())
+	b := r.next(size)
+	if r.err != nil || size < 1 || b[size-1] != 0 {
+		r.fail("invalid bson string")
+		return ""
+	}
+	return string(b[:size-1])
+}
+
+func (r *bsonReader) document() bsonDoc {
+	doc, n, err := decodeBSON(r.buf)
+	if err != nil {
+		r.fail("%s", err)
+		return nil
+	}
+	r.buf = r.buf[n:]
+	return doc
+}
+
+func (r *bsonReader) objectID() bsonObjectID {
+	var id bsonObjectID
+	copy(id[:], r.next(12))
+	return id
+}
+
+func (r *bsonReader) value(typ byte) interface{} {
+	switch typ {
+	case 0x01:
+		return math.Float64frombits(r.uint64())
+	case 0x02:
+		return r.string()
+	case 0x03:
+		return r.document()
+	case 0x04:
+		doc := r.document()
+		arr := make(bsonArray, len(doc))
+		for i, e := range doc {
+			arr[i] = e.Value
+		}
+		return arr
+	case 0x05:
+		size := int(r.int32())
+		subtype := r.byte()
+		data := append([]byte{}, r.next(size)...)
+		return bsonBinary{Subtype: subtype, Data: data}
+	case 0x06:
+		return bsonUndefined{}
+	case 0x07:
+		return r.objectID()
+	case 0x08:
+		return r.byte() != 0
+	case 0x09:
+		return bsonDateTime(r.uint64())
+	case 0x0A:
+		return nil
+	case 0x0B:
+		return bsonRegex{Pattern: r.cstring(), Options: r.cstring()}
+	case 0x0C:
+		return bsonDBPointer{Ref: r.string(), ID: r.objectID()}
+	case 0x0D:
+		return bsonCode(r.string())
+	case 0x0E:
+		return bsonSymbol(r.string())
+	case 0x0F:
+		r.int32()
+		return bsonCodeWithScope{Code: r.string(), Scope: r.document()}
+	case 0x10:
+		return r.int32()
+	case 0x11:
+		v := r.uint64()
+		return bsonTimestamp{T: uint32(v >> 32), I: uint32(v)}
+	case 0x12:
+		return int64(r.uint64())
+	case 0x13:
+		low := r.uint64()
+		return bsonDecimal128{High: r.uint64(), Low: low}
+	case 0xFF:
+		return bsonMinKey{}
+	case 0x7F:
+		return bsonMaxKey{}
+	}
+	r.fail("unsupported bson type 0x%02x", typ)
+	return nil
+}
+
+// encodeBSON encodes the document in the BSON format.
+func encodeBSON(doc bsonDoc) []byte {
+	b := make([]byte, 4, 64)
+	for _, e := range doc {
+		b = appendBSONElem(b, e.Key, e.Value)
+	}
+	b = append(b, 0)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func appendBSONElem(b []byte, key string, v interface{}) []byte {
+	elem := func(typ byte) []byte {
+		return append(append(append(b, typ), key...), 0)
+	}
+	switch v := v.(type) {
+	case float64:
+		return bsonUint64(elem(0x01), math.Float64bits(v))
+	case string:
+		return bsonString(elem(0x02), v)
+	case bsonDoc:
+		return append(elem(0x03), encodeBSON(v)...)
+	case bsonArray:
+		doc := make(bsonDoc, len(v))
+		for i, item := range v {
+			doc[i] = bsonElem{Key: strconv.Itoa(i), Value: item}
+		}
+		return append(elem(0x04), encodeBSON(doc)...)
+	case bsonBinary:
+		b = bsonInt32(elem(0x05), int32(len(v.Data)))
+		return append(append(b, v.Subtype), v.Data...)
+	case bsonUndefined:
+		return elem(0x06)
+	case bsonObjectID:
+		return append(elem(0x07), v[:]...)
+	case bool:
+		if v {
+			return append(elem(0x08), 1)
+		}
+		return append(elem(0x08), 0)
+	case bsonDateTime:
+		return bsonUint64(elem(0x09), uint64(v))
+	case nil:
+		return elem(0x0A)
+	case bsonRegex:
+		b = append(append(elem(0x0B), v.Pattern...), 0)
+		return append(append(b, v.Options...), 0)
+	case bsonDBPointer:
+		return append(bsonString(elem(0x0C), v.Ref), v.ID[:]...)
+	case bsonCode:
+		return bsonString(elem(0x0D), string(v))
+	case bsonSymbol:
+		return bsonString(elem(0x0E), string(v))
+	case bsonCodeWithScope:
+		body := append(bsonString(nil, v.Code), encodeBSON(v.Scope)...)
+		return append(bsonInt32(elem(0x0F), int32(len(body)+4)), body...)
+	case int32:
+		return bsonInt32(elem(0x10), v)
+	case bsonTimestamp:
+		return bsonUint64(elem(0x11), uint64(v.T)<<32|uint64(v.I))
+	case int64:
+		return bsonUint64(elem(0x12), uint64(v))
+	case bsonDecimal128:
+		return bsonUint64(bsonUint64(elem(0x13), v.Low), v.High)
+	case bsonMinKey:
+		return elem(0xFF)
+	case bsonMaxKey:
+		return elem(0x7F)
+	}
+	panic(fmt.Sprintf("keploy: cannot encode %T as bson", v))
+}
+
+func bsonInt32(b []byte, v int32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func bsonUint64(b []byte, v uint64) []byte {
+	return bsonInt32(bsonInt32(b, int32(v)), int32(v>>32))
+}
+
+func bsonString(b []byte, s string) []byte {
+	return append(append(bsonInt32(b, int32(len(s)+1)), s...), 0)
+}
+
+// extJSON renders a BSON value as canonical Extended JSON v2.
+func extJSON(v interface{}) string {
+	var b strings.Builder
+	writeExtJSON(&b, v)
+	return b.String()
+}
+
+func writeExtJSON(b *strings.Builder, v interface{}) {
+	str := func(s string) {
+		enc, _ := json.Marshal(s)
+		b.Write(enc)
+	}
+	wrap := func(key string, value string) {
+		b.WriteString(`{"` + key + `": `)
+		b.WriteString(value)
+		b.WriteString("}")
+	}
+	quote := func(s string) string {
+		enc, _ := json.Marshal(s)
+		return string(enc)
+	}
+	switch v := v.(type) {
+	case bsonDoc:
+		b.WriteString("{")
+		for i, e := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			str(e.Key)
+			b.WriteString(": ")
+			writeExtJSON(b, e.Value)
+		}
+		b.WriteString("}")
+	case bsonArray:
+		b.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeExtJSON(b, item)
+		}
+		b.WriteString("]")
+	case string:
+		str(v)
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case nil:
+		b.WriteString("null")
+	case float64:
+		wrap("$numberDouble", quote(formatExtDouble(v)))
+	case int32:
+		wrap("$numberInt", quote(strconv.FormatInt(int64(v), 10)))
+	case int64:
+		wrap("$numberLong", quote(strconv.FormatInt(v, 10)))
+	case bsonDecimal128:
+		wrap("$numberDecimal", quote(v.String()))
+	case bsonObjectID:
+		wrap("$oid", quote(hex.EncodeToString(v[:])))
+	case bsonDateTime:
+		wrap("$date", `{"$numberLong": `+quote(strconv.FormatInt(int64(v), 10))+"}")
+	case bsonBinary:
+		wrap("$binary", `{"base64": `+quote(base64.StdEncoding.EncodeToString(v.Data))+`, "subType": `+quote(fmt.Sprintf("%02x", v.Subtype))+"}")
+	case bsonRegex:
+		wrap("$regularExpression", `{"pattern": `+quote(v.Pattern)+`, "options": `+quote(v.Options)+"}")
+	case bsonTimestamp:
+		wrap("$timestamp", fmt.Sprintf(`{"t": %d, "i": %d}`, v.T, v.I))
+	case bsonDBPointer:
+		wrap("$dbPointer", `{"$ref": `+quote(v.Ref)+`, "$id": {"$oid": `+quote(hex.EncodeToString(v.ID[:]))+"}}")
+	case bsonCode:
+		wrap("$code", quote(string(v)))
+	case bsonCodeWithScope:
+		b.WriteString(`{"$code": ` + quote(v.Code) + `, "$scope": `)
+		writeExtJSON(b, v.Scope)
+		b.WriteString("}")
+	case bsonSymbol:
+		wrap("$symbol", quote(string(v)))
+	case bsonUndefined:
+		wrap("$undefined", "true")
+	case bsonMinKey:
+		wrap("$minKey", "1")
+	case bsonMaxKey:
+		wrap("$maxKey", "1")
+	default:
+		panic(fmt.Sprintf("keploy: cannot render %T as extended json", v))
+	}
+}
+
+func formatExtDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	s := strings.ToUpper(strconv.FormatFloat(f, 'g', -1, 64))
+	if !strings.ContainsAny(s, ".E") {
+		s += ".0"
+	}
+	return s
+}
+
+// parseExtJSON parses a document written in canonical or relaxed Extended
+// JSON v2.
+func parseExtJSON(s string) (bsonDoc, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	v, err := readJSON(dec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended json %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid extended json: unexpected data after the document")
+	}
+	obj, ok := v.(bsonDoc)
+	if !ok {
+		return nil, errors.New("invalid extended json: not a document")
+	}
+	doc, err := fromExtJSON(obj)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended json %w", err)
+	}
+	return doc.(bsonDoc), nil
+}
+
+// readJSON reads a json value keeping the order of object keys. Objects are
+// returned as bsonDoc, arrays as bsonArray and numbers as json.Number.
+func readJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := bsonDoc{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := readJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, bsonElem{Key: key.(string), Value: v})
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := bsonArray{}
+		for dec.More() {
+			v, err := readJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err := dec.Token()
+		return arr, err
+	}
+	return tok, nil
+}
+
+// fromExtJSON converts the raw json value to the BSON value it describes.
+func fromExtJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case bsonArray:
+		out := make(bsonArray, len(v))
+		for i, item := range v {
+			var err error
+			if out[i], err = fromExtJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case json.Number:
+		// relaxed numbers: integers become int32 or int64, the rest doubles
+		if n, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			if n >= math.MinInt32 && n <= math.MaxInt32 {
+				return int32(n), nil
+			}
+			return n, nil
+		}
+		return strconv.ParseFloat(v.String(), 64)
+	case bsonDoc:
+		if len(v) > 0 && strings.HasPrefix(v[0].Key, "$") {
+			if out, ok, err := fromExtJSONWrapper(v); ok || err != nil {
+				return out, err
+			}
+		}
+		out := make(bsonDoc, len(v))
+		for i, e := range v {
+			value, err := fromExtJSON(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = bsonElem{Key: e.Key, Value: value}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// fromExtJSONWrapper converts the {"$type": ...} objects of Extended JSON.
+func fromExtJSONWrapper(v bsonDoc) (interface{}, bool, error) {
+	key, value := v[0].Key, v[0].Value
+	str, _ := value.(string)
+	sub, _ := value.(bsonDoc)
+	field := func(doc bsonDoc, key string) string {
+		s, _ := doc.lookup(key)
+		switch s := s.(type) {
+		case string:
+			return s
+		case json.Number:
+			return s.String()
+		}
+		return ""
+	}
+	objectID := func(s string) (bsonObjectID, error) {
+		var id bsonObjectID
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != 12 {
+			return id, fmt.Errorf("invalid $oid %q", s)
+		}
+		copy(id[:], b)
+		return id, nil
+	}
+
+	if key == "$code" {
+		if scope, ok := v.lookup("$scope"); ok {
+			doc, err := fromExtJSON(scope)
+			if err != nil {
+				return nil, true, err
+			}
+			scopeDoc, ok := doc.(bsonDoc)
+			if !ok {
+				return nil, true, errors.New("invalid $scope")
+			}
+			return bsonCodeWithScope{Code: str, Scope: scopeDoc}, true, nil
+		}
+	}
+	if len(v) != 1 {
+		return nil, false, nil
+	}
+	switch key {
+	case "$numberDouble":
+		switch str {
+		case "Infinity":
+			return math.Inf(1), true, nil
+		case "-Infinity":
+			return math.Inf(-1), true, nil
+		case "NaN":
+			return math.NaN(), true, nil
+		}
+		f, err := strconv.ParseFloat(str, 64)
+		return f, true, err
+	case "$numberInt":
+		n, err := strconv.ParseInt(str, 10, 32)
+		return int32(n), true, err
+	case "$numberLong":
+		n, err := strconv.ParseInt(str, 10, 64)
+		return n, true, err
+	case "$numberDecimal":
+		d, err := parseDecimal128(str)
+		return d, true, err
+	case "$oid":
+		id, err := objectID(str)
+		return id, true, err
+	case "$symbol":
+		return bsonSymbol(str), true, nil
+	case "$code":
+		return bsonCode(str), true, nil
+	case "$undefined":
+		return bsonUndefined{}, true, nil
+	case "$minKey":
+		return bsonMinKey{}, true, nil
+	case "$maxKey":
+		return bsonMaxKey{}, true, nil
+	case "$date":
+		switch value := value.(type) {
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, value)
+			return bsonDateTime(t.UnixNano() / int64(time.Millisecond)), true, err
+		case json.Number:
+			n, err := value.Int64()
+			return bsonDateTime(n), true, err
+		case bsonDoc:
+			n, err := strconv.ParseInt(field(value, "$numberLong"), 10, 64)
+			return bsonDateTime(n), true, err
+		}
+		return nil, true, errors.New("invalid $date")
+	case "$binary":
+		if sub == nil {
+			return nil, true, errors.New("invalid $binary")
+		}
+		data, err := base64.StdEncoding.DecodeString(field(sub, "base64"))
+		if err != nil {
+			return nil, true, err
+		}
+		subtype, err := strconv.ParseUint(field(sub, "subType"), 16, 8)
+		return bsonBinary{Subtype: byte(subtype), Data: data}, true, err
+	case "$regularExpression":
+		if sub == nil {
+			return nil, true, errors.New("invalid $regularExpression")
+		}
+		return bsonRegex{Pattern: field(sub, "pattern"), Options: field(sub, "options")}, true, nil
+	case "$timestamp":
+		if sub == nil {
+			return nil, true, errors.New("invalid $timestamp")
+		}
+		t, err := strconv.ParseUint(field(sub, "t"), 10, 32)
+		if err != nil {
+			return nil, true, err
+		}
+		i, err := strconv.ParseUint(field(sub, "i"), 10, 32)
+		return bsonTimestamp{T: uint32(t), I: uint32(i)}, true, err
+	case "$dbPointer":
+		if sub == nil {
+			return nil, true, errors.New("invalid $dbPointer")
+		}
+		idDoc, _ := sub.lookup("$id")
+		idObj, _ := idDoc.(bsonDoc)
+		id, err := objectID(field(idObj, "$oid"))
+		return bsonDBPointer{Ref: field(sub, "$ref"), ID: id}, true, err
+	}
+	return nil, false, nil
+}
+
+// decimal128 layout constants, see the IEEE 754-2008 decimal128 BID encoding.
+const (
+	decimalExponentBias = 6176
+	decimalMaxExponent  = 6111
+	decimalMinExponent  = -6176
+	decimalMaxDigits    = 34
+)
+
+// String formats the decimal as described by the BSON decimal128 spec.
+func (d bsonDecimal128) String() string {
+	sign := ""
+	if d.High>>63 == 1 {
+		sign = "-"
+	}
+	var (
+		exponent int
+		coeff    = new(big.Int)
+	)
+	combination := (d.High >> 58) & 0x1f
+	switch {
+	case combination == 0x1e:
+		return sign + "Infinity"
+	case combination == 0x1f:
+		return "NaN"
+	case combination>>3 == 3:
+		// the implicit leading bits make the coefficient exceed 10^34-1
+		exponent = int((d.High>>47)&0x3fff) - decimalExponentBias
+	default:
+		exponent = int((d.High>>49)&0x3fff) - decimalExponentBias
+		coeff.SetUint64(d.High & 0x1ffffffffffff)
+		coeff.Lsh(coeff, 64)
+		coeff.Or(coeff, new(big.Int).SetUint64(d.Low))
+		if len(coeff.String()) > decimalMaxDigits {
+			coeff.SetInt64(0)
+		}
+	}
+
+	digits := coeff.String()
+	adjusted := exponent + len(digits) - 1
+	if exponent > 0 || adjusted < -6 {
+		s := digits[:1]
+		if len(digits) > 1 {
+			s += "." + digits[1:]
+		}
+		return fmt.Sprintf("%s%sE%+d", sign, s, adjusted)
+	}
+	if exponent == 0 {
+		return sign + digits
+	}
+	point := len(digits) + exponent
+	if point > 0 {
+		return sign + digits[:point] + "." + digits[point:]
+	}
+	return sign + "0." + strings.Repeat("0", -point) + digits
+}
+
+// parseDecimal128 parses the string form of a decimal128 value.
+func parseDecimal128(s string) (bsonDecimal128, error) {
+	var d bsonDecimal128
+	neg := strings.HasPrefix(s, "-")
+	body := strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	switch strings.ToLower(body) {
+	case "infinity", "inf":
+		d.High = 0x78 << 56
+		if neg {
+			d.High |= 1 << 63
+		}
+		return d, nil
+	case "nan":
+		d.High = 0x7c << 56
+		return d, nil
+	}
+
+	exponent := 0
+	if i := strings.IndexAny(body, "eE"); i >= 0 {
+		e, err := strconv.Atoi(body[i+1:])
+		if err != nil {
+			return d, fmt.Errorf("invalid decimal %q", s)
+		}
+		exponent, body = e, body[:i]
+	}
+	if i := strings.IndexByte(body, '.'); i >= 0 {
+		exponent -= len(body) - i - 1
+		body = body[:i] + body[i+1:]
+	}
+	coeff, ok := new(big.Int).SetString(body, 10)
+	if body == "" || !ok || coeff.Sign() < 0 {
+		return d, fmt.Errorf("invalid decimal %q", s)
+	}
+	if len(coeff.String()) > decimalMaxDigits || exponent > decimalMaxExponent || exponent < decimalMinExponent {
+		return d, fmt.Errorf("decimal %q is out of the decimal128 range", s)
+	}
+
+	low := new(big.Int).And(coeff, new(big.Int).SetUint64(math.MaxUint64))
+	d.Low = low.Uint64()
+	d.High = new(big.Int).Rsh(coeff, 64).Uint64()
+	d.High |= uint64(exponent+decimalExponentBias) << 49
+	if neg {
+		d.High |= 1 << 63
+	}
+	return d, nil
+}
@@ -0,0 +1,86 @@
+package keploy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBSONRoundTrip(t *testing.T) {
+	doc := bsonDoc{
+		{"double", 1.5},
+		{"string", "héllo"},
+		{"doc", bsonDoc{{"a", int32(1)}}},
+		{"array", bsonArray{int32(1), "two", nil}},
+		{"binary", bsonBinary{Subtype: 4, Data: []byte{1, 2, 3}}},
+		{"undefined", bsonUndefined{}},
+		{"oid", bsonObjectID{0x65, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{"bool", true},
+		{"date", bsonDateTime(1700000000000)},
+		{"null", nil},
+		{"regex", bsonRegex{Pattern: "^a", Options: "i"}},
+		{"dbPointer", bsonDBPointer{Ref: "db.c", ID: bsonObjectID{1}}},
+		{"code", bsonCode("function() {}")},
+		{"symbol", bsonSymbol("s")},
+		{"codeWithScope", bsonCodeWithScope{Code: "x", Scope: bsonDoc{{"x", int32(1)}}}},
+		{"int32", int32(-7)},
+		{"timestamp", bsonTimestamp{T: 1, I: 2}},
+		{"int64", int64(1) << 40},
+		{"decimal", mustDecimal(t, "1.50")},
+		{"minKey", bsonMinKey{}},
+		{"maxKey", bsonMaxKey{}},
+	}
+	encoded := encodeBSON(doc)
+	decoded, n, err := decodeBSON(append(encoded, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(encoded) || !reflect.DeepEqual(decoded, doc) {
+		t.Fatalf("decoded %d bytes %v, want %d bytes %v", n, decoded, len(encoded), doc)
+	}
+
+	parsed, err := parseExtJSON(extJSON(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, doc) {
+		t.Fatalf("extended json round trip got %v, want %v", parsed, doc)
+	}
+}
+
+func mustDecimal(t *testing.T, s string) bsonDecimal128 {
+	t.Helper()
+	d, err := parseDecimal128(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.String() != s {
+		t.Fatalf("decimal %s is rendered %s", s, d.String())
+	}
+	return d
+}
+
+func TestDecodeBSONRejectsMalformed(t *testing.T) {
+	valid := encodeBSON(bsonDoc{{"a", "b"}, {"n", int32(1)}})
+	for name, b := range map[string][]byte{
+		"too short":       valid[:4],
+		"truncated":       valid[:len(valid)-1],
+		"negative length": {0xff, 0xff, 0xff, 0xff, 0},
+		"bad string size": append([]byte{15, 0, 0, 0, 2, 'a', 0, 0xff, 0xff, 0xff, 0x7f, 'b', 0}, 0, 0),
+		"unknown type":    {8, 0, 0, 0, 0x42, 'a', 0, 0},
+	} {
+		if _, _, err := decodeBSON(b); err == nil {
+			t.Errorf("%s: decodeBSON(%v) did not fail", name, b)
+		}
+	}
+}
+
+func TestParseRelaxedExtJSON(t *testing.T) {
+	doc, err := parseExtJSON(`{"n": 1, "big": 8589934592, "f": 1.5, "d": {"$date": "2023-11-14T22:13:20Z"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bsonDoc{{"n", int32(1)}, {"big", int64(8589934592)}, {"f", 1.5}, {"d", bsonDateTime(1700000000000)}}
+	if !reflect.DeepEqual(doc, want) {
+		t.Fatalf("got %v, want %v", doc, want)
+	}
+}
@@ -0,0 +1,248 @@
+package keploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// callsCapture is the key of the replayed calls in the captures of a session.
+const callsCapture = "calls"
+
+// MockCall is a mock replayed in MODE_TEST, with the request it was replayed for.
+// The calls are kept for the mocks replayed by Transport, Func, the keploygen
+// wrappers, the commands, Resolver and the WebSocket, Postgres, MySQL and
+// MongoDB stand-ins.
+type MockCall struct {
+	Kind string // Kind of the mock, like "Http" or "Func"
+	Mock string // Name of the mock, like "http-0"
+	// Target is the called endpoint: the method and the URL of the HTTP
+	// requests, the name of the functions, the command line of the commands,
+	// the type and the name of the DNS questions, the path of the WebSocket
+	// connections, the SQL queries and the name and the collection of the
+	// MongoDB commands.
+	Target string
+	// Payload is the request sent to the endpoint, before its redaction: the
+	// body of the HTTP requests, the JSON request of the functions, the stdin
+	// of the commands, the JSON arguments of the SQL queries and the extended
+	// JSON of the MongoDB commands.
+	Payload string
+}
+
+func (c MockCall) String() string {
+	if c.Payload == "" {
+		return fmt.Sprintf("%s mock %s: %s", c.Kind, c.Mock, c.Target)
+	}
+	return fmt.Sprintf("%s mock %s: %s with %q", c.Kind, c.Mock, c.Target, c.Payload)
+}
+
+// CallMatcher selects replayed calls. Its zero fields match any call.
+type CallMatcher struct {
+	Kind string // Kind of the mocks, like "Http"
+	Mock string // Name of the mock, like "http-0"
+	// Target is a regular expression matched against the target of the calls,
+	// like `^GET https://api\.example\.com/users/`.
+	Target string
+}
+
+func (c *CallMatcher) String() string {
+	var parts []string
+	if c.Kind != "" {
+		parts = append(parts, "kind "+c.Kind)
+	}
+	if c.Mock != "" {
+		parts = append(parts, "mock "+c.Mock)
+	}
+	if c.Target != "" {
+		parts = append(parts, fmt.Sprintf("target %q", c.Target))
+	}
+	if len(parts) == 0 {
+		return "any call"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// compile returns the function matching the calls selected by c.
+func (c *CallMatcher) compile() (func(MockCall) bool, error) {
+	var target *regexp.Regexp
+	if c.Target != "" {
+		re, err := regexp.Compile(c.Target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target pattern %w", err)
+		}
+		target = re
+	}
+	return func(call MockCall) bool {
+		return (c.Kind == "" || c.Kind == call.Kind) &&
+			(c.Mock == "" || c.Mock == call.Mock) &&
+			(target == nil || target.MatchString(call.Target))
+	}, nil
+}
+
+// called keeps the call of m, a mock being replayed, for the assertions of
+// the test.
+func (s *session) called(m *Mock, target, payload string) {
+	s.capture(callsCapture, MockCall{Kind: m.Kind, Mock: m.Name, Target: target, Payload: payload})
+}
+
+// replayedCalls returns the calls replayed since the last call to New.
+func replayedCalls() []MockCall {
+	var calls []MockCall
+	for _, v := range activeSession().captured(callsCapture) {
+		calls = append(calls, v.(MockCall))
+	}
+	return calls
+}
+
+// ReplayedCalls is the list of replayed calls checked by a test. The filters
+// return the matching calls, and the assertions fail the test when they do
+// not hold.
+type ReplayedCalls struct {
+	matcher string // description of the matcher and the filters of the calls
+	list    checkList[MockCall]
+}
+
+// Calls returns the calls matching matcher replayed since the last call to
+// New, in the order they were replayed.
+func Calls(t testing.TB, matcher CallMatcher) *ReplayedCalls {
+	t.Helper()
+	match, err := matcher.compile()
+	if err != nil {
+		t.Fatalf("keploy: %v", err)
+		return newReplayedCalls(t, matcher.String(), nil)
+	}
+	var calls []MockCall
+	for _, c := range replayedCalls() {
+		if match(c) {
+			calls = append(calls, c)
+		}
+	}
+	return newReplayedCalls(t, matcher.String(), calls)
+}
+
+func newReplayedCalls(t testing.TB, matcher string, calls []MockCall) *ReplayedCalls {
+	return &ReplayedCalls{matcher: matcher, list: checkList[MockCall]{
+		t:      t,
+		items:  calls,
+		what:   "calls matching " + matcher + " were replayed",
+		none:   "no call matching " + matcher + " was replayed",
+		format: MockCall.String,
+	}}
+}
+
+// All returns the calls.
+func (c *ReplayedCalls) All() []MockCall {
+	return c.list.items
+}
+
+// Mocks returns the names of the replayed mocks, in the order they were first
+// replayed.
+func (c *ReplayedCalls) Mocks() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, call := range c.list.items {
+		if !seen[call.Mock] {
+			seen[call.Mock] = true
+			names = append(names, call.Mock)
+		}
+	}
+	return names
+}
+
+// Containing returns the calls whose payload contains s.
+func (c *ReplayedCalls) Containing(s string) *ReplayedCalls {
+	return c.filter(fmt.Sprintf("payload containing %q", s), func(call MockCall) bool { return strings.Contains(call.Payload, s) })
+}
+
+// WithPayload returns the calls whose payload is the JSON encoding of v, or v
+// itself when it is a string. JSON payloads are compared decoded.
+func (c *ReplayedCalls) WithPayload(v interface{}) *ReplayedCalls {
+	want, ok := v.(string)
+	if !ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			c.list.t.Fatalf("keploy: failed to encode the payload %v", err)
+			return newReplayedCalls(c.list.t, c.matcher, nil)
+		}
+		want = string(b)
+	}
+	return c.filter(fmt.Sprintf("payload %s", want), func(call MockCall) bool { return samePayload(call.Payload, want) })
+}
+
+func (c *ReplayedCalls) filter(desc string, match func(MockCall) bool) *ReplayedCalls {
+	return newReplayedCalls(c.list.t, c.matcher+", "+desc, c.list.filter(match).items)
+}
+
+// Count asserts that there are n calls.
+func (c *ReplayedCalls) Count(n int) *ReplayedCalls {
+	c.list.t.Helper()
+	c.list.count(n)
+	return c
+}
+
+// AtLeast asserts that there are at least n calls.
+func (c *ReplayedCalls) AtLeast(n int) *ReplayedCalls {
+	c.list.t.Helper()
+	c.list.atLeast(n)
+	return c
+}
+
+// Never asserts that there are no calls.
+func (c *ReplayedCalls) Never() *ReplayedCalls {
+	c.list.t.Helper()
+	return c.Count(0)
+}
+
+// First asserts that there is at least one call and returns the first one.
+func (c *ReplayedCalls) First() MockCall {
+	c.list.t.Helper()
+	return c.list.first()
+}
+
+// CallsInOrder asserts that calls matching each of matchers were replayed
+// since the last call to New in the order of matchers, other calls being
+// allowed in between.
+func CallsInOrder(t testing.TB, matchers ...CallMatcher) {
+	t.Helper()
+	calls := replayedCalls()
+	next := 0
+	for i := range matchers {
+		match, err := matchers[i].compile()
+		if err != nil {
+			t.Fatalf("keploy: %v", err)
+			return
+		}
+		for next < len(calls) && !match(calls[next]) {
+			next++
+		}
+		if next == len(calls) {
+			t.Errorf("keploy: no call matching %s was replayed after the calls matching the previous matchers, replayed calls:%s", matchers[i].String(), formatCalls(calls))
+			return
+		}
+		next++
+	}
+}
+
+// samePayload reports whether a payload is want, comparing them decoded when
+// they are both JSON.
+func samePayload(payload, want string) bool {
+	if payload == want {
+		return true
+	}
+	var a, b interface{}
+	if decodeJSON([]byte(payload), &a) != nil || decodeJSON([]byte(want), &b) != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func formatCalls(calls []MockCall) string {
+	var b strings.Builder
+	for _, call := range calls {
+		fmt.Fprintf(&b, "\n\t%s", call)
+	}
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package keploy
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const callsStubs = `version: api.keploy.io/v1beta1
+kind: Http
+name: list
+spec:
+    req:
+        method: GET
+        url: http://api.test/users
+    resp:
+        status_code: 200
+        body: '[]'
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: create
+spec:
+    req:
+        method: POST
+        url: http://api.test/users
+        # the placeholder of ann@example.com without a redaction key
+        body: '{"email":"redacted-email-0eb072f6a631","name":"ann"}'
+    resp:
+        status_code: 201
+---
+version: api.keploy.io/v1beta1
+kind: Func
+name: notify
+spec:
+    name: notify
+    request: ann
+    response: true
+`
+
+func TestCalls(t *testing.T) {
+	dir := writeStubs(t, "TestCalls", callsStubs)
+	c := &http.Client{Transport: &Transport{}}
+	notify := Func("notify", func(context.Context, string) (bool, error) { return false, nil })
+
+	startTestSession(t, MODE_TEST, dir, Config{Redaction: Redaction{Builtin: true}})
+	for _, req := range []struct{ method, body string }{{"GET", ""}, {"POST", `{"name":"ann","email":"ann@example.com"}`}, {"GET", ""}} {
+		if _, _, err := send(t, c, req.method, "http://api.test/users", nil, req.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := notify(context.Background(), "ann"); err != nil {
+		t.Fatal(err)
+	}
+
+	Calls(t, CallMatcher{}).Count(4)
+	if mocks := Calls(t, CallMatcher{Kind: "Http"}).AtLeast(3).Mocks(); !reflect.DeepEqual(mocks, []string{"list", "create"}) {
+		t.Fatalf("replayed the mocks %q", mocks)
+	}
+	// the payloads are the requests before their redaction
+	create := Calls(t, CallMatcher{Target: `^POST .*/users$`}).Containing("ann@example.com").Count(1).First()
+	if create.Mock != "create" || create.Target != "POST http://api.test/users" {
+		t.Fatalf("got the call %v", create)
+	}
+	Calls(t, CallMatcher{Mock: "create"}).WithPayload(map[string]string{"email": "ann@example.com", "name": "ann"}).Count(1)
+	Calls(t, CallMatcher{Kind: "Func"}).WithPayload(`"ann"`).Count(1)
+	Calls(t, CallMatcher{Kind: "Command"}).Never()
+	CallsInOrder(t, CallMatcher{Mock: "list"}, CallMatcher{Mock: "create"}, CallMatcher{Mock: "list"}, CallMatcher{Kind: "Func"})
+
+	tb := &failures{}
+	Calls(tb, CallMatcher{Kind: "Http", Target: "GET"}).Containing("x").Count(1)
+	Calls(tb, CallMatcher{Mock: "list"}).AtLeast(3)
+	Calls(tb, CallMatcher{Kind: "Func"}).Never()
+	want := []string{
+		`keploy: 0 calls matching kind Http, target "GET", payload containing "x" were replayed instead of 1`,
+		"keploy: 2 calls matching mock list were replayed instead of at least 3\n\tHttp mock list: GET http://api.test/users\n\tHttp mock list: GET http://api.test/users",
+		"keploy: 1 calls matching kind Func were replayed instead of 0\n\tFunc mock notify: notify with \"\\\"ann\\\"\"",
+	}
+	if strings.Join(tb.errors, "|") != strings.Join(want, "|") || tb.fatal {
+		t.Fatalf("got failures %q, want %q", tb.errors, want)
+	}
+
+	tb = &failures{}
+	if call := Calls(tb, CallMatcher{Mock: "delete"}).First(); call != (MockCall{}) || !tb.fatal || len(tb.errors) != 1 || tb.errors[0] != "keploy: no call matching mock delete was replayed" {
+		t.Fatalf("got %v, failures %q", call, tb.errors)
+	}
+	tb = &failures{}
+	if calls := Calls(tb, CallMatcher{Target: "("}).All(); calls != nil || !tb.fatal {
+		t.Fatalf("got %v, failures %q, want the invalid target to fail", calls, tb.errors)
+	}
+	tb = &failures{}
+	CallsInOrder(tb, CallMatcher{Kind: "Func"}, CallMatcher{Mock: "create"})
+	if len(tb.errors) != 1 || !strings.HasPrefix(tb.errors[0], "keploy: no call matching mock create was replayed after the calls matching the previous matchers") {
+		t.Fatalf("got failures %q", tb.errors)
+	}
+
+	// the calls are the ones since the last call to New
+	startTestSession(t, MODE_TEST, dir, Config{})
+	Calls(t, CallMatcher{}).Never()
+}
@@ -0,0 +1,66 @@
+package keploy
+
+import (
+	"strings"
+	"testing"
+)
+
+// checkList is a list of values captured since the last call to New and
+// checked by a test, the common part of the assertions of Emails, Published,
+// Produced and Calls.
+type checkList[T any] struct {
+	t     testing.TB
+	items []T
+	// what describes the items in the failure messages, e.g. "emails were
+	// sent", and none their absence, e.g. "no email was sent".
+	what, none string
+	format     func(T) string // summary of an item in the failure messages
+}
+
+// filter returns the items matching match.
+func (l checkList[T]) filter(match func(T) bool) checkList[T] {
+	out := l
+	out.items = nil
+	for _, item := range l.items {
+		if match(item) {
+			out.items = append(out.items, item)
+		}
+	}
+	return out
+}
+
+// count asserts that there are n items.
+func (l checkList[T]) count(n int) {
+	l.t.Helper()
+	if len(l.items) != n {
+		l.t.Errorf("keploy: %d %s instead of %d%s", len(l.items), l.what, n, l.summary())
+	}
+}
+
+// atLeast asserts that there are at least n items.
+func (l checkList[T]) atLeast(n int) {
+	l.t.Helper()
+	if len(l.items) < n {
+		l.t.Errorf("keploy: %d %s instead of at least %d%s", len(l.items), l.what, n, l.summary())
+	}
+}
+
+// first asserts that there is at least one item and returns the first one.
+func (l checkList[T]) first() T {
+	l.t.Helper()
+	if len(l.items) == 0 {
+		l.t.Fatalf("keploy: %s", l.none)
+		var zero T
+		return zero
+	}
+	return l.items[0]
+}
+
+func (l checkList[T]) summary() string {
+	var b strings.Builder
+	for _, item := range l.items {
+		b.WriteString("\n\t")
+		b.WriteString(l.format(item))
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package keploy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// failures is a testing.TB collecting the failures of the assertions.
+type failures struct {
+	testing.TB
+	errors []string
+	fatal  bool
+}
+
+func (f *failures) Helper() {}
+
+func (f *failures) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *failures) Fatalf(format string, args ...interface{}) {
+	f.Errorf(format, args...)
+	f.fatal = true
+}
+
+func TestCheckList(t *testing.T) {
+	tb := &failures{}
+	list := checkList[int]{t: tb, items: []int{1, 2, 3, 4}, what: "numbers were seen", none: "no number was seen", format: func(n int) string { return fmt.Sprint("number ", n) }}
+
+	even := list.filter(func(n int) bool { return n%2 == 0 })
+	even.count(2)
+	even.atLeast(1)
+	if got := even.first(); got != 2 || len(tb.errors) != 0 {
+		t.Fatalf("first = %d, failures %q", got, tb.errors)
+	}
+	if len(list.items) != 4 {
+		t.Fatalf("filter changed the list to %v", list.items)
+	}
+
+	even.count(3)
+	even.atLeast(3)
+	want := []string{
+		"keploy: 2 numbers were seen instead of 3\n\tnumber 2\n\tnumber 4",
+		"keploy: 2 numbers were seen instead of at least 3\n\tnumber 2\n\tnumber 4",
+	}
+	if strings.Join(tb.errors, "|") != strings.Join(want, "|") || tb.fatal {
+		t.Fatalf("got failures %q, want %q", tb.errors, want)
+	}
+
+	tb.errors = nil
+	none := list.filter(func(n int) bool { return n > 4 })
+	if got := none.first(); got != 0 || !tb.fatal || len(tb.errors) != 1 || tb.errors[0] != "keploy: no number was seen" {
+		t.Fatalf("first = %d, failures %q", got, tb.errors)
+	}
+}
@@ -0,0 +1,133 @@
+package keploy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// clockKind is the kind of the mocks recorded by the clocks.
+const clockKind = "Clock"
+
+// clockSpec is the spec of a Clock mock, a time observed by the application.
+type clockSpec struct {
+	Clock string    `yaml:"clock"`
+	Time  time.Time `yaml:"time"`
+}
+
+// Clock is the source of the current time of an application. Reading the time
+// through a Clock instead of time.Now makes it deterministic across the record
+// and the replay of a test.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// RealClock is the Clock of the system, which is never recorded.
+var RealClock Clock = realClock{}
+
+// ClockConfig configures a Clock created with NewClock.
+type ClockConfig struct {
+	Name   string // Name of the recorded sequence of times, so that clocks used by different goroutines replay independently. Default: "default"
+	Freeze bool   // In MODE_TEST, return the first recorded time on every call instead of the recorded sequence. Default: false
+}
+
+// NewClock returns a Clock following the mode of the last call to New. In
+// MODE_RECORD it returns the system time and records it in the stubs file. In
+// MODE_TEST it returns the recorded times in order, and keeps returning the
+// last one once they are exhausted. In MODE_OFF it returns the system time.
+func NewClock(conf ClockConfig) Clock {
+	if conf.Name == "" {
+		conf.Name = "default"
+	}
+	return &sessionClock{conf: conf}
+}
+
+type sessionClock struct {
+	conf ClockConfig
+
+	mu sync.Mutex
+	// the state of the replay, reset when New starts another session
+	session *session
+	last    time.Time
+}
+
+func (c *sessionClock) Now() time.Time {
+	s := activeSession()
+	switch s.mode {
+	case MODE_RECORD:
+		now := time.Now()
+		if err := s.record(clockKind, clockSpec{Clock: c.conf.Name, Time: now}); err != nil {
+			logger.Error(fmt.Sprintf("failed to record the time of clock %s", c.conf.Name), zap.Error(err))
+		}
+		return now
+	case MODE_TEST:
+		return c.replay(s)
+	}
+	return time.Now()
+}
+
+func (c *sessionClock) replay(s *session) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != s {
+		c.session, c.last = s, time.Time{}
+	}
+	if c.conf.Freeze && !c.last.IsZero() {
+		return c.last
+	}
+
+	set, err := s.mocks(clockKind)
+	if err == nil {
+		if m, ok := set.next(func(m *Mock) bool {
+			spec := &clockSpec{}
+			return m.decode(spec) == nil && spec.Clock == c.conf.Name
+		}); ok {
+			spec := &clockSpec{}
+			if err = m.decode(spec); err == nil {
+				c.last = spec.Time.In(time.Local)
+				return c.last
+			}
+		}
+	}
+	if !c.last.IsZero() {
+		return c.last
+	}
+	s.warnOnce(fmt.Sprintf("no recorded time for clock %s, using the system time", c.conf.Name), zap.Error(err))
+	return time.Now()
+}
+
+// defaultClock is the clock used by Now and Since.
+var defaultClock = NewClock(ClockConfig{})
+
+// Now returns the current time of the default clock. It can be plugged into the
+// libraries which accept a time function, like gorm's NowFunc.
+func Now() time.Time {
+	return defaultClock.Now()
+}
+
+// Since returns the time elapsed since t according to the default clock.
+func Since(t time.Time) time.Duration {
+	return defaultClock.Now().Sub(t)
+}
+
+type clockContextKey struct{}
+
+// ContextWithClock returns a copy of ctx carrying the clock.
+func ContextWithClock(ctx context.Context, clock Clock) context.Context {
+	return context.WithValue(ctx, clockContextKey{}, clock)
+}
+
+// ClockFromContext returns the clock carried by ctx, or the default clock.
+func ClockFromContext(ctx context.Context) Clock {
+	if clock, ok := ctx.Value(clockContextKey{}).(Clock); ok {
+		return clock
+	}
+	return defaultClock
+}
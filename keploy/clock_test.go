@@ -0,0 +1,70 @@
+package keploy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClockRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	other := NewClock(ClockConfig{Name: "worker"})
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	first := Now()
+	time.Sleep(2 * time.Millisecond)
+	worker := other.Now()
+	time.Sleep(2 * time.Millisecond)
+	second := Now()
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	for i, want := range []time.Time{first, second, second} {
+		if got := Now(); !got.Equal(want) {
+			t.Errorf("time %d = %v, want %v", i, got, want)
+		}
+	}
+	if got := other.Now(); !got.Equal(worker) {
+		t.Errorf("worker time = %v, want %v", got, worker)
+	}
+	// the replayed times have no monotonic clock reading
+	if got, want := Since(first), second.Round(0).Sub(first.Round(0)); got != want {
+		t.Errorf("Since = %v, want %v", got, want)
+	}
+}
+
+func TestClockFreeze(t *testing.T) {
+	dir := t.TempDir()
+	clock := NewClock(ClockConfig{Freeze: true})
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	first := clock.Now()
+	time.Sleep(2 * time.Millisecond)
+	clock.Now()
+
+	for i := 0; i < 2; i++ {
+		// every session replays from the start
+		startTestSession(t, MODE_TEST, dir, Config{})
+		for j := 0; j < 3; j++ {
+			if got := clock.Now(); !got.Equal(first) {
+				t.Fatalf("session %d time %d = %v, want %v", i, j, got, first)
+			}
+		}
+	}
+}
+
+func TestClockWithoutRecording(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), ""), Config{})
+	before := time.Now()
+	if got := Now(); got.Before(before) || got.After(time.Now()) {
+		t.Fatalf("got %v, want the system time", got)
+	}
+}
+
+func TestClockFromContext(t *testing.T) {
+	if got := ClockFromContext(context.Background()); got != defaultClock {
+		t.Fatalf("got %v, want the default clock", got)
+	}
+	if got := ClockFromContext(ContextWithClock(context.Background(), RealClock)); got != RealClock {
+		t.Fatalf("got %v, want the clock of the context", got)
+	}
+}
@@ -0,0 +1,337 @@
+package keploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// closestCount is the number of recorded mocks reported when no mock matches
+// a request.
+const closestCount = 3
+
+// mismatch is a field of a recorded request which differs from the replayed
+// one, with both values formatted for the report.
+type mismatch struct {
+	field    string
+	recorded string
+	got      string
+	// key is set for the fields identifying the endpoint, like the URL or
+	// the SQL query, which rank a mock lower than the other fields.
+	key bool
+}
+
+// candidate is a recorded mock with the fields of its request differing from
+// the replayed one.
+type candidate struct {
+	name       string
+	mismatches []mismatch
+}
+
+// closest reports the recorded mocks of the set which are the closest to a
+// request matching none of them, diff returning the mismatches of a mock or
+// false when the mock is not a candidate. The mocks differing in the fewest
+// key fields, then in the fewest fields, come first, in recording order. The
+// mocks of a scenario in another state differ in the state of the scenario.
+// The report is empty when there are no candidates.
+func (s *mockSet) closest(diff func(*Mock) ([]mismatch, bool)) string {
+	s.mu.Lock()
+	mocks := append([]*Mock{}, s.mocks...)
+	s.mu.Unlock()
+
+	var candidates []candidate
+	for _, m := range mocks {
+		if mismatches, ok := diff(m); ok {
+			if !s.states.allows(m) {
+				field := fmt.Sprintf("scenario %q state", m.Scenario.Name)
+				mismatches = append(mismatches, diffString(field, m.Scenario.State, s.states.state(m.Scenario.Name))...)
+			}
+			candidates = append(candidates, candidate{name: m.Name, mismatches: mismatches})
+		}
+	}
+	return formatCandidates(candidates)
+}
+
+func formatCandidates(candidates []candidate) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	keys := func(c candidate) int {
+		n := 0
+		for _, m := range c.mismatches {
+			if m.key {
+				n++
+			}
+		}
+		return n
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if ki, kj := keys(candidates[i]), keys(candidates[j]); ki != kj {
+			return ki < kj
+		}
+		return len(candidates[i].mismatches) < len(candidates[j].mismatches)
+	})
+	if len(candidates) > closestCount {
+		candidates = candidates[:closestCount]
+	}
+	var b strings.Builder
+	b.WriteString(", closest recorded mocks:")
+	for _, c := range candidates {
+		fmt.Fprintf(&b, "\n\t%s:", c.name)
+		for _, m := range c.mismatches {
+			fmt.Fprintf(&b, "\n\t\t%s: recorded %s, got %s", m.field, m.recorded, m.got)
+		}
+	}
+	return b.String()
+}
+
+// diffString returns the mismatch of a field whose values differ.
+func diffString(field, recorded, got string) []mismatch {
+	if recorded == got {
+		return nil
+	}
+	r, g := excerpts(recorded, got)
+	return []mismatch{{field: field, recorded: r, got: g}}
+}
+
+// diffKey is diffString for a key field.
+func diffKey(field, recorded, got string) []mismatch {
+	out := diffString(field, recorded, got)
+	for i := range out {
+		out[i].key = true
+	}
+	return out
+}
+
+// excerptWidth bounds the values shown in the report.
+const excerptWidth = 64
+
+// excerpts returns the quoted values, cut around their first difference when
+// they are long.
+func excerpts(recorded, got string) (string, string) {
+	i := 0
+	for i < len(recorded) && i < len(got) && recorded[i] == got[i] {
+		i++
+	}
+	start := 0
+	if i > excerptWidth/2 {
+		start = i - excerptWidth/2
+	}
+	return excerpt(recorded, start), excerpt(got, start)
+}
+
+func excerpt(s string, start int) string {
+	if start > len(s) {
+		start = len(s)
+	}
+	prefix, suffix := "", ""
+	if start > 0 {
+		prefix = "..."
+	}
+	end := start + excerptWidth
+	if end < len(s) {
+		suffix = "..."
+	} else {
+		end = len(s)
+	}
+	return prefix + strconv.Quote(s[start:end]) + suffix
+}
+
+// diffHTTP returns the fields of the recorded request differing from req, the
+// ones matchHTTP compares.
+func (m *matcher) diffHTTP(recorded httpRequest, req *http.Request, body []byte) []mismatch {
+	out := diffKey("method", recorded.Method, req.Method)
+	rule := m.httpRule(req)
+	if rule == nil {
+		out = append(out, diffKey("url", recorded.URL, req.URL.String())...)
+		return append(out, diffBody("body", BodyExact, []byte(recorded.Body), body)...)
+	}
+
+	u, err := url.Parse(recorded.URL)
+	if err != nil {
+		return append(out, diffKey("url", recorded.URL, req.URL.String())...)
+	}
+	out = append(out, diffKey("scheme", u.Scheme, req.URL.Scheme)...)
+	out = append(out, diffKey("host", u.Host, req.URL.Host)...)
+	if rule.path != nil {
+		if !rule.path.MatchString(u.Path) {
+			out = append(out, mismatch{field: "path", recorded: strconv.Quote(u.Path) + " not matching " + quotePattern(rule.path), got: strconv.Quote(req.URL.Path), key: true})
+		}
+	} else {
+		out = append(out, diffKey("path", u.Path, req.URL.Path)...)
+	}
+	out = append(out, rule.diffQuery(u.Query(), req.URL.Query())...)
+	if rule.headers {
+		keys := make([]string, 0, len(recorded.Header))
+		for k := range recorded.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if rule.ignored[http.CanonicalHeaderKey(k)] {
+				continue
+			}
+			if v := req.Header.Values(k); len(v) == 0 {
+				out = append(out, mismatch{field: "header " + k, recorded: strconv.Quote(recorded.Header[k]), got: "none"})
+			} else {
+				out = append(out, diffString("header "+k, recorded.Header[k], strings.Join(v, ", "))...)
+			}
+		}
+	}
+	return append(out, diffBody("body", rule.body, []byte(recorded.Body), body)...)
+}
+
+func (r *httpRule) diffQuery(recorded, query url.Values) []mismatch {
+	keys := map[string]bool{}
+	for k := range recorded {
+		keys[k] = true
+	}
+	for k := range query {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var out []mismatch
+	for _, k := range sorted {
+		want, got := strings.Join(recorded[k], ","), strings.Join(query[k], ",")
+		if re, ok := r.query[k]; ok {
+			if !re.MatchString(want) || !re.MatchString(got) {
+				out = append(out, mismatch{field: "query " + k, recorded: strconv.Quote(want), got: strconv.Quote(got) + " for pattern " + quotePattern(re)})
+			}
+			continue
+		}
+		if !equalStrings(recorded[k], query[k]) {
+			out = append(out, diffString("query "+k, want, got)...)
+		}
+	}
+	return out
+}
+
+// quotePattern quotes the expression of a regular expression compiled by
+// fullRegexp.
+func quotePattern(re *regexp.Regexp) string {
+	return strconv.Quote(strings.TrimSuffix(strings.TrimPrefix(re.String(), "^(?:"), ")$"))
+}
+
+// diffBody returns the JSON paths of the body differing from the recorded one
+// when both are JSON, or the whole body otherwise.
+func diffBody(field string, match BodyMatch, recorded, body []byte) []mismatch {
+	if matchBody(match, recorded, body) {
+		return nil
+	}
+	var want, got interface{}
+	if decodeJSON(recorded, &want) == nil && decodeJSON(body, &got) == nil {
+		var out []mismatch
+		diffJSON(field+" $", want, got, match == BodyJSONSubset, &out)
+		if len(out) > 0 {
+			return out
+		}
+	}
+	r, g := excerpts(string(recorded), string(body))
+	return []mismatch{{field: field, recorded: r, got: g}}
+}
+
+// diffJSON appends the paths of the decoded JSON values which differ. With
+// subset, the objects of got may have more keys than the ones of want.
+func diffJSON(path string, want, got interface{}, subset bool, out *[]mismatch) {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		got, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(want)+len(got))
+		for k := range want {
+			keys = append(keys, k)
+		}
+		for k := range got {
+			if _, ok := want[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			w, inWant := want[k]
+			g, inGot := got[k]
+			switch {
+			case !inGot:
+				*out = append(*out, mismatch{field: path + "." + k, recorded: jsonText(w), got: "none"})
+			case !inWant:
+				if !subset {
+					*out = append(*out, mismatch{field: path + "." + k, recorded: "none", got: jsonText(g)})
+				}
+			default:
+				diffJSON(path+"."+k, w, g, subset, out)
+			}
+		}
+		return
+	case []interface{}:
+		got, ok := got.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(want) || i < len(got); i++ {
+			field := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(got):
+				*out = append(*out, mismatch{field: field, recorded: jsonText(want[i]), got: "none"})
+			case i >= len(want):
+				*out = append(*out, mismatch{field: field, recorded: "none", got: jsonText(got[i])})
+			default:
+				diffJSON(field, want[i], got[i], subset, out)
+			}
+		}
+		return
+	}
+	if !matchJSON(want, got, subset) {
+		*out = append(*out, mismatch{field: path, recorded: jsonText(want), got: jsonText(got)})
+	}
+}
+
+func jsonText(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	if len(b) > excerptWidth {
+		return string(b[:excerptWidth]) + "..."
+	}
+	return string(b)
+}
+
+// diffSQL returns the differences of a query and its arguments with the
+// recorded ones, the ones the stand-ins compare.
+func (m *matcher) diffSQL(recorded string, recordedArgs []*string, query string, args []*string) []mismatch {
+	out := diffKey("query", m.normalizeQuery(recorded), m.normalizeQuery(query))
+	if m.matchArgs(recordedArgs, args) {
+		return out
+	}
+	for i := 0; i < len(recordedArgs) || i < len(args); i++ {
+		field := fmt.Sprintf("arg $%d", i+1)
+		switch {
+		case i >= len(args):
+			out = append(out, mismatch{field: field, recorded: sqlArgText(recordedArgs[i]), got: "none"})
+		case i >= len(recordedArgs):
+			out = append(out, mismatch{field: field, recorded: "none", got: sqlArgText(args[i])})
+		case !equalArgs(recordedArgs[i:i+1], args[i:i+1]):
+			out = append(out, mismatch{field: field, recorded: sqlArgText(recordedArgs[i]), got: sqlArgText(args[i])})
+		}
+	}
+	return out
+}
+
+func sqlArgText(arg *string) string {
+	if arg == nil {
+		return "NULL"
+	}
+	return excerpt(*arg, 0)
+}
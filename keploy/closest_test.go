@@ -0,0 +1,154 @@
+package keploy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const closestStubs = `version: api.keploy.io/v1beta1
+kind: Http
+name: users
+spec:
+    req:
+        method: GET
+        url: http://api.test/users/1
+    resp:
+        status_code: 200
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: book
+spec:
+    req:
+        method: POST
+        url: http://api.test/orders
+        body: '{"item":"book","qty":1,"tags":["a"]}'
+    resp:
+        status_code: 201
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: pen
+spec:
+    req:
+        method: POST
+        url: http://api.test/orders
+        body: '{"item":"pen","qty":1}'
+    resp:
+        status_code: 201
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: cart
+spec:
+    req:
+        method: POST
+        url: http://api.test/carts
+        body: '{}'
+    resp:
+        status_code: 201
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: cancel
+spec:
+    req:
+        method: DELETE
+        url: http://api.test/orders
+    resp:
+        status_code: 204
+`
+
+func TestClosestHTTP(t *testing.T) {
+	dir := writeStubs(t, "TestClosestHTTP", closestStubs)
+	c := &http.Client{Transport: &Transport{}}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	_, _, err := send(t, c, "POST", "http://api.test/orders", nil, `{"item":"book","qty":2,"tags":["a","b"],"gift":true}`)
+	if err == nil {
+		t.Fatal("the request matched a mock")
+	}
+	// the mocks of the same endpoint come first, the fewest differences first
+	want := `keploy: no recorded mock matches POST http://api.test/orders, closest recorded mocks:
+	book:
+		body $.gift: recorded none, got true
+		body $.qty: recorded 1, got 2
+		body $.tags[1]: recorded none, got "b"
+	pen:
+		body $.gift: recorded none, got true
+		body $.item: recorded "pen", got "book"
+		body $.qty: recorded 1, got 2
+		body $.tags: recorded none, got ["a","b"]
+	cancel:
+		method: recorded "DELETE", got "POST"
+		body: recorded "", got "{\"item\":\"book\",\"qty\":2,\"tags\":[\"a\",\"b\"],\"gift\":true}"`
+	if !strings.HasSuffix(err.Error(), want) {
+		t.Fatalf("got %v\nwant the report\n%s", err, want)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{Matching: Matching{HTTP: []HTTPRule{{
+		Path:    "/users/[0-9]+",
+		Query:   map[string]string{"page": "[0-9]+"},
+		Headers: true,
+	}}}})
+	req, _ := http.NewRequest("GET", "http://api.test/users/2?page=x", nil)
+	if _, err := c.Do(req); err == nil || !strings.Contains(err.Error(), "\tusers:\n\t\tquery page: recorded \"\", got \"x\" for pattern \"[0-9]+\"") {
+		t.Fatalf("got %v, want the query parameter reported", err)
+	}
+}
+
+func TestClosestPostgres(t *testing.T) {
+	c := dialPostgres(t, startPostgres(t))
+	c.send(t, 'Q', pgString(nil, "UPDATE users SET name = 'bobby'"))
+	msgs := c.until(t, 'Z')
+	if msgs[0].typ != 'E' {
+		t.Fatalf("unexpected response %q", msgs)
+	}
+	want := `keploy: no recorded mock matches query "UPDATE users SET name = 'bobby'", closest recorded mocks:
+	postgres-0:
+		query: recorded "SELECT id, name FROM users WHERE id = $1", got "UPDATE users SET name = 'bobby'"
+	postgres-1:
+		query: recorded "UPDATE users SET name = 'bob'", got "UPDATE users SET name = 'bobby'"`
+	// the mocks differing as much come in recording order
+	if !bytes.Contains(msgs[0].body, []byte("M"+want+"\x00")) {
+		t.Fatalf("got %q\nwant the report\n%s", msgs[0].body, want)
+	}
+}
+
+func TestDiffSQL(t *testing.T) {
+	one, two := "1", "2"
+	m := &matcher{}
+	got := m.diffSQL("SELECT * FROM t WHERE a = $1 AND b = $2", []*string{&one, nil},
+		"SELECT * FROM t WHERE a = $1 AND b = $2", []*string{&two, nil, &one})
+	want := []mismatch{
+		{field: "arg $1", recorded: `"1"`, got: `"2"`},
+		{field: "arg $3", recorded: "none", got: `"1"`},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("mismatch %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := m.diffSQL("SELECT 1", nil, "SELECT 2", nil); len(got) != 1 || !got[0].key {
+		t.Fatalf("got %+v, want the query as a key field", got)
+	}
+}
+
+func TestExcerpts(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	r, g := excerpts(long+"recorded"+long, long+"got"+long)
+	if !strings.HasPrefix(r, `..."aaaa`) || !strings.Contains(r, "recorded") || !strings.HasSuffix(r, `"...`) {
+		t.Errorf("recorded excerpt %s", r)
+	}
+	if !strings.HasPrefix(g, `..."aaaa`) || !strings.Contains(g, "got") {
+		t.Errorf("got excerpt %s", g)
+	}
+	if r, g := excerpts("short", "other"); r != `"short"` || g != `"other"` {
+		t.Errorf("got %s and %s", r, g)
+	}
+}
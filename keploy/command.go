@@ -0,0 +1,284 @@
+package keploy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// commandKind is the kind of the mocks recorded by Command.
+const commandKind = "Command"
+
+// commandSpec is the spec of a Command mock, a single execution of a program.
+type commandSpec struct {
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	Args     []string          `yaml:"args"`
+	Dir      string            `yaml:"dir,omitempty"`
+	Env      map[string]string `yaml:"env,omitempty"`
+	Stdin    string            `yaml:"stdin,omitempty"`
+	Stdout   string            `yaml:"stdout,omitempty"`
+	Stderr   string            `yaml:"stderr,omitempty"`
+	ExitCode int               `yaml:"exit_code"`
+	Error    string            `yaml:"error,omitempty"`
+}
+
+// Cmd is an external command prepared by Command. Its fields are read when the
+// command is run. Path, Args, Dir and the standard streams have the meaning of
+// the ones of exec.Cmd, unlike Env.
+type Cmd struct {
+	Path string
+	Args []string
+	// Env is added to the environment of the process. Only the variables set
+	// here are recorded and compared in MODE_TEST.
+	Env    []string
+	Dir    string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	ctx      context.Context
+	exitCode int
+}
+
+// ExitError is the error of a command which exited with a non-zero status, in
+// every mode. In MODE_RECORD and MODE_OFF it wraps the *exec.ExitError.
+type ExitError struct {
+	Code   int
+	Stderr []byte // the standard error when it was collected by Output
+	err    error
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit code of the process.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.err
+}
+
+// Command returns a command running name with args, like exec.CommandContext,
+// following the mode of the last call to New. In MODE_RECORD the program is
+// run and its argv, Dir, Env, stdin, stdout, stderr and exit code are recorded
+// in the stubs file. In MODE_TEST the recorded outputs and exit code of the
+// same execution, in the same Dir, are replayed without running the program,
+// so that it does not need to be installed. In MODE_OFF the program is run.
+func Command(ctx context.Context, name string, args ...string) *Cmd {
+	return &Cmd{Path: name, Args: append([]string{name}, args...), ctx: ctx, exitCode: -1}
+}
+
+// Run runs the command and waits for it to complete.
+func (c *Cmd) Run() error {
+	s := activeSession()
+	switch s.mode {
+	case MODE_RECORD:
+		spec := commandSpec{Args: c.Args, Dir: c.Dir, Env: commandEnv(c.Env)}
+		var stdin, stdout, stderr bytes.Buffer
+		if c.Stdin != nil {
+			if _, err := io.Copy(&stdin, c.Stdin); err != nil {
+				return err
+			}
+		}
+		// Stdout and Stderr may be the same writer, as with CombinedOutput
+		var mu sync.Mutex
+		start := time.Now()
+		err := c.run(bytes.NewReader(stdin.Bytes()),
+			&lockedWriter{mu: &mu, w: io.MultiWriter(c.writer(c.Stdout), &stdout)},
+			&lockedWriter{mu: &mu, w: io.MultiWriter(c.writer(c.Stderr), &stderr)})
+		spec.Stdin, spec.Stdout, spec.Stderr, spec.ExitCode = stdin.String(), stdout.String(), stderr.String(), c.exitCode
+		var exitErr *ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			spec.Error = err.Error()
+		}
+		if recErr := s.recordLatency(commandKind, spec, time.Since(start)); recErr != nil {
+			logger.Error(fmt.Sprintf("failed to record the execution of %s", c.Path), zap.Error(recErr))
+		}
+		return err
+	case MODE_TEST:
+		return c.replay(s)
+	}
+	return c.run(c.Stdin, c.Stdout, c.Stderr)
+}
+
+// Output runs the command and returns its standard output. The standard error
+// is returned in the Stderr of an *ExitError when it is not set on c.
+func (c *Cmd) Output() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	captureErr := c.Stderr == nil
+	if captureErr {
+		c.Stderr = &stderr
+	}
+	err := c.Run()
+	var exitErr *ExitError
+	if captureErr && errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its standard output and standard
+// error together. In MODE_TEST the standard output comes first.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	err := c.Run()
+	return out.Bytes(), err
+}
+
+// ExitCode returns the exit code of the command, or -1 when it has not exited.
+func (c *Cmd) ExitCode() int {
+	return c.exitCode
+}
+
+// String returns the command line of c.
+func (c *Cmd) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+func (c *Cmd) run(stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(c.ctx, c.Path, c.Args[1:]...)
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = c.Dir, stdin, stdout, stderr
+	err := cmd.Run()
+	if cmd.ProcessState != nil {
+		c.exitCode = cmd.ProcessState.ExitCode()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Code: exitErr.ExitCode(), err: err}
+	}
+	return err
+}
+
+func (c *Cmd) replay(s *session) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	set, err := s.mocks(commandKind)
+	if err != nil {
+		return err
+	}
+	var stdin []byte
+	if c.Stdin != nil {
+		if stdin, err = io.ReadAll(c.Stdin); err != nil {
+			return err
+		}
+	}
+	call := commandSpec{Args: c.Args, Dir: c.Dir, Env: commandEnv(c.Env), Stdin: string(stdin)}
+	if err := s.redact.value(commandKind, &call); err != nil {
+		return fmt.Errorf("failed to redact the command %w", err)
+	}
+	m, ok := set.find(func(m *Mock) bool {
+		recorded := &commandSpec{}
+		if m.decode(recorded) != nil {
+			return false
+		}
+		want := commandSpec{Args: recorded.Args, Dir: recorded.Dir, Env: recorded.Env, Stdin: recorded.Stdin}
+		got := call
+		if s.normalizeNoise(m, &want) != nil || s.normalizeNoise(m, &got) != nil {
+			return false
+		}
+		if !equalStrings(want.Args, got.Args) || want.Dir != got.Dir || want.Stdin != got.Stdin || len(want.Env) != len(got.Env) {
+			return false
+		}
+		for k, v := range got.Env {
+			if rv, ok := want.Env[k]; !ok || rv != v {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		return fmt.Errorf("keploy: no recorded mock matches the command %q", c.String())
+	}
+	spec := &commandSpec{}
+	if err := m.decode(spec); err != nil {
+		return err
+	}
+	s.called(m, c.String(), string(stdin))
+	if err := s.wait(c.ctx, m); err != nil {
+		return err
+	}
+	if spec.Error != "" {
+		return errors.New(spec.Error)
+	}
+	if _, err := io.WriteString(c.writer(c.Stdout), spec.Stdout); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(c.writer(c.Stderr), spec.Stderr); err != nil {
+		return err
+	}
+	c.exitCode = spec.ExitCode
+	if spec.ExitCode != 0 {
+		return &ExitError{Code: spec.ExitCode}
+	}
+	return nil
+}
+
+func (c *Cmd) writer(w io.Writer) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// commandEnv returns the KEY=value entries of env as a map.
+func commandEnv(env []string) map[string]string {
+	if len(env) == 0 {
+		return nil
+	}
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		vars[k] = v
+	}
+	return vars
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
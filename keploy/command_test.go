@@ -0,0 +1,175 @@
+package keploy
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandRecordReplay(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	dir, workDir := t.TempDir(), t.TempDir()
+	ctx := context.Background()
+	run := func() (string, string, *ExitError) {
+		cmd := Command(ctx, "sh", "-c", `read name; echo "hello $name from $GREETER"; echo oops >&2; exit 3`)
+		cmd.Env = []string{"GREETER=keploy"}
+		cmd.Dir = workDir
+		cmd.Stdin = strings.NewReader("alice\n")
+		out, err := cmd.Output()
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("got %v, want an *ExitError", err)
+		}
+		if cmd.ExitCode() != 3 {
+			t.Fatalf("exit code %d, want 3", cmd.ExitCode())
+		}
+		return string(out), string(exitErr.Stderr), exitErr
+	}
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	out, stderr, exitErr := run()
+	if out != "hello alice from keploy\n" || stderr != "oops\n" || exitErr.Code != 3 {
+		t.Fatalf("recorded %q %q %v", out, stderr, exitErr)
+	}
+	var execErr *exec.ExitError
+	if !errors.As(exitErr, &execErr) {
+		t.Fatal("the *exec.ExitError is not wrapped in MODE_RECORD")
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	if gotOut, gotStderr, _ := run(); gotOut != out || gotStderr != stderr {
+		t.Fatalf("replayed %q %q, want %q %q", gotOut, gotStderr, out, stderr)
+	}
+
+	// the executions differing by their stdin or their Env do not match
+	cmd := Command(ctx, "sh", "-c", `read name; echo "hello $name from $GREETER"; echo oops >&2; exit 3`)
+	cmd.Env = []string{"GREETER=someone"}
+	cmd.Stdin = strings.NewReader("alice\n")
+	if err := cmd.Run(); err == nil || !strings.Contains(err.Error(), "no recorded mock matches the command") {
+		t.Fatalf("got %v, want the command not to match", err)
+	}
+}
+
+func TestCommandEnvExtendsTheEnvironment(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	t.Setenv("KEPLOY_INHERITED", "inherited")
+	cmd := Command(context.Background(), "sh", "-c", `echo "$KEPLOY_INHERITED $KEPLOY_ADDED"`)
+	cmd.Env = []string{"KEPLOY_ADDED=added"}
+	out, err := cmd.Output()
+	if err != nil || string(out) != "inherited added\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+}
+
+const commandStubs = `version: api.keploy.io/v1beta1
+kind: Command
+name: command-0
+spec:
+  args: [keploy-missing-tool, version]
+  stdout: "v1\n"
+  exit_code: 0
+---
+version: api.keploy.io/v1beta1
+kind: Command
+name: command-1
+spec:
+  args: [keploy-missing-tool, version]
+  stdout: "v2\n"
+  exit_code: 0
+---
+version: api.keploy.io/v1beta1
+kind: Command
+name: command-2
+spec:
+  args: [keploy-missing-tool, deploy]
+  stdout: "deploying\n"
+  stderr: "no credentials\n"
+  exit_code: 1
+`
+
+func TestCommandReplayWithoutTheProgram(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), commandStubs), Config{})
+	ctx := context.Background()
+
+	// the reused mock is the one whose outputs are replayed
+	var got []string
+	for i := 0; i < 3; i++ {
+		out, err := Command(ctx, "keploy-missing-tool", "version").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(out))
+	}
+	var charged []string
+	for _, call := range Calls(t, CallMatcher{Kind: commandKind}).All() {
+		charged = append(charged, call.Mock)
+	}
+	if !reflect.DeepEqual(got, []string{"v1\n", "v2\n", "v1\n"}) || !reflect.DeepEqual(charged, []string{"command-0", "command-1", "command-0"}) {
+		t.Fatalf("got outputs %q from mocks %q", got, charged)
+	}
+
+	cmd := Command(ctx, "keploy-missing-tool", "deploy")
+	out, err := cmd.CombinedOutput()
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 || cmd.ExitCode() != 1 {
+		t.Fatalf("got %v, want exit status 1", err)
+	}
+	if string(out) != "deploying\nno credentials\n" {
+		t.Fatalf("got combined output %q", out)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := Command(canceled, "keploy-missing-tool", "version").Run(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the error of the context", err)
+	}
+}
+
+const commandDirStubs = `version: api.keploy.io/v1beta1
+kind: Command
+name: command-0
+spec:
+  args: [keploy-missing-tool, status]
+  dir: /srv/repo
+  stdout: "clean\n"
+  exit_code: 0
+---
+version: api.keploy.io/v1beta1
+kind: Command
+name: command-1
+noise:
+    - $.dir
+spec:
+  args: [keploy-missing-tool, build]
+  dir: /tmp/build-123
+  stdout: "built\n"
+  exit_code: 0
+`
+
+func TestCommandMatchesDir(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), commandDirStubs), Config{})
+	ctx := context.Background()
+	run := func(dir string, args ...string) (string, error) {
+		cmd := Command(ctx, "keploy-missing-tool", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		return string(out), err
+	}
+	if out, err := run("/srv/repo", "status"); err != nil || out != "clean\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if _, err := run("/srv/other", "status"); err == nil || !strings.Contains(err.Error(), "no recorded mock matches the command") {
+		t.Fatalf("got %v, want a command run in another Dir not to match", err)
+	}
+	// a Dir declared as noise matches any Dir
+	if out, err := run("/tmp/build-456", "build"); err != nil || out != "built\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+}
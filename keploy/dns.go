@@ -0,0 +1,473 @@
+package keploy
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dnsKind is the kind of the mocks recorded by Resolver.
+const dnsKind = "DNS"
+
+// dnsSpec is the spec of a DNS mock, a question and the answers of the server.
+type dnsSpec struct {
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	Name     string            `yaml:"name"`
+	Type     string            `yaml:"type"`
+	Rcode    string            `yaml:"rcode"`
+	Answers  []dnsRecord       `yaml:"answers,omitempty"`
+}
+
+// dnsRecord is a resource record in its presentation format, e.g. an IP
+// address for A and AAAA records or "10 mail.example.com." for MX records.
+// The records of the other types are kept in the generic "\# length hex" form.
+// The strings of TXT records are recorded in Text; a TXT record written with
+// Data has it split in strings of 255 bytes.
+type dnsRecord struct {
+	Name string   `yaml:"name"`
+	Type string   `yaml:"type"`
+	TTL  uint32   `yaml:"ttl"`
+	Data string   `yaml:"data,omitempty"`
+	Text []string `yaml:"text,omitempty"`
+}
+
+var dnsTypes = map[uint16]string{1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 15: "MX", 16: "TXT", 28: "AAAA", 33: "SRV", 65: "HTTPS", 255: "ANY"}
+
+var dnsRcodes = map[uint16]string{0: "NOERROR", 1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED"}
+
+// dnsTimeout bounds the exchanges with the real server in MODE_RECORD.
+const dnsTimeout = 5 * time.Second
+
+// Resolver returns a resolver following the mode of the last call to New. In
+// MODE_RECORD the questions are sent to the configured name servers and their
+// answers recorded in the stubs file. In MODE_TEST the answers are served from
+// the stubs file without any network access, and names without a recorded
+// answer do not exist. In MODE_OFF it behaves like the pure Go resolver, as it
+// does for the names left out by Config.Filters in every mode.
+func Resolver() *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: dialDNS}
+}
+
+func dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	s := activeSession()
+	if s.mode != MODE_RECORD && s.mode != MODE_TEST {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	// the resolver frames the messages with their length on connections which
+	// are not a net.PacketConn, as over TCP
+	client, server := net.Pipe()
+	go serveDNS(s, server, network, address)
+	return client, nil
+}
+
+func serveDNS(s *session, conn net.Conn, network, address string) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		mode := s.mode
+		if name, _, _, err := parseDNSQuestion(query); err == nil {
+			t := addrTarget("dns", address)
+			t.host = name
+			mode = s.modeFor(t)
+		}
+		var resp []byte
+		var err error
+		switch mode {
+		case MODE_RECORD:
+			resp, err = recordDNS(s, network, address, query)
+		case MODE_TEST:
+			resp, err = replayDNS(s, query)
+		default:
+			resp, err = resolveDNS(network, address, query)
+		}
+		if err != nil {
+			logger.Error("failed to answer the dns question", zap.Error(err))
+			return
+		}
+		if _, err := conn.Write(appendUint16(nil, uint16(len(resp)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func recordDNS(s *session, network, address string, query []byte) ([]byte, error) {
+	resp, err := resolveDNS(network, address, query)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := parseDNSResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.record(dnsKind, spec); err != nil {
+		logger.Error(fmt.Sprintf("failed to record the dns answer of %s", spec.Name), zap.Error(err))
+	}
+	return resp, nil
+}
+
+// resolveDNS asks the name server at address, over TCP when the answer over
+// UDP is truncated.
+func resolveDNS(network, address string, query []byte) ([]byte, error) {
+	resp, err := exchangeDNS(network, address, query)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 && strings.HasPrefix(network, "udp") {
+		// truncated, ask again over TCP
+		resp, err = exchangeDNS("tcp", address, query)
+	}
+	return resp, err
+}
+
+func exchangeDNS(network, address string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, address, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if !strings.HasPrefix(network, "tcp") {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	if _, err := conn.Write(append(appendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(conn, resp)
+	return resp, err
+}
+
+func replayDNS(s *session, query []byte) ([]byte, error) {
+	name, typ, end, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+	spec := &dnsSpec{}
+	set, err := s.mocks(dnsKind)
+	if err == nil {
+		if m, ok := set.find(func(m *Mock) bool {
+			recorded := &dnsSpec{}
+			return m.decode(recorded) == nil && strings.EqualFold(dnsFQDN(recorded.Name), name) && recorded.Type == typ
+		}); ok {
+			if err = m.decode(spec); err == nil {
+				s.called(m, typ+" "+name, "")
+			}
+		} else {
+			err = errors.New("keploy: no recorded mock matches the dns question")
+		}
+	}
+	if err != nil {
+		s.warnOnce(fmt.Sprintf("no recorded answer for %s %s, answering NXDOMAIN", typ, name), zap.Error(err))
+		spec = &dnsSpec{Rcode: "NXDOMAIN"}
+	}
+	return encodeDNSResponse(query, end, spec)
+}
+
+// parseDNSQuestion returns the name and the type of the first question of a
+// message, and the offset of the end of the question section.
+func parseDNSQuestion(msg []byte) (string, string, int, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return "", "", 0, errors.New("malformed dns message")
+	}
+	name, off, err := readDNSName(msg, 12)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if len(msg) < off+4 {
+		return "", "", 0, errors.New("malformed dns message")
+	}
+	typ := dnsTypeName(binary.BigEndian.Uint16(msg[off:]))
+	off += 4
+	for i := 1; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return "", "", 0, err
+		}
+		off += 4
+	}
+	if off > len(msg) {
+		return "", "", 0, errors.New("malformed dns message")
+	}
+	return name, typ, off, nil
+}
+
+func parseDNSResponse(msg []byte) (*dnsSpec, error) {
+	name, typ, off, err := parseDNSQuestion(msg)
+	if err != nil {
+		return nil, err
+	}
+	rcode := binary.BigEndian.Uint16(msg[2:]) & 0x0f
+	spec := &dnsSpec{Name: name, Type: typ, Rcode: dnsRcodes[rcode]}
+	if spec.Rcode == "" {
+		spec.Rcode = strconv.Itoa(int(rcode))
+	}
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])); i++ {
+		var rr dnsRecord
+		if rr.Name, off, err = readDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if len(msg) < off+10 {
+			return nil, errors.New("malformed dns message")
+		}
+		t := binary.BigEndian.Uint16(msg[off:])
+		rr.Type = dnsTypeName(t)
+		rr.TTL = binary.BigEndian.Uint32(msg[off+4:])
+		size := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if len(msg) < off+size {
+			return nil, errors.New("malformed dns message")
+		}
+		if rr.Type == "TXT" {
+			rr.Text, err = readDNSStrings(msg[off : off+size])
+		} else {
+			rr.Data, err = dnsRecordData(msg, off, size, t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		off += size
+		spec.Answers = append(spec.Answers, rr)
+	}
+	return spec, nil
+}
+
+// dnsRecordData returns the presentation format of the rdata of size bytes at
+// off in msg, which may point to names earlier in the message.
+func dnsRecordData(msg []byte, off, size int, typ uint16) (string, error) {
+	rdata := msg[off : off+size]
+	switch dnsTypeName(typ) {
+	case "A", "AAAA":
+		if len(rdata) == net.IPv4len || len(rdata) == net.IPv6len {
+			return net.IP(rdata).String(), nil
+		}
+	case "CNAME", "NS", "PTR":
+		name, _, err := readDNSName(msg, off)
+		return name, err
+	case "MX":
+		if size > 2 {
+			name, _, err := readDNSName(msg, off+2)
+			return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), name), err
+		}
+	case "SRV":
+		if size > 6 {
+			name, _, err := readDNSName(msg, off+6)
+			return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]), binary.BigEndian.Uint16(rdata[4:]), name), err
+		}
+	}
+	return fmt.Sprintf(`\# %d %s`, size, hex.EncodeToString(rdata)), nil
+}
+
+func encodeDNSResponse(query []byte, end int, spec *dnsSpec) ([]byte, error) {
+	rcode, ok := dnsNumber(dnsRcodes, spec.Rcode)
+	if !ok {
+		return nil, fmt.Errorf("unknown dns rcode %s", spec.Rcode)
+	}
+	// QR, the RD of the query, and RA
+	flags := 0x8000 | binary.BigEndian.Uint16(query[2:])&0x0100 | 0x0080 | rcode
+	msg := append([]byte{}, query[:2]...)
+	msg = appendUint16(msg, flags)
+	msg = append(msg, query[4:6]...)
+	msg = appendUint16(msg, uint16(len(spec.Answers)))
+	msg = append(msg, 0, 0, 0, 0)
+	msg = append(msg, query[12:end]...)
+	for _, rr := range spec.Answers {
+		typ, ok := dnsNumber(dnsTypes, rr.Type)
+		if !ok {
+			return nil, fmt.Errorf("unknown dns type %s", rr.Type)
+		}
+		var (
+			rdata []byte
+			err   error
+		)
+		if len(rr.Text) > 0 {
+			rdata, err = appendDNSStrings(nil, rr.Text)
+		} else {
+			rdata, err = encodeDNSRecordData(typ, rr.Data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the %s record of %s %w", rr.Type, rr.Name, err)
+		}
+		msg = appendDNSName(msg, rr.Name)
+		msg = appendUint16(msg, typ)
+		msg = appendUint16(msg, 1) // IN
+		msg = appendUint32(msg, rr.TTL)
+		msg = appendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return msg, nil
+}
+
+func encodeDNSRecordData(typ uint16, data string) ([]byte, error) {
+	if strings.HasPrefix(data, `\# `) {
+		var size int
+		var h string
+		if _, err := fmt.Sscan(data[3:], &size, &h); err != nil {
+			return nil, err
+		}
+		return hex.DecodeString(h)
+	}
+	switch dnsTypeName(typ) {
+	case "A":
+		if ip := net.ParseIP(data).To4(); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("invalid IPv4 address %s", data)
+	case "AAAA":
+		if ip := net.ParseIP(data); ip != nil {
+			return ip.To16(), nil
+		}
+		return nil, fmt.Errorf("invalid IPv6 address %s", data)
+	case "CNAME", "NS", "PTR":
+		return appendDNSName(nil, data), nil
+	case "MX":
+		var pref uint16
+		var name string
+		if _, err := fmt.Sscan(data, &pref, &name); err != nil {
+			return nil, err
+		}
+		return appendDNSName(appendUint16(nil, pref), name), nil
+	case "SRV":
+		var priority, weight, port uint16
+		var target string
+		if _, err := fmt.Sscan(data, &priority, &weight, &port, &target); err != nil {
+			return nil, err
+		}
+		b := appendUint16(appendUint16(appendUint16(nil, priority), weight), port)
+		return appendDNSName(b, target), nil
+	case "TXT":
+		var b []byte
+		for {
+			n := len(data)
+			if n > 255 {
+				n = 255
+			}
+			b = append(append(b, byte(n)), data[:n]...)
+			if data = data[n:]; data == "" {
+				return b, nil
+			}
+		}
+	}
+	return nil, errors.New(`the record data must be in the "\# length hex" form`)
+}
+
+// readDNSStrings returns the character strings of the rdata of a TXT record.
+func readDNSStrings(rdata []byte) ([]string, error) {
+	var out []string
+	for i := 0; i < len(rdata); {
+		n := int(rdata[i])
+		if i+1+n > len(rdata) {
+			return nil, errors.New("malformed dns message")
+		}
+		out = append(out, string(rdata[i+1:i+1+n]))
+		i += 1 + n
+	}
+	return out, nil
+}
+
+// appendDNSStrings appends the character strings of a TXT record.
+func appendDNSStrings(b []byte, strs []string) ([]byte, error) {
+	for _, s := range strs {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("the TXT string %q is longer than 255 bytes", s)
+		}
+		b = append(append(b, byte(len(s))), s...)
+	}
+	return b, nil
+}
+
+// readDNSName reads the possibly compressed name at off in msg and returns it
+// with a trailing dot, along with the offset following it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("malformed dns name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, errors.New("malformed dns name")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("malformed dns name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			b = append(append(b, byte(len(label))), label...)
+		}
+	}
+	return append(b, 0)
+}
+
+func dnsFQDN(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func dnsTypeName(typ uint16) string {
+	if name, ok := dnsTypes[typ]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(typ))
+}
+
+// dnsNumber returns the number of a type or rcode name, or of its numeric form.
+func dnsNumber(names map[uint16]string, name string) (uint16, bool) {
+	for n, s := range names {
+		if strings.EqualFold(s, name) {
+			return n, true
+		}
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(name), "TYPE"), 10, 16)
+	return uint16(n), err == nil
+}
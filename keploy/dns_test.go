@@ -0,0 +1,263 @@
+package keploy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const dnsStubs = `version: api.keploy.io/v1beta1
+kind: DNS
+name: dns-0
+spec:
+  name: api.example.com.
+  type: A
+  rcode: NOERROR
+  answers:
+    - {name: api.example.com., type: CNAME, ttl: 60, data: lb.example.com.}
+    - {name: lb.example.com., type: A, ttl: 60, data: 10.0.0.1}
+---
+version: api.keploy.io/v1beta1
+kind: DNS
+name: dns-1
+spec:
+  name: api.example.com.
+  type: AAAA
+  rcode: NOERROR
+  answers:
+    - {name: api.example.com., type: CNAME, ttl: 60, data: lb.example.com.}
+    - {name: lb.example.com., type: AAAA, ttl: 60, data: "fd00::1"}
+---
+version: api.keploy.io/v1beta1
+kind: DNS
+name: dns-2
+spec:
+  name: example.com.
+  type: MX
+  rcode: NOERROR
+  answers:
+    - {name: example.com., type: MX, ttl: 60, data: 10 mail.example.com.}
+---
+version: api.keploy.io/v1beta1
+kind: DNS
+name: dns-3
+spec:
+  name: _http._tcp.example.com.
+  type: SRV
+  rcode: NOERROR
+  answers:
+    - {name: _http._tcp.example.com., type: SRV, ttl: 60, data: 1 2 8080 web.example.com.}
+---
+version: api.keploy.io/v1beta1
+kind: DNS
+name: dns-4
+spec:
+  name: example.com.
+  type: TXT
+  rcode: NOERROR
+  answers:
+    - {name: example.com., type: TXT, ttl: 60, data: "first"}
+---
+version: api.keploy.io/v1beta1
+kind: DNS
+name: dns-5
+spec:
+  name: example.com.
+  type: TXT
+  rcode: NOERROR
+  answers:
+    - {name: example.com., type: TXT, ttl: 60, data: "second"}
+`
+
+func TestDNSReplay(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), dnsStubs), Config{})
+	ctx := context.Background()
+	r := Resolver()
+
+	addrs, err := r.LookupHost(ctx, "api.example.com")
+	sort.Strings(addrs)
+	if err != nil || !reflect.DeepEqual(addrs, []string{"10.0.0.1", "fd00::1"}) {
+		t.Errorf("LookupHost = %v, %v", addrs, err)
+	}
+	if cname, err := r.LookupCNAME(ctx, "api.example.com"); err != nil || cname != "lb.example.com." {
+		t.Errorf("LookupCNAME = %v, %v", cname, err)
+	}
+	if mx, err := r.LookupMX(ctx, "example.com"); err != nil || len(mx) != 1 || *mx[0] != (net.MX{Host: "mail.example.com.", Pref: 10}) {
+		t.Errorf("LookupMX = %v, %v", mx, err)
+	}
+	_, srv, err := r.LookupSRV(ctx, "http", "tcp", "example.com")
+	if err != nil || len(srv) != 1 || *srv[0] != (net.SRV{Target: "web.example.com.", Port: 8080, Priority: 1, Weight: 2}) {
+		t.Errorf("LookupSRV = %v, %v", srv, err)
+	}
+	if _, err := r.LookupHost(ctx, "unknown.example.com"); !isNotFound(err) {
+		t.Errorf("got %v, want names without an answer not to exist", err)
+	}
+}
+
+// TestDNSReplaysTheChargedMock asks more questions than recorded: the answer
+// must come from the reused mock.
+func TestDNSReplaysTheChargedMock(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), dnsStubs), Config{})
+	var got []string
+	for i := 0; i < 3; i++ {
+		txt, err := Resolver().LookupTXT(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, txt...)
+	}
+	var charged []string
+	for _, call := range Calls(t, CallMatcher{Kind: dnsKind}).All() {
+		charged = append(charged, call.Mock)
+	}
+	if !reflect.DeepEqual(got, []string{"first", "second", "first"}) || !reflect.DeepEqual(charged, []string{"dns-4", "dns-5", "dns-4"}) {
+		t.Fatalf("got answers %q from mocks %q", got, charged)
+	}
+}
+
+func TestDNSRecordReplay(t *testing.T) {
+	server := startDNSServer(t, map[string]*dnsSpec{
+		"db.internal. A":   {Rcode: "NOERROR", Answers: []dnsRecord{{Name: "db.internal.", Type: "A", TTL: 30, Data: "192.168.1.7"}}},
+		"db.internal. TXT": {Rcode: "NOERROR", Answers: []dnsRecord{{Name: "db.internal.", Type: "TXT", TTL: 30, Text: []string{"role=primary", " zone=a"}}}},
+	})
+	// the questions are sent to the test server instead of the system ones
+	resolver := func() *net.Resolver {
+		r := Resolver()
+		r.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialDNS(ctx, network, server)
+		}
+		return r
+	}
+	lookup := func() (string, error) {
+		addrs, err := resolver().LookupIPAddr(context.Background(), "db.internal")
+		if err != nil || len(addrs) != 1 {
+			return "", err
+		}
+		txt, err := resolver().LookupTXT(context.Background(), "db.internal")
+		if err != nil || len(txt) != 1 {
+			return "", err
+		}
+		return addrs[0].String() + " " + txt[0], nil
+	}
+	dir := t.TempDir()
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	recorded, err := lookup()
+	if err != nil || recorded != "192.168.1.7 role=primary zone=a" {
+		t.Fatalf("recorded %q, %v", recorded, err)
+	}
+	mocks, err := readMocks(filepath.Join(dir, "stubs", t.Name()+".yaml"), dnsKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txt []string
+	for _, m := range mocks {
+		spec := &dnsSpec{}
+		if err := m.decode(spec); err != nil {
+			t.Fatal(err)
+		}
+		if spec.Type == "TXT" {
+			txt = spec.Answers[0].Text
+		}
+	}
+	// the strings of the record are kept apart
+	if !reflect.DeepEqual(txt, []string{"role=primary", " zone=a"}) {
+		t.Fatalf("recorded the TXT strings %q", txt)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	server = "127.0.0.1:1" // nothing must be sent in MODE_TEST
+	if replayed, err := lookup(); err != nil || replayed != recorded {
+		t.Fatalf("replayed %q, %v, want %q", replayed, err, recorded)
+	}
+	if _, err := resolver().LookupHost(context.Background(), "cache.internal"); !isNotFound(err) {
+		t.Fatalf("got %v, want names without an answer not to exist", err)
+	}
+}
+
+// startDNSServer serves the answers keyed by question name and type over UDP
+// and returns its address. The other questions get empty answers.
+func startDNSServer(t *testing.T, answers map[string]*dnsSpec) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			name, typ, end, err := parseDNSQuestion(query)
+			if err != nil {
+				continue
+			}
+			spec, ok := answers[name+" "+typ]
+			if !ok {
+				spec = &dnsSpec{Rcode: "NOERROR"}
+			}
+			resp, err := encodeDNSResponse(query, end, spec)
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func TestDNSRecordData(t *testing.T) {
+	for _, rr := range []dnsRecord{
+		{Type: "A", Data: "10.0.0.1"},
+		{Type: "AAAA", Data: "fd00::1"},
+		{Type: "CNAME", Data: "lb.example.com."},
+		{Type: "MX", Data: "10 mail.example.com."},
+		{Type: "SRV", Data: "1 2 8080 web.example.com."},
+		{Type: "HTTPS", Data: `\# 3 010000`},
+	} {
+		typ, _ := dnsNumber(dnsTypes, rr.Type)
+		rdata, err := encodeDNSRecordData(typ, rr.Data)
+		if err != nil {
+			t.Errorf("failed to encode %s %s %v", rr.Type, rr.Data, err)
+			continue
+		}
+		if got, err := dnsRecordData(rdata, 0, len(rdata), typ); err != nil || got != rr.Data {
+			t.Errorf("%s %s decoded as %q, %v", rr.Type, rr.Data, got, err)
+		}
+	}
+}
+
+func TestDNSTXTStrings(t *testing.T) {
+	rdata, err := appendDNSStrings(nil, []string{"v=spf1", " -all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readDNSStrings(rdata); err != nil || !reflect.DeepEqual(got, []string{"v=spf1", " -all"}) {
+		t.Fatalf("decoded %q, %v", got, err)
+	}
+	if _, err := appendDNSStrings(nil, []string{strings.Repeat("x", 256)}); err == nil {
+		t.Fatal("a string longer than 255 bytes is encoded")
+	}
+	// a record written with data has it split in strings of 255 bytes
+	long := strings.Repeat("x", 300)
+	rdata, err = encodeDNSRecordData(16, long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readDNSStrings(rdata); err != nil || !reflect.DeepEqual(got, []string{long[:255], long[255:]}) {
+		t.Fatalf("decoded %q, %v", got, err)
+	}
+}
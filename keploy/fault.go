@@ -0,0 +1,182 @@
+package keploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+// Fault is a failure injected in MODE_TEST in the replay of the mocks it
+// applies to, without editing their recorded responses. It is declared in
+// Config.Faults, or as the fault annotation of a mock in the stubs file:
+//
+//	kind: Http
+//	name: http-0
+//	fault:
+//	  latency: 2s
+//	  status: 503
+//	  probability: 0.5
+//	spec:
+//	  ...
+//
+// The annotation of a mock takes precedence over Config.Faults. The faults are
+// applied by Transport, Func, the wrappers generated by keploygen and the
+// Postgres and MySQL stand-ins.
+type Fault struct {
+	// Mock is the name of the mock the fault applies to. Default: every mock
+	// of Kind matching Match.
+	Mock string `yaml:"-"`
+	// Kind is the kind of the mocks the fault applies to, like "Http", "Func",
+	// "Postgres" or "MySQL". Default: every kind.
+	Kind string `yaml:"-"`
+	// Match is a regular expression searched in the recorded request of the
+	// mocks: "METHOD URL" for Http mocks, the function name for Func mocks and
+	// the query for the SQL mocks. Default: every request.
+	Match string `yaml:"-"`
+
+	// Probability is the probability of the fault, between 0 and 1, drawn on
+	// every replay. Default: 1
+	Probability float64 `yaml:"probability,omitempty"`
+	// Latency delays the response, and the other failures.
+	Latency time.Duration `yaml:"latency,omitempty"`
+	// Reset fails the call with a connection reset by peer.
+	Reset bool `yaml:"reset,omitempty"`
+	// Timeout leaves the call without response until its context is done, or
+	// the client of a stand-in gives up. Calls whose context is never done fail
+	// with a timeout right away.
+	Timeout bool `yaml:"timeout,omitempty"`
+	// Truncate cuts an HTTP response body at half its length, or its chunks,
+	// and fails its read with io.ErrUnexpectedEOF.
+	Truncate bool `yaml:"truncate,omitempty"`
+	// Status substitutes the status code of an HTTP response.
+	Status int `yaml:"status,omitempty"`
+	// Error fails the call with the given error message: returned by
+	// Transport and Func, or sent as the error of the query by the stand-ins.
+	Error string `yaml:"error,omitempty"`
+}
+
+// faultRule is a Fault of Config.Faults, compiled.
+type faultRule struct {
+	fault Fault
+	match *regexp.Regexp
+}
+
+func compileFaults(faults []Fault) ([]faultRule, error) {
+	var out []faultRule
+	for i, f := range faults {
+		if f.Probability < 0 || f.Probability > 1 {
+			return nil, fmt.Errorf("invalid probability %v of fault %d, it must be between 0 and 1", f.Probability, i)
+		}
+		r := faultRule{fault: f}
+		if f.Match != "" {
+			var err error
+			if r.match, err = regexp.Compile(f.Match); err != nil {
+				return nil, fmt.Errorf("invalid match of fault %d %w", i, err)
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// fault returns the fault to inject in the replay of m, whose recorded request
+// is described by request, or nil. The probability of the fault is drawn on
+// every call.
+func (s *session) fault(m *Mock, request string) *Fault {
+	f := m.Fault
+	if f == nil {
+		for i := range s.faults {
+			r := &s.faults[i]
+			if (r.fault.Mock == "" || r.fault.Mock == m.Name) && (r.fault.Kind == "" || r.fault.Kind == m.Kind) && (r.match == nil || r.match.MatchString(request)) {
+				f = &r.fault
+				break
+			}
+		}
+	}
+	if f == nil || f.Probability > 0 && rand.Float64() >= f.Probability {
+		return nil
+	}
+	return f
+}
+
+// errFaultTimeout is the error of the calls failed by a Timeout fault whose
+// context is never done.
+var errFaultTimeout error = &net.OpError{Op: "read", Net: "tcp", Err: faultTimeout{}}
+
+type faultTimeout struct{}
+
+func (faultTimeout) Error() string   { return "keploy: injected timeout" }
+func (faultTimeout) Timeout() bool   { return true }
+func (faultTimeout) Temporary() bool { return true }
+
+// errFaultReset is the error of the calls failed by a Reset fault. It wraps
+// syscall.ECONNRESET.
+var errFaultReset error = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+// inject waits for the latency of the fault and returns the error failing the
+// call, if any. A Timeout fault waits until ctx is done.
+func (f *Fault) inject(ctx context.Context) error {
+	if err := sleepContext(ctx, f.Latency); err != nil {
+		return err
+	}
+	switch {
+	case f.Timeout:
+		if ctx.Done() == nil {
+			return errFaultTimeout
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	case f.Reset:
+		return errFaultReset
+	case f.Error != "":
+		return errors.New(f.Error)
+	}
+	return nil
+}
+
+// errConnDropped ends the connections of the stand-ins dropped by a fault.
+var errConnDropped = errors.New("keploy: connection dropped by a fault")
+
+// injectConn applies the fault to a stand-in connection before its response.
+// It returns errConnDropped when the connection has to be dropped: reset, or
+// left without response until the client closes it.
+func (f *Fault) injectConn(conn net.Conn) error {
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	switch {
+	case f.Timeout:
+		_, _ = io.Copy(io.Discard, conn)
+		return errConnDropped
+	case f.Reset:
+		if tc, ok := conn.(*net.TCPConn); ok {
+			_ = tc.SetLinger(0)
+		}
+		return errConnDropped
+	}
+	return nil
+}
+
+// truncatedBody is the body of a response cut by a Truncate fault.
+type truncatedBody struct {
+	body io.ReadCloser
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.body.Close()
+}
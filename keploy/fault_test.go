@@ -0,0 +1,183 @@
+package keploy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const faultStubs = `version: api.keploy.io/v1beta1
+kind: Http
+name: hello
+spec:
+    req:
+        method: GET
+        url: http://api.test/hello
+    resp:
+        status_code: 200
+        header:
+            Content-Length: "12"
+        body: hello world!
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: flaky
+fault:
+    status: 503
+spec:
+    req:
+        method: GET
+        url: http://api.test/flaky
+    resp:
+        status_code: 200
+        body: ok
+---
+version: api.keploy.io/v1beta1
+kind: Func
+name: lookup
+spec:
+    name: lookup
+    request: 1
+    response: one
+`
+
+func TestHTTPFaults(t *testing.T) {
+	dir := writeStubs(t, "TestHTTPFaults", faultStubs)
+	c := &http.Client{Transport: &Transport{}}
+	get := func(t *testing.T, ctx context.Context, url string) (*http.Response, []byte, error) {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		resp, err := c.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return resp, b, err
+	}
+	hello := func(f Fault) Fault {
+		f.Kind, f.Match = "Http", "^GET .*/hello$"
+		return f
+	}
+
+	t.Run("Status", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{Faults: []Fault{hello(Fault{Status: 500})}})
+		resp, b, err := get(t, context.Background(), "http://api.test/hello")
+		if err != nil || resp.StatusCode != 500 || string(b) != "hello world!" {
+			t.Fatalf("got %v %q %v, want the recorded body with the status 500", resp, b, err)
+		}
+	})
+
+	t.Run("Annotation", func(t *testing.T) {
+		// the annotation of the mock takes precedence
+		startTestSession(t, MODE_TEST, dir, Config{Faults: []Fault{{Status: 500}}})
+		if resp, _, err := get(t, context.Background(), "http://api.test/flaky"); err != nil || resp.StatusCode != 503 {
+			t.Fatalf("got %v %v, want the status 503", resp, err)
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{Faults: []Fault{hello(Fault{Reset: true})}})
+		if _, _, err := get(t, context.Background(), "http://api.test/hello"); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("got %v, want a connection reset", err)
+		}
+		// the fault only applies to the matching requests
+		if resp, _, err := get(t, context.Background(), "http://api.test/flaky"); err != nil || resp.StatusCode != 503 {
+			t.Fatalf("got %v %v", resp, err)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{Faults: []Fault{hello(Fault{Timeout: true})}})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, _, err := get(t, ctx, "http://api.test/hello"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want the deadline of the context", err)
+		}
+		var netErr net.Error
+		if _, _, err := get(t, context.Background(), "http://api.test/hello"); !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("got %v, want a timeout", err)
+		}
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{Faults: []Fault{hello(Fault{Truncate: true})}})
+		if _, b, err := get(t, context.Background(), "http://api.test/hello"); err != io.ErrUnexpectedEOF || string(b) != "hello " {
+			t.Fatalf("got %q %v, want half of the body and an unexpected EOF", b, err)
+		}
+	})
+
+	t.Run("LatencyAndError", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{Faults: []Fault{hello(Fault{Latency: 50 * time.Millisecond, Error: "boom"})}})
+		start := time.Now()
+		_, _, err := get(t, context.Background(), "http://api.test/hello")
+		if err == nil || !bytes.Contains([]byte(err.Error()), []byte("boom")) {
+			t.Fatalf("got %v, want the injected error", err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Fatalf("failed after %v, want the injected latency", elapsed)
+		}
+	})
+
+	t.Run("Probability", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{Faults: []Fault{hello(Fault{Status: 500, Probability: 0.5})}})
+		statuses := map[int]int{}
+		for i := 0; i < 200; i++ {
+			resp, _, err := get(t, context.Background(), "http://api.test/hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			statuses[resp.StatusCode]++
+		}
+		if statuses[200] == 0 || statuses[500] == 0 || statuses[200]+statuses[500] != 200 {
+			t.Fatalf("got the statuses %v, want both 200 and 500", statuses)
+		}
+	})
+
+	t.Run("Func", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{Faults: []Fault{{Kind: "Func", Match: "^lookup$", Error: "unavailable"}}})
+		lookup := Func("lookup", func(context.Context, int) (string, error) { return "", nil })
+		if _, err := lookup(context.Background(), 1); err == nil || err.Error() != "unavailable" {
+			t.Fatalf("got %v, want the injected error", err)
+		}
+	})
+}
+
+func TestInvalidFaults(t *testing.T) {
+	for _, faults := range [][]Fault{
+		{{Probability: 1.5}},
+		{{Probability: -1}},
+		{{Match: "(GET"}},
+	} {
+		if _, err := compileFaults(faults); err == nil {
+			t.Errorf("compileFaults(%+v) did not fail", faults)
+		}
+	}
+}
+
+func TestPostgresFaults(t *testing.T) {
+	t.Run("Error", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, t.TempDir(), Config{Faults: []Fault{{Kind: "Postgres", Match: "^UPDATE", Error: "deadlock detected"}}})
+		c := dialPostgres(t, startPostgres(t))
+		c.send(t, 'Q', pgString(nil, "UPDATE users SET name = 'bob'"))
+		msgs := c.until(t, 'Z')
+		if msgs[0].typ != 'E' || !bytes.Contains(msgs[0].body, []byte("Mdeadlock detected\x00")) {
+			t.Fatalf("unexpected response %q", msgs)
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, t.TempDir(), Config{Faults: []Fault{{Kind: "Postgres", Reset: true}}})
+		c := dialPostgres(t, startPostgres(t))
+		c.send(t, 'Q', pgString(nil, "UPDATE users SET name = 'bob'"))
+		if msg, err := c.receive(); err == nil {
+			t.Fatalf("got %q, want the connection to be dropped", msg)
+		}
+	})
+}
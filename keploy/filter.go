@@ -0,0 +1,116 @@
+package keploy
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Filters selects the traffic of the dependencies recorded and replayed by
+// Transport, Resolver and the WebSocket, AMQP and Kafka stand-ins. The traffic
+// which is neither recorded nor replayed goes to its real destination in every
+// mode, like telemetry exporters or local sidecars.
+type Filters struct {
+	// Include restricts the recorded and replayed traffic to the one matching
+	// one of its filters. Default: all the traffic
+	Include []Filter
+	// Exclude leaves out the traffic matching one of its filters.
+	Exclude []Filter
+	// Passthrough sends the traffic matching one of its filters to its real
+	// destination in MODE_TEST instead of replaying it. It is still recorded in
+	// MODE_RECORD.
+	Passthrough []Filter
+}
+
+// Filter matches the traffic by its destination. Its zero fields match any
+// destination.
+type Filter struct {
+	// Protocol is one of "http", "https", "ws", "wss", "dns", "amqp", "amqps"
+	// and "kafka".
+	Protocol string
+	// Host is a host name or IP address, or "*.example.com" for the
+	// subdomains of example.com. DNS questions are matched by the queried
+	// name.
+	Host string
+	// Port is the port of the destination, the default port of the protocol
+	// when it is not set by the URL.
+	Port int
+	// PathPrefix is a prefix of the path of the HTTP and WebSocket requests.
+	PathPrefix string
+}
+
+// target is the destination of some traffic, matched by the filters.
+type target struct {
+	protocol string
+	host     string
+	port     int
+	path     string
+}
+
+var defaultPorts = map[string]int{"http": 80, "https": 443, "ws": 80, "wss": 443, "amqp": 5672, "amqps": 5671, "dns": 53, "kafka": 9092}
+
+// urlTarget returns the destination of a URL.
+func urlTarget(u *url.URL) target {
+	t := target{protocol: strings.ToLower(u.Scheme), host: u.Hostname(), path: u.Path}
+	t.port = defaultPorts[t.protocol]
+	if p, err := strconv.Atoi(u.Port()); err == nil {
+		t.port = p
+	}
+	return t
+}
+
+// addrTarget returns the destination of a host:port address.
+func addrTarget(protocol, addr string) target {
+	t := target{protocol: protocol, host: addr, port: defaultPorts[protocol]}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		t.host = host
+		t.port, _ = strconv.Atoi(port)
+	}
+	return t
+}
+
+func (f *Filter) match(t target) bool {
+	if f.Protocol != "" && !strings.EqualFold(f.Protocol, t.protocol) {
+		return false
+	}
+	if f.Port != 0 && f.Port != t.port {
+		return false
+	}
+	if f.Host != "" {
+		host := strings.ToLower(strings.TrimSuffix(t.host, "."))
+		if suffix := strings.TrimPrefix(strings.ToLower(f.Host), "*"); suffix != strings.ToLower(f.Host) {
+			if !strings.HasSuffix(host, suffix) {
+				return false
+			}
+		} else if host != strings.ToLower(f.Host) {
+			return false
+		}
+	}
+	return strings.HasPrefix(t.path, f.PathPrefix)
+}
+
+func matchFilters(filters []Filter, t target) bool {
+	for i := range filters {
+		if filters[i].match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// modeFor returns the mode of the traffic to t: the mode of the session, or
+// MODE_OFF for the traffic going to its real destination.
+func (s *session) modeFor(t target) Mode {
+	f := &s.filters
+	if s.mode != MODE_RECORD && s.mode != MODE_TEST {
+		return s.mode
+	}
+	if len(f.Include) > 0 && !matchFilters(f.Include, t) || matchFilters(f.Exclude, t) {
+		return MODE_OFF
+	}
+	if s.mode == MODE_TEST && matchFilters(f.Passthrough, t) {
+		return MODE_OFF
+	}
+	return s.mode
+}
@@ -0,0 +1,117 @@
+package keploy
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	u := func(s string) target {
+		parsed, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return urlTarget(parsed)
+	}
+	for _, tc := range []struct {
+		filter Filter
+		target target
+		want   bool
+	}{
+		{Filter{}, u("https://api.test/v1"), true},
+		{Filter{Protocol: "HTTPS"}, u("https://api.test/v1"), true},
+		{Filter{Protocol: "http"}, u("https://api.test/v1"), false},
+		{Filter{Port: 443}, u("https://api.test/v1"), true},
+		{Filter{Port: 8443}, u("https://api.test:8443/v1"), true},
+		{Filter{Port: 443}, u("https://api.test:8443/v1"), false},
+		{Filter{Host: "API.test"}, u("https://api.test/v1"), true},
+		{Filter{Host: "api.test"}, u("https://www.api.test/v1"), false},
+		{Filter{Host: "*.api.test"}, u("https://www.api.test/v1"), true},
+		{Filter{Host: "*.api.test"}, u("https://api.test/v1"), false},
+		{Filter{PathPrefix: "/v1/"}, u("https://api.test/v1/users"), true},
+		{Filter{PathPrefix: "/v1/"}, u("https://api.test/v2/users"), false},
+		{Filter{Protocol: "kafka", Host: "broker", Port: 9092}, addrTarget("kafka", "broker:9092"), true},
+		{Filter{Port: 9092}, addrTarget("kafka", "broker"), true},
+		{Filter{Host: "*.internal"}, addrTarget("dns", "db.internal."), true},
+		{Filter{Port: 53}, addrTarget("dns", "db.internal."), true},
+	} {
+		if got := tc.filter.match(tc.target); got != tc.want {
+			t.Errorf("%+v matched %+v: %v, want %v", tc.filter, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestModeFor(t *testing.T) {
+	api, telemetry, sidecar := target{protocol: "https", host: "api.test", port: 443}, target{protocol: "https", host: "otel.test", port: 443}, target{protocol: "http", host: "localhost", port: 3500}
+	filters := Filters{
+		Include:     []Filter{{Protocol: "https"}, {Host: "localhost"}},
+		Exclude:     []Filter{{Host: "otel.test"}},
+		Passthrough: []Filter{{Port: 3500}},
+	}
+	for _, tc := range []struct {
+		mode   Mode
+		target target
+		want   Mode
+	}{
+		{MODE_RECORD, api, MODE_RECORD},
+		{MODE_TEST, api, MODE_TEST},
+		{MODE_OFF, api, MODE_OFF},
+		{MODE_RECORD, telemetry, MODE_OFF},
+		{MODE_TEST, telemetry, MODE_OFF},
+		{MODE_RECORD, sidecar, MODE_RECORD},
+		{MODE_TEST, sidecar, MODE_OFF},
+		{MODE_TEST, target{protocol: "dns", host: "api.test", port: 53}, MODE_OFF},
+	} {
+		s := &session{mode: tc.mode, sessionOptions: &sessionOptions{filters: filters}}
+		if got := s.modeFor(tc.target); got != tc.want {
+			t.Errorf("the mode of %+v in %s is %s, want %s", tc.target, tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestTransportFilters(t *testing.T) {
+	dir := t.TempDir()
+	srv := startHTTPServer(t)
+	c := &http.Client{Transport: &Transport{}}
+	echo := func(t *testing.T) string {
+		t.Helper()
+		resp, err := c.Post(srv.URL+"/echo", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return resp.Header.Get("X-Method")
+	}
+	filters := Filters{Exclude: []Filter{{PathPrefix: "/counter"}}}
+
+	startTestSession(t, MODE_RECORD, dir, Config{Filters: filters})
+	echo(t)
+	if got := httpGet(t, c, srv.URL+"/counter"); got != "1" {
+		t.Fatalf("got %q", got)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "stubs", "TestTransportFilters.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "/echo") || strings.Contains(string(b), "/counter") {
+		t.Fatalf("recorded\n%s\nwant only the echo", b)
+	}
+
+	// the excluded requests reach the server in MODE_TEST too
+	startTestSession(t, MODE_TEST, dir, Config{Filters: filters})
+	echo(t)
+	if got := httpGet(t, c, srv.URL+"/counter"); got != "2" {
+		t.Fatalf("got %q, want the response of the server", got)
+	}
+
+	filters.Passthrough = []Filter{{Protocol: "http", PathPrefix: "/echo"}}
+	startTestSession(t, MODE_TEST, dir, Config{Filters: filters})
+	srv.Close()
+	if _, err := c.Post(srv.URL+"/echo", "text/plain", strings.NewReader("hello")); err == nil || strings.Contains(err.Error(), "keploy") {
+		t.Fatalf("got %v, want the request to reach the closed server", err)
+	}
+}
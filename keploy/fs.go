@@ -0,0 +1,322 @@
+package keploy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fsKind is the kind of the mocks recorded by FS.
+const fsKind = "FS"
+
+// fsSpec is the spec of an FS mock, a file or a directory read by the
+// application. The content of a file can be removed from the stubs file, the
+// file is then read from the wrapped file system in MODE_TEST and compared
+// with the recorded hash.
+type fsSpec struct {
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	Op       string            `yaml:"op"`
+	Path     string            `yaml:"path"`
+	Dir      bool              `yaml:"dir,omitempty"`
+	Hash     string            `yaml:"hash,omitempty"`
+	Content  string            `yaml:"content,omitempty"`
+	Entries  []fsEntry         `yaml:"entries,omitempty"`
+	Error    string            `yaml:"error,omitempty"`
+}
+
+type fsEntry struct {
+	Name string `yaml:"name"`
+	Dir  bool   `yaml:"dir,omitempty"`
+}
+
+// FS wraps a file system following the mode of the last call to New. In
+// MODE_RECORD every Open, ReadFile and ReadDir is served by fsys and recorded
+// in the stubs file along with the hash of the content. In MODE_TEST the
+// recorded content is served, and fsys, which may be nil, is only read to
+// detect drift: a file or directory of fsys whose hash differs from the
+// recorded one fails with an error. In MODE_OFF fsys is used.
+//
+// The files opened in MODE_RECORD are read entirely when opened.
+func FS(fsys fs.FS) fs.FS {
+	return &recordedFS{fsys: fsys}
+}
+
+type recordedFS struct {
+	fsys fs.FS
+}
+
+func (r *recordedFS) Open(name string) (fs.File, error) {
+	s := activeSession()
+	switch s.mode {
+	case MODE_RECORD:
+		f, err := r.fsys.Open(name)
+		if err != nil {
+			r.record(s, &fsSpec{Op: "open", Path: name}, err)
+			return nil, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		spec := &fsSpec{Op: "open", Path: name, Dir: info.IsDir()}
+		if spec.Dir {
+			entries, err := fs.ReadDir(r.fsys, name)
+			if err != nil {
+				return nil, err
+			}
+			spec.Entries = dirEntries(entries)
+		} else {
+			b, err := io.ReadAll(f)
+			if err != nil {
+				return nil, err
+			}
+			spec.Content = string(b)
+		}
+		r.record(s, spec, nil)
+		return newMemFile(spec), nil
+	case MODE_TEST:
+		spec, err := r.replay(s, "open", name)
+		if err != nil {
+			return nil, err
+		}
+		return newMemFile(spec), nil
+	}
+	return r.fsys.Open(name)
+}
+
+func (r *recordedFS) ReadFile(name string) ([]byte, error) {
+	s := activeSession()
+	switch s.mode {
+	case MODE_RECORD:
+		b, err := fs.ReadFile(r.fsys, name)
+		r.record(s, &fsSpec{Op: "readfile", Path: name, Content: string(b)}, err)
+		return b, err
+	case MODE_TEST:
+		spec, err := r.replay(s, "readfile", name)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(spec.Content), nil
+	}
+	return fs.ReadFile(r.fsys, name)
+}
+
+func (r *recordedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	s := activeSession()
+	switch s.mode {
+	case MODE_RECORD:
+		entries, err := fs.ReadDir(r.fsys, name)
+		r.record(s, &fsSpec{Op: "readdir", Path: name, Dir: true, Entries: dirEntries(entries)}, err)
+		return entries, err
+	case MODE_TEST:
+		spec, err := r.replay(s, "readdir", name)
+		if err != nil {
+			return nil, err
+		}
+		return newMemFile(spec).ReadDir(-1)
+	}
+	return fs.ReadDir(r.fsys, name)
+}
+
+func (r *recordedFS) record(s *session, spec *fsSpec, err error) {
+	if err != nil {
+		spec.Content, spec.Entries, spec.Error = "", nil, fsErrorMessage(err)
+	} else {
+		spec.Hash = spec.hash()
+	}
+	if err := s.record(fsKind, spec); err != nil {
+		logger.Error(fmt.Sprintf("failed to record the %s of %s", spec.Op, spec.Path), zap.Error(err))
+	}
+}
+
+func (r *recordedFS) replay(s *session, op, name string) (*fsSpec, error) {
+	set, err := s.mocks(fsKind)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := set.find(func(m *Mock) bool {
+		recorded := &fsSpec{}
+		return m.decode(recorded) == nil && recorded.Op == op && recorded.Path == name
+	})
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("keploy: no recorded mock matches the file")}
+	}
+	spec := &fsSpec{}
+	if err := m.decode(spec); err != nil {
+		return nil, err
+	}
+	if spec.Error != "" {
+		// the file systems fail to open the file for every operation
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fsError(spec.Error)}
+	}
+
+	// the content may have been left out of the stubs file
+	stored := spec.Hash == "" || spec.Hash == spec.hash()
+	if r.fsys == nil {
+		if !stored {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("keploy: the recorded content was left out and no file system is wrapped")}
+		}
+		return spec, nil
+	}
+	current := &fsSpec{Op: op, Path: name, Dir: spec.Dir}
+	if spec.Dir {
+		var entries []fs.DirEntry
+		entries, err = fs.ReadDir(r.fsys, name)
+		current.Entries = dirEntries(entries)
+	} else {
+		var b []byte
+		b, err = fs.ReadFile(r.fsys, name)
+		current.Content = string(b)
+	}
+	if err != nil {
+		if !stored {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		return spec, nil
+	}
+	if spec.Hash != "" && current.hash() != spec.Hash {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("keploy: the content drifted from the recording, %s instead of %s", current.hash(), spec.Hash)}
+	}
+	if !stored {
+		return current, nil
+	}
+	return spec, nil
+}
+
+// hash returns the hash of the content of a file or of the entries of a
+// directory.
+func (spec *fsSpec) hash() string {
+	h := sha256.New()
+	if spec.Dir {
+		for _, e := range spec.Entries {
+			if e.Dir {
+				fmt.Fprintf(h, "%s/\n", e.Name)
+			} else {
+				fmt.Fprintf(h, "%s\n", e.Name)
+			}
+		}
+	} else {
+		io.WriteString(h, spec.Content)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func dirEntries(entries []fs.DirEntry) []fsEntry {
+	out := make([]fsEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, fsEntry{Name: e.Name(), Dir: e.IsDir()})
+	}
+	return out
+}
+
+// fsErrorMessage returns the message recorded for err, the one of the fs error
+// it wraps when there is one, so that the replay can restore it.
+func fsErrorMessage(err error) string {
+	for _, target := range []error{fs.ErrNotExist, fs.ErrPermission, fs.ErrInvalid, fs.ErrExist} {
+		if errors.Is(err, target) {
+			return target.Error()
+		}
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
+
+func fsError(msg string) error {
+	for _, target := range []error{fs.ErrNotExist, fs.ErrPermission, fs.ErrInvalid, fs.ErrExist} {
+		if msg == target.Error() {
+			return target
+		}
+	}
+	return errors.New(msg)
+}
+
+// memFile is a recorded file or directory opened in MODE_TEST.
+type memFile struct {
+	info    memFileInfo
+	content *bytes.Reader
+	entries []fs.DirEntry
+}
+
+func newMemFile(spec *fsSpec) *memFile {
+	f := &memFile{info: memFileInfo{name: path.Base(spec.Path), size: int64(len(spec.Content)), dir: spec.Dir}}
+	f.content = bytes.NewReader([]byte(spec.Content))
+	for _, e := range spec.Entries {
+		f.entries = append(f.entries, memFileInfo{name: e.Name, dir: e.Dir})
+	}
+	sort.Slice(f.entries, func(i, j int) bool { return f.entries[i].Name() < f.entries[j].Name() })
+	return f
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.info.dir {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: fs.ErrInvalid}
+	}
+	return f.content.Read(p)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	return f.content.Seek(offset, whence)
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.content.ReadAt(p, off)
+}
+
+func (f *memFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.info.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.name, Err: errors.New("not a directory")}
+	}
+	if n <= 0 || n >= len(f.entries) {
+		entries := f.entries
+		f.entries = nil
+		if n > 0 && len(entries) == 0 {
+			return nil, io.EOF
+		}
+		return entries, nil
+	}
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *memFile) Close() error { return nil }
+
+// memFileInfo describes a recorded file, which has no recorded mode nor
+// modification time. It also serves as the entries of the directories.
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memFileInfo) Name() string { return i.name }
+func (i memFileInfo) Size() int64  { return i.size }
+func (i memFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+func (i memFileInfo) ModTime() time.Time         { return time.Time{} }
+func (i memFileInfo) IsDir() bool                { return i.dir }
+func (i memFileInfo) Sys() interface{}           { return nil }
+func (i memFileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i memFileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+var _ fs.ReadDirFS = (*recordedFS)(nil)
+var _ fs.ReadFileFS = (*recordedFS)(nil)
@@ -0,0 +1,124 @@
+package keploy
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// useFS reads fsys the way an application loading its configuration would.
+func useFS(t *testing.T, fsys fs.FS) (string, []string, int64) {
+	t.Helper()
+	conf, err := fs.ReadFile(fsys, "conf.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var walked []string
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		walked = append(walked, p)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Open("templates/mail.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(fsys, "missing.yaml"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got %v, want fs.ErrNotExist", err)
+	}
+	return string(conf), walked, info.Size()
+}
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"conf.yaml":          {Data: []byte("port: 8080\n")},
+		"templates/mail.txt": {Data: []byte("Hello {{.Name}}")},
+	}
+}
+
+func TestFSRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	conf, walked, size := useFS(t, FS(testFS()))
+	if conf != "port: 8080\n" || size != 15 {
+		t.Fatalf("recorded %q of size %d", conf, size)
+	}
+
+	for name, fsys := range map[string]fs.FS{"without file system": nil, "with the same files": testFS()} {
+		t.Run(name, func(t *testing.T) {
+			startTestSession(t, MODE_TEST, dir, Config{})
+			gotConf, gotWalked, gotSize := useFS(t, FS(fsys))
+			if gotConf != conf || !reflect.DeepEqual(gotWalked, walked) || gotSize != size {
+				t.Fatalf("replayed %q %q %d, want %q %q %d", gotConf, gotWalked, gotSize, conf, walked, size)
+			}
+		})
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	drifted := testFS()
+	drifted["conf.yaml"] = &fstest.MapFile{Data: []byte("port: 9090\n")}
+	if _, err := fs.ReadFile(FS(drifted), "conf.yaml"); err == nil || !strings.Contains(err.Error(), "drifted") {
+		t.Fatalf("got %v, want the drift to be detected", err)
+	}
+}
+
+const fsStubs = `version: api.keploy.io/v1beta1
+kind: FS
+name: fs-0
+spec:
+  op: readfile
+  path: version.txt
+  content: "1"
+---
+version: api.keploy.io/v1beta1
+kind: FS
+name: fs-1
+spec:
+  op: readfile
+  path: version.txt
+  content: "2"
+---
+version: api.keploy.io/v1beta1
+kind: FS
+name: fs-2
+spec:
+  op: readfile
+  path: secret.pem
+  hash: sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b
+`
+
+func TestFSReplaysTheReusedMock(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), fsStubs), Config{})
+	fsys := FS(nil)
+	var got []string
+	for i := 0; i < 3; i++ {
+		b, err := fs.ReadFile(fsys, "version.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+	}
+	if !reflect.DeepEqual(got, []string{"1", "2", "1"}) {
+		t.Fatalf("got %q, want the first recorded content to be reused", got)
+	}
+}
+
+func TestFSContentLeftOut(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), fsStubs), Config{})
+	if _, err := fs.ReadFile(FS(nil), "secret.pem"); err == nil || !strings.Contains(err.Error(), "left out") {
+		t.Fatalf("got %v, want the missing content to be reported", err)
+	}
+	b, err := fs.ReadFile(FS(fstest.MapFS{"secret.pem": {Data: []byte("secret")}}), "secret.pem")
+	if err != nil || string(b) != "secret" {
+		t.Fatalf("got %q, %v, want the content of the wrapped file system", b, err)
+	}
+}
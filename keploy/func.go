@@ -0,0 +1,313 @@
+package keploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// funcKind is the kind of the mocks recorded by Func.
+const funcKind = "Func"
+
+// funcSpec is the spec of a Func mock. The request and the response are
+// stored as their JSON encoding, written as YAML to keep the stubs readable.
+type funcSpec struct {
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	Name     string            `yaml:"name"`
+	Request  interface{}       `yaml:"request"`
+	Response interface{}       `yaml:"response,omitempty"`
+	Error    string            `yaml:"error,omitempty"`
+}
+
+// Func wraps a dependency call which cannot be intercepted on the network, like
+// a cloud SDK client with a custom transport or a CGO library. In MODE_RECORD
+// the wrapped function calls fn and records its input and output under name in
+// the stubs file. In MODE_TEST it returns the recorded output, or error, of the
+// call made with the same input without calling fn. In MODE_OFF it calls fn.
+//
+// Req and Resp are recorded with encoding/json, so they must round trip
+// through it. A recorded error is replayed as an error with the same message.
+func Func[Req, Resp any](name string, fn func(context.Context, Req) (Resp, error)) func(context.Context, Req) (Resp, error) {
+	return func(ctx context.Context, req Req) (Resp, error) {
+		s := activeSession()
+		switch s.mode {
+		case MODE_RECORD:
+			start := time.Now()
+			resp, err := fn(ctx, req)
+			if recErr := recordFunc(s, name, req, resp, err, time.Since(start)); recErr != nil {
+				logger.Error(fmt.Sprintf("failed to record the call of %s", name), zap.Error(recErr))
+			}
+			return resp, err
+		case MODE_TEST:
+			var resp Resp
+			spec, err := replayFunc(ctx, s, name, req)
+			if err != nil {
+				return resp, err
+			}
+			if spec.Response != nil {
+				if err := fromJSONValue(spec.Response, &resp); err != nil {
+					return resp, fmt.Errorf("keploy: failed to decode the recorded response of %s %w", name, err)
+				}
+			}
+			if spec.Error != "" {
+				return resp, errors.New(spec.Error)
+			}
+			return resp, nil
+		}
+		return fn(ctx, req)
+	}
+}
+
+func recordFunc(s *session, name string, req, resp interface{}, callErr error, latency time.Duration) error {
+	spec := funcSpec{Name: name}
+	var err error
+	if spec.Request, err = toJSONValue(req); err != nil {
+		return err
+	}
+	if callErr != nil {
+		spec.Error = callErr.Error()
+	} else if spec.Response, err = toJSONValue(resp); err != nil {
+		return err
+	}
+	return s.recordLatency(funcKind, spec, latency)
+}
+
+// replayFunc returns the recorded call of name matching req, after injecting
+// its fault.
+func replayFunc(ctx context.Context, s *session, name string, req interface{}) (*funcSpec, error) {
+	set, err := s.mocks(funcKind)
+	if err != nil {
+		return nil, err
+	}
+	want, err := toJSONValue(req)
+	if err != nil {
+		return nil, err
+	}
+	payload, _ := json.Marshal(want)
+	want, _ = s.redact.document(want)
+	wantKey, _ := json.Marshal(want)
+	match := s.match.funcRequest(name)
+
+	m, ok := set.find(func(m *Mock) bool {
+		recorded := &funcSpec{}
+		if m.decode(recorded) != nil || recorded.Name != name {
+			return false
+		}
+		key, wantKey, err := s.funcKeys(m, recorded, want)
+		return err == nil && matchBody(match, key, wantKey)
+	})
+	if !ok {
+		return nil, fmt.Errorf("keploy: no recorded mock matches the call of %s with %s%s", name, wantKey, closestCall(s, set, name, match, want))
+	}
+	spec := &funcSpec{}
+	if err := m.decode(spec); err != nil {
+		return nil, err
+	}
+	s.called(m, name, string(payload))
+	if err := s.wait(ctx, m); err != nil {
+		return nil, err
+	}
+	if fault := s.fault(m, name); fault != nil {
+		if err := fault.inject(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+// funcKeys returns the JSON encodings of the recorded request of m and of
+// want, without their noise fields, to be compared.
+func (s *session) funcKeys(m *Mock, recorded *funcSpec, want interface{}) ([]byte, []byte, error) {
+	recordedCall := funcSpec{Name: recorded.Name, Request: recorded.Request}
+	call := funcSpec{Name: recorded.Name, Request: want}
+	if err := s.normalizeNoise(m, &recordedCall); err != nil {
+		return nil, nil, err
+	}
+	if err := s.normalizeNoise(m, &call); err != nil {
+		return nil, nil, err
+	}
+	key, err := json.Marshal(normalizeYAMLValue(recordedCall.Request))
+	if err != nil {
+		return nil, nil, err
+	}
+	wantKey, err := json.Marshal(normalizeYAMLValue(call.Request))
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, wantKey, nil
+}
+
+// closestCall reports the recorded calls of name closest to the request, or
+// the recorded calls of other functions when name has none.
+func closestCall(s *session, set *mockSet, name string, match BodyMatch, want interface{}) string {
+	diff := func(sameName bool) func(*Mock) ([]mismatch, bool) {
+		return func(m *Mock) ([]mismatch, bool) {
+			recorded := &funcSpec{}
+			if m.decode(recorded) != nil || (recorded.Name == name) != sameName {
+				return nil, false
+			}
+			key, wantKey, err := s.funcKeys(m, recorded, want)
+			if err != nil {
+				return nil, false
+			}
+			return append(diffKey("name", recorded.Name, name), diffBody("request", match, key, wantKey)...), true
+		}
+	}
+	if closest := set.closest(diff(true)); closest != "" {
+		return closest
+	}
+	return set.closest(diff(false))
+}
+
+// toJSONValue converts v to the generic value of its JSON encoding.
+func toJSONValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %T %w", v, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var out interface{}
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	return jsonNumbers(out), nil
+}
+
+// jsonNumbers converts the json.Number values to int64 when they are integers
+// and to float64 otherwise, so that ids do not end up in exponent notation.
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumbers(item)
+		}
+	}
+	return v
+}
+
+// fromJSONValue decodes a generic value read from the stubs file into v.
+func fromJSONValue(value interface{}, v interface{}) error {
+	b, err := json.Marshal(normalizeYAMLValue(value))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// normalizeYAMLValue converts the maps decoded by yaml, which may have non
+// string keys, to values encoding/json accepts.
+func normalizeYAMLValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = normalizeYAMLValue(item)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[fmt.Sprint(k)] = normalizeYAMLValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = normalizeYAMLValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+// Call records or replays a single method call made through a wrapper
+// generated by keploygen. args holds the arguments of the call and results
+// pointers to the results of the method, which invoke fills by calling the
+// wrapped implementation. Error results are recorded by their message.
+//
+// In MODE_TEST a call without a recorded match gets the error in its last
+// error result, or panics when the method returns no error.
+func Call(name string, args []interface{}, results []interface{}, invoke func()) {
+	s := activeSession()
+	switch s.mode {
+	case MODE_RECORD:
+		start := time.Now()
+		invoke()
+		if err := recordCall(s, name, args, results, time.Since(start)); err != nil {
+			logger.Error(fmt.Sprintf("failed to record the call of %s", name), zap.Error(err))
+		}
+	case MODE_TEST:
+		if err := replayCall(s, name, args, results); err != nil {
+			for i := len(results) - 1; i >= 0; i-- {
+				if ep, ok := results[i].(*error); ok {
+					*ep = err
+					return
+				}
+			}
+			panic(err)
+		}
+	default:
+		invoke()
+	}
+}
+
+func recordCall(s *session, name string, args, results []interface{}, latency time.Duration) error {
+	spec := funcSpec{Name: name}
+	var err error
+	if spec.Request, err = toJSONValue(args); err != nil {
+		return err
+	}
+	response := make([]interface{}, len(results))
+	for i, r := range results {
+		if ep, ok := r.(*error); ok {
+			if *ep != nil {
+				response[i] = (*ep).Error()
+			}
+			continue
+		}
+		if response[i], err = toJSONValue(r); err != nil {
+			return err
+		}
+	}
+	spec.Response = response
+	return s.recordLatency(funcKind, spec, latency)
+}
+
+func replayCall(s *session, name string, args, results []interface{}) error {
+	spec, err := replayFunc(context.Background(), s, name, args)
+	if err != nil {
+		return err
+	}
+	response, _ := spec.Response.([]interface{})
+	if len(response) != len(results) {
+		return fmt.Errorf("keploy: the recorded call of %s has %d results instead of %d", name, len(response), len(results))
+	}
+	for i, r := range results {
+		if ep, ok := r.(*error); ok {
+			if msg, ok := response[i].(string); ok {
+				*ep = errors.New(msg)
+			}
+			continue
+		}
+		if err := fromJSONValue(response[i], r); err != nil {
+			return fmt.Errorf("keploy: failed to decode the recorded result %d of %s %w", i, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package keploy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFuncReplaysTheChargedMock replays more calls than recorded: the reused
+// mock must be the one whose response is returned and whose call is kept.
+func TestFuncReplaysTheChargedMock(t *testing.T) {
+	dir := t.TempDir()
+	responses := []string{"a", "b"}
+	next := func(ctx context.Context, id int) (string, error) {
+		resp := responses[0]
+		responses = responses[1:]
+		return resp, nil
+	}
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	get := Func("get", next)
+	for i := 0; i < 2; i++ {
+		if _, err := get(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	var got []string
+	for i := 0; i < 4; i++ {
+		resp, err := get(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resp)
+	}
+	var charged []string
+	for _, call := range Calls(t, CallMatcher{Kind: funcKind}).All() {
+		charged = append(charged, call.Mock)
+	}
+	wantResponses := []string{"a", "b", "a", "a"}
+	wantMocks := []string{"func-0", "func-1", "func-0", "func-0"}
+	for i := range wantResponses {
+		if got[i] != wantResponses[i] || charged[i] != wantMocks[i] {
+			t.Fatalf("got responses %q from mocks %q, want %q from %q", got, charged, wantResponses, wantMocks)
+		}
+	}
+}
+
+type funcUser struct {
+	ID   int      `json:"id"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+func TestFuncRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	calls := 0
+	lookup := func(ctx context.Context, id int) (*funcUser, error) {
+		calls++
+		if id == 0 {
+			return nil, errors.New("user 0 not found")
+		}
+		return &funcUser{ID: id, Name: "alice", Tags: []string{"admin"}}, nil
+	}
+	ctx := context.Background()
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	get := Func("users.Get", lookup)
+	if _, err := get(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(ctx, 0); err == nil {
+		t.Fatal("the error of the call is not returned")
+	}
+	if calls != 2 {
+		t.Fatalf("fn was called %d times in MODE_RECORD, want 2", calls)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	user, err := get(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(user, &funcUser{ID: 7, Name: "alice", Tags: []string{"admin"}}) {
+		t.Fatalf("got %+v", user)
+	}
+	if _, err := get(ctx, 0); err == nil || err.Error() != "user 0 not found" {
+		t.Fatalf("got %v, want the recorded error", err)
+	}
+	_, err = get(ctx, 8)
+	if err == nil || !strings.Contains(err.Error(), "no recorded mock matches the call of users.Get with 8") {
+		t.Fatalf("got %v, want no recorded mock", err)
+	}
+	if !strings.Contains(err.Error(), "closest recorded mocks") {
+		t.Fatalf("got %v, want the closest mocks", err)
+	}
+	if calls != 2 {
+		t.Fatalf("fn was called in MODE_TEST")
+	}
+
+	startTestSession(t, MODE_OFF, dir, Config{})
+	if _, err := get(ctx, 9); err != nil || calls != 3 {
+		t.Fatalf("fn was not called in MODE_OFF: %v", err)
+	}
+}
+
+func TestFuncMatchesRequestsByValue(t *testing.T) {
+	dir := t.TempDir()
+	type query struct {
+		Filter map[string]interface{} `json:"filter"`
+		Limit  float64                `json:"limit"`
+	}
+	search := Func("search", func(ctx context.Context, q query) (int, error) { return len(q.Filter), nil })
+	ctx := context.Background()
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	if _, err := search(ctx, query{Filter: map[string]interface{}{"b": 1, "a": "x"}, Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	// the keys of the maps are compared regardless of their order, and the
+	// numbers by value
+	n, err := search(ctx, query{Filter: map[string]interface{}{"a": "x", "b": 1.0}, Limit: 10})
+	if err != nil || n != 2 {
+		t.Fatalf("got %d %v", n, err)
+	}
+}
+
+func TestCallRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	get := func(id int) (user *funcUser, err error) {
+		Call("Store.Get", []interface{}{id}, []interface{}{&user, &err}, func() {
+			if id == 0 {
+				user, err = nil, errors.New("user 0 not found")
+				return
+			}
+			user = &funcUser{ID: id, Name: "alice"}
+		})
+		return user, err
+	}
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	for _, id := range []int{7, 0} {
+		get(id)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	user, err := get(7)
+	if err != nil || !reflect.DeepEqual(user, &funcUser{ID: 7, Name: "alice"}) {
+		t.Fatalf("got %+v, %v", user, err)
+	}
+	if user, err := get(0); user != nil || err == nil || err.Error() != "user 0 not found" {
+		t.Fatalf("got %+v, %v, want the recorded error", user, err)
+	}
+	if _, err := get(8); err == nil || !strings.Contains(err.Error(), "no recorded mock matches the call of Store.Get") {
+		t.Fatalf("got %v, want the error of the unmatched call", err)
+	}
+}
+
+func TestCallWithoutErrorResultPanics(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), ""), Config{})
+	defer func() {
+		if err, ok := recover().(error); !ok || !strings.Contains(err.Error(), "no recorded mock matches") {
+			t.Fatalf("recovered %v, want the error of the unmatched call", err)
+		}
+	}()
+	var n int
+	Call("Counter.Next", nil, []interface{}{&n}, func() { n = 1 })
+	t.Fatal("an unmatched call without error result does not panic")
+}
@@ -0,0 +1,37 @@
+package keploy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeStubs writes the stubs file named name, holding mocks, under a
+// temporary directory and returns the directory.
+func writeStubs(t *testing.T, name, mocks string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "stubs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stubs", name+".yaml"), []byte(mocks), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// startTestSession starts an in-process session recording into or replaying
+// the stubs file named after the top-level test under dir, and turns it off at
+// the end of the test.
+func startTestSession(t *testing.T, mode Mode, dir string, conf Config) {
+	t.Helper()
+	conf.Mode = mode
+	conf.Name = strings.SplitN(t.Name(), "/", 2)[0]
+	conf.Path = dir
+	conf.InProcess = true
+	if err := New(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = New(Config{Mode: MODE_OFF, InProcess: true}) })
+}
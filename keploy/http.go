@@ -0,0 +1,396 @@
+package keploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// httpKind is the kind of the mocks recorded by Transport, the one of the
+// HTTP mocks recorded by the keploy binary.
+const httpKind = "Http"
+
+// httpSpec is the spec of an Http mock, a request and its response.
+type httpSpec struct {
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	Request  httpRequest       `yaml:"req"`
+	Response httpResponse      `yaml:"resp"`
+}
+
+type httpRequest struct {
+	Method string            `yaml:"method"`
+	URL    string            `yaml:"url"`
+	Header map[string]string `yaml:"header,omitempty"`
+	Body   string            `yaml:"body,omitempty"`
+}
+
+// httpResponse is a recorded response. Streamed responses, chunked or
+// Server-Sent Events, keep their body as the ordered chunks read by the
+// application instead of Body.
+type httpResponse struct {
+	StatusCode int               `yaml:"status_code"`
+	Header     map[string]string `yaml:"header,omitempty"`
+	Body       string            `yaml:"body,omitempty"`
+	Chunks     []httpChunk       `yaml:"chunks,omitempty"`
+}
+
+type httpChunk struct {
+	Data  string        `yaml:"data"`
+	Delay time.Duration `yaml:"delay,omitempty"` // since the previous chunk, or the headers
+}
+
+// Transport is an http.RoundTripper following the mode of the last call to
+// New. In MODE_RECORD the requests are sent through Next and recorded in the
+// stubs file along with their responses. In MODE_TEST the recorded response
+// of the same request is returned without any network access. In MODE_OFF the
+// requests are only sent through Next, like the requests left out by
+// Config.Filters in every mode.
+//
+// Streamed responses, with a chunked transfer encoding or Server-Sent Events,
+// are recorded as the ordered chunks read by the application with the delay
+// between them, and are replayed chunk by chunk.
+//
+// The headers and the body of the mocks annotated with "template: true" are
+// text/template templates rendered for the replayed request, for a mock to
+// serve the requests accepted by a Config.Matching rule:
+//
+//	kind: Http
+//	name: http-0
+//	template: true
+//	spec:
+//	  resp:
+//	    body: '{"id": {{ .Vars.id }}, "name": {{ json .Request.JSON.name }}, "at": "{{ now.Format "2006-01-02T15:04:05Z07:00" }}"}'
+//
+// The templates access the request as .Request, with its Method, URL, Host,
+// Path, Query, Header, Body and JSON decoded body, and the named groups of
+// the Path and Query patterns of the matching rule as .Vars. Their helpers
+// are now, unix, unixMilli, uuid, randInt, int, add, json, upper, lower and
+// default.
+type Transport struct {
+	Next http.RoundTripper // Default: http.DefaultTransport
+	// Timing makes MODE_TEST wait for the recorded delay before each chunk of a
+	// streamed response, to replay it at the recorded speed. Config.Latency
+	// replays them too, scaled.
+	Timing bool
+}
+
+func (t *Transport) next() http.RoundTripper {
+	if t.Next != nil {
+		return t.Next
+	}
+	return http.DefaultTransport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := activeSession()
+	switch s.modeFor(urlTarget(req.URL)) {
+	case MODE_RECORD:
+		return t.record(s, req)
+	case MODE_TEST:
+		return t.replay(s, req)
+	}
+	return t.next().RoundTrip(req)
+}
+
+func (t *Transport) record(s *session, req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := t.next().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	latency := time.Since(start)
+	spec := &httpSpec{
+		Request:  httpRequest{Method: req.Method, URL: req.URL.String(), Header: flattenHeader(req.Header), Body: string(body)},
+		Response: httpResponse{StatusCode: resp.StatusCode, Header: flattenHeader(resp.Header)},
+	}
+	save := func() {
+		if err := s.recordLatency(httpKind, spec, latency); err != nil {
+			logger.Error(fmt.Sprintf("failed to record the response of %s %s", req.Method, req.URL), zap.Error(err))
+		}
+	}
+	if isStreamed(resp) {
+		resp.Body = &recordingBody{body: resp.Body, spec: spec, last: time.Now(), save: save}
+		return resp, nil
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	spec.Response.Body = string(b)
+	latency = time.Since(start)
+	save()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return resp, nil
+}
+
+func (t *Transport) replay(s *session, req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	set, err := s.mocks(httpKind)
+	if err != nil {
+		return nil, err
+	}
+	redacted, redactedBody, err := s.redactRequest(req, body)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := set.find(func(m *Mock) bool {
+		recorded := &httpSpec{}
+		if m.decode(recorded) != nil {
+			return false
+		}
+		want, req, body, err := s.httpWithoutNoise(m, recorded.Request, redacted, redactedBody)
+		return err == nil && s.match.matchHTTP(want, req, body)
+	})
+	if !ok {
+		closest := set.closest(func(m *Mock) ([]mismatch, bool) {
+			recorded := &httpSpec{}
+			if m.decode(recorded) != nil {
+				return nil, false
+			}
+			want, req, body, err := s.httpWithoutNoise(m, recorded.Request, redacted, redactedBody)
+			if err != nil {
+				return nil, false
+			}
+			return s.match.diffHTTP(want, req, body), true
+		})
+		return nil, fmt.Errorf("keploy: no recorded mock matches %s %s%s", req.Method, redacted.URL, closest)
+	}
+	spec := &httpSpec{}
+	if err := m.decode(spec); err != nil {
+		return nil, err
+	}
+	s.called(m, req.Method+" "+req.URL.String(), string(body))
+	if err := s.wait(req.Context(), m); err != nil {
+		return nil, err
+	}
+	fault := s.fault(m, spec.Request.Method+" "+spec.Request.URL)
+	if fault != nil {
+		if err := fault.inject(req.Context()); err != nil {
+			return nil, err
+		}
+		if fault.Status != 0 {
+			spec.Response.StatusCode = fault.Status
+		}
+	}
+	if m.Template {
+		if err := renderResponse(m, &spec.Response, s.newTemplateData(req, body)); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", spec.Response.StatusCode, http.StatusText(spec.Response.StatusCode)),
+		StatusCode: spec.Response.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+	}
+	for k, v := range spec.Response.Header {
+		resp.Header.Set(k, v)
+	}
+	truncate := fault != nil && fault.Truncate
+	if chunks := spec.Response.Chunks; chunks != nil {
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		if truncate {
+			chunks = chunks[:len(chunks)/2]
+		}
+		body := &chunkedBody{ctx: req.Context(), chunks: chunks}
+		if s.latency.Replay {
+			body.delay = s.latency.delay
+		} else if t.Timing {
+			body.delay = func(d time.Duration) time.Duration { return d }
+		}
+		resp.Body = body
+	} else {
+		body := spec.Response.Body
+		// the recorded length is stale when the body was rendered, redacted
+		// or edited
+		resp.ContentLength = int64(len(body))
+		if resp.Header.Get("Content-Length") != "" {
+			resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		if truncate {
+			body = body[:len(body)/2]
+		}
+		resp.Body = io.NopCloser(strings.NewReader(body))
+	}
+	if truncate {
+		resp.Body = &truncatedBody{body: resp.Body}
+	}
+	return resp, nil
+}
+
+// readRequestBody reads the body of req and replaces it so that it can be
+// sent.
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the request body %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+func isStreamed(resp *http.Response) bool {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return true
+	}
+	for _, te := range resp.TransferEncoding {
+		if te == "chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+// redactRequest returns req and its body redacted like the recorded requests,
+// to be matched with them.
+func (s *session) redactRequest(req *http.Request, body []byte) (*http.Request, []byte, error) {
+	if s.redact == nil {
+		return req, body, nil
+	}
+	recorded := httpRequest{Method: req.Method, URL: req.URL.String(), Header: flattenHeader(req.Header), Body: string(body)}
+	if err := s.redact.value(httpKind, &recorded); err != nil {
+		return nil, nil, fmt.Errorf("failed to redact the request %w", err)
+	}
+	out, err := requestWith(req, recorded)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, []byte(recorded.Body), nil
+}
+
+// httpWithoutNoise returns the recorded request of m and the replayed one,
+// with its body, without their noise fields, to be compared.
+func (s *session) httpWithoutNoise(m *Mock, recorded httpRequest, req *http.Request, body []byte) (httpRequest, *http.Request, []byte, error) {
+	if s.noise == nil && len(m.Noise) == 0 {
+		return recorded, req, body, nil
+	}
+	want := httpSpec{Request: recorded}
+	got := httpSpec{Request: httpRequest{Method: req.Method, URL: req.URL.String(), Header: flattenHeader(req.Header), Body: string(body)}}
+	if err := s.normalizeNoise(m, &want); err != nil {
+		return recorded, nil, nil, err
+	}
+	if err := s.normalizeNoise(m, &got); err != nil {
+		return recorded, nil, nil, err
+	}
+	out, err := requestWith(req, got.Request)
+	if err != nil {
+		return recorded, nil, nil, err
+	}
+	return want.Request, out, []byte(got.Request.Body), nil
+}
+
+// requestWith returns a copy of req with the url and the headers of recorded.
+func requestWith(req *http.Request, recorded httpRequest) (*http.Request, error) {
+	u, err := url.Parse(recorded.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the url %s %w", recorded.URL, err)
+	}
+	out := req.Clone(req.Context())
+	out.URL = u
+	out.Header = http.Header{}
+	for k, v := range recorded.Header {
+		out.Header.Set(k, v)
+	}
+	return out, nil
+}
+
+func flattenHeader(h http.Header) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		out[k] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+// recordingBody records the chunks of a streamed response as the application
+// reads them. The mock is written at the end of the stream, or when the
+// application closes it.
+type recordingBody struct {
+	body io.ReadCloser
+	spec *httpSpec
+	last time.Time
+	save func()
+	once sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		now := time.Now()
+		b.spec.Response.Chunks = append(b.spec.Response.Chunks, httpChunk{Data: string(p[:n]), Delay: now.Sub(b.last)})
+		b.last = now
+	}
+	if err == io.EOF {
+		b.once.Do(b.save)
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.once.Do(b.save)
+	return b.body.Close()
+}
+
+// chunkedBody replays the chunks of a streamed response. When delay is set,
+// it waits for the delay it returns for the recorded one before each chunk.
+type chunkedBody struct {
+	ctx    context.Context
+	chunks []httpChunk
+	delay  func(time.Duration) time.Duration
+	data   string // the rest of the current chunk
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	for b.data == "" {
+		if len(b.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := b.chunks[0]
+		b.chunks = b.chunks[1:]
+		if b.delay != nil {
+			if err := sleepContext(b.ctx, b.delay(chunk.Delay)); err != nil {
+				return 0, err
+			}
+		}
+		b.data = chunk.Data
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *chunkedBody) Close() error {
+	b.chunks = nil
+	return nil
+}
@@ -0,0 +1,177 @@
+package keploy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startHTTPServer starts a server echoing the body of /echo, counting the
+// requests to /counter and streaming events on /events.
+func startHTTPServer(t *testing.T) *httptest.Server {
+	var count int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			b, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			fmt.Fprintf(w, "got %s", b)
+		case "/counter":
+			fmt.Fprint(w, atomic.AddInt32(&count, 1))
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(w, "data: token%d\n\n", i)
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func httpGet(t *testing.T, c *http.Client, url string) string {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// readEvents returns the events of the stream at url.
+func readEvents(t *testing.T, c *http.Client, url string) []string {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var events []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if sc.Text() != "" {
+			events = append(events, sc.Text())
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestTransportRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	srv := startHTTPServer(t)
+	transport := &Transport{}
+	c := &http.Client{Transport: transport}
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	resp, err := c.Post(srv.URL+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "got hello" {
+		t.Fatalf("recorded %q", b)
+	}
+	counters := []string{httpGet(t, c, srv.URL+"/counter"), httpGet(t, c, srv.URL+"/counter")}
+	events := readEvents(t, c, srv.URL+"/events")
+	if !reflect.DeepEqual(events, []string{"data: token0", "data: token1", "data: token2"}) {
+		t.Fatalf("recorded events %q", events)
+	}
+	srv.Close()
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	resp, err = c.Post(srv.URL+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(resp.Body)
+	if string(b) != "got hello" || resp.StatusCode != http.StatusOK || resp.Header.Get("X-Method") != "POST" || resp.ContentLength != 9 {
+		t.Fatalf("replayed %d %v %q", resp.StatusCode, resp.Header, b)
+	}
+	if _, err := c.Post(srv.URL+"/echo", "text/plain", strings.NewReader("bye")); err == nil || !strings.Contains(err.Error(), "no recorded mock matches POST") {
+		t.Fatalf("got %v, want the request with another body not to match", err)
+	}
+
+	// the reused mock is the one whose response is replayed
+	replayed := []string{httpGet(t, c, srv.URL+"/counter"), httpGet(t, c, srv.URL+"/counter"), httpGet(t, c, srv.URL+"/counter")}
+	if want := []string{counters[0], counters[1], counters[0]}; !reflect.DeepEqual(replayed, want) {
+		t.Fatalf("replayed %q, want %q", replayed, want)
+	}
+
+	if got := readEvents(t, c, srv.URL+"/events"); !reflect.DeepEqual(got, events) {
+		t.Fatalf("replayed events %q, want %q", got, events)
+	}
+	transport.Timing = true
+	start := time.Now()
+	readEvents(t, c, srv.URL+"/events")
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("replayed the events in %v, want the recorded delays", elapsed)
+	}
+}
+
+func TestReplayedContentLength(t *testing.T) {
+	dir := writeStubs(t, "TestReplayedContentLength", `version: api.keploy.io/v1beta1
+kind: Http
+name: edited
+spec:
+    req:
+        method: GET
+        url: http://api.test/edited
+    resp:
+        status_code: 200
+        header:
+            content-length: "99"
+        body: hi
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: templated
+template: true
+spec:
+    req:
+        method: GET
+        url: http://api.test/templated
+    resp:
+        status_code: 200
+        header:
+            Content-Length: "3"
+        body: '{{ .Request.URL }}'
+`)
+	c := &http.Client{Transport: &Transport{}}
+	startTestSession(t, MODE_TEST, dir, Config{})
+	for url, want := range map[string]string{
+		"http://api.test/edited":    "hi",
+		"http://api.test/templated": "http://api.test/templated",
+	} {
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(b) != want {
+			t.Fatalf("got %q %v, want %q", b, err, want)
+		}
+		if n := fmt.Sprint(len(want)); resp.Header.Get("Content-Length") != n || resp.ContentLength != int64(len(want)) {
+			t.Errorf("%s replayed with the length %q %d, want %s", url, resp.Header.Get("Content-Length"), resp.ContentLength, n)
+		}
+	}
+}
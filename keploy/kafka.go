@@ -0,0 +1,1578 @@
+package keploy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// kafkaKind is the kind of the mocks recorded by the Kafka stand-in.
+const kafkaKind = "Kafka"
+
+// kafkaSpec is the spec of a Kafka mock, a record produced by the application
+// or fetched by it.
+type kafkaSpec struct {
+	Metadata    map[string]string `yaml:"metadata,omitempty"`
+	Type        string            `yaml:"type"` // produce or fetch
+	KafkaRecord `yaml:",inline"`
+}
+
+// KafkaRecord is a record produced to or fetched from the Kafka stand-in.
+type KafkaRecord struct {
+	Topic     string `yaml:"topic"`
+	Partition int32  `yaml:"partition"`
+	// Offset is the offset of a fetched record.
+	Offset    int64             `yaml:"offset,omitempty"`
+	Key       string            `yaml:"key,omitempty"`
+	Value     string            `yaml:"value"`
+	Headers   map[string]string `yaml:"headers,omitempty"`
+	Timestamp time.Time         `yaml:"timestamp,omitempty"`
+}
+
+// api keys of the requests
+const (
+	kafkaProduce          = 0
+	kafkaFetch            = 1
+	kafkaListOffsets      = 2
+	kafkaMetadata         = 3
+	kafkaOffsetCommit     = 8
+	kafkaOffsetFetch      = 9
+	kafkaFindCoordinator  = 10
+	kafkaJoinGroup        = 11
+	kafkaHeartbeat        = 12
+	kafkaLeaveGroup       = 13
+	kafkaSyncGroup        = 14
+	kafkaSASLHandshake    = 17
+	kafkaAPIVersions      = 18
+	kafkaInitProducerID   = 22
+	kafkaSASLAuthenticate = 36
+)
+
+// error codes of the responses
+const (
+	kafkaOffsetOutOfRange           = 1
+	kafkaCorruptMessage             = 2
+	kafkaUnknownTopicOrPartition    = 3
+	kafkaIllegalGeneration          = 22
+	kafkaUnknownMemberID            = 25
+	kafkaRebalanceInProgress        = 27
+	kafkaUnsupportedSASLMechanism   = 33
+	kafkaUnsupportedVersion         = 35
+	kafkaUnsupportedCompressionType = 76
+)
+
+// kafkaNodeID is the node id of the broker served in MODE_TEST.
+const kafkaNodeID = 0
+
+// kafkaVersions are the versions of the requests served in MODE_TEST, none of
+// them using the flexible encoding of the recent versions.
+var kafkaVersions = map[int16][2]int16{
+	kafkaProduce:          {3, 8},
+	kafkaFetch:            {4, 11},
+	kafkaListOffsets:      {1, 5},
+	kafkaMetadata:         {0, 8},
+	kafkaOffsetCommit:     {2, 7},
+	kafkaOffsetFetch:      {1, 5},
+	kafkaFindCoordinator:  {0, 2},
+	kafkaJoinGroup:        {0, 5},
+	kafkaHeartbeat:        {0, 3},
+	kafkaLeaveGroup:       {0, 2},
+	kafkaSyncGroup:        {0, 3},
+	kafkaSASLHandshake:    {1, 1},
+	kafkaAPIVersions:      {0, 2},
+	kafkaInitProducerID:   {0, 1},
+	kafkaSASLAuthenticate: {0, 1},
+}
+
+// kafkaProxyVersions caps the versions advertised by the upstream brokers for
+// the requests and responses the proxy decodes.
+var kafkaProxyVersions = map[int16]int16{
+	kafkaProduce:         8,
+	kafkaFetch:           11,
+	kafkaMetadata:        8,
+	kafkaFindCoordinator: 2,
+}
+
+// KafkaStandIn is a localhost Kafka broker following the mode of the last call
+// to New. In MODE_RECORD it proxies the connections to the upstream cluster,
+// standing in for each of its brokers, and records the records produced by the
+// application and the ones it fetches. In MODE_TEST it is a single broker
+// serving Metadata, Produce, Fetch, ListOffsets and the consumer groups
+// without any cluster: the partitions hold the recorded fetched records, the
+// produced records are appended to them, and topics are created on demand. In
+// MODE_OFF it only proxies, as it does in every mode when the bootstrap broker
+// is left out by Config.Filters.
+//
+// The produced records are kept for the assertions of Produced in every mode.
+// Record batches may be uncompressed, or compressed with gzip or snappy.
+type KafkaStandIn struct {
+	*standIn
+	upstream string
+	done     chan struct{} // closed by Close, to end the pending fetches and joins
+
+	mu      sync.Mutex
+	nodes   map[int32]*kafkaNode // stand-ins of the upstream brokers
+	broker  *kafkaBroker
+	fetched map[string]bool // records already recorded, by topic/partition/offset
+	session *session        // session of fetched
+}
+
+// kafkaNode is the listener standing in for an upstream broker.
+type kafkaNode struct {
+	*standIn
+	addr string
+}
+
+// StartKafkaStandIn starts a Kafka stand-in of the upstream cluster, the
+// host:port of a bootstrap broker which is only used in MODE_RECORD and
+// MODE_OFF, on a random localhost port. The clients are configured with Addr
+// as their only seed broker.
+func StartKafkaStandIn(upstream string) (*KafkaStandIn, error) {
+	k := &KafkaStandIn{upstream: upstream, done: make(chan struct{}), nodes: map[int32]*kafkaNode{}}
+	var err error
+	k.standIn, err = listenStandIn(func(conn net.Conn) { k.serveConn(conn, k.upstream) })
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Close stops the stand-in, along with the stand-ins of the upstream brokers.
+func (k *KafkaStandIn) Close() error {
+	k.mu.Lock()
+	nodes := k.nodes
+	k.nodes = map[int32]*kafkaNode{}
+	select {
+	case <-k.done:
+	default:
+		close(k.done)
+	}
+	k.mu.Unlock()
+	for _, n := range nodes {
+		n.Close()
+	}
+	return k.standIn.Close()
+}
+
+func (k *KafkaStandIn) serveConn(conn net.Conn, upstream string) {
+	s := activeSession()
+	// the whole cluster is filtered by its bootstrap broker, for its brokers
+	// to be either all replayed or all proxied
+	mode := s.modeFor(addrTarget("kafka", k.upstream))
+	if mode == MODE_TEST {
+		k.testBroker(s).serve(conn, k.Addr())
+		return
+	}
+	if err := k.proxy(s, mode, conn, upstream); err != nil {
+		logger.Error(fmt.Sprintf("failed to proxy the kafka connection to %s", upstream), zap.Error(err))
+	}
+}
+
+// testBroker returns the broker of the session, seeded with its stubs file.
+func (k *KafkaStandIn) testBroker(s *session) *kafkaBroker {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.broker == nil || k.broker.s != s {
+		k.broker = newKafkaBroker(s, k.done)
+	}
+	return k.broker
+}
+
+// node returns the localhost address standing in for the upstream broker of
+// the given node id.
+func (k *KafkaStandIn) node(id int32, addr string) (string, int32, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	n, ok := k.nodes[id]
+	if !ok {
+		n = &kafkaNode{}
+		var err error
+		n.standIn, err = listenStandIn(func(conn net.Conn) {
+			k.mu.Lock()
+			addr := n.addr
+			k.mu.Unlock()
+			k.serveConn(conn, addr)
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		k.nodes[id] = n
+	}
+	n.addr = addr
+	host, _, _ := net.SplitHostPort(n.Addr())
+	return host, int32(n.Port()), nil
+}
+
+// kafkaRequestHeader is the header of a request, the same in every version up
+// to the client id.
+type kafkaRequestHeader struct {
+	apiKey        int16
+	version       int16
+	correlationID int32
+	clientID      string
+}
+
+func readKafkaRequestHeader(r *kafkaReader) kafkaRequestHeader {
+	return kafkaRequestHeader{apiKey: r.int16(), version: r.int16(), correlationID: r.int32(), clientID: r.string()}
+}
+
+// readKafkaFrame reads a request or a response without its size.
+func readKafkaFrame(r *bufio.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 100<<20 {
+		return nil, fmt.Errorf("kafka message of %d bytes is out of bounds", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func writeKafkaFrame(w io.Writer, frame []byte) error {
+	_, err := w.Write(append(kafkaInt32(nil, int32(len(frame))), frame...))
+	return err
+}
+
+func (k *KafkaStandIn) proxy(s *session, mode Mode, conn net.Conn, upstream string) error {
+	if upstream == "" {
+		return errors.New("keploy: no upstream kafka broker")
+	}
+	up, err := net.DialTimeout("tcp", upstream, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer up.Close()
+
+	var mu sync.Mutex
+	pending := map[int32]kafkaRequestHeader{}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// unblock the other direction once this one is over
+		defer conn.Close()
+		defer up.Close()
+		r := bufio.NewReader(conn)
+		for {
+			frame, err := readKafkaFrame(r)
+			if err != nil {
+				return
+			}
+			req := &kafkaReader{buf: frame}
+			h := readKafkaRequestHeader(req)
+			mu.Lock()
+			pending[h.correlationID] = h
+			mu.Unlock()
+			if h.apiKey == kafkaProduce && req.err == nil {
+				k.proxyProduce(s, mode, h.version, req)
+			}
+			if err := writeKafkaFrame(up, frame); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		defer up.Close()
+		r := bufio.NewReader(up)
+		for {
+			frame, err := readKafkaFrame(r)
+			if err != nil {
+				return
+			}
+			correlationID := int32(binary.BigEndian.Uint32(frame))
+			mu.Lock()
+			h, ok := pending[correlationID]
+			delete(pending, correlationID)
+			mu.Unlock()
+			if ok {
+				frame = k.proxyResponse(s, mode, h, frame)
+			}
+			if err := writeKafkaFrame(conn, frame); err != nil {
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	return nil
+}
+
+func (k *KafkaStandIn) proxyProduce(s *session, mode Mode, version int16, r *kafkaReader) {
+	if version < 3 {
+		s.warnOnce("keploy: produce requests older than version 3 are not recorded")
+		return
+	}
+	_, topics := readKafkaProduce(r)
+	for _, t := range topics {
+		for _, p := range t.partitions {
+			records, err := decodeKafkaBatches(t.name, p.index, p.data)
+			if err != nil {
+				s.warnOnce("failed to decode the produced kafka records", zap.Error(err))
+				continue
+			}
+			for _, record := range records {
+				kafkaProduced(s, mode, record)
+			}
+		}
+	}
+}
+
+// proxyResponse returns the response of an upstream broker for the client,
+// with the addresses of the brokers replaced by the ones of their stand-ins.
+func (k *KafkaStandIn) proxyResponse(s *session, mode Mode, h kafkaRequestHeader, frame []byte) []byte {
+	body := frame[4:] // correlation id
+	switch h.apiKey {
+	case kafkaAPIVersions:
+		capKafkaVersions(body, h.version)
+	case kafkaMetadata:
+		out, err := k.rewriteMetadata(frame, h.version)
+		if err != nil {
+			logger.Error("failed to rewrite the addresses of the kafka brokers", zap.Error(err))
+			return frame
+		}
+		return out
+	case kafkaFindCoordinator:
+		out, err := k.rewriteCoordinator(frame, h.version)
+		if err != nil {
+			logger.Error("failed to rewrite the address of the kafka coordinator", zap.Error(err))
+			return frame
+		}
+		return out
+	case kafkaFetch:
+		if mode == MODE_RECORD {
+			k.recordFetch(s, h.version, body)
+		}
+	}
+	return frame
+}
+
+// capKafkaVersions caps, in place, the versions of an ApiVersions response to
+// the ones decoded by the proxy.
+func capKafkaVersions(body []byte, version int16) {
+	r := &kafkaReader{buf: body}
+	// brokers answer the unsupported versions with a version 0 response
+	flexible := version >= 3 && r.int16() != kafkaUnsupportedVersion
+	var n int
+	if flexible {
+		n = int(r.uvarint()) - 1
+	} else {
+		n = r.array()
+	}
+	for i := 0; i < n && r.err == nil; i++ {
+		entry := r.next(6)
+		if max, ok := kafkaProxyVersions[int16(binary.BigEndian.Uint16(entry))]; ok && int16(binary.BigEndian.Uint16(entry[4:])) > max {
+			binary.BigEndian.PutUint16(entry[4:], uint16(max))
+		}
+		if flexible {
+			r.taggedFields()
+		}
+	}
+}
+
+func (k *KafkaStandIn) rewriteMetadata(frame []byte, version int16) ([]byte, error) {
+	r := &kafkaReader{buf: frame[4:]}
+	if version >= 3 {
+		r.int32() // throttle time
+	}
+	n := r.array()
+	out := append([]byte{}, frame[:len(frame)-len(r.buf)]...)
+	for i := 0; i < n && r.err == nil; i++ {
+		id, host, port := r.int32(), r.string(), r.int32()
+		host, port, err := k.node(id, net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			return nil, err
+		}
+		out = kafkaString(kafkaInt32(out, id), host)
+		out = kafkaInt32(out, port)
+		if version >= 1 {
+			rack := r.buf
+			r.string()
+			out = append(out, rack[:len(rack)-len(r.buf)]...)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return append(out, r.buf...), nil
+}
+
+func (k *KafkaStandIn) rewriteCoordinator(frame []byte, version int16) ([]byte, error) {
+	r := &kafkaReader{buf: frame[4:]}
+	if version >= 1 {
+		r.int32() // throttle time
+	}
+	errorCode := r.int16()
+	if version >= 1 {
+		r.string() // error message
+	}
+	id := r.int32()
+	out := append([]byte{}, frame[:len(frame)-len(r.buf)]...)
+	host, port := r.string(), r.int32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if errorCode != 0 {
+		return frame, nil
+	}
+	host, port, err := k.node(id, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	out = kafkaInt32(kafkaString(out, host), port)
+	return append(out, r.buf...), nil
+}
+
+// recordFetch records the records of a fetch response, once per session.
+func (k *KafkaStandIn) recordFetch(s *session, version int16, body []byte) {
+	r := &kafkaReader{buf: body}
+	if version >= 1 {
+		r.int32() // throttle time
+	}
+	if version >= 7 {
+		r.int16() // error code
+		r.int32() // session id
+	}
+	for i, n := 0, r.array(); i < n && r.err == nil; i++ {
+		topic := r.string()
+		for j, m := 0, r.array(); j < m && r.err == nil; j++ {
+			partition := r.int32()
+			r.int16() // error code
+			r.int64() // high watermark
+			if version >= 4 {
+				r.int64() // last stable offset
+			}
+			if version >= 5 {
+				r.int64() // log start offset
+			}
+			if version >= 4 {
+				for a, aborted := 0, r.array(); a < aborted && r.err == nil; a++ {
+					r.int64() // producer id
+					r.int64() // first offset
+				}
+			}
+			if version >= 11 {
+				r.int32() // preferred read replica
+			}
+			data := r.bytes()
+			if r.err != nil || len(data) == 0 {
+				continue
+			}
+			records, err := decodeKafkaBatches(topic, partition, data)
+			if err != nil {
+				s.warnOnce("failed to decode the fetched kafka records", zap.Error(err))
+				continue
+			}
+			for _, record := range records {
+				if !k.firstFetch(s, record) {
+					continue
+				}
+				if err := s.record(kafkaKind, kafkaSpec{Type: "fetch", KafkaRecord: record}); err != nil {
+					logger.Error(fmt.Sprintf("failed to record the kafka record %s/%d/%d", topic, partition, record.Offset), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// firstFetch reports whether the record is fetched for the first time during
+// the session, as the consumers fetch the same records again after a
+// rebalance.
+func (k *KafkaStandIn) firstFetch(s *session, record KafkaRecord) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.session != s {
+		k.session, k.fetched = s, map[string]bool{}
+	}
+	key := fmt.Sprintf("%s/%d/%d", record.Topic, record.Partition, record.Offset)
+	if k.fetched[key] {
+		return false
+	}
+	k.fetched[key] = true
+	return true
+}
+
+// kafkaProduced keeps a produced record for the assertions of the test and
+// records it when mode is MODE_RECORD.
+func kafkaProduced(s *session, mode Mode, record KafkaRecord) {
+	record.Offset = 0
+	s.capture(kafkaKind, record)
+	if mode != MODE_RECORD {
+		return
+	}
+	if err := s.record(kafkaKind, kafkaSpec{Type: "produce", KafkaRecord: record}); err != nil {
+		logger.Error(fmt.Sprintf("failed to record the kafka record produced to %s", record.Topic), zap.Error(err))
+	}
+}
+
+type kafkaTopicData struct {
+	name       string
+	partitions []kafkaPartitionData
+}
+
+type kafkaPartitionData struct {
+	index int32
+	data  []byte
+}
+
+// readKafkaProduce reads a produce request of version 3 or later.
+func readKafkaProduce(r *kafkaReader) (int16, []kafkaTopicData) {
+	r.string() // transactional id
+	acks := r.int16()
+	r.int32() // timeout
+	var topics []kafkaTopicData
+	for i, n := 0, r.array(); i < n && r.err == nil; i++ {
+		t := kafkaTopicData{name: r.string()}
+		for j, m := 0, r.array(); j < m && r.err == nil; j++ {
+			t.partitions = append(t.partitions, kafkaPartitionData{index: r.int32(), data: r.bytes()})
+		}
+		topics = append(topics, t)
+	}
+	return acks, topics
+}
+
+// kafkaBroker is the broker served in MODE_TEST, for a session. Its partitions
+// are seeded with the fetched records of the stubs file.
+type kafkaBroker struct {
+	s    *session
+	done chan struct{}
+
+	mu      sync.Mutex
+	topics  map[string][]*kafkaLog
+	groups  map[string]*kafkaGroup
+	changed chan struct{} // closed when records are appended
+	ids     int64         // counter of the producer and member ids
+}
+
+// kafkaLog is a partition, the records in offset order.
+type kafkaLog struct {
+	start   int64 // log start offset
+	end     int64 // high watermark
+	records []KafkaRecord
+}
+
+func newKafkaBroker(s *session, done chan struct{}) *kafkaBroker {
+	b := &kafkaBroker{s: s, done: done, topics: map[string][]*kafkaLog{}, groups: map[string]*kafkaGroup{}, changed: make(chan struct{})}
+	set, err := s.mocks(kafkaKind)
+	if err != nil {
+		s.warnOnce("failed to read the kafka mocks", zap.Error(err))
+		return b
+	}
+	for {
+		m, ok := set.next(func(m *Mock) bool {
+			recorded := &kafkaSpec{}
+			return m.decode(recorded) == nil && recorded.Type == "fetch"
+		})
+		if !ok {
+			return b
+		}
+		spec := &kafkaSpec{}
+		if err := m.decode(spec); err != nil {
+			s.warnOnce("failed to read the kafka mocks", zap.Error(err))
+			return b
+		}
+		log := b.log(spec.Topic, spec.Partition)
+		// the records written by hand may have no offset
+		if spec.Offset < log.end {
+			spec.Offset = log.end
+		}
+		if len(log.records) == 0 {
+			log.start = spec.Offset
+		}
+		log.records = append(log.records, spec.KafkaRecord)
+		log.end = spec.Offset + 1
+	}
+}
+
+// topic returns the partitions of a topic, created with a single partition
+// when it does not exist.
+func (b *kafkaBroker) topic(name string) []*kafkaLog {
+	if _, ok := b.topics[name]; !ok {
+		b.topics[name] = []*kafkaLog{{}}
+	}
+	return b.topics[name]
+}
+
+// log returns a partition, created along with its topic when it does not
+// exist.
+func (b *kafkaBroker) log(topic string, partition int32) *kafkaLog {
+	logs := b.topic(topic)
+	for int32(len(logs)) <= partition {
+		logs = append(logs, &kafkaLog{})
+	}
+	b.topics[topic] = logs
+	return logs[partition]
+}
+
+func (b *kafkaBroker) serve(conn net.Conn, addr string) {
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readKafkaFrame(r)
+		if err != nil {
+			return
+		}
+		req := &kafkaReader{buf: frame}
+		h := readKafkaRequestHeader(req)
+		if req.err != nil {
+			return
+		}
+		resp, err := b.handle(h, req, addr)
+		if err != nil {
+			if err != io.EOF {
+				logger.Error("failed to serve the kafka connection", zap.Error(err))
+			}
+			return
+		}
+		if resp == nil {
+			continue
+		}
+		if err := writeKafkaFrame(conn, append(kafkaInt32(nil, h.correlationID), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response body of a request, nil when no response is
+// expected. io.EOF is returned when the stand-in is closed.
+func (b *kafkaBroker) handle(h kafkaRequestHeader, r *kafkaReader, addr string) ([]byte, error) {
+	versions, ok := kafkaVersions[h.apiKey]
+	if h.apiKey == kafkaAPIVersions && h.version > versions[1] {
+		// the client retries with a version of the response
+		return b.apiVersions(0, kafkaUnsupportedVersion), nil
+	}
+	if !ok || h.version < versions[0] || h.version > versions[1] {
+		return nil, fmt.Errorf("kafka request %d of version %d is not supported", h.apiKey, h.version)
+	}
+
+	var resp []byte
+	var err error
+	switch h.apiKey {
+	case kafkaAPIVersions:
+		resp = b.apiVersions(h.version, 0)
+	case kafkaMetadata:
+		resp = b.metadata(h.version, r, addr)
+	case kafkaProduce:
+		resp = b.produce(h.version, r)
+	case kafkaFetch:
+		resp, err = b.fetch(h.version, r)
+	case kafkaListOffsets:
+		resp = b.listOffsets(h.version, r)
+	case kafkaFindCoordinator:
+		resp = b.findCoordinator(h.version, r, addr)
+	case kafkaJoinGroup:
+		resp, err = b.joinGroup(h.version, r)
+	case kafkaSyncGroup:
+		resp, err = b.syncGroup(h.version, r)
+	case kafkaHeartbeat:
+		resp = b.heartbeat(h.version, r)
+	case kafkaLeaveGroup:
+		resp = b.leaveGroup(h.version, r)
+	case kafkaOffsetCommit:
+		resp = b.offsetCommit(h.version, r)
+	case kafkaOffsetFetch:
+		resp = b.offsetFetch(h.version, r)
+	case kafkaInitProducerID:
+		resp = b.initProducerID(r)
+	case kafkaSASLHandshake:
+		resp = b.saslHandshake(r)
+	case kafkaSASLAuthenticate:
+		resp = b.saslAuthenticate(h.version)
+	}
+	if err == nil && r.err != nil {
+		err = fmt.Errorf("failed to decode the kafka request %d %w", h.apiKey, r.err)
+	}
+	return resp, err
+}
+
+func (b *kafkaBroker) apiVersions(version, errorCode int16) []byte {
+	keys := make([]int, 0, len(kafkaVersions))
+	for k := range kafkaVersions {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+	out := kafkaInt16(nil, errorCode)
+	out = kafkaInt32(out, int32(len(keys)))
+	for _, k := range keys {
+		versions := kafkaVersions[int16(k)]
+		out = kafkaInt16(kafkaInt16(kafkaInt16(out, int16(k)), versions[0]), versions[1])
+	}
+	if version >= 1 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	return out
+}
+
+func (b *kafkaBroker) metadata(version int16, r *kafkaReader, addr string) []byte {
+	n := r.int32()
+	var names []string
+	for i := int32(0); i < n && r.err == nil; i++ {
+		names = append(names, r.string())
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// a null list, or an empty one in version 0, requests every topic
+	if n < 0 || version == 0 && n == 0 {
+		for name := range b.topics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+
+	var out []byte
+	if version >= 3 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	out = kafkaInt32(out, 1)
+	out = kafkaString(kafkaInt32(out, kafkaNodeID), host)
+	out = kafkaInt32(out, int32(portNumber))
+	if version >= 1 {
+		out = kafkaNullString(out, "") // rack
+	}
+	if version >= 2 {
+		out = kafkaNullString(out, "keploy") // cluster id
+	}
+	if version >= 1 {
+		out = kafkaInt32(out, kafkaNodeID) // controller
+	}
+	out = kafkaInt32(out, int32(len(names)))
+	for _, name := range names {
+		logs := b.topic(name)
+		out = kafkaString(kafkaInt16(out, 0), name)
+		if version >= 1 {
+			out = append(out, 0) // internal
+		}
+		out = kafkaInt32(out, int32(len(logs)))
+		for i := range logs {
+			out = kafkaInt32(kafkaInt16(out, 0), int32(i))
+			out = kafkaInt32(out, kafkaNodeID) // leader
+			if version >= 7 {
+				out = kafkaInt32(out, 0) // leader epoch
+			}
+			out = kafkaInt32(kafkaInt32(out, 1), kafkaNodeID) // replicas
+			out = kafkaInt32(kafkaInt32(out, 1), kafkaNodeID) // in-sync replicas
+			if version >= 5 {
+				out = kafkaInt32(out, 0) // offline replicas
+			}
+		}
+		if version >= 8 {
+			out = kafkaInt32(out, math.MinInt32) // authorized operations
+		}
+	}
+	if version >= 8 {
+		out = kafkaInt32(out, math.MinInt32)
+	}
+	return out
+}
+
+func (b *kafkaBroker) produce(version int16, r *kafkaReader) []byte {
+	acks, topics := readKafkaProduce(r)
+	if r.err != nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := kafkaInt32(nil, int32(len(topics)))
+	appended := false
+	for _, t := range topics {
+		out = kafkaString(out, t.name)
+		out = kafkaInt32(out, int32(len(t.partitions)))
+		for _, p := range t.partitions {
+			log := b.log(t.name, p.index)
+			base := log.end
+			var errorCode int16
+			records, err := decodeKafkaBatches(t.name, p.index, p.data)
+			switch {
+			case err == errKafkaCompression:
+				errorCode, base = kafkaUnsupportedCompressionType, -1
+			case err != nil:
+				errorCode, base = kafkaCorruptMessage, -1
+			}
+			if errorCode == 0 {
+				for _, record := range records {
+					kafkaProduced(b.s, MODE_TEST, record)
+					record.Offset = log.end
+					log.records = append(log.records, record)
+					log.end++
+					appended = true
+				}
+			}
+			out = kafkaInt16(kafkaInt32(out, p.index), errorCode)
+			out = kafkaInt64(out, base)
+			if version >= 2 {
+				out = kafkaInt64(out, -1) // log append time
+			}
+			if version >= 5 {
+				out = kafkaInt64(out, log.start)
+			}
+			if version >= 8 {
+				out = kafkaInt32(out, 0)       // record errors
+				out = kafkaNullString(out, "") // error message
+			}
+		}
+	}
+	out = kafkaInt32(out, 0) // throttle time
+	if appended {
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+	if acks == 0 {
+		return nil
+	}
+	return out
+}
+
+type kafkaFetchTopic struct {
+	name       string
+	partitions []kafkaFetchPartition
+}
+
+type kafkaFetchPartition struct {
+	index    int32
+	offset   int64
+	maxBytes int32
+}
+
+// fetch answers with the records available at the fetched offsets, waiting up
+// to the maximum wait time for some to be produced.
+func (b *kafkaBroker) fetch(version int16, r *kafkaReader) ([]byte, error) {
+	r.int32() // replica id
+	maxWait := time.Duration(r.int32()) * time.Millisecond
+	r.int32() // min bytes
+	r.int32() // max bytes
+	r.int8()  // isolation level
+	if version >= 7 {
+		r.int32() // session id
+		r.int32() // session epoch
+	}
+	var topics []kafkaFetchTopic
+	for i, n := 0, r.array(); i < n && r.err == nil; i++ {
+		t := kafkaFetchTopic{name: r.string()}
+		for j, m := 0, r.array(); j < m && r.err == nil; j++ {
+			p := kafkaFetchPartition{index: r.int32()}
+			if version >= 9 {
+				r.int32() // current leader epoch
+			}
+			p.offset = r.int64()
+			if version >= 5 {
+				r.int64() // log start offset
+			}
+			p.maxBytes = r.int32()
+			t.partitions = append(t.partitions, p)
+		}
+		topics = append(topics, t)
+	}
+	if r.err != nil {
+		return nil, nil
+	}
+
+	deadline := time.Now().Add(maxWait)
+	for {
+		b.mu.Lock()
+		resp, ready := b.fetchResponse(version, topics)
+		changed := b.changed
+		b.mu.Unlock()
+		wait := time.Until(deadline)
+		if ready || wait <= 0 {
+			return resp, nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-b.done:
+			timer.Stop()
+			return nil, io.EOF
+		}
+		timer.Stop()
+	}
+}
+
+// fetchResponse returns a fetch response, and whether it holds records or
+// errors.
+func (b *kafkaBroker) fetchResponse(version int16, topics []kafkaFetchTopic) ([]byte, bool) {
+	ready := false
+	out := kafkaInt32(nil, 0) // throttle time
+	if version >= 7 {
+		out = kafkaInt16(out, 0)
+		out = kafkaInt32(out, 0) // no fetch session
+	}
+	out = kafkaInt32(out, int32(len(topics)))
+	for _, t := range topics {
+		out = kafkaString(out, t.name)
+		out = kafkaInt32(out, int32(len(t.partitions)))
+		for _, p := range t.partitions {
+			var errorCode int16
+			var data []byte
+			start, end := int64(-1), int64(-1)
+			logs, ok := b.topics[t.name]
+			switch {
+			case !ok || p.index < 0 || int(p.index) >= len(logs):
+				errorCode = kafkaUnknownTopicOrPartition
+			case p.offset < logs[p.index].start || p.offset > logs[p.index].end:
+				errorCode = kafkaOffsetOutOfRange
+			default:
+				data = logs[p.index].batches(p.offset, p.maxBytes)
+			}
+			if ok && int(p.index) < len(logs) && p.index >= 0 {
+				start, end = logs[p.index].start, logs[p.index].end
+			}
+			if errorCode != 0 || len(data) > 0 {
+				ready = true
+			}
+			out = kafkaInt16(kafkaInt32(out, p.index), errorCode)
+			out = kafkaInt64(out, end)
+			out = kafkaInt64(out, end) // last stable offset
+			if version >= 5 {
+				out = kafkaInt64(out, start)
+			}
+			out = kafkaInt32(out, 0) // aborted transactions
+			if version >= 11 {
+				out = kafkaInt32(out, -1) // preferred read replica
+			}
+			out = append(kafkaInt32(out, int32(len(data))), data...)
+		}
+	}
+	return out, ready
+}
+
+// batches encodes the records from offset on, within maxBytes but at least
+// one.
+func (l *kafkaLog) batches(offset int64, maxBytes int32) []byte {
+	var data []byte
+	i := sort.Search(len(l.records), func(i int) bool { return l.records[i].Offset >= offset })
+	for ; i < len(l.records); i++ {
+		batch := encodeKafkaBatch(l.records[i : i+1])
+		if len(data) > 0 && len(data)+len(batch) > int(maxBytes) {
+			break
+		}
+		data = append(data, batch...)
+	}
+	return data
+}
+
+func (b *kafkaBroker) listOffsets(version int16, r *kafkaReader) []byte {
+	r.int32() // replica id
+	if version >= 2 {
+		r.int8() // isolation level
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []byte
+	if version >= 2 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	n := r.array()
+	out = kafkaInt32(out, int32(n))
+	for i := 0; i < n && r.err == nil; i++ {
+		name := r.string()
+		out = kafkaString(out, name)
+		m := r.array()
+		out = kafkaInt32(out, int32(m))
+		for j := 0; j < m && r.err == nil; j++ {
+			index := r.int32()
+			if version >= 4 {
+				r.int32() // current leader epoch
+			}
+			timestamp := r.int64()
+			var errorCode int16
+			found, offset := int64(-1), int64(-1)
+			logs, ok := b.topics[name]
+			if !ok || index < 0 || int(index) >= len(logs) {
+				errorCode = kafkaUnknownTopicOrPartition
+			} else {
+				found, offset = logs[index].offset(timestamp)
+			}
+			out = kafkaInt16(kafkaInt32(out, index), errorCode)
+			out = kafkaInt64(kafkaInt64(out, found), offset)
+			if version >= 4 {
+				out = kafkaInt32(out, 0) // leader epoch
+			}
+		}
+	}
+	return out
+}
+
+// offset returns the timestamp and the offset of the first record at or after
+// timestamp, the latest (-1) and earliest (-2) offsets being special.
+func (l *kafkaLog) offset(timestamp int64) (int64, int64) {
+	switch timestamp {
+	case -1:
+		return -1, l.end
+	case -2:
+		return -1, l.start
+	}
+	for _, record := range l.records {
+		if record.Timestamp.UnixMilli() >= timestamp {
+			return record.Timestamp.UnixMilli(), record.Offset
+		}
+	}
+	return -1, -1
+}
+
+func (b *kafkaBroker) findCoordinator(version int16, r *kafkaReader, addr string) []byte {
+	r.string() // key
+	if version >= 1 {
+		r.int8() // key type
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+	var out []byte
+	if version >= 1 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	out = kafkaInt16(out, 0)
+	if version >= 1 {
+		out = kafkaNullString(out, "")
+	}
+	out = kafkaString(kafkaInt32(out, kafkaNodeID), host)
+	return kafkaInt32(out, int32(portNumber))
+}
+
+// kafkaGroup is a consumer group. Every join starts a rebalance, which
+// completes once all the members have joined again, or at the end of the
+// longest rebalance timeout without the missing members.
+type kafkaGroup struct {
+	generation  int32
+	protocol    string
+	leader      string
+	members     map[string]*kafkaMember
+	order       []string // member ids in joining order
+	rebalancing bool
+	timer       *time.Timer
+	assignments map[string][]byte // set by the leader for the generation
+	synced      chan struct{}     // closed once assignments is set
+	offsets     map[string]map[int32]kafkaCommit
+}
+
+type kafkaMember struct {
+	protocols      []kafkaProtocol
+	sessionTimeout time.Duration
+	rebalance      time.Duration
+	seen           time.Time
+	joined         chan struct{} // closed when the rebalance it joined completes
+}
+
+type kafkaProtocol struct {
+	name     string
+	metadata []byte
+}
+
+type kafkaCommit struct {
+	offset   int64
+	metadata string
+}
+
+func (b *kafkaBroker) group(id string) *kafkaGroup {
+	g, ok := b.groups[id]
+	if !ok {
+		g = &kafkaGroup{members: map[string]*kafkaMember{}, offsets: map[string]map[int32]kafkaCommit{}, synced: make(chan struct{})}
+		b.groups[id] = g
+	}
+	return g
+}
+
+// check returns the error code of a request of a member of the group for a
+// generation.
+func (g *kafkaGroup) check(memberID string, generation int32) int16 {
+	if g == nil || g.members[memberID] == nil {
+		return kafkaUnknownMemberID
+	}
+	if g.rebalancing {
+		return kafkaRebalanceInProgress
+	}
+	if generation != g.generation {
+		return kafkaIllegalGeneration
+	}
+	return 0
+}
+
+// rebalance starts a rebalance of the group, dropping the members which
+// expired.
+func (b *kafkaBroker) rebalance(g *kafkaGroup) {
+	if g.rebalancing {
+		return
+	}
+	g.rebalancing = true
+	timeout := time.Duration(0)
+	for id, m := range g.members {
+		if m.joined == nil && time.Since(m.seen) > m.sessionTimeout {
+			b.removeMember(g, id)
+			continue
+		}
+		if m.rebalance > timeout {
+			timeout = m.rebalance
+		}
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if g.timer == timer {
+			b.completeRebalance(g, true)
+		}
+	})
+	g.timer = timer
+	b.completeRebalance(g, false)
+}
+
+// completeRebalance starts the next generation once every member joined, or
+// with the members which joined when forced.
+func (b *kafkaBroker) completeRebalance(g *kafkaGroup, force bool) {
+	if !g.rebalancing {
+		return
+	}
+	for id, m := range g.members {
+		if m.joined != nil {
+			continue
+		}
+		if !force {
+			return
+		}
+		b.removeMember(g, id)
+	}
+	g.rebalancing = false
+	g.timer.Stop()
+	g.timer = nil
+	g.generation++
+	g.assignments = nil
+	g.synced = make(chan struct{})
+	if g.members[g.leader] == nil {
+		g.leader = ""
+		if len(g.order) > 0 {
+			g.leader = g.order[0]
+		}
+	}
+	g.protocol = ""
+	if leader := g.members[g.leader]; leader != nil {
+		g.protocol = leader.protocols[0].name
+	candidates:
+		for _, p := range leader.protocols {
+			for _, m := range g.members {
+				if m.protocol(p.name) == nil {
+					continue candidates
+				}
+			}
+			g.protocol = p.name
+			break
+		}
+	}
+	for _, m := range g.members {
+		close(m.joined)
+		m.joined = nil
+	}
+}
+
+func (b *kafkaBroker) removeMember(g *kafkaGroup, id string) {
+	delete(g.members, id)
+	for i, member := range g.order {
+		if member == id {
+			g.order = append(g.order[:i:i], g.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *kafkaMember) protocol(name string) *kafkaProtocol {
+	for i := range m.protocols {
+		if m.protocols[i].name == name {
+			return &m.protocols[i]
+		}
+	}
+	return nil
+}
+
+func (b *kafkaBroker) joinGroup(version int16, r *kafkaReader) ([]byte, error) {
+	groupID := r.string()
+	m := &kafkaMember{sessionTimeout: time.Duration(r.int32()) * time.Millisecond}
+	m.rebalance = m.sessionTimeout
+	if version >= 1 {
+		m.rebalance = time.Duration(r.int32()) * time.Millisecond
+	}
+	memberID := r.string()
+	if version >= 5 {
+		r.string() // group instance id
+	}
+	r.string() // protocol type
+	for i, n := 0, r.array(); i < n && r.err == nil; i++ {
+		m.protocols = append(m.protocols, kafkaProtocol{name: r.string(), metadata: r.bytes()})
+	}
+	if r.err != nil || len(m.protocols) == 0 {
+		return nil, r.err
+	}
+
+	b.mu.Lock()
+	g := b.group(groupID)
+	if g.members[memberID] == nil {
+		b.ids++
+		memberID = fmt.Sprintf("keploy-%d", b.ids)
+		g.order = append(g.order, memberID)
+	}
+	joined := make(chan struct{})
+	m.seen, m.joined = time.Now(), joined
+	if previous := g.members[memberID]; previous != nil && previous.joined != nil {
+		// a join sent again replaces the pending one
+		close(previous.joined)
+	}
+	g.members[memberID] = m
+	if g.rebalancing {
+		b.completeRebalance(g, false)
+	} else {
+		b.rebalance(g)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-joined:
+	case <-b.done:
+		return nil, io.EOF
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []byte
+	if version >= 2 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	if g.members[memberID] == nil || g.rebalancing {
+		out = kafkaInt32(kafkaInt16(out, kafkaUnknownMemberID), -1)
+		out = kafkaString(kafkaString(out, ""), "")
+		return kafkaInt32(kafkaString(out, memberID), 0), nil
+	}
+	out = kafkaInt32(kafkaInt16(out, 0), g.generation)
+	out = kafkaString(kafkaString(out, g.protocol), g.leader)
+	out = kafkaString(out, memberID)
+	if memberID != g.leader {
+		return kafkaInt32(out, 0), nil
+	}
+	out = kafkaInt32(out, int32(len(g.order)))
+	for _, id := range g.order {
+		out = kafkaString(out, id)
+		if version >= 5 {
+			out = kafkaNullString(out, "") // group instance id
+		}
+		var metadata []byte
+		if p := g.members[id].protocol(g.protocol); p != nil {
+			metadata = p.metadata
+		}
+		out = append(kafkaInt32(out, int32(len(metadata))), metadata...)
+	}
+	return out, nil
+}
+
+func (b *kafkaBroker) syncGroup(version int16, r *kafkaReader) ([]byte, error) {
+	groupID, generation, memberID := r.string(), r.int32(), r.string()
+	if version >= 3 {
+		r.string() // group instance id
+	}
+	assignments := map[string][]byte{}
+	for i, n := 0, r.array(); i < n && r.err == nil; i++ {
+		id := r.string()
+		assignments[id] = r.bytes()
+	}
+	response := func(errorCode int16, assignment []byte) []byte {
+		var out []byte
+		if version >= 1 {
+			out = kafkaInt32(out, 0) // throttle time
+		}
+		out = kafkaInt16(out, errorCode)
+		return append(kafkaInt32(out, int32(len(assignment))), assignment...)
+	}
+
+	b.mu.Lock()
+	g := b.groups[groupID]
+	if errorCode := g.check(memberID, generation); errorCode != 0 {
+		b.mu.Unlock()
+		return response(errorCode, nil), nil
+	}
+	m := g.members[memberID]
+	m.seen = time.Now()
+	if memberID == g.leader && g.assignments == nil {
+		g.assignments = assignments
+		close(g.synced)
+	}
+	synced := g.synced
+	b.mu.Unlock()
+
+	timer := time.NewTimer(m.sessionTimeout)
+	defer timer.Stop()
+	select {
+	case <-synced:
+	case <-timer.C:
+	case <-b.done:
+		return nil, io.EOF
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if g.generation != generation || g.assignments == nil {
+		return response(kafkaRebalanceInProgress, nil), nil
+	}
+	return response(0, g.assignments[memberID]), nil
+}
+
+func (b *kafkaBroker) heartbeat(version int16, r *kafkaReader) []byte {
+	groupID, generation, memberID := r.string(), r.int32(), r.string()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.groups[groupID]
+	errorCode := g.check(memberID, generation)
+	if m := g.member(memberID); m != nil {
+		m.seen = time.Now()
+	}
+	var out []byte
+	if version >= 1 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	return kafkaInt16(out, errorCode)
+}
+
+func (g *kafkaGroup) member(id string) *kafkaMember {
+	if g == nil {
+		return nil
+	}
+	return g.members[id]
+}
+
+func (b *kafkaBroker) leaveGroup(version int16, r *kafkaReader) []byte {
+	groupID, memberID := r.string(), r.string()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var errorCode int16
+	g := b.groups[groupID]
+	if m := g.member(memberID); m == nil {
+		errorCode = kafkaUnknownMemberID
+	} else {
+		if m.joined != nil {
+			close(m.joined)
+		}
+		b.removeMember(g, memberID)
+		if g.rebalancing {
+			b.completeRebalance(g, false)
+		} else if len(g.members) > 0 {
+			b.rebalance(g)
+		}
+	}
+	var out []byte
+	if version >= 1 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	return kafkaInt16(out, errorCode)
+}
+
+func (b *kafkaBroker) offsetCommit(version int16, r *kafkaReader) []byte {
+	groupID := r.string()
+	r.int32()  // generation
+	r.string() // member id
+	if version >= 7 {
+		r.string() // group instance id
+	}
+	if version <= 4 {
+		r.int64() // retention time
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.group(groupID)
+	var out []byte
+	if version >= 3 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	n := r.array()
+	out = kafkaInt32(out, int32(n))
+	for i := 0; i < n && r.err == nil; i++ {
+		name := r.string()
+		if g.offsets[name] == nil {
+			g.offsets[name] = map[int32]kafkaCommit{}
+		}
+		out = kafkaString(out, name)
+		m := r.array()
+		out = kafkaInt32(out, int32(m))
+		for j := 0; j < m && r.err == nil; j++ {
+			index := r.int32()
+			commit := kafkaCommit{offset: r.int64()}
+			if version >= 6 {
+				r.int32() // leader epoch
+			}
+			commit.metadata = r.string()
+			g.offsets[name][index] = commit
+			out = kafkaInt16(kafkaInt32(out, index), 0)
+		}
+	}
+	return out
+}
+
+func (b *kafkaBroker) offsetFetch(version int16, r *kafkaReader) []byte {
+	groupID := r.string()
+	n := r.int32()
+	var topics []kafkaFetchTopic
+	for i := int32(0); i < n && r.err == nil; i++ {
+		t := kafkaFetchTopic{name: r.string()}
+		for j, m := 0, r.array(); j < m && r.err == nil; j++ {
+			t.partitions = append(t.partitions, kafkaFetchPartition{index: r.int32()})
+		}
+		topics = append(topics, t)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.group(groupID)
+	if n < 0 {
+		// a null list requests every committed offset
+		for name, commits := range g.offsets {
+			t := kafkaFetchTopic{name: name}
+			for index := range commits {
+				t.partitions = append(t.partitions, kafkaFetchPartition{index: index})
+			}
+			topics = append(topics, t)
+		}
+	}
+	var out []byte
+	if version >= 3 {
+		out = kafkaInt32(out, 0) // throttle time
+	}
+	out = kafkaInt32(out, int32(len(topics)))
+	for _, t := range topics {
+		out = kafkaString(out, t.name)
+		out = kafkaInt32(out, int32(len(t.partitions)))
+		for _, p := range t.partitions {
+			commit, ok := g.offsets[t.name][p.index]
+			if !ok {
+				commit.offset = -1
+			}
+			out = kafkaInt64(kafkaInt32(out, p.index), commit.offset)
+			if version >= 5 {
+				out = kafkaInt32(out, -1) // leader epoch
+			}
+			out = kafkaInt16(kafkaNullString(out, commit.metadata), 0)
+		}
+	}
+	if version >= 2 {
+		out = kafkaInt16(out, 0)
+	}
+	return out
+}
+
+func (b *kafkaBroker) initProducerID(r *kafkaReader) []byte {
+	r.string() // transactional id
+	r.int32()  // transaction timeout
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ids++
+	out := kafkaInt16(kafkaInt32(nil, 0), 0)
+	out = kafkaInt64(out, b.ids)
+	return kafkaInt16(out, 0) // epoch
+}
+
+// saslHandshake accepts the PLAIN mechanism, with any credentials.
+func (b *kafkaBroker) saslHandshake(r *kafkaReader) []byte {
+	var errorCode int16
+	if mechanism := r.string(); mechanism != "PLAIN" {
+		errorCode = kafkaUnsupportedSASLMechanism
+	}
+	return kafkaString(kafkaInt32(kafkaInt16(nil, errorCode), 1), "PLAIN")
+}
+
+func (b *kafkaBroker) saslAuthenticate(version int16) []byte {
+	out := kafkaNullString(kafkaInt16(nil, 0), "")
+	out = kafkaInt32(out, 0) // auth bytes
+	if version >= 1 {
+		out = kafkaInt64(out, 0) // session lifetime
+	}
+	return out
+}
+
+// ProducedRecords is the list of Kafka records checked by a test. The filters
+// return the matching records, and the assertions fail the test when they do
+// not hold.
+type ProducedRecords struct {
+	list checkList[KafkaRecord]
+}
+
+// Produced returns the records produced through the Kafka stand-ins since the
+// last call to New, in the order they were produced.
+func Produced(t testing.TB) *ProducedRecords {
+	t.Helper()
+	var records []KafkaRecord
+	for _, v := range activeSession().captured(kafkaKind) {
+		records = append(records, v.(KafkaRecord))
+	}
+	return &ProducedRecords{list: checkList[KafkaRecord]{
+		t:     t,
+		items: records,
+		what:  "records were produced",
+		none:  "no record was produced",
+		format: func(r KafkaRecord) string {
+			return fmt.Sprintf("to %s/%d with key %q: %q", r.Topic, r.Partition, r.Key, r.Value)
+		},
+	}}
+}
+
+// All returns the records.
+func (p *ProducedRecords) All() []KafkaRecord {
+	return p.list.items
+}
+
+// ToTopic returns the records produced to the topic.
+func (p *ProducedRecords) ToTopic(topic string) *ProducedRecords {
+	return p.filter(func(r KafkaRecord) bool { return r.Topic == topic })
+}
+
+// WithKey returns the records with the key.
+func (p *ProducedRecords) WithKey(key string) *ProducedRecords {
+	return p.filter(func(r KafkaRecord) bool { return r.Key == key })
+}
+
+// WithHeader returns the records with the header set to value.
+func (p *ProducedRecords) WithHeader(name, value string) *ProducedRecords {
+	return p.filter(func(r KafkaRecord) bool {
+		v, ok := r.Headers[name]
+		return ok && v == value
+	})
+}
+
+// Containing returns the records whose value contains s.
+func (p *ProducedRecords) Containing(s string) *ProducedRecords {
+	return p.filter(func(r KafkaRecord) bool { return strings.Contains(r.Value, s) })
+}
+
+func (p *ProducedRecords) filter(match func(KafkaRecord) bool) *ProducedRecords {
+	return &ProducedRecords{list: p.list.filter(match)}
+}
+
+// Count asserts that there are n records.
+func (p *ProducedRecords) Count(n int) *ProducedRecords {
+	p.list.t.Helper()
+	p.list.count(n)
+	return p
+}
+
+// First asserts that there is at least one record and returns the first one.
+func (p *ProducedRecords) First() KafkaRecord {
+	p.list.t.Helper()
+	return p.list.first()
+}
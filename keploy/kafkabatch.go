@@ -0,0 +1,423 @@
+package keploy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+)
+
+// compression codecs of the attributes of a record batch
+const (
+	kafkaNoCompression     = 0
+	kafkaGzipCompression   = 1
+	kafkaSnappyCompression = 2
+)
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errKafkaCompression reports a record batch compressed with a codec the
+// stand-in cannot decode, lz4 or zstd.
+var errKafkaCompression = errors.New("keploy: the compression codec of the record batch is not supported")
+
+// decodeKafkaBatches returns the records of the record batches (magic 2) of a
+// topic partition. A batch truncated by the size limit of a fetch ends the
+// records.
+func decodeKafkaBatches(topic string, partition int32, data []byte) ([]KafkaRecord, error) {
+	var records []KafkaRecord
+	for len(data) >= 17 {
+		r := &kafkaReader{buf: data}
+		baseOffset := r.int64()
+		length := int(r.int32())
+		if length < 49 || len(r.buf) < length {
+			break
+		}
+		data = r.buf[length:]
+		r.buf = r.buf[:length]
+		r.int32() // partition leader epoch
+		if magic := r.int8(); magic != 2 {
+			return nil, fmt.Errorf("keploy: record batches of magic %d are not supported", magic)
+		}
+		r.int32() // crc
+		attributes := r.int16()
+		r.int32() // last offset delta
+		firstTimestamp := r.int64()
+		r.int64() // max timestamp
+		r.int64() // producer id
+		r.int16() // producer epoch
+		r.int32() // base sequence
+		count := int(r.int32())
+		if r.err != nil {
+			return nil, r.err
+		}
+		if attributes&0x20 != 0 {
+			// control batches mark the end of transactions
+			continue
+		}
+
+		body := r.buf
+		switch attributes & 0x07 {
+		case kafkaNoCompression:
+		case kafkaGzipCompression:
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress the record batch %w", err)
+			}
+			if body, err = io.ReadAll(zr); err != nil {
+				return nil, fmt.Errorf("failed to decompress the record batch %w", err)
+			}
+		case kafkaSnappyCompression:
+			var err error
+			if body, err = decodeSnappy(body); err != nil {
+				return nil, fmt.Errorf("failed to decompress the record batch %w", err)
+			}
+		default:
+			return nil, errKafkaCompression
+		}
+
+		r = &kafkaReader{buf: body}
+		for i := 0; i < count && r.err == nil; i++ {
+			rr := &kafkaReader{buf: r.next(int(r.varint()))}
+			rr.int8() // attributes
+			record := KafkaRecord{Topic: topic, Partition: partition}
+			timestamp := firstTimestamp + rr.varint()
+			if timestamp > 0 {
+				record.Timestamp = time.UnixMilli(timestamp).UTC()
+			}
+			record.Offset = baseOffset + rr.varint()
+			record.Key = string(rr.varbytes())
+			record.Value = string(rr.varbytes())
+			if n := int(rr.varint()); n > 0 {
+				record.Headers = make(map[string]string, n)
+				for j := 0; j < n && rr.err == nil; j++ {
+					k := string(rr.varbytes())
+					record.Headers[k] = string(rr.varbytes())
+				}
+			}
+			if rr.err != nil {
+				return nil, rr.err
+			}
+			records = append(records, record)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+	return records, nil
+}
+
+// encodeKafkaBatch encodes records with consecutive offsets as an
+// uncompressed record batch.
+func encodeKafkaBatch(records []KafkaRecord) []byte {
+	// records without timestamp have the timestamp -1
+	first := int64(-1)
+	if !records[0].Timestamp.IsZero() {
+		first = records[0].Timestamp.UnixMilli()
+	}
+	max := first
+	var body []byte
+	for i, record := range records {
+		timestamp := first
+		if !record.Timestamp.IsZero() {
+			timestamp = record.Timestamp.UnixMilli()
+		}
+		if timestamp > max {
+			max = timestamp
+		}
+		rec := []byte{0} // attributes
+		rec = kafkaVarint(rec, timestamp-first)
+		rec = kafkaVarint(rec, int64(i))
+		rec = kafkaVarbytes(rec, record.Key, record.Key == "")
+		rec = kafkaVarbytes(rec, record.Value, false)
+		rec = kafkaVarint(rec, int64(len(record.Headers)))
+		keys := make([]string, 0, len(record.Headers))
+		for k := range record.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			rec = kafkaVarbytes(rec, k, false)
+			rec = kafkaVarbytes(rec, record.Headers[k], false)
+		}
+		body = append(kafkaVarint(body, int64(len(rec))), rec...)
+	}
+
+	// the crc covers the batch from the attributes on
+	tail := kafkaInt16(nil, 0) // attributes
+	tail = kafkaInt32(tail, int32(len(records)-1))
+	tail = kafkaInt64(tail, first)
+	tail = kafkaInt64(tail, max)
+	tail = kafkaInt64(tail, -1) // producer id
+	tail = kafkaInt16(tail, -1) // producer epoch
+	tail = kafkaInt32(tail, -1) // base sequence
+	tail = kafkaInt32(tail, int32(len(records)))
+	tail = append(tail, body...)
+
+	batch := kafkaInt64(nil, records[0].Offset)
+	batch = kafkaInt32(batch, int32(4+1+4+len(tail)))
+	batch = kafkaInt32(batch, 0) // partition leader epoch
+	batch = append(batch, 2)     // magic
+	batch = kafkaInt32(batch, int32(crc32.Checksum(tail, kafkaCRCTable)))
+	return append(batch, tail...)
+}
+
+func kafkaInt16(b []byte, v int16) []byte {
+	return appendUint16(b, uint16(v))
+}
+
+func kafkaInt32(b []byte, v int32) []byte {
+	return appendUint32(b, uint32(v))
+}
+
+func kafkaInt64(b []byte, v int64) []byte {
+	return appendUint64(b, uint64(v))
+}
+
+func kafkaVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func kafkaVarbytes(b []byte, s string, null bool) []byte {
+	if null {
+		return kafkaVarint(b, -1)
+	}
+	return append(kafkaVarint(b, int64(len(s))), s...)
+}
+
+// decodeSnappy decodes a snappy block, or the xerial framing of snappy blocks
+// written by the Java clients.
+func decodeSnappy(src []byte) ([]byte, error) {
+	xerial := []byte("\x82SNAPPY\x00")
+	if !bytes.HasPrefix(src, xerial) {
+		return decodeSnappyBlock(src)
+	}
+	if len(src) < 16 {
+		return nil, errors.New("malformed snappy frame")
+	}
+	src = src[16:] // header, version and compatible version
+	var out []byte
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, errors.New("malformed snappy frame")
+		}
+		n := int(binary.BigEndian.Uint32(src))
+		if len(src) < 4+n {
+			return nil, errors.New("malformed snappy frame")
+		}
+		block, err := decodeSnappyBlock(src[4 : 4+n])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block...)
+		src = src[4+n:]
+	}
+	return out, nil
+}
+
+func decodeSnappyBlock(src []byte) ([]byte, error) {
+	errMalformed := errors.New("malformed snappy block")
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > 1<<30 {
+		return nil, errMalformed
+	}
+	src = src[n:]
+	dst := make([]byte, 0, size)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 0x03 {
+		case 0: // literal
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errMalformed
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if len(src) < length {
+				return nil, errMalformed
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errMalformed
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errMalformed
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errMalformed
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, errMalformed
+		}
+		// copies may overlap their own output
+		for start := len(dst) - offset; length > 0; length-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+	if len(dst) != int(size) {
+		return nil, errMalformed
+	}
+	return dst, nil
+}
+
+// kafkaReader decodes the fields of a Kafka request or response. The first
+// decoding error is kept in err and every later read returns a zero value.
+type kafkaReader struct {
+	buf []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.buf) < n {
+		if r.err == nil {
+			r.err = errors.New("malformed kafka message")
+		}
+		r.buf = nil
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string or a nullable string, null being read as "".
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// bytes reads nullable bytes, null being read as nil.
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+// array reads the length of an array, a null array having no element.
+func (r *kafkaReader) array() int {
+	n := int(r.int32())
+	if n < 0 {
+		return 0
+	}
+	if n > len(r.buf) && r.err == nil {
+		r.err = errors.New("malformed kafka message")
+	}
+	return n
+}
+
+func (r *kafkaReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.next(len(r.buf) + 1)
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *kafkaReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.next(len(r.buf) + 1)
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// taggedFields skips the tagged fields of the flexible versions.
+func (r *kafkaReader) taggedFields() {
+	for i, n := uint64(0), r.uvarint(); i < n && r.err == nil; i++ {
+		r.uvarint() // tag
+		r.next(int(r.uvarint()))
+	}
+}
+
+func (r *kafkaReader) varbytes() []byte {
+	n := r.varint()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func kafkaString(b []byte, s string) []byte {
+	return append(kafkaInt16(b, int16(len(s))), s...)
+}
+
+func kafkaNullString(b []byte, s string) []byte {
+	if s == "" {
+		return kafkaInt16(b, -1)
+	}
+	return kafkaString(b, s)
+}
+
+func kafkaBytes(b []byte, v []byte) []byte {
+	if v == nil {
+		return kafkaInt32(b, -1)
+	}
+	return append(kafkaInt32(b, int32(len(v))), v...)
+}
@@ -0,0 +1,73 @@
+package keploy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Latency configures the playback in MODE_TEST of the latency observed in
+// MODE_RECORD, the duration of the HTTP calls of Transport, of the calls of
+// Func and of the keploygen wrappers, and of the commands. It is stored as the
+// latency of the mocks in the stubs file, where it can be set on the mocks of
+// the Postgres, MySQL and Mongo stand-ins too.
+type Latency struct {
+	// Replay waits for the recorded latency of a mock before returning its
+	// response, and replays the chunks of the streamed HTTP responses at the
+	// recorded speed.
+	Replay bool
+	// Scale multiplies the recorded latencies, 0.5 halving them and 2
+	// doubling them. Default: 1
+	Scale float64
+	// Jitter varies the latencies randomly by up to the given fraction, 0.1
+	// waiting between 90% and 110% of them. Default: 0
+	Jitter float64
+}
+
+func (l Latency) validate() error {
+	if l.Scale < 0 {
+		return fmt.Errorf("invalid latency scale %v, it must not be negative", l.Scale)
+	}
+	if l.Jitter < 0 || l.Jitter > 1 {
+		return fmt.Errorf("invalid latency jitter %v, it must be between 0 and 1", l.Jitter)
+	}
+	return nil
+}
+
+// delay returns how long to wait for the replay of a response recorded with
+// the given latency, 0 when the latencies are not replayed.
+func (l Latency) delay(latency time.Duration) time.Duration {
+	if !l.Replay || latency <= 0 {
+		return 0
+	}
+	d := float64(latency)
+	if l.Scale != 0 {
+		d *= l.Scale
+	}
+	if l.Jitter != 0 {
+		d *= 1 + l.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(d)
+}
+
+// wait waits for the recorded latency of m, when it is replayed, or until ctx
+// is done.
+func (s *session) wait(ctx context.Context, m *Mock) error {
+	return sleepContext(ctx, s.latency.delay(m.Latency))
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,146 @@
+package keploy
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatencyDelay(t *testing.T) {
+	for _, tc := range []struct {
+		latency Latency
+		want    time.Duration
+	}{
+		{Latency{}, 0},
+		{Latency{Scale: 2}, 0},
+		{Latency{Replay: true}, 100 * time.Millisecond},
+		{Latency{Replay: true, Scale: 0.5}, 50 * time.Millisecond},
+		{Latency{Replay: true, Scale: 2}, 200 * time.Millisecond},
+	} {
+		if got := tc.latency.delay(100 * time.Millisecond); got != tc.want {
+			t.Errorf("%+v delayed %v, want %v", tc.latency, got, tc.want)
+		}
+	}
+	if got := (Latency{Replay: true}).delay(0); got != 0 {
+		t.Errorf("a mock without latency delayed %v", got)
+	}
+
+	jitter := Latency{Replay: true, Jitter: 0.1}
+	min, max := time.Hour, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := jitter.delay(100 * time.Millisecond)
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	if min < 90*time.Millisecond || max > 110*time.Millisecond || min == max {
+		t.Errorf("the jitter delayed between %v and %v, want between 90ms and 110ms", min, max)
+	}
+}
+
+func TestInvalidLatency(t *testing.T) {
+	for _, l := range []Latency{{Scale: -1}, {Jitter: -0.1}, {Jitter: 1.5}} {
+		if err := l.validate(); err == nil {
+			t.Errorf("%+v is valid", l)
+		}
+	}
+}
+
+func TestLatencyRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	slow := Func("slow", func(context.Context, int) (int, error) {
+		time.Sleep(60 * time.Millisecond)
+		return 1, nil
+	})
+	call := func(t *testing.T, ctx context.Context) (time.Duration, error) {
+		t.Helper()
+		start := time.Now()
+		_, err := slow(ctx, 1)
+		return time.Since(start), err
+	}
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	if _, err := call(t, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mocks, err := readMocks(filepath.Join(dir, "stubs", "TestLatencyRecordReplay.yaml"), funcKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mocks) != 1 || mocks[0].Latency < 60*time.Millisecond {
+		t.Fatalf("recorded %+v, want the latency of the call", mocks)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{Latency: Latency{Replay: true, Scale: 2}})
+	if elapsed, err := call(t, context.Background()); err != nil || elapsed < 120*time.Millisecond {
+		t.Fatalf("replayed in %v %v, want twice the recorded latency", elapsed, err)
+	}
+	// a deadline shorter than the latency expires as it would have
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := call(t, ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline of the context", err)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := call(t, ctx); err != nil {
+		t.Fatalf("got %v, want the response right away", err)
+	}
+}
+
+const standInLatencyStubs = `version: api.keploy.io/v1beta1
+kind: Postgres
+name: postgres-0
+latency: 150ms
+spec:
+  query: UPDATE users SET name = 'bob'
+  command_tag: UPDATE 1
+---
+version: api.keploy.io/v1beta1
+kind: Mongo
+name: mongo-0
+latency: 150ms
+spec:
+  command: ping
+  response: '{"ok": {"$numberDouble": "1.0"}}'
+`
+
+func TestLatencyStandIns(t *testing.T) {
+	dir := writeStubs(t, t.Name(), standInLatencyStubs)
+	p, err := StartPostgresStandIn(dir, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	m, err := StartMongoStandIn(dir, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	for _, replay := range []bool{false, true} {
+		startTestSession(t, MODE_TEST, dir, Config{Latency: Latency{Replay: replay}})
+		c := dialPostgres(t, p)
+		start := time.Now()
+		c.send(t, 'Q', pgString(nil, "UPDATE users SET name = 'bob'"))
+		c.until(t, 'Z')
+		postgres := time.Since(start)
+		start = time.Now()
+		if _, ok := m.lookup(bsonDoc{{"ping", int32(1)}, {"$db", "admin"}}); !ok {
+			t.Fatal("the ping is not answered")
+		}
+		mongo := time.Since(start)
+		if replay && (postgres < 150*time.Millisecond || mongo < 150*time.Millisecond) {
+			t.Errorf("the stand-ins answered in %v and %v, want the recorded 150ms", postgres, mongo)
+		}
+		if !replay && (postgres >= 150*time.Millisecond || mongo >= 150*time.Millisecond) {
+			t.Errorf("the stand-ins answered in %v and %v without Latency.Replay", postgres, mongo)
+		}
+	}
+}
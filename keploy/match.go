@@ -0,0 +1,330 @@
+package keploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Matching configures how the requests replayed in MODE_TEST are matched with
+// the recorded ones. The zero value matches them exactly.
+type Matching struct {
+	// HTTP holds the rules of the requests replayed by Transport. The first
+	// rule applying to a request is used.
+	HTTP []HTTPRule
+	// SQL applies to the queries of the Postgres and MySQL stand-ins.
+	SQL SQLRule
+	// Func holds the rules of the calls replayed by Func and the wrappers
+	// generated by keploygen. The first rule applying to a call is used.
+	Func []FuncRule
+}
+
+// BodyMatch is the comparison of a body, or of a payload, with the recorded
+// one.
+type BodyMatch int
+
+const (
+	// BodyExact compares the bodies byte for byte.
+	BodyExact BodyMatch = iota
+	// BodyJSON compares JSON bodies semantically, ignoring the order of the
+	// keys and the whitespace.
+	BodyJSON
+	// BodyJSONSubset only requires the recorded JSON to be contained in the
+	// body: the objects of the body may have more keys than the recorded ones.
+	BodyJSONSubset
+)
+
+// HTTPRule relaxes the matching of the HTTP requests whose method and path
+// match Method and Path.
+type HTTPRule struct {
+	Method string // Default: every method
+	// Path is a regular expression matched against the whole path of the
+	// requests. The rule applies to the requests whose path matches it, which
+	// then match the recorded requests whose path matches it too. Default:
+	// every path, compared as is.
+	Path string
+	// Query holds regular expressions of the query parameters. A parameter
+	// listed matches when its values, joined with commas, match the regular
+	// expression in the request and in the recording, ".*" ignoring it. The
+	// other parameters are compared as is, in any order.
+	Query map[string]string
+	// Headers requires the request to have the recorded headers, with the same
+	// values, except IgnoreHeaders. The headers are not compared otherwise.
+	Headers       bool
+	IgnoreHeaders []string
+	Body          BodyMatch
+}
+
+// SQLRule relaxes the matching of SQL queries, whose whitespace and trailing
+// semicolon never matter.
+type SQLRule struct {
+	// Normalize compares the queries without their comments, with the text
+	// outside of quotes lowercased and without spaces around punctuation.
+	Normalize bool
+	// IgnoreArgs matches the queries whatever their arguments.
+	IgnoreArgs bool
+}
+
+// FuncRule relaxes the matching of the calls of the function, or method of a
+// keploygen wrapper, with the given name.
+type FuncRule struct {
+	Name string // Default: every function
+	// Request compares the JSON encoding of the request, or arguments, with
+	// the recorded one. BodyExact and BodyJSON are the same.
+	Request BodyMatch
+}
+
+// matcher is the compiled Matching of a session.
+type matcher struct {
+	http []httpRule
+	sql  SQLRule
+	fn   []FuncRule
+}
+
+type httpRule struct {
+	method  string
+	path    *regexp.Regexp
+	query   map[string]*regexp.Regexp
+	headers bool
+	ignored map[string]bool
+	body    BodyMatch
+}
+
+func compileMatching(m Matching) (*matcher, error) {
+	out := &matcher{sql: m.SQL, fn: m.Func}
+	for _, rule := range m.HTTP {
+		r := httpRule{method: rule.Method, headers: rule.Headers, ignored: map[string]bool{}, body: rule.Body}
+		var err error
+		if rule.Path != "" {
+			if r.path, err = fullRegexp(rule.Path); err != nil {
+				return nil, fmt.Errorf("invalid path of the http matching rule %w", err)
+			}
+		}
+		if len(rule.Query) > 0 {
+			r.query = map[string]*regexp.Regexp{}
+		}
+		for k, v := range rule.Query {
+			if r.query[k], err = fullRegexp(v); err != nil {
+				return nil, fmt.Errorf("invalid query parameter %s of the http matching rule %w", k, err)
+			}
+		}
+		for _, h := range rule.IgnoreHeaders {
+			r.ignored[http.CanonicalHeaderKey(h)] = true
+		}
+		out.http = append(out.http, r)
+	}
+	return out, nil
+}
+
+// fullRegexp compiles a regular expression which has to match whole strings.
+func fullRegexp(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// matchHTTP reports whether req, with its body, matches the recorded request.
+func (m *matcher) matchHTTP(recorded httpRequest, req *http.Request, body []byte) bool {
+	if recorded.Method != req.Method {
+		return false
+	}
+	rule := m.httpRule(req)
+	if rule == nil {
+		return recorded.URL == req.URL.String() && recorded.Body == string(body)
+	}
+
+	u, err := url.Parse(recorded.URL)
+	if err != nil || u.Scheme != req.URL.Scheme || u.Host != req.URL.Host {
+		return false
+	}
+	if rule.path != nil {
+		if !rule.path.MatchString(u.Path) {
+			return false
+		}
+	} else if u.Path != req.URL.Path {
+		return false
+	}
+	if !rule.matchQuery(u.Query(), req.URL.Query()) {
+		return false
+	}
+	if rule.headers {
+		for k, v := range recorded.Header {
+			if !rule.ignored[http.CanonicalHeaderKey(k)] && strings.Join(req.Header.Values(k), ", ") != v {
+				return false
+			}
+		}
+	}
+	return matchBody(rule.body, []byte(recorded.Body), body)
+}
+
+// httpRule returns the first rule applying to req, or nil.
+func (m *matcher) httpRule(req *http.Request) *httpRule {
+	for i := range m.http {
+		r := &m.http[i]
+		if (r.method == "" || strings.EqualFold(r.method, req.Method)) && (r.path == nil || r.path.MatchString(req.URL.Path)) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *httpRule) matchQuery(recorded, query url.Values) bool {
+	keys := map[string]bool{}
+	for k := range recorded {
+		keys[k] = true
+	}
+	for k := range query {
+		keys[k] = true
+	}
+	for k := range keys {
+		if re, ok := r.query[k]; ok {
+			if !re.MatchString(strings.Join(recorded[k], ",")) || !re.MatchString(strings.Join(query[k], ",")) {
+				return false
+			}
+			continue
+		}
+		if !equalStrings(recorded[k], query[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBody compares a body with the recorded one. JSON comparisons fall back
+// to the exact one when a body is not JSON.
+func matchBody(match BodyMatch, recorded, body []byte) bool {
+	if match == BodyExact || bytes.Equal(recorded, body) {
+		return bytes.Equal(recorded, body)
+	}
+	var want, got interface{}
+	if decodeJSON(recorded, &want) != nil || decodeJSON(body, &got) != nil {
+		return false
+	}
+	return matchJSON(want, got, match == BodyJSONSubset)
+}
+
+func decodeJSON(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("trailing data after the json value")
+	}
+	return nil
+}
+
+// matchJSON compares the decoded JSON values. With subset, the objects of got
+// may have more keys than the ones of want.
+func matchJSON(want, got interface{}, subset bool) bool {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		got, ok := got.(map[string]interface{})
+		if !ok || !subset && len(got) != len(want) {
+			return false
+		}
+		for k, v := range want {
+			item, ok := got[k]
+			if !ok || !matchJSON(v, item, subset) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		got, ok := got.([]interface{})
+		if !ok || len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !matchJSON(want[i], got[i], subset) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		got, ok := got.(json.Number)
+		if !ok {
+			return false
+		}
+		if want == got {
+			return true
+		}
+		w, err1 := want.Float64()
+		g, err2 := got.Float64()
+		return err1 == nil && err2 == nil && w == g
+	}
+	return want == got
+}
+
+// funcRequest returns how the requests of the named function are compared.
+func (m *matcher) funcRequest(name string) BodyMatch {
+	for _, rule := range m.fn {
+		if rule.Name == "" || rule.Name == name {
+			return rule.Request
+		}
+	}
+	return BodyJSON
+}
+
+// normalizeQuery returns the form of a query compared with the recorded ones.
+func (m *matcher) normalizeQuery(query string) string {
+	if !m.sql.Normalize {
+		return normalizeSQL(query)
+	}
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			b.WriteByte(c)
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			b.WriteByte(c)
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			b.WriteByte(' ')
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			b.WriteByte(' ')
+		case 'A' <= c && c <= 'Z':
+			b.WriteByte(c + 'a' - 'A')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	fields := strings.Fields(b.String())
+	// the spaces around punctuation are dropped
+	var out strings.Builder
+	for i, f := range fields {
+		if i > 0 && !isSQLPunct(fields[i-1][len(fields[i-1])-1]) && !isSQLPunct(f[0]) {
+			out.WriteByte(' ')
+		}
+		out.WriteString(f)
+	}
+	return strings.TrimSuffix(out.String(), ";")
+}
+
+func isSQLPunct(c byte) bool {
+	return strings.IndexByte("(),=<>+-*/;", c) >= 0
+}
+
+// matchArgs reports whether the arguments of a query match the recorded ones.
+// They are only compared when both are known.
+func (m *matcher) matchArgs(recorded, args []*string) bool {
+	return m.sql.IgnoreArgs || args == nil || recorded == nil || equalArgs(recorded, args)
+}
@@ -0,0 +1,195 @@
+package keploy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const matchingStubs = `version: api.keploy.io/v1beta1
+kind: Http
+name: mock-0
+spec:
+    req:
+        method: POST
+        url: http://api.test/users/42/orders?page=1&trace=abc
+        header:
+            Authorization: Bearer t1
+            X-Request-Id: r1
+        body: '{"item":"book","qty":1}'
+    resp:
+        status_code: 201
+        body: created
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: mock-1
+spec:
+    req:
+        method: PUT
+        url: http://api.test/profile
+        body: '{"name":"ann","tags":["a","b"]}'
+    resp:
+        status_code: 200
+        body: updated
+`
+
+// send returns the status and body replayed for the request.
+func send(t *testing.T, c *http.Client, method, url string, header map[string]string, body string) (int, string, error) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b), nil
+}
+
+func TestHTTPMatching(t *testing.T) {
+	dir := writeStubs(t, "TestHTTPMatching", matchingStubs)
+	c := &http.Client{Transport: &Transport{}}
+	auth := map[string]string{"Authorization": "Bearer t1", "X-Request-Id": "r2", "X-Trace": "new"}
+
+	t.Run("Exact", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{})
+		if _, _, err := send(t, c, "POST", "http://api.test/users/42/orders?page=1&trace=abc", nil, `{"qty":1,"item":"book"}`); err == nil {
+			t.Fatal("the body with its keys in another order matched without a rule")
+		}
+		if status, body, err := send(t, c, "POST", "http://api.test/users/42/orders?page=1&trace=abc", nil, `{"item":"book","qty":1}`); err != nil || status != 201 || body != "created" {
+			t.Fatalf("got %d %q %v", status, body, err)
+		}
+	})
+
+	t.Run("Rules", func(t *testing.T) {
+		startTestSession(t, MODE_TEST, dir, Config{Matching: Matching{HTTP: []HTTPRule{
+			{
+				Method:        "post",
+				Path:          `/users/\d+/orders`,
+				Query:         map[string]string{"trace": ".*"},
+				Headers:       true,
+				IgnoreHeaders: []string{"x-request-id"},
+				Body:          BodyJSON,
+			},
+			{Path: "/profile", Body: BodyJSONSubset},
+		}}})
+		for _, tc := range []struct {
+			name, method, url string
+			header            map[string]string
+			body              string
+			want              string // the replayed body, empty when nothing matches
+		}{
+			{"JSONKeyOrder", "POST", "http://api.test/users/7/orders?trace=xyz&page=1", auth, `{ "qty": 1.0, "item": "book" }`, "created"},
+			{"MissingHeader", "POST", "http://api.test/users/7/orders?page=1", map[string]string{"X-Request-Id": "r1"}, `{"item":"book","qty":1}`, ""},
+			{"OtherHeaderValue", "POST", "http://api.test/users/7/orders?page=1", map[string]string{"Authorization": "Bearer t2"}, `{"item":"book","qty":1}`, ""},
+			{"OtherQuery", "POST", "http://api.test/users/7/orders?page=2", auth, `{"item":"book","qty":1}`, ""},
+			{"OtherPath", "POST", "http://api.test/users/ann/orders?page=1", auth, `{"item":"book","qty":1}`, ""},
+			{"OtherBody", "POST", "http://api.test/users/7/orders?page=1", auth, `{"item":"book","qty":2}`, ""},
+			{"Subset", "PUT", "http://api.test/profile", nil, `{"tags":["a","b"],"name":"ann","age":3}`, "updated"},
+			{"SubsetArray", "PUT", "http://api.test/profile", nil, `{"name":"ann","tags":["a"]}`, ""},
+			{"NotJSON", "PUT", "http://api.test/profile", nil, `name=ann`, ""},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				_, body, err := send(t, c, tc.method, tc.url, tc.header, tc.body)
+				if tc.want == "" {
+					if err == nil {
+						t.Fatalf("replayed %q, want no match", body)
+					}
+					return
+				}
+				if err != nil || body != tc.want {
+					t.Fatalf("got %q %v, want %q", body, err, tc.want)
+				}
+			})
+		}
+	})
+}
+
+func TestInvalidMatching(t *testing.T) {
+	for _, m := range []Matching{
+		{HTTP: []HTTPRule{{Path: "/users/("}}},
+		{HTTP: []HTTPRule{{Query: map[string]string{"page": "[0-9"}}}},
+	} {
+		if _, err := compileMatching(m); err == nil {
+			t.Errorf("compileMatching(%+v) did not fail", m)
+		}
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	normalized := &matcher{sql: SQLRule{Normalize: true}}
+	for _, tc := range []struct{ a, b string }{
+		{"SELECT id FROM users WHERE id = $1", "select id from users where id=$1;"},
+		{"SELECT  id\n\tFROM users -- by id\nWHERE id = ?", "select id from users where id = ?"},
+		{"SELECT /* all */ * FROM t", "select * from t"},
+		{"INSERT INTO t (a, b) VALUES ($1, $2)", "insert into t(a,b) values($1,$2)"},
+	} {
+		if a, b := normalized.normalizeQuery(tc.a), normalized.normalizeQuery(tc.b); a != b {
+			t.Errorf("%q and %q normalized to %q and %q", tc.a, tc.b, a, b)
+		}
+	}
+	// the quoted text is kept as is
+	if a, b := normalized.normalizeQuery("SELECT 'A  B'"), normalized.normalizeQuery("select 'a b'"); a == b {
+		t.Errorf("the quoted strings normalized to %q", a)
+	}
+	exact := &matcher{}
+	if a, b := exact.normalizeQuery("SELECT id FROM t;"), exact.normalizeQuery("SELECT  id\nFROM t"); a != b {
+		t.Errorf("the whitespace matters without Normalize: %q and %q", a, b)
+	}
+	if a, b := exact.normalizeQuery("SELECT id FROM t"), exact.normalizeQuery("select id from t"); a == b {
+		t.Errorf("the case does not matter without Normalize: %q", a)
+	}
+
+	one, two := "1", "2"
+	if exact.matchArgs([]*string{&one}, []*string{&two}) {
+		t.Error("other arguments matched")
+	}
+	if !(&matcher{sql: SQLRule{IgnoreArgs: true}}).matchArgs([]*string{&one}, []*string{&two}) {
+		t.Error("other arguments did not match with IgnoreArgs")
+	}
+}
+
+func TestFuncMatching(t *testing.T) {
+	type query struct {
+		Name  string `json:"name"`
+		Limit int    `json:"limit,omitempty"`
+	}
+	dir := writeStubs(t, "TestFuncMatching", `version: api.keploy.io/v1beta1
+kind: Func
+name: mock-0
+spec:
+    name: search
+    request:
+        name: ann
+    response: 3
+`)
+	search := Func("search", func(context.Context, query) (int, error) {
+		t.Fatal("the function was called in MODE_TEST")
+		return 0, nil
+	})
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	if _, err := search(context.Background(), query{Name: "ann", Limit: 10}); err == nil {
+		t.Fatal("the request with another field matched without a rule")
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{Matching: Matching{Func: []FuncRule{{Name: "search", Request: BodyJSONSubset}}}})
+	if n, err := search(context.Background(), query{Name: "ann", Limit: 10}); err != nil || n != 3 {
+		t.Fatalf("got %d %v", n, err)
+	}
+	if _, err := search(context.Background(), query{Name: "bob"}); err == nil {
+		t.Fatal("the request with another name matched")
+	}
+}
@@ -16,7 +16,9 @@ import (
 )
 
 var (
-	logger *zap.Logger
+	// logger is replaced by New; the stand-ins and wrappers may be used
+	// before it is called.
+	logger = zap.NewNop()
 )
 
 type Config struct {
@@ -25,6 +27,13 @@ type Config struct {
 	Path           string // Path in which Keploy "/mocks" will be generated. Default: current working directroy.
 	MuteKeployLogs bool
 	Delay          int
+	InProcess      bool      // Only use the in-process record/replay helpers (Func...) and do not start the keploy binary. Default: false
+	Matching       Matching  // How the in-process helpers and the stand-ins match the requests with the recorded ones in MODE_TEST. Default: exact matching
+	Faults         []Fault   // Failures injected in the replay of the matching mocks in MODE_TEST, the first applying one being used
+	Latency        Latency   // Playback of the latency recorded for the mocks in MODE_TEST. Default: the mocks are replayed right away
+	Filters        Filters   // Destinations recorded and replayed by Transport, Resolver and the proxying stand-ins, the others reaching the real service. Default: every destination
+	Redaction      Redaction // Secrets and personal data replaced by placeholders in the recorded mocks. Default: none
+	Noise          Noise     // Fields differing on every run, ignored by the matching in MODE_TEST. Default: none
 }
 
 func New(conf Config) error {
@@ -43,7 +52,9 @@ func New(conf Config) error {
 	}()
 
 	// killing keploy instance if it is running already
-	KillProcessOnPort()
+	if !conf.InProcess {
+		KillProcessOnPort()
+	}
 
 	if Mode(conf.Mode).Valid() {
 		mode = Mode(conf.Mode)
@@ -51,11 +62,17 @@ func New(conf Config) error {
 		return errors.New("provided keploy mode is invalid, either use MODE_RECORD/MODE_TEST/MODE_OFF")
 	}
 
+	opts, err := compileOptions(conf)
+	if err != nil {
+		return err
+	}
+
 	if conf.Delay > 5 {
 		delay = conf.Delay
 	}
 
 	if mode == MODE_OFF {
+		startSession(mode, path, conf.Name, opts)
 		return nil
 	}
 
@@ -84,14 +101,24 @@ func New(conf Config) error {
 
 	if mode == MODE_RECORD {
 		if _, err := os.Stat(path + "/stubs/" + conf.Name + ".yaml"); !os.IsNotExist(err) {
-			cmd := exec.Command("sudo", "rm", "-rf", path+"/stubs/"+conf.Name+".yaml")
-			_, err := cmd.CombinedOutput()
+			opts.previous = previousMocks(path + "/stubs/" + conf.Name + ".yaml")
+			if conf.InProcess {
+				err = os.Remove(path + "/stubs/" + conf.Name + ".yaml")
+			} else {
+				cmd := exec.Command("sudo", "rm", "-rf", path+"/stubs/"+conf.Name+".yaml")
+				_, err = cmd.CombinedOutput()
+			}
 			if err != nil {
 				return fmt.Errorf("failed to replace existing mock file %w", err)
 			}
 		}
 	}
 
+	startSession(mode, path, conf.Name, opts)
+	if conf.InProcess {
+		return nil
+	}
+
 	appPid := os.Getpid()
 
 	recordCmd := "sudo -E /usr/local/bin/keploy mockRecord --pid " + strconv.Itoa(appPid) + " --path " + path + " --mockName " + conf.Name + " --debug"
@@ -0,0 +1,76 @@
+package keploy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestStandInsWithoutNew runs in a process of its own, in which New is never
+// called, the stand-ins failing to reach their upstream servers.
+func TestStandInsWithoutNew(t *testing.T) {
+	if os.Getenv("KEPLOY_TEST_WITHOUT_NEW") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestStandInsWithoutNew$", "-test.v")
+		cmd.Env = append(os.Environ(), "KEPLOY_TEST_WITHOUT_NEW=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	t.Run("WebSocket", func(t *testing.T) {
+		w, err := StartWebSocketStandIn("ws://127.0.0.1:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if _, _, resp := dialWebSocket(t, w.Addr(), "/"); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("got %s, want %d", resp.Status, http.StatusBadGateway)
+		}
+	})
+
+	t.Run("AMQP", func(t *testing.T) {
+		a, err := StartAMQPStandIn("amqp://127.0.0.1:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		conn, err := net.Dial("tcp", a.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(amqpProtocolHeader); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("got %v, want the connection to be closed", err)
+		}
+	})
+
+	t.Run("Kafka", func(t *testing.T) {
+		k, err := StartKafkaStandIn("127.0.0.1:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer k.Close()
+		conn, err := net.Dial("tcp", k.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// an ApiVersions v0 request of the client "c"
+		if err := writeKafkaFrame(conn, []byte{0, 18, 0, 0, 0, 0, 0, 1, 0, 1, 'c'}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("got %v, want the connection to be closed", err)
+		}
+	})
+}
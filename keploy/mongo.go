@@ -0,0 +1,403 @@
+package keploy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// mongoKind is the kind of the mocks served by the MongoDB stand-in.
+const mongoKind = "Mongo"
+
+// mongoSpec is the spec of a Mongo mock. The command and its reply are kept as
+// canonical Extended JSON so that the documents stay readable and editable.
+// When Request is omitted the mock answers any Command on the Collection.
+type mongoSpec struct {
+	Metadata   map[string]string `yaml:"metadata,omitempty"`
+	Database   string            `yaml:"database,omitempty"`
+	Command    string            `yaml:"command"`
+	Collection string            `yaml:"collection,omitempty"`
+	Request    string            `yaml:"request,omitempty"`
+	Response   string            `yaml:"response"`
+}
+
+// mongoIgnoredFields are the command fields set by drivers per session or per
+// connection, which are left out when comparing a command with a mock.
+var mongoIgnoredFields = []string{"lsid", "$clusterTime", "txnNumber", "$readPreference", "signature", "apiVersion", "apiStrict", "apiDeprecationErrors"}
+
+// wire protocol opcodes handled by the stand-in
+const (
+	opReply = 1
+	opQuery = 2004
+	opMsg   = 2013
+)
+
+// mongoMaxWireVersion is the wire version reported by the stand-in, the one
+// of MongoDB 6.0.
+const mongoMaxWireVersion = 17
+
+// MongoStandIn is a localhost server speaking the MongoDB wire protocol. It
+// answers the connection handshake itself and every other command from the
+// Mongo mocks of a stubs file, so the official driver can be tested by only
+// changing its URI.
+type MongoStandIn struct {
+	*standIn
+	mocks   *mockSet
+	specs   map[*Mock]*mongoSpec
+	request map[*Mock]string
+	loose   map[*Mock]string
+	reply   map[*Mock]bsonDoc
+	connID  int32
+}
+
+// StartMongoStandIn loads the Mongo mocks of stubs/<name>.yaml under path and
+// starts serving them on a random localhost port.
+func StartMongoStandIn(path, name string) (*MongoStandIn, error) {
+	file, err := stubsFile(path, name)
+	if err != nil {
+		return nil, err
+	}
+	mocks, err := readMocks(file, mongoKind)
+	if err != nil {
+		return nil, err
+	}
+	s := &MongoStandIn{
+		mocks:   newMockSet(mocks),
+		specs:   map[*Mock]*mongoSpec{},
+		request: map[*Mock]string{},
+		loose:   map[*Mock]string{},
+		reply:   map[*Mock]bsonDoc{},
+	}
+	for _, m := range mocks {
+		spec := &mongoSpec{}
+		if err := m.decode(spec); err != nil {
+			return nil, err
+		}
+		s.specs[m] = spec
+		if spec.Request != "" {
+			req, err := parseExtJSON(spec.Request)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse request of mongo mock %q %w", m.Name, err)
+			}
+			s.request[m] = mongoCommandKey(req)
+			s.loose[m] = mongoLooseKey(req)
+		}
+		if s.reply[m], err = parseExtJSON(spec.Response); err != nil {
+			return nil, fmt.Errorf("failed to parse response of mongo mock %q %w", m.Name, err)
+		}
+	}
+	s.standIn, err = listenStandIn(s.serveConn)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// URI returns a connection string pointing at the stand-in.
+func (s *MongoStandIn) URI() string {
+	return "mongodb://" + s.Addr() + "/?directConnection=true"
+}
+
+// mongoCommandKey renders the command without its session fields, to compare
+// it with the recorded ones.
+func mongoCommandKey(cmd bsonDoc) string {
+	return extJSON(cmd.without(mongoIgnoredFields...))
+}
+
+// mongoLooseKey renders the command like mongoCommandKey, without the _id of
+// the inserted documents too, which drivers generate when the application
+// leaves it out.
+func mongoLooseKey(cmd bsonDoc) string {
+	cmd = cmd.without(mongoIgnoredFields...)
+	if name, _, _ := mongoCommand(cmd); name != "insert" {
+		return extJSON(cmd)
+	}
+	for i, e := range cmd {
+		docs, ok := e.Value.(bsonArray)
+		if e.Key != "documents" || !ok {
+			continue
+		}
+		stripped := make(bsonArray, len(docs))
+		for j, d := range docs {
+			if doc, ok := d.(bsonDoc); ok {
+				d = doc.without("_id")
+			}
+			stripped[j] = d
+		}
+		cmd[i].Value = stripped
+	}
+	return extJSON(cmd)
+}
+
+// mongoCommand returns the name, database and collection of a command.
+func mongoCommand(cmd bsonDoc) (name, db, coll string) {
+	if len(cmd) > 0 {
+		name = cmd[0].Key
+		coll, _ = cmd[0].Value.(string)
+	}
+	if v, ok := cmd.lookup("$db"); ok {
+		db, _ = v.(string)
+	}
+	return name, db, coll
+}
+
+// lookup returns the reply recorded for the command. A mock recorded for the
+// same command document is preferred, then one recorded for the same document
+// but the generated _id of the inserted documents, then one without a request,
+// which answers any command of the same name on the same collection.
+func (s *MongoStandIn) lookup(cmd bsonDoc) (bsonDoc, bool) {
+	name, db, coll := mongoCommand(cmd)
+	key := mongoCommandKey(cmd)
+	sameCommand := func(m *Mock) bool {
+		spec := s.specs[m]
+		return spec.Command == name && spec.Collection == coll && (spec.Database == "" || spec.Database == db)
+	}
+	m, ok := s.mocks.find(func(m *Mock) bool {
+		return sameCommand(m) && s.request[m] == key
+	})
+	if !ok {
+		loose := mongoLooseKey(cmd)
+		m, ok = s.mocks.find(func(m *Mock) bool {
+			return sameCommand(m) && s.request[m] != "" && s.loose[m] == loose
+		})
+	}
+	if !ok {
+		m, ok = s.mocks.find(func(m *Mock) bool {
+			return sameCommand(m) && s.request[m] == ""
+		})
+	}
+	if !ok {
+		return nil, false
+	}
+	session := activeSession()
+	session.called(m, strings.TrimSpace(name+" "+coll), key)
+	time.Sleep(session.latency.delay(m.Latency))
+	return s.reply[m], true
+}
+
+// handleCommand returns the reply to a command. The handshake is always
+// answered by the stand-in, and a few housekeeping commands are when they are
+// not mocked.
+func (s *MongoStandIn) handleCommand(cmd bsonDoc, connID int32) bsonDoc {
+	name, _, _ := mongoCommand(cmd)
+	switch strings.ToLower(name) {
+	case "hello", "ismaster":
+		return bsonDoc{
+			{"helloOk", true},
+			{"ismaster", true},
+			{"isWritablePrimary", true},
+			{"maxBsonObjectSize", int32(16 * 1024 * 1024)},
+			{"maxMessageSizeBytes", int32(48000000)},
+			{"maxWriteBatchSize", int32(100000)},
+			{"localTime", bsonDateTime(time.Now().UnixNano() / int64(time.Millisecond))},
+			{"logicalSessionTimeoutMinutes", int32(30)},
+			{"connectionId", connID},
+			{"minWireVersion", int32(0)},
+			{"maxWireVersion", int32(mongoMaxWireVersion)},
+			{"readOnly", false},
+			{"ok", 1.0},
+		}
+	}
+	if reply, ok := s.lookup(cmd); ok {
+		return reply
+	}
+	switch strings.ToLower(name) {
+	case "ping", "endsessions", "killcursors", "aborttransaction", "committransaction":
+		return bsonDoc{{"ok", 1.0}}
+	case "buildinfo":
+		return bsonDoc{
+			{"version", "6.0.0"},
+			{"versionArray", bsonArray{int32(6), int32(0), int32(0), int32(0)}},
+			{"maxBsonObjectSize", int32(16 * 1024 * 1024)},
+			{"ok", 1.0},
+		}
+	}
+	return bsonDoc{
+		{"ok", 0.0},
+		{"errmsg", "keploy: no recorded mock matches command " + mongoCommandKey(cmd)},
+		{"code", int32(8000)},
+		{"codeName", "KeployMockNotFound"},
+	}
+}
+
+func (s *MongoStandIn) serveConn(conn net.Conn) {
+	connID := atomic.AddInt32(&s.connID, 1)
+	r := bufio.NewReader(conn)
+	for {
+		var hdr [16]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		size := int(int32(binary.LittleEndian.Uint32(hdr[0:])))
+		requestID := int32(binary.LittleEndian.Uint32(hdr[4:]))
+		opCode := int32(binary.LittleEndian.Uint32(hdr[12:]))
+		if size < 16 || size > 48000000 {
+			return
+		}
+		body := make([]byte, size-16)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		var (
+			reply []byte
+			err   error
+		)
+		switch opCode {
+		case opMsg:
+			var (
+				cmd        bsonDoc
+				moreToCome bool
+			)
+			cmd, moreToCome, err = decodeOpMsg(body)
+			if err != nil {
+				return
+			}
+			doc := s.handleCommand(cmd, connID)
+			if moreToCome {
+				continue
+			}
+			reply = encodeOpMsg(requestID, doc)
+		case opQuery:
+			var cmd bsonDoc
+			if cmd, err = decodeOpQuery(body); err != nil {
+				return
+			}
+			reply = encodeOpReply(requestID, s.handleCommand(cmd, connID))
+		default:
+			return
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// decodeOpMsg returns the command of an OP_MSG, with the document sequences
+// merged into it as arrays, and whether the client expects no reply.
+func decodeOpMsg(b []byte) (bsonDoc, bool, error) {
+	if len(b) < 4 {
+		return nil, false, errors.New("invalid OP_MSG")
+	}
+	flags := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	if flags&1 != 0 { // checksumPresent
+		if len(b) < 4 {
+			return nil, false, errors.New("invalid OP_MSG checksum")
+		}
+		b = b[:len(b)-4]
+	}
+	var (
+		cmd       bsonDoc
+		sequences bsonDoc
+	)
+	for len(b) > 0 {
+		kind := b[0]
+		b = b[1:]
+		switch kind {
+		case 0:
+			doc, n, err := decodeBSON(b)
+			if err != nil {
+				return nil, false, err
+			}
+			cmd, b = doc, b[n:]
+		case 1:
+			if len(b) < 4 {
+				return nil, false, errors.New("invalid OP_MSG document sequence")
+			}
+			size := int(int32(binary.LittleEndian.Uint32(b)))
+			if size < 5 || size > len(b) {
+				return nil, false, errors.New("invalid OP_MSG document sequence")
+			}
+			seq := b[4:size]
+			b = b[size:]
+			i := bytes.IndexByte(seq, 0)
+			if i < 0 {
+				return nil, false, errors.New("invalid OP_MSG document sequence")
+			}
+			id, docs := string(seq[:i]), bsonArray{}
+			for seq = seq[i+1:]; len(seq) > 0; {
+				doc, n, err := decodeBSON(seq)
+				if err != nil {
+					return nil, false, err
+				}
+				docs, seq = append(docs, doc), seq[n:]
+			}
+			sequences = append(sequences, bsonElem{Key: id, Value: docs})
+		default:
+			return nil, false, fmt.Errorf("unsupported OP_MSG section kind %d", kind)
+		}
+	}
+	if cmd == nil {
+		return nil, false, errors.New("OP_MSG without a body section")
+	}
+	// keep the sequences ahead of $db and the session fields, where drivers
+	// not using sequences put them
+	if len(sequences) > 0 {
+		cmd = append(append(cmd[:1:1], sequences...), cmd[1:]...)
+	}
+	return cmd, flags&2 != 0, nil
+}
+
+func encodeOpMsg(responseTo int32, doc bsonDoc) []byte {
+	b := mongoHeader(responseTo, opMsg)
+	b = bsonInt32(b, 0) // flags
+	b = append(b, 0)    // body section
+	b = append(b, encodeBSON(doc)...)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// decodeOpQuery returns the command of a legacy OP_QUERY, which drivers still
+// use for the first handshake of a connection.
+func decodeOpQuery(b []byte) (bsonDoc, error) {
+	r := &bsonReader{buf: b}
+	r.int32() // flags
+	coll := r.cstring()
+	r.int32() // numberToSkip
+	r.int32() // numberToReturn
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !strings.HasSuffix(coll, ".$cmd") {
+		return nil, fmt.Errorf("unsupported OP_QUERY on %q", coll)
+	}
+	query := r.document()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if v, ok := query.lookup("$query"); ok {
+		if inner, ok := v.(bsonDoc); ok {
+			query = inner
+		}
+	}
+	return append(query, bsonElem{Key: "$db", Value: strings.TrimSuffix(coll, ".$cmd")}), nil
+}
+
+func encodeOpReply(responseTo int32, doc bsonDoc) []byte {
+	b := mongoHeader(responseTo, opReply)
+	b = bsonInt32(b, 0)  // responseFlags
+	b = bsonUint64(b, 0) // cursorID
+	b = bsonInt32(b, 0)  // startingFrom
+	b = bsonInt32(b, 1)  // numberReturned
+	b = append(b, encodeBSON(doc)...)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// mongoRequestID numbers the messages sent by the stand-in.
+var mongoRequestID int32
+
+func mongoHeader(responseTo int32, opCode int32) []byte {
+	b := make([]byte, 4, 64) // length, set once the message is complete
+	b = bsonInt32(b, atomic.AddInt32(&mongoRequestID, 1))
+	b = bsonInt32(b, responseTo)
+	return bsonInt32(b, opCode)
+}
@@ -0,0 +1,84 @@
+package keploy
+
+import "testing"
+
+const mongoStubs = `version: api.keploy.io/v1beta1
+kind: Mongo
+name: mongo-0
+spec:
+  database: keploy
+  command: insert
+  collection: urls
+  response: '{"n": {"$numberInt": "1"}, "ok": {"$numberDouble": "1.0"}}'
+---
+version: api.keploy.io/v1beta1
+kind: Mongo
+name: mongo-1
+spec:
+  database: keploy
+  command: find
+  collection: urls
+  request: '{"find": "urls", "filter": {"_id": "Lw8fMw"}, "$db": "keploy"}'
+  response: '{"cursor": {"firstBatch": [{"_id": "Lw8fMw"}], "id": {"$numberLong": "0"}, "ns": "keploy.urls"}, "ok": {"$numberDouble": "1.0"}}'
+---
+version: api.keploy.io/v1beta1
+kind: Mongo
+name: mongo-2
+spec:
+  database: keploy
+  command: insert
+  collection: users
+  request: '{"insert": "users", "documents": [{"_id": {"$oid": "65f0a1b2c3d4e5f6a7b8c9d0"}, "name": "ann"}], "ordered": true, "$db": "keploy"}'
+  response: '{"n": {"$numberInt": "1"}, "ok": {"$numberDouble": "1.0"}}'
+`
+
+func startMongo(t *testing.T) *MongoStandIn {
+	t.Helper()
+	s, err := StartMongoStandIn(writeStubs(t, "mongo", mongoStubs), "mongo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func mongoCommandDoc(t *testing.T, s string) bsonDoc {
+	t.Helper()
+	cmd, err := parseExtJSON(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestMongoLookupRejectsDifferentRequest(t *testing.T) {
+	s := startMongo(t)
+	if _, ok := s.lookup(mongoCommandDoc(t, `{"find": "urls", "filter": {"_id": "Lw8fMw"}, "lsid": {"id": "x"}, "$db": "keploy"}`)); !ok {
+		t.Fatal("the recorded find is not answered")
+	}
+	reply := s.handleCommand(mongoCommandDoc(t, `{"find": "urls", "filter": {"_id": "OTHER"}, "$db": "keploy"}`), 1)
+	if name, _ := reply.lookup("codeName"); name != "KeployMockNotFound" {
+		t.Fatalf("a find with another filter got %v, want KeployMockNotFound", reply)
+	}
+	// a mock without a request answers any command of its name and collection
+	for _, id := range []string{"a", "b"} {
+		if _, ok := s.lookup(mongoCommandDoc(t, `{"insert": "urls", "documents": [{"_id": "`+id+`"}], "$db": "keploy"}`)); !ok {
+			t.Fatalf("the insert of %s is not answered", id)
+		}
+	}
+}
+
+func TestMongoLookupIgnoresGeneratedIDs(t *testing.T) {
+	s := startMongo(t)
+	reply, ok := s.lookup(mongoCommandDoc(t, `{"insert": "users", "documents": [{"_id": {"$oid": "65f0a1b2c3d4e5f6a7b8c9ff"}, "name": "ann"}], "ordered": true, "lsid": {"id": "x"}, "$db": "keploy"}`))
+	if !ok {
+		t.Fatal("the insert with another generated _id is not answered")
+	}
+	if n, _ := reply.lookup("n"); n != int32(1) {
+		t.Fatalf("got %v, want the reply of mongo-2", reply)
+	}
+	reply = s.handleCommand(mongoCommandDoc(t, `{"insert": "users", "documents": [{"_id": {"$oid": "65f0a1b2c3d4e5f6a7b8c9ff"}, "name": "bob"}], "ordered": true, "$db": "keploy"}`), 1)
+	if name, _ := reply.lookup("codeName"); name != "KeployMockNotFound" {
+		t.Fatalf("an insert of another document got %v, want KeployMockNotFound", reply)
+	}
+}
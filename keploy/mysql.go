@@ -0,0 +1,1076 @@
+package keploy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// mysqlKind is the kind of the mocks served by the MySQL stand-in.
+const mysqlKind = "MySQL"
+
+// mysqlSpec is the spec of a MySQL mock. Values are kept in the MySQL text
+// format and a nil value is a SQL NULL. When Args is omitted the mock matches
+// the query with any args.
+type mysqlSpec struct {
+	Metadata     map[string]string `yaml:"metadata,omitempty"`
+	Query        string            `yaml:"query"`
+	Args         []*string         `yaml:"args,omitempty"`
+	Columns      []mysqlColumn     `yaml:"columns,omitempty"`
+	Rows         [][]*string       `yaml:"rows,omitempty"`
+	AffectedRows uint64            `yaml:"affected_rows,omitempty"`
+	LastInsertID uint64            `yaml:"last_insert_id,omitempty"`
+	Error        *mysqlError       `yaml:"error,omitempty"`
+}
+
+// mysqlColumn describes a column of a result set. Type is a MySQL type name
+// such as BIGINT, VARCHAR or DATETIME, optionally followed by UNSIGNED, and
+// defaults to VARCHAR.
+type mysqlColumn struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type,omitempty"`
+}
+
+// mysqlError is an ERR packet returned instead of a result.
+type mysqlError struct {
+	Code    uint16 `yaml:"code"`
+	State   string `yaml:"state,omitempty"`
+	Message string `yaml:"message"`
+}
+
+// mysql column types, see include/field_types.h in the MySQL sources
+const (
+	mysqlTypeDecimal    = 0x00
+	mysqlTypeTiny       = 0x01
+	mysqlTypeShort      = 0x02
+	mysqlTypeLong       = 0x03
+	mysqlTypeFloat      = 0x04
+	mysqlTypeDouble     = 0x05
+	mysqlTypeNull       = 0x06
+	mysqlTypeTimestamp  = 0x07
+	mysqlTypeLongLong   = 0x08
+	mysqlTypeInt24      = 0x09
+	mysqlTypeDate       = 0x0a
+	mysqlTypeTime       = 0x0b
+	mysqlTypeDateTime   = 0x0c
+	mysqlTypeYear       = 0x0d
+	mysqlTypeVarchar    = 0x0f
+	mysqlTypeBit        = 0x10
+	mysqlTypeJSON       = 0xf5
+	mysqlTypeNewDecimal = 0xf6
+	mysqlTypeBlob       = 0xfc
+	mysqlTypeVarString  = 0xfd
+	mysqlTypeString     = 0xfe
+)
+
+var mysqlTypes = map[string]byte{
+	"DECIMAL":   mysqlTypeNewDecimal,
+	"TINYINT":   mysqlTypeTiny,
+	"BOOL":      mysqlTypeTiny,
+	"BOOLEAN":   mysqlTypeTiny,
+	"SMALLINT":  mysqlTypeShort,
+	"MEDIUMINT": mysqlTypeInt24,
+	"INT":       mysqlTypeLong,
+	"INTEGER":   mysqlTypeLong,
+	"BIGINT":    mysqlTypeLongLong,
+	"FLOAT":     mysqlTypeFloat,
+	"DOUBLE":    mysqlTypeDouble,
+	"TIMESTAMP": mysqlTypeTimestamp,
+	"DATE":      mysqlTypeDate,
+	"TIME":      mysqlTypeTime,
+	"DATETIME":  mysqlTypeDateTime,
+	"YEAR":      mysqlTypeYear,
+	"BIT":       mysqlTypeBit,
+	"JSON":      mysqlTypeJSON,
+	"CHAR":      mysqlTypeString,
+	"BINARY":    mysqlTypeString,
+	"VARCHAR":   mysqlTypeVarString,
+	"VARBINARY": mysqlTypeVarString,
+	"TEXT":      mysqlTypeBlob,
+	"BLOB":      mysqlTypeBlob,
+}
+
+// column definition flags
+const (
+	mysqlFlagUnsigned = 0x0020
+	mysqlFlagBinary   = 0x0080
+)
+
+// capability flags of the stand-in
+const (
+	mysqlClientLongPassword   = 0x00000001
+	mysqlClientFoundRows      = 0x00000002
+	mysqlClientLongFlag       = 0x00000004
+	mysqlClientConnectWithDB  = 0x00000008
+	mysqlClientProtocol41     = 0x00000200
+	mysqlClientTransactions   = 0x00002000
+	mysqlClientSecureConn     = 0x00008000
+	mysqlClientMultiStmts     = 0x00010000
+	mysqlClientMultiResults   = 0x00020000
+	mysqlClientPluginAuth     = 0x00080000
+	mysqlClientConnectAttrs   = 0x00100000
+	mysqlClientPluginAuthData = 0x00200000
+
+	mysqlCapabilities = mysqlClientLongPassword | mysqlClientFoundRows | mysqlClientLongFlag |
+		mysqlClientConnectWithDB | mysqlClientProtocol41 | mysqlClientTransactions |
+		mysqlClientSecureConn | mysqlClientMultiStmts | mysqlClientMultiResults |
+		mysqlClientPluginAuth | mysqlClientConnectAttrs | mysqlClientPluginAuthData
+)
+
+// server status flags
+const (
+	mysqlStatusInTrans    = 0x0001
+	mysqlStatusAutocommit = 0x0002
+)
+
+// commands handled by the stand-in
+const (
+	mysqlComQuit        = 0x01
+	mysqlComInitDB      = 0x02
+	mysqlComQuery       = 0x03
+	mysqlComPing        = 0x0e
+	mysqlComStmtPrepare = 0x16
+	mysqlComStmtExecute = 0x17
+	mysqlComStmtClose   = 0x19
+	mysqlComStmtReset   = 0x1a
+	mysqlComSetOption   = 0x1b
+	mysqlComResetConn   = 0x1f
+)
+
+// MySQLStandIn is a localhost server speaking the MySQL client/server
+// protocol. It answers text queries and prepared statements from the MySQL
+// mocks of a stubs file, so code using go-sql-driver/mysql can be tested fully
+// offline.
+type MySQLStandIn struct {
+	*standIn
+	mocks   *mockSet
+	specs   map[*Mock]*mysqlSpec
+	inlined map[*Mock]*regexp.Regexp
+	connID  uint32
+}
+
+// StartMySQLStandIn loads the MySQL mocks of stubs/<name>.yaml under path and
+// starts serving them on a random localhost port.
+func StartMySQLStandIn(path, name string) (*MySQLStandIn, error) {
+	file, err := stubsFile(path, name)
+	if err != nil {
+		return nil, err
+	}
+	mocks, err := readMocks(file, mysqlKind)
+	if err != nil {
+		return nil, err
+	}
+	s := &MySQLStandIn{
+		mocks:   newMockSet(mocks),
+		specs:   map[*Mock]*mysqlSpec{},
+		inlined: map[*Mock]*regexp.Regexp{},
+	}
+	for _, m := range mocks {
+		spec := &mysqlSpec{}
+		if err := m.decode(spec); err != nil {
+			return nil, err
+		}
+		for _, col := range spec.Columns {
+			if _, _, err := mysqlColumnType(col); err != nil {
+				return nil, fmt.Errorf("invalid column in mysql mock %q %w", m.Name, err)
+			}
+		}
+		s.specs[m] = spec
+		if strings.Contains(spec.Query, "?") {
+			s.inlined[m] = mysqlInlinedQuery(spec.Query)
+		}
+	}
+	s.standIn, err = listenStandIn(s.serveConn)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// DSN returns a go-sql-driver/mysql data source name pointing at the stand-in.
+func (s *MySQLStandIn) DSN() string {
+	return fmt.Sprintf("keploy:keploy@tcp(%s)/keploy", s.Addr())
+}
+
+// lookup returns the mock recorded for the query. Args are only compared when
+// both the caller and the mock provide them.
+func (s *MySQLStandIn) lookup(query string, args []*string, use bool) (*mysqlSpec, *Mock, bool) {
+	session := activeSession()
+	matching := session.match
+	normalized := matching.normalizeQuery(query)
+	match := func(m *Mock) bool {
+		spec := s.specs[m]
+		return matching.normalizeQuery(spec.Query) == normalized && matching.matchArgs(spec.Args, args)
+	}
+	var (
+		m  *Mock
+		ok bool
+	)
+	if use {
+		if m, ok = s.mocks.find(match); ok {
+			var payload []byte
+			if args != nil {
+				payload, _ = json.Marshal(args)
+			}
+			session.called(m, query, string(payload))
+		}
+	} else {
+		m, ok = s.mocks.peek(match)
+	}
+	if !ok {
+		return nil, nil, false
+	}
+	return s.specs[m], m, true
+}
+
+// lookupText returns the mock recorded for a text query, which carries the
+// arguments inlined when the driver interpolates them client side.
+func (s *MySQLStandIn) lookupText(query string) (*mysqlSpec, *Mock, bool) {
+	session := activeSession()
+	matching := session.match
+	normalized := matching.normalizeQuery(query)
+	query = normalizeSQL(query)
+	m, ok := s.mocks.find(func(m *Mock) bool {
+		spec := s.specs[m]
+		if matching.normalizeQuery(spec.Query) == normalized {
+			return true
+		}
+		re, ok := s.inlined[m]
+		if !ok {
+			return false
+		}
+		args, ok := mysqlInlinedArgs(re, query)
+		return ok && matching.matchArgs(spec.Args, args)
+	})
+	if !ok {
+		return nil, nil, false
+	}
+	session.called(m, query, "")
+	return s.specs[m], m, true
+}
+
+// mysqlLiteral matches a literal interpolated for a ? placeholder.
+const mysqlLiteral = `((?:_binary)?'(?:[^'\\]|\\.|'')*'|-?[0-9][0-9.eE+-]*|NULL|null|TRUE|FALSE|true|false|0x[0-9a-fA-F]+)`
+
+// mysqlInlinedQuery builds a regexp matching query with its placeholders
+// replaced by literals.
+func mysqlInlinedQuery(query string) *regexp.Regexp {
+	parts := strings.Split(normalizeSQL(query), "?")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, mysqlLiteral) + "$")
+}
+
+// mysqlInlinedArgs extracts the placeholder values of query in the text
+// format.
+func mysqlInlinedArgs(re *regexp.Regexp, query string) ([]*string, bool) {
+	match := re.FindStringSubmatch(query)
+	if match == nil {
+		return nil, false
+	}
+	args := make([]*string, 0, len(match)-1)
+	for _, lit := range match[1:] {
+		var v string
+		switch {
+		case strings.EqualFold(lit, "null"):
+			args = append(args, nil)
+			continue
+		case strings.EqualFold(lit, "true"):
+			v = "1"
+		case strings.EqualFold(lit, "false"):
+			v = "0"
+		case strings.HasPrefix(lit, "0x"):
+			b := make([]byte, 0, len(lit)/2)
+			for i := 2; i+1 < len(lit); i += 2 {
+				n, _ := strconv.ParseUint(lit[i:i+2], 16, 8)
+				b = append(b, byte(n))
+			}
+			v = string(b)
+		case strings.HasSuffix(lit, "'"):
+			v = mysqlUnquote(lit[strings.IndexByte(lit, '\'')+1 : len(lit)-1])
+		default:
+			v = lit
+		}
+		args = append(args, &v)
+	}
+	return args, true
+}
+
+// mysqlUnquote reverses the escaping of a quoted string literal.
+func mysqlUnquote(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case '0':
+				b.WriteByte(0)
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 'Z':
+				b.WriteByte(0x1a)
+			default:
+				b.WriteByte(s[i])
+			}
+		case c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+			b.WriteByte('\'')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// mysqlColumnType returns the type and flags of a column.
+func mysqlColumnType(col mysqlColumn) (byte, uint16, error) {
+	fields := strings.Fields(strings.ToUpper(col.Type))
+	if len(fields) == 0 {
+		return mysqlTypeVarString, 0, nil
+	}
+	name := fields[0]
+	if i := strings.IndexByte(name, '('); i >= 0 {
+		name = name[:i]
+	}
+	typ, ok := mysqlTypes[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown mysql type %q", col.Type)
+	}
+	var flags uint16
+	for _, f := range fields[1:] {
+		if f == "UNSIGNED" {
+			flags |= mysqlFlagUnsigned
+		}
+	}
+	switch name {
+	case "BINARY", "VARBINARY", "BLOB":
+		flags |= mysqlFlagBinary
+	}
+	return typ, flags, nil
+}
+
+// mysqlStatement is a statement prepared with COM_STMT_PREPARE.
+type mysqlStatement struct {
+	query      string
+	params     int
+	paramTypes []uint16
+}
+
+// mysqlConn holds the state of a single client connection.
+type mysqlConn struct {
+	s          *MySQLStandIn
+	r          *bufio.Reader
+	conn       net.Conn
+	seq        byte
+	status     uint16
+	statements map[uint32]*mysqlStatement
+	nextStmt   uint32
+}
+
+func (s *MySQLStandIn) serveConn(conn net.Conn) {
+	c := &mysqlConn{
+		s:          s,
+		r:          bufio.NewReader(conn),
+		conn:       conn,
+		status:     mysqlStatusAutocommit,
+		statements: map[uint32]*mysqlStatement{},
+	}
+	if err := c.handshake(atomic.AddUint32(&s.connID, 1)); err != nil {
+		return
+	}
+	for {
+		c.seq = 0
+		pkt, err := c.readPacket()
+		if err != nil || len(pkt) == 0 {
+			return
+		}
+		if pkt[0] == mysqlComQuit {
+			return
+		}
+		if err := c.handle(pkt[0], pkt[1:]); err != nil {
+			return
+		}
+	}
+}
+
+// handshake sends the initial greeting and accepts any credentials.
+func (c *mysqlConn) handshake(connID uint32) error {
+	salt := make([]byte, 20)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	for i := range salt {
+		salt[i] = salt[i]%94 + 33 // printable and never zero
+	}
+	b := []byte{10}
+	b = append(append(b, "8.0.34-keploy"...), 0)
+	b = mysqlUint32(b, connID)
+	b = append(append(b, salt[:8]...), 0)
+	b = mysqlUint16(b, uint16(mysqlCapabilities&0xffff))
+	b = append(b, 255) // utf8mb4_0900_ai_ci
+	b = mysqlUint16(b, c.status)
+	b = mysqlUint16(b, uint16(mysqlCapabilities>>16))
+	b = append(b, byte(len(salt)+1))
+	b = append(b, make([]byte, 10)...)
+	b = append(append(b, salt[8:]...), 0)
+	b = append(append(b, "mysql_native_password"...), 0)
+	if err := c.writePacket(b); err != nil {
+		return err
+	}
+	if _, err := c.readPacket(); err != nil {
+		return err
+	}
+	return c.ok(0, 0)
+}
+
+func (c *mysqlConn) handle(cmd byte, body []byte) error {
+	switch cmd {
+	case mysqlComQuery:
+		return c.query(string(body))
+	case mysqlComInitDB, mysqlComPing, mysqlComResetConn:
+		return c.ok(0, 0)
+	case mysqlComStmtPrepare:
+		return c.prepare(string(body))
+	case mysqlComStmtExecute:
+		return c.execute(body)
+	case mysqlComStmtClose:
+		if len(body) >= 4 {
+			delete(c.statements, binary.LittleEndian.Uint32(body))
+		}
+		return nil
+	case mysqlComStmtReset:
+		return c.ok(0, 0)
+	case mysqlComSetOption:
+		return c.eof()
+	}
+	return c.error(&mysqlError{Code: 1047, State: "08S01", Message: fmt.Sprintf("keploy: unsupported command 0x%02x", cmd)})
+}
+
+func (c *mysqlConn) query(query string) error {
+	spec, m, ok := c.s.lookupText(query)
+	if !ok {
+		spec, ok = builtinMySQL(query)
+	}
+	if !ok {
+		return c.error(c.s.noMock(query, nil))
+	}
+	if replied, err := c.injectFault(m, spec.Query); replied || err != nil {
+		return err
+	}
+	return c.result(spec, false)
+}
+
+func (c *mysqlConn) prepare(query string) error {
+	spec, _, ok := c.s.lookup(query, nil, false)
+	if !ok {
+		if spec, ok = builtinMySQL(query); !ok {
+			return c.error(c.s.noMock(query, nil))
+		}
+	}
+	c.nextStmt++
+	stmt := &mysqlStatement{query: query, params: mysqlParamCount(query)}
+	c.statements[c.nextStmt] = stmt
+
+	b := []byte{0}
+	b = mysqlUint32(b, c.nextStmt)
+	b = mysqlUint16(b, uint16(len(spec.Columns)))
+	b = mysqlUint16(b, uint16(stmt.params))
+	b = append(b, 0)
+	b = mysqlUint16(b, 0) // warnings
+	if err := c.writePacket(b); err != nil {
+		return err
+	}
+	if stmt.params > 0 {
+		for i := 0; i < stmt.params; i++ {
+			if err := c.writePacket(mysqlColumnDef(mysqlColumn{Name: "?"}, mysqlTypeVarString, 0)); err != nil {
+				return err
+			}
+		}
+		if err := c.eof(); err != nil {
+			return err
+		}
+	}
+	if len(spec.Columns) > 0 {
+		for _, col := range spec.Columns {
+			typ, flags, _ := mysqlColumnType(col)
+			if err := c.writePacket(mysqlColumnDef(col, typ, flags)); err != nil {
+				return err
+			}
+		}
+		return c.eof()
+	}
+	return nil
+}
+
+func (c *mysqlConn) execute(body []byte) error {
+	if len(body) < 9 {
+		return errors.New("malformed COM_STMT_EXECUTE")
+	}
+	stmt, ok := c.statements[binary.LittleEndian.Uint32(body)]
+	if !ok {
+		return c.error(&mysqlError{Code: 1243, State: "HY000", Message: "unknown prepared statement handler"})
+	}
+	args, err := stmt.decodeArgs(body[9:])
+	if err != nil {
+		return c.error(&mysqlError{Code: 1210, State: "HY000", Message: err.Error()})
+	}
+	spec, m, ok := c.s.lookup(stmt.query, args, true)
+	if !ok {
+		spec, ok = builtinMySQL(stmt.query)
+	}
+	if !ok {
+		return c.error(c.s.noMock(stmt.query, args))
+	}
+	if replied, err := c.injectFault(m, spec.Query); replied || err != nil {
+		return err
+	}
+	return c.result(spec, true)
+}
+
+// injectFault waits for the latency of the mock, when it is replayed, and
+// injects its fault, if any, before its response. It reports whether the fault
+// replied in place of the mock, and returns errConnDropped when the connection
+// has to be dropped.
+func (c *mysqlConn) injectFault(m *Mock, query string) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	session := activeSession()
+	time.Sleep(session.latency.delay(m.Latency))
+	fault := session.fault(m, query)
+	if fault == nil {
+		return false, nil
+	}
+	if err := fault.injectConn(c.conn); err != nil {
+		return true, err
+	}
+	if fault.Error != "" {
+		return true, c.error(&mysqlError{Code: 1105, State: "HY000", Message: fault.Error})
+	}
+	return false, nil
+}
+
+// decodeArgs converts the parameters of a COM_STMT_EXECUTE to the text format.
+func (stmt *mysqlStatement) decodeArgs(b []byte) ([]*string, error) {
+	if stmt.params == 0 {
+		return []*string{}, nil
+	}
+	bitmapLen := (stmt.params + 7) / 8
+	if len(b) < bitmapLen+1 {
+		return nil, errors.New("malformed COM_STMT_EXECUTE")
+	}
+	nulls := b[:bitmapLen]
+	b = b[bitmapLen:]
+	if b[0] == 1 {
+		b = b[1:]
+		if len(b) < 2*stmt.params {
+			return nil, errors.New("malformed COM_STMT_EXECUTE")
+		}
+		stmt.paramTypes = make([]uint16, stmt.params)
+		for i := range stmt.paramTypes {
+			stmt.paramTypes[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+		b = b[2*stmt.params:]
+	} else {
+		b = b[1:]
+	}
+	if len(stmt.paramTypes) != stmt.params {
+		return nil, errors.New("parameter types were never sent")
+	}
+
+	args := make([]*string, stmt.params)
+	for i, typ := range stmt.paramTypes {
+		if nulls[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		v, n, err := mysqlDecodeBinary(byte(typ), typ&0x8000 != 0, b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		args[i] = &v
+	}
+	return args, nil
+}
+
+// result writes the result of a mock, as a text or a binary result set.
+func (c *mysqlConn) result(spec *mysqlSpec, binaryRows bool) error {
+	if spec.Error != nil {
+		return c.error(spec.Error)
+	}
+	if len(spec.Columns) == 0 {
+		c.trackTransaction(spec.Query)
+		return c.ok(spec.AffectedRows, spec.LastInsertID)
+	}
+
+	types := make([]byte, len(spec.Columns))
+	if err := c.writePacket(mysqlLenEnc(nil, uint64(len(spec.Columns)))); err != nil {
+		return err
+	}
+	for i, col := range spec.Columns {
+		typ, flags, _ := mysqlColumnType(col)
+		types[i] = typ
+		if err := c.writePacket(mysqlColumnDef(col, typ, flags)); err != nil {
+			return err
+		}
+	}
+	if err := c.eof(); err != nil {
+		return err
+	}
+	for _, row := range spec.Rows {
+		if len(row) != len(spec.Columns) {
+			return c.error(&mysqlError{Code: 1105, State: "HY000", Message: fmt.Sprintf("keploy: mock row has %d values for %d columns", len(row), len(spec.Columns))})
+		}
+		var (
+			b   []byte
+			err error
+		)
+		if binaryRows {
+			b, err = mysqlBinaryRow(types, row)
+		} else {
+			b = mysqlTextRow(row)
+		}
+		if err != nil {
+			return c.error(&mysqlError{Code: 1105, State: "HY000", Message: err.Error()})
+		}
+		if err := c.writePacket(b); err != nil {
+			return err
+		}
+	}
+	return c.eof()
+}
+
+// trackTransaction keeps the in transaction status flag up to date.
+func (c *mysqlConn) trackTransaction(query string) {
+	fields := strings.Fields(strings.ToUpper(normalizeSQL(query)))
+	if len(fields) == 0 {
+		return
+	}
+	switch fields[0] {
+	case "BEGIN", "START":
+		c.status |= mysqlStatusInTrans
+	case "COMMIT", "ROLLBACK":
+		c.status &^= mysqlStatusInTrans
+	}
+}
+
+func (c *mysqlConn) ok(affected, lastInsertID uint64) error {
+	b := mysqlLenEnc([]byte{0}, affected)
+	b = mysqlLenEnc(b, lastInsertID)
+	b = mysqlUint16(b, c.status)
+	b = mysqlUint16(b, 0) // warnings
+	return c.writePacket(b)
+}
+
+func (c *mysqlConn) eof() error {
+	b := mysqlUint16([]byte{0xfe}, 0)
+	return c.writePacket(mysqlUint16(b, c.status))
+}
+
+func (c *mysqlConn) error(e *mysqlError) error {
+	state := e.State
+	if len(state) != 5 {
+		state = "HY000"
+	}
+	b := mysqlUint16([]byte{0xff}, e.Code)
+	b = append(append(b, '#'), state...)
+	return c.writePacket(append(b, e.Message...))
+}
+
+func (c *mysqlConn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return nil, err
+		}
+		size := int(uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16)
+		c.seq = hdr[3] + 1
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(c.r, chunk); err != nil {
+			return nil, err
+		}
+		payload = append(payload, chunk...)
+		if size < 0xffffff {
+			return payload, nil
+		}
+	}
+}
+
+func (c *mysqlConn) writePacket(payload []byte) error {
+	for {
+		size := len(payload)
+		if size > 0xffffff {
+			size = 0xffffff
+		}
+		b := append([]byte{byte(size), byte(size >> 8), byte(size >> 16), c.seq}, payload[:size]...)
+		c.seq++
+		if _, err := c.conn.Write(b); err != nil {
+			return err
+		}
+		payload = payload[size:]
+		if size < 0xffffff {
+			return nil
+		}
+	}
+}
+
+// builtinMySQL answers the transaction and session statements which are
+// rarely worth recording, when the stubs file has no mock for them.
+func builtinMySQL(query string) (*mysqlSpec, bool) {
+	fields := strings.Fields(strings.ToUpper(normalizeSQL(query)))
+	if len(fields) == 0 {
+		return nil, false
+	}
+	switch fields[0] {
+	case "BEGIN", "START", "COMMIT", "ROLLBACK", "SAVEPOINT", "RELEASE", "SET", "USE":
+		return &mysqlSpec{Query: query}, true
+	}
+	return nil, false
+}
+
+// noMock returns the error of a query matching no recorded mock, reporting
+// the closest ones.
+func (s *MySQLStandIn) noMock(query string, args []*string) *mysqlError {
+	matching := activeSession().match
+	closest := s.mocks.closest(func(m *Mock) ([]mismatch, bool) {
+		spec := s.specs[m]
+		return matching.diffSQL(spec.Query, spec.Args, query, args), true
+	})
+	return &mysqlError{Code: 1105, State: "HY000", Message: fmt.Sprintf("keploy: no recorded mock matches query %q%s", normalizeSQL(query), closest)}
+}
+
+// mysqlParamCount counts the ? placeholders outside of quoted strings.
+func mysqlParamCount(query string) int {
+	count := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '?':
+			count++
+		}
+	}
+	return count
+}
+
+func mysqlColumnDef(col mysqlColumn, typ byte, flags uint16) []byte {
+	b := mysqlLenEncString(nil, "def")
+	b = mysqlLenEncString(b, "") // schema
+	b = mysqlLenEncString(b, "") // table
+	b = mysqlLenEncString(b, "") // org_table
+	b = mysqlLenEncString(b, col.Name)
+	b = mysqlLenEncString(b, col.Name)
+	b = append(b, 0x0c)
+	charset := uint16(255)
+	if flags&mysqlFlagBinary != 0 || (typ != mysqlTypeVarString && typ != mysqlTypeString && typ != mysqlTypeBlob && typ != mysqlTypeJSON && typ != mysqlTypeVarchar) {
+		charset = 63 // binary
+	}
+	b = mysqlUint16(b, charset)
+	b = mysqlUint32(b, 1024) // column length
+	b = append(b, typ)
+	b = mysqlUint16(b, flags)
+	b = append(b, 0)       // decimals
+	return append(b, 0, 0) // filler
+}
+
+func mysqlTextRow(row []*string) []byte {
+	var b []byte
+	for _, v := range row {
+		if v == nil {
+			b = append(b, 0xfb)
+			continue
+		}
+		b = mysqlLenEncString(b, *v)
+	}
+	return b
+}
+
+func mysqlBinaryRow(types []byte, row []*string) ([]byte, error) {
+	nulls := make([]byte, (len(row)+7+2)/8)
+	var values []byte
+	for i, v := range row {
+		if v == nil {
+			pos := i + 2
+			nulls[pos/8] |= 1 << (pos % 8)
+			continue
+		}
+		var err error
+		if values, err = mysqlEncodeBinary(values, types[i], *v); err != nil {
+			return nil, err
+		}
+	}
+	b := append([]byte{0}, nulls...)
+	return append(b, values...), nil
+}
+
+// mysqlTimeLayouts are the text formats of DATE, DATETIME and TIMESTAMP.
+var mysqlTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02",
+}
+
+// mysqlEncodeBinary appends the binary protocol form of the text value v.
+func mysqlEncodeBinary(b []byte, typ byte, v string) ([]byte, error) {
+	parseInt := func(bits int) (uint64, error) {
+		if n, err := strconv.ParseInt(v, 10, bits); err == nil {
+			return uint64(n), nil
+		}
+		return strconv.ParseUint(v, 10, bits)
+	}
+	switch typ {
+	case mysqlTypeTiny:
+		n, err := parseInt(8)
+		return append(b, byte(n)), err
+	case mysqlTypeShort, mysqlTypeYear:
+		n, err := parseInt(16)
+		return mysqlUint16(b, uint16(n)), err
+	case mysqlTypeLong, mysqlTypeInt24:
+		n, err := parseInt(32)
+		return mysqlUint32(b, uint32(n)), err
+	case mysqlTypeLongLong:
+		n, err := parseInt(64)
+		return mysqlUint64(b, n), err
+	case mysqlTypeFloat:
+		f, err := strconv.ParseFloat(v, 32)
+		return mysqlUint32(b, math.Float32bits(float32(f))), err
+	case mysqlTypeDouble:
+		f, err := strconv.ParseFloat(v, 64)
+		return mysqlUint64(b, math.Float64bits(f)), err
+	case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp:
+		var (
+			t   time.Time
+			err error
+		)
+		for _, layout := range mysqlTimeLayouts {
+			if t, err = time.Parse(layout, v); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("keploy: cannot parse %q as a datetime", v)
+		}
+		date := []byte{0, 0, byte(t.Month()), byte(t.Day())}
+		binary.LittleEndian.PutUint16(date, uint16(t.Year()))
+		if typ == mysqlTypeDate {
+			return append(append(b, 4), date...), nil
+		}
+		b = append(append(b, 11), date...)
+		b = append(b, byte(t.Hour()), byte(t.Minute()), byte(t.Second()))
+		return mysqlUint32(b, uint32(t.Nanosecond()/1000)), nil
+	case mysqlTypeTime:
+		neg := strings.HasPrefix(v, "-")
+		parts := strings.Split(strings.TrimPrefix(v, "-"), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("keploy: cannot parse %q as a time", v)
+		}
+		hours, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		minutes, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		secs, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return nil, err
+		}
+		sign := byte(0)
+		if neg {
+			sign = 1
+		}
+		b = append(b, 12, sign)
+		b = mysqlUint32(b, uint32(hours/24))
+		b = append(b, byte(hours%24), byte(minutes), byte(secs))
+		return mysqlUint32(b, uint32(math.Round((secs-math.Floor(secs))*1e6))), nil
+	}
+	return mysqlLenEncString(b, v), nil
+}
+
+// mysqlDecodeBinary decodes a binary protocol parameter to the text format
+// and returns the number of bytes it took.
+func mysqlDecodeBinary(typ byte, unsigned bool, b []byte) (string, int, error) {
+	short := errors.New("malformed parameter value")
+	need := func(n int) error {
+		if len(b) < n {
+			return short
+		}
+		return nil
+	}
+	signed := func(n int64, u uint64) string {
+		if unsigned {
+			return strconv.FormatUint(u, 10)
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	switch typ {
+	case mysqlTypeNull:
+		return "", 0, nil
+	case mysqlTypeTiny:
+		if err := need(1); err != nil {
+			return "", 0, err
+		}
+		return signed(int64(int8(b[0])), uint64(b[0])), 1, nil
+	case mysqlTypeShort, mysqlTypeYear:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		u := binary.LittleEndian.Uint16(b)
+		return signed(int64(int16(u)), uint64(u)), 2, nil
+	case mysqlTypeLong, mysqlTypeInt24:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		u := binary.LittleEndian.Uint32(b)
+		return signed(int64(int32(u)), uint64(u)), 4, nil
+	case mysqlTypeLongLong:
+		if err := need(8); err != nil {
+			return "", 0, err
+		}
+		u := binary.LittleEndian.Uint64(b)
+		return signed(int64(u), u), 8, nil
+	case mysqlTypeFloat:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		f := math.Float32frombits(binary.LittleEndian.Uint32(b))
+		return strconv.FormatFloat(float64(f), 'g', -1, 32), 4, nil
+	case mysqlTypeDouble:
+		if err := need(8); err != nil {
+			return "", 0, err
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(b))
+		return strconv.FormatFloat(f, 'g', -1, 64), 8, nil
+	case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp:
+		if err := need(1); err != nil {
+			return "", 0, err
+		}
+		n := int(b[0])
+		if err := need(1 + n); err != nil {
+			return "", 0, err
+		}
+		v := b[1 : 1+n]
+		var t time.Time
+		if n >= 4 {
+			t = time.Date(int(binary.LittleEndian.Uint16(v)), time.Month(v[2]), int(v[3]), 0, 0, 0, 0, time.UTC)
+		}
+		if n >= 7 {
+			t = t.Add(time.Duration(v[4])*time.Hour + time.Duration(v[5])*time.Minute + time.Duration(v[6])*time.Second)
+		}
+		if n >= 11 {
+			t = t.Add(time.Duration(binary.LittleEndian.Uint32(v[7:])) * time.Microsecond)
+		}
+		if typ == mysqlTypeDate {
+			return t.Format("2006-01-02"), 1 + n, nil
+		}
+		return t.Format("2006-01-02 15:04:05.999999"), 1 + n, nil
+	case mysqlTypeTime:
+		if err := need(1); err != nil {
+			return "", 0, err
+		}
+		n := int(b[0])
+		if err := need(1 + n); err != nil {
+			return "", 0, err
+		}
+		if n < 8 {
+			return "00:00:00", 1 + n, nil
+		}
+		v := b[1 : 1+n]
+		sign := ""
+		if v[0] == 1 {
+			sign = "-"
+		}
+		hours := int(binary.LittleEndian.Uint32(v[1:]))*24 + int(v[5])
+		s := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, v[6], v[7])
+		if n >= 12 {
+			if micros := binary.LittleEndian.Uint32(v[8:]); micros > 0 {
+				s += strings.TrimRight(fmt.Sprintf(".%06d", micros), "0")
+			}
+		}
+		return s, 1 + n, nil
+	}
+	size, n, ok := mysqlReadLenEnc(b)
+	if !ok || uint64(len(b)-n) < size {
+		return "", 0, short
+	}
+	return string(b[n : n+int(size)]), n + int(size), nil
+}
+
+func mysqlUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func mysqlUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func mysqlUint64(b []byte, v uint64) []byte {
+	return mysqlUint32(mysqlUint32(b, uint32(v)), uint32(v>>32))
+}
+
+func mysqlLenEnc(b []byte, v uint64) []byte {
+	switch {
+	case v < 251:
+		return append(b, byte(v))
+	case v < 1<<16:
+		return mysqlUint16(append(b, 0xfc), uint16(v))
+	case v < 1<<24:
+		return append(b, 0xfd, byte(v), byte(v>>8), byte(v>>16))
+	}
+	return mysqlUint64(append(b, 0xfe), v)
+}
+
+func mysqlLenEncString(b []byte, s string) []byte {
+	return append(mysqlLenEnc(b, uint64(len(s))), s...)
+}
+
+// mysqlReadLenEnc decodes a length encoded integer and returns the number of
+// bytes it took.
+func mysqlReadLenEnc(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	switch b[0] {
+	case 0xfc:
+		if len(b) < 3 {
+			return 0, 0, false
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:])), 3, true
+	case 0xfd:
+		if len(b) < 4 {
+			return 0, 0, false
+		}
+		return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, 4, true
+	case 0xfe:
+		if len(b) < 9 {
+			return 0, 0, false
+		}
+		return binary.LittleEndian.Uint64(b[1:]), 9, true
+	}
+	return uint64(b[0]), 1, true
+}
@@ -0,0 +1,78 @@
+package keploy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMySQLLenEnc(t *testing.T) {
+	for _, v := range []uint64{0, 250, 251, 1<<16 - 1, 1 << 16, 1<<24 - 1, 1 << 24, 1<<64 - 1} {
+		b := mysqlLenEnc(nil, v)
+		got, n, ok := mysqlReadLenEnc(append(b, 0xaa))
+		if !ok || got != v || n != len(b) {
+			t.Errorf("length encoded %d decoded as %d in %d bytes of %d", v, got, n, len(b))
+		}
+		if _, _, ok := mysqlReadLenEnc(b[:len(b)-1]); ok && len(b) > 1 {
+			t.Errorf("truncated length encoded %d was decoded", v)
+		}
+	}
+}
+
+func TestMySQLBinaryValues(t *testing.T) {
+	for _, tc := range []struct {
+		typ byte
+		v   string
+	}{
+		{mysqlTypeTiny, "-5"},
+		{mysqlTypeShort, "2023"},
+		{mysqlTypeLong, "-70000"},
+		{mysqlTypeLongLong, "9007199254740993"},
+		{mysqlTypeFloat, "1.5"},
+		{mysqlTypeDouble, "-0.125"},
+		{mysqlTypeDate, "2023-01-02"},
+		{mysqlTypeDateTime, "2023-01-02 03:04:05.25"},
+		{mysqlTypeTime, "-26:03:04.5"},
+		{mysqlTypeVarString, "héllo"},
+	} {
+		b, err := mysqlEncodeBinary(nil, tc.typ, tc.v)
+		if err != nil {
+			t.Errorf("encode %q: %v", tc.v, err)
+			continue
+		}
+		got, n, err := mysqlDecodeBinary(tc.typ, false, append(b, 0xaa))
+		if err != nil || got != tc.v || n != len(b) {
+			t.Errorf("type %#x: %q decoded as %q in %d bytes of %d %v", tc.typ, tc.v, got, n, len(b), err)
+		}
+		if len(b) > 1 {
+			if _, _, err := mysqlDecodeBinary(tc.typ, false, b[:len(b)-1]); err == nil {
+				t.Errorf("type %#x: truncated %q was decoded", tc.typ, tc.v)
+			}
+		}
+	}
+	if got, _, _ := mysqlDecodeBinary(mysqlTypeTiny, true, []byte{0xff}); got != "255" {
+		t.Errorf("unsigned tiny decoded as %s", got)
+	}
+}
+
+func TestMySQLInlinedArgs(t *testing.T) {
+	re := mysqlInlinedQuery("SELECT * FROM users WHERE name = ? AND id = ? AND note IS ? AND active = ? AND data = ?")
+	args, ok := mysqlInlinedArgs(re, `SELECT * FROM users WHERE name = 'o\'brien ''x''' AND id = -12 AND note IS NULL AND active = TRUE AND data = _binary'a\nb'`)
+	if !ok {
+		t.Fatal("the interpolated query is not matched")
+	}
+	var got []interface{}
+	for _, a := range args {
+		if a == nil {
+			got = append(got, nil)
+		} else {
+			got = append(got, *a)
+		}
+	}
+	want := []interface{}{"o'brien 'x'", "-12", nil, "1", "a\nb"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if _, ok := mysqlInlinedArgs(re, "SELECT * FROM users"); ok {
+		t.Fatal("another query is matched")
+	}
+}
@@ -0,0 +1,256 @@
+package keploy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Noise configures the fields of the mocks whose values differ on every run,
+// like timestamps, request ids and ETags. They are ignored when the requests
+// replayed in MODE_TEST by Transport, Func, the keploygen wrappers, the
+// commands and the WebSocket stand-in are matched with the recorded ones, and
+// when a recording is compared with the previous one.
+//
+// A mock can list its own noise fields as JSONPaths of its spec, the strings
+// holding JSON being followed like the decoded JSON:
+//
+//	kind: Http
+//	name: http-0
+//	noise:
+//	  - $.req.header.X-Request-Id
+//	  - $.req.body.sentAt
+//	spec:
+//	  ...
+//
+// In MODE_RECORD the noise fields of the mocks of the previous recording of
+// the stubs file are kept, and a mock whose spec only differs from its previous
+// recording in noise fields, and whose latency is within latencyJitter of the
+// previous one or differs from it by less than half, is written as it was, for
+// the stubs file not to change when it is recorded again.
+type Noise struct {
+	// Headers are the HTTP headers whose values are noise, like Date, ETag or
+	// X-Request-Id, in the requests and the responses.
+	Headers []string
+	// Paths are JSONPaths of the noise values of the JSON bodies, messages and
+	// payloads, and of the requests and responses of the Func mocks, like
+	// "$.requestId" or "$..updatedAt".
+	Paths []string
+	// Detect compares a recording with the previous recording of the stubs
+	// file, mock by mock, and adds the fields whose values differ to the noise
+	// fields of the mocks: recording twice a test making the same calls in the
+	// same order detects its noise.
+	Detect bool
+}
+
+// noiseValue replaces the values of the noise fields in the compared specs.
+const noiseValue = "keploy-noise"
+
+func compileNoise(conf Noise) (*redactor, error) {
+	if len(conf.Headers) == 0 && len(conf.Paths) == 0 {
+		return nil, nil
+	}
+	r := &redactor{constant: noiseValue, headers: map[string]string{}}
+	for _, h := range conf.Headers {
+		r.headers[strings.ToLower(h)] = "noise"
+	}
+	for i, path := range conf.Paths {
+		steps, err := parsePath(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid noise path %d %w", i, err)
+		}
+		r.paths = append(r.paths, pathRule{name: "noise", steps: steps})
+	}
+	return r, nil
+}
+
+// previousMocks returns the mocks of the previous recording of a stubs file
+// by name, or nil when there is none.
+func previousMocks(file string) map[string]*Mock {
+	mocks, err := readMocks(file, "")
+	if err != nil || len(mocks) == 0 {
+		return nil
+	}
+	out := make(map[string]*Mock, len(mocks))
+	for _, m := range mocks {
+		out[m.Name] = m
+	}
+	return out
+}
+
+// checkNoise checks the noise paths of the mocks.
+func checkNoise(mocks []*Mock) error {
+	for _, m := range mocks {
+		for _, path := range m.Noise {
+			if _, err := parsePath(path); err != nil {
+				return fmt.Errorf("invalid noise of %s mock %q %w", m.Kind, m.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// withoutNoise returns the spec n of a mock of kind as a decoded value, with
+// the configured noise fields and the ones listed in noise replaced by
+// noiseValue.
+func (s *session) withoutNoise(kind string, noise []string, n *yaml.Node) (interface{}, error) {
+	var v interface{}
+	if err := n.Decode(&v); err != nil {
+		return nil, err
+	}
+	if s.noise != nil {
+		var copied yaml.Node
+		if err := copied.Encode(v); err != nil {
+			return nil, err
+		}
+		s.noise.spec(kind, &copied)
+		if err := copied.Decode(&v); err != nil {
+			return nil, err
+		}
+	}
+	v = normalizeYAMLValue(v)
+	for _, path := range noise {
+		// the paths of the replayed mocks are checked when they are loaded
+		steps, err := parsePath(path)
+		if err != nil {
+			continue
+		}
+		v, _ = redactPath(v, steps, func(v interface{}) (interface{}, bool) {
+			return noiseValue, v != noiseValue
+		})
+	}
+	return v, nil
+}
+
+// normalizeNoise replaces the noise fields of v, a spec of the kind of m or a
+// part of it, with noiseValue, for its comparison with m to ignore them.
+func (s *session) normalizeNoise(m *Mock, v interface{}) error {
+	if s.noise == nil && len(m.Noise) == 0 {
+		return nil
+	}
+	var n yaml.Node
+	if err := n.Encode(v); err != nil {
+		return err
+	}
+	normalized, err := s.withoutNoise(m.Kind, m.Noise, &n)
+	if err != nil {
+		return err
+	}
+	if err := n.Encode(normalized); err != nil {
+		return err
+	}
+	out := reflect.New(reflect.TypeOf(v).Elem())
+	if err := n.Decode(out.Interface()); err != nil {
+		return err
+	}
+	reflect.ValueOf(v).Elem().Set(out.Elem())
+	return nil
+}
+
+// latencyJitter is the difference between the latencies of two recordings of a
+// mock which is always taken for jitter.
+const latencyJitter = 10 * time.Millisecond
+
+// markNoise compares a mock being recorded with its previous recording: the
+// mock keeps the noise fields of the previous one, adds the fields whose values
+// changed with Config.Noise.Detect, and keeps the previous spec when they only
+// differ in noise fields, and the previous latency when it is close.
+func (s *session) markNoise(m *Mock) {
+	prev, ok := s.previous[m.Name]
+	if !ok || prev.Kind != m.Kind {
+		return
+	}
+	m.Noise = append([]string{}, prev.Noise...)
+	before, err := s.withoutNoise(m.Kind, m.Noise, &prev.Spec)
+	if err != nil {
+		return
+	}
+	after, err := s.withoutNoise(m.Kind, m.Noise, &m.Spec)
+	if err != nil {
+		return
+	}
+	if s.detectNoise {
+		var changed []string
+		diffPaths("$", before, after, &changed)
+		m.Noise = append(m.Noise, changed...)
+	} else if !reflect.DeepEqual(before, after) {
+		return
+	}
+	m.Spec = prev.Spec
+	if sameLatency(prev.Latency, m.Latency) {
+		m.Latency = prev.Latency
+	}
+}
+
+// sameLatency reports whether the latencies a and b of two recordings of a
+// mock only differ by jitter.
+func sameLatency(a, b time.Duration) bool {
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	return d <= latencyJitter || 2*d < a || 2*d < b
+}
+
+// diffPaths appends the JSONPaths of the values which differ between a and b,
+// two decoded specs. The strings holding JSON are compared decoded.
+func diffPaths(path string, a, b interface{}, out *[]string) {
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok && sa != sb {
+			da, okA := decodeJSONDocument(sa)
+			db, okB := decodeJSONDocument(sb)
+			if okA && okB {
+				diffPaths(path, da, db, out)
+				return
+			}
+		}
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffPaths(path+pathKey(k), a[k], b[k], out)
+		}
+		return
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			break
+		}
+		for i := range a {
+			diffPaths(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], out)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*out = append(*out, path)
+	}
+}
+
+// pathKey returns the JSONPath step of a key.
+func pathKey(k string) string {
+	if k != "" && k != "*" && !strings.ContainsAny(k, ".[]'\"") {
+		return "." + k
+	}
+	if strings.Contains(k, "'") {
+		return `["` + k + `"]`
+	}
+	return "['" + k + "']"
+}
@@ -0,0 +1,188 @@
+package keploy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type noisyRequest struct {
+	ID     int    `json:"id"`
+	SentAt string `json:"sentAt"`
+}
+
+func TestNoiseDetection(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "stubs", "TestNoiseDetection.yaml")
+	run := 0
+	echo := Func("echo", func(_ context.Context, req noisyRequest) (noisyRequest, error) {
+		return req, nil
+	})
+	sentAt := []string{"2024-01-02T03:04:05Z", "2024-01-02T03:04:06Z", "2024-01-02T03:04:07Z"}
+	record := func(t *testing.T) []byte {
+		t.Helper()
+		startTestSession(t, MODE_RECORD, dir, Config{Noise: Noise{Detect: true}})
+		if _, err := echo(context.Background(), noisyRequest{ID: 1, SentAt: sentAt[run]}); err != nil {
+			t.Fatal(err)
+		}
+		run++
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	record(t)
+	second := record(t)
+	mocks, err := readMocks(file, funcKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mocks) != 1 {
+		t.Fatalf("recorded %d mocks", len(mocks))
+	}
+	if want := []string{"$.request.sentAt", "$.response.sentAt"}; !reflect.DeepEqual(mocks[0].Noise, want) {
+		t.Fatalf("recorded the noise %q, want %q", mocks[0].Noise, want)
+	}
+	// the spec is kept as it was recorded the first time
+	spec := &funcSpec{}
+	if err := mocks[0].decode(spec); err != nil {
+		t.Fatal(err)
+	}
+	if req := normalizeYAMLValue(spec.Request).(map[string]interface{}); req["sentAt"] != sentAt[0] {
+		t.Fatalf("recorded the request %v", req)
+	}
+	// the stubs file does not change when it is recorded again
+	if third := record(t); !bytes.Equal(third, second) {
+		t.Fatalf("recorded\n%s\nagain, was\n%s", third, second)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	if got, err := echo(context.Background(), noisyRequest{ID: 1, SentAt: "2030-01-01T00:00:00Z"}); err != nil || got.SentAt != sentAt[0] {
+		t.Fatalf("got %+v %v, want the recorded response", got, err)
+	}
+	if _, err := echo(context.Background(), noisyRequest{ID: 2, SentAt: sentAt[0]}); err == nil {
+		t.Fatal("the request with another id matched")
+	}
+}
+
+func TestSameLatency(t *testing.T) {
+	for _, tc := range []struct {
+		a, b time.Duration
+		same bool
+	}{
+		{0, 0, true},
+		{120 * time.Microsecond, 3 * time.Millisecond, true},
+		{100 * time.Millisecond, 140 * time.Millisecond, true},
+		{100 * time.Millisecond, 300 * time.Millisecond, false},
+		{0, 20 * time.Millisecond, false},
+	} {
+		if got := sameLatency(tc.a, tc.b); got != tc.same {
+			t.Errorf("sameLatency(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.same)
+		}
+	}
+}
+
+const noiseStubs = `version: api.keploy.io/v1beta1
+kind: Http
+name: create
+spec:
+    req:
+        method: POST
+        url: http://api.test/orders
+        header:
+            X-Request-Id: r1
+        body: '{"id":1,"sentAt":"2024-01-02T03:04:05Z"}'
+    resp:
+        status_code: 201
+        body: created
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: update
+noise:
+    - $.req.body.meta.etag
+spec:
+    req:
+        method: PUT
+        url: http://api.test/orders/1
+        body: '{"id":1,"meta":{"etag":"abc"}}'
+    resp:
+        status_code: 200
+        body: updated
+`
+
+func TestHTTPNoise(t *testing.T) {
+	dir := writeStubs(t, "TestHTTPNoise", noiseStubs)
+	c := &http.Client{Transport: &Transport{}}
+	startTestSession(t, MODE_TEST, dir, Config{
+		Matching: Matching{HTTP: []HTTPRule{{Headers: true, Body: BodyJSON}}},
+		Noise:    Noise{Headers: []string{"X-Request-Id"}, Paths: []string{"$.sentAt"}},
+	})
+	for _, tc := range []struct {
+		name, method, url, requestID, body string
+		want                               string // the replayed body, empty when nothing matches
+	}{
+		{"ConfiguredNoise", "POST", "http://api.test/orders", "r2", `{"id":1,"sentAt":"2030-01-01T00:00:00Z"}`, "created"},
+		{"OtherField", "POST", "http://api.test/orders", "r2", `{"id":2,"sentAt":"2024-01-02T03:04:05Z"}`, ""},
+		{"MockNoise", "PUT", "http://api.test/orders/1", "", `{"id":1,"meta":{"etag":"def"}}`, "updated"},
+		{"MockNoiseOtherField", "PUT", "http://api.test/orders/1", "", `{"id":2,"meta":{"etag":"abc"}}`, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := map[string]string{}
+			if tc.requestID != "" {
+				header["X-Request-Id"] = tc.requestID
+			}
+			_, body, err := send(t, c, tc.method, tc.url, header, tc.body)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("replayed %q, want no match", body)
+				}
+				return
+			}
+			if err != nil || body != tc.want {
+				t.Fatalf("got %q %v, want %q", body, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestInvalidNoise(t *testing.T) {
+	if _, err := compileNoise(Noise{Paths: []string{"sentAt"}}); err == nil {
+		t.Error("the noise path without $ is valid")
+	}
+	if err := checkNoise([]*Mock{{Kind: httpKind, Name: "m", Noise: []string{"$.a[x]"}}}); err == nil {
+		t.Error("the noise of the mock is valid")
+	}
+}
+
+func TestDiffPaths(t *testing.T) {
+	a := map[string]interface{}{
+		"id":   1,
+		"body": `{"at":"1","same":true}`,
+		"list": []interface{}{"x", "y"},
+		"a.b":  "1",
+		"it's": "1",
+		"gone": "1",
+	}
+	b := map[string]interface{}{
+		"id":   1,
+		"body": `{"at":"2","same":true}`,
+		"list": []interface{}{"x", "z"},
+		"a.b":  "2",
+		"it's": "2",
+		"new":  "1",
+	}
+	var got []string
+	diffPaths("$", a, b, &got)
+	want := []string{"$['a.b']", "$.body.at", "$.gone", `$["it's"]`, "$.list[1]", "$.new"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
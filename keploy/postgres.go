@@ -0,0 +1,1178 @@
+package keploy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// postgresKind is the kind of the mocks served by the Postgres stand-in.
+const postgresKind = "Postgres"
+
+// postgresSpec is the spec of a Postgres mock. Values are kept in the
+// Postgres text format so the stubs stay readable and editable; a nil value is
+// a SQL NULL. When Args is omitted the mock matches the query with any args.
+// When Tag is omitted the command tag is derived from the query and the number
+// of rows, like "INSERT 0 1" or "SELECT 2", which is only the affected row count
+// for queries returning the affected rows.
+type postgresSpec struct {
+	Metadata  map[string]string `yaml:"metadata,omitempty"`
+	Query     string            `yaml:"query"`
+	Args      []*string         `yaml:"args,omitempty"`
+	ParamOIDs []uint32          `yaml:"param_oids,omitempty"`
+	Columns   []postgresColumn  `yaml:"columns,omitempty"`
+	Rows      [][]*string       `yaml:"rows,omitempty"`
+	Tag       string            `yaml:"command_tag,omitempty"`
+	Error     *postgresError    `yaml:"error,omitempty"`
+}
+
+// postgresColumn describes a column of a result set. OID defaults to text.
+type postgresColumn struct {
+	Name string `yaml:"name"`
+	OID  uint32 `yaml:"oid,omitempty"`
+}
+
+// postgresError is an ErrorResponse returned instead of a result set.
+type postgresError struct {
+	Severity string `yaml:"severity,omitempty"`
+	Code     string `yaml:"code"`
+	Message  string `yaml:"message"`
+	Detail   string `yaml:"detail,omitempty"`
+}
+
+// the largest messages accepted by the stand-in: the startup limit of postgres
+// and a limit well above the queries and arguments of tests for the others
+const (
+	pgMaxStartupSize = 10000
+	pgMaxMessageSize = 48000000
+)
+
+// postgres type oids understood by the binary codec of the stand-in
+const (
+	oidBool        = 16
+	oidBytea       = 17
+	oidName        = 19
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidText        = 25
+	oidJSON        = 114
+	oidFloat4      = 700
+	oidFloat8      = 701
+	oidBPChar      = 1042
+	oidVarchar     = 1043
+	oidDate        = 1082
+	oidTimestamp   = 1114
+	oidTimestamptz = 1184
+	oidUUID        = 2950
+	oidJSONB       = 3802
+)
+
+// PostgresStandIn is a localhost server speaking the Postgres frontend/backend
+// protocol. It answers simple and extended queries from the Postgres mocks of
+// a stubs file, so code using pgx or any other driver directly can be tested
+// by pointing its DSN at the stand-in.
+type PostgresStandIn struct {
+	*standIn
+	mocks *mockSet
+	specs map[*Mock]*postgresSpec
+	// inlined matches the queries of the mocks with their arguments
+	// interpolated by the client, as drivers do for the simple protocol.
+	inlined map[*Mock]*regexp.Regexp
+
+	mu sync.Mutex
+	// conns are the connections by process id, the key of their cancel
+	// requests.
+	conns   map[int32]*pgConn
+	lastPID int32
+}
+
+// StartPostgresStandIn loads the Postgres mocks of stubs/<name>.yaml under
+// path and starts serving them on a random localhost port.
+func StartPostgresStandIn(path, name string) (*PostgresStandIn, error) {
+	file, err := stubsFile(path, name)
+	if err != nil {
+		return nil, err
+	}
+	mocks, err := readMocks(file, postgresKind)
+	if err != nil {
+		return nil, err
+	}
+	p := &PostgresStandIn{
+		mocks:   newMockSet(mocks),
+		specs:   map[*Mock]*postgresSpec{},
+		inlined: map[*Mock]*regexp.Regexp{},
+		conns:   map[int32]*pgConn{},
+	}
+	for _, m := range mocks {
+		spec := &postgresSpec{}
+		if err := m.decode(spec); err != nil {
+			return nil, err
+		}
+		p.specs[m] = spec
+		if spec.Tag == "" && spec.Error == nil && len(spec.Columns) == 0 && isPgDML(spec.Query) {
+			logger.Warn(fmt.Sprintf("keploy: postgres mock %q has no command_tag, reporting %q", m.Name, defaultCommandTag(spec)))
+		}
+		if pgParamCount(spec.Query) > 0 {
+			p.inlined[m] = inlinedQuery(spec.Query)
+		}
+	}
+	p.standIn, err = listenStandIn(p.serveConn)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DSN returns a connection string pointing at the stand-in.
+func (p *PostgresStandIn) DSN() string {
+	return fmt.Sprintf("postgres://keploy:keploy@%s/keploy?sslmode=disable", p.Addr())
+}
+
+// lookup returns the mock recorded for the query. Args are only compared when
+// both the caller and the mock provide them.
+func (p *PostgresStandIn) lookup(query string, args []*string, use bool) (*postgresSpec, *Mock, bool) {
+	session := activeSession()
+	matching := session.match
+	normalized := matching.normalizeQuery(query)
+	match := func(m *Mock) bool {
+		spec := p.specs[m]
+		return matching.normalizeQuery(spec.Query) == normalized && matching.matchArgs(spec.Args, args)
+	}
+	var (
+		m  *Mock
+		ok bool
+	)
+	if use {
+		if m, ok = p.mocks.find(match); ok {
+			var payload []byte
+			if args != nil {
+				payload, _ = json.Marshal(args)
+			}
+			session.called(m, query, string(payload))
+		}
+	} else {
+		m, ok = p.mocks.peek(match)
+	}
+	if !ok {
+		return nil, nil, false
+	}
+	return p.specs[m], m, true
+}
+
+// lookupSimple returns the mock recorded for a query sent with the simple
+// protocol, which may carry the arguments inlined by the client.
+func (p *PostgresStandIn) lookupSimple(query string) (*postgresSpec, *Mock, bool) {
+	session := activeSession()
+	matching := session.match
+	normalized := matching.normalizeQuery(query)
+	query = normalizeSQL(query)
+	m, ok := p.mocks.find(func(m *Mock) bool {
+		spec := p.specs[m]
+		if matching.normalizeQuery(spec.Query) == normalized {
+			return true
+		}
+		re, ok := p.inlined[m]
+		if !ok {
+			return false
+		}
+		args, ok := inlinedArgs(re, query)
+		return ok && matching.matchArgs(spec.Args, args)
+	})
+	if !ok {
+		return nil, nil, false
+	}
+	session.called(m, query, "")
+	return p.specs[m], m, true
+}
+
+// pgLiteral matches a literal interpolated for a $n placeholder.
+const pgLiteral = `\(?\s*('(?:[^']|'')*'|-?\s*[0-9][0-9.eE+-]*|NULL|null|true|false)\s*\)?(?:::[a-z ]+)?`
+
+var pgPlaceholder = regexp.MustCompile(`\$[0-9]+`)
+
+// inlinedQuery builds a regexp matching query with its placeholders replaced
+// by literals. The n-th group captures the literal of the n-th placeholder.
+func inlinedQuery(query string) *regexp.Regexp {
+	query = normalizeSQL(query)
+	var b strings.Builder
+	b.WriteString("^")
+	last, seen := 0, map[string]bool{}
+	for _, loc := range pgPlaceholder.FindAllStringIndex(query, -1) {
+		b.WriteString(regexp.QuoteMeta(query[last:loc[0]]))
+		if n := query[loc[0]+1 : loc[1]]; !seen[n] {
+			seen[n] = true
+			fmt.Fprintf(&b, "(?P<p%s>%s)", n, pgLiteral)
+		} else {
+			b.WriteString(pgLiteral)
+		}
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(query[last:]))
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// inlinedArgs extracts the placeholder values of query in the text format.
+func inlinedArgs(re *regexp.Regexp, query string) ([]*string, bool) {
+	match := re.FindStringSubmatch(query)
+	if match == nil {
+		return nil, false
+	}
+	var args []*string
+	for i, name := range re.SubexpNames() {
+		if !strings.HasPrefix(name, "p") {
+			continue
+		}
+		n, _ := strconv.Atoi(name[1:])
+		for len(args) < n {
+			args = append(args, nil)
+		}
+		lit := strings.TrimSpace(match[i])
+		lit = strings.TrimSuffix(strings.TrimPrefix(lit, "("), ")")
+		if j := strings.Index(lit, "::"); j >= 0 && !strings.HasPrefix(lit, "'") {
+			lit = lit[:j]
+		} else if strings.HasPrefix(lit, "'") {
+			lit = lit[:strings.LastIndex(lit, "'")+1]
+		}
+		lit = strings.TrimSpace(lit)
+		switch {
+		case strings.EqualFold(lit, "null"):
+			continue
+		case strings.HasPrefix(lit, "'"):
+			lit = strings.ReplaceAll(lit[1:len(lit)-1], "''", "'")
+		default:
+			lit = strings.ReplaceAll(lit, " ", "")
+		}
+		v := lit
+		args[n-1] = &v
+	}
+	return args, true
+}
+
+// normalizeSQL collapses whitespace and drops the trailing semicolon so that
+// formatting differences between the recording and the code do not matter.
+func normalizeSQL(query string) string {
+	return strings.TrimSuffix(strings.Join(strings.Fields(query), " "), ";")
+}
+
+func equalArgs(a, b []*string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if (a[i] == nil) != (b[i] == nil) {
+			return false
+		}
+		if a[i] != nil && *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pgStatement is a statement prepared with a Parse message.
+type pgStatement struct {
+	query     string
+	paramOIDs []uint32
+}
+
+// pgPortal is a statement bound to its arguments with a Bind message.
+type pgPortal struct {
+	stmt    *pgStatement
+	args    []*string
+	formats []int16
+}
+
+// pgConn holds the state of a single client connection.
+type pgConn struct {
+	p          *PostgresStandIn
+	r          *bufio.Reader
+	conn       net.Conn
+	out        []byte
+	statements map[string]*pgStatement
+	portals    map[string]*pgPortal
+	txStatus   byte
+	// failed is set when an extended query errored; messages are then
+	// discarded until the next Sync.
+	failed bool
+	pid    int32
+	// canceled receives the cancel requests of the connection.
+	canceled chan struct{}
+}
+
+func (p *PostgresStandIn) serveConn(conn net.Conn) {
+	c := &pgConn{
+		p:          p,
+		r:          bufio.NewReader(conn),
+		conn:       conn,
+		statements: map[string]*pgStatement{},
+		portals:    map[string]*pgPortal{},
+		txStatus:   'I',
+		canceled:   make(chan struct{}, 1),
+	}
+	p.mu.Lock()
+	p.lastPID++
+	c.pid = p.lastPID
+	p.conns[c.pid] = c
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, c.pid)
+		p.mu.Unlock()
+	}()
+
+	if err := c.startup(); err != nil {
+		return
+	}
+	for {
+		typ, body, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		if typ == 'X' {
+			return
+		}
+		if err := c.handle(typ, body); err != nil {
+			return
+		}
+	}
+}
+
+// startup negotiates the connection: SSL and GSS encryption are refused and
+// any credentials are accepted.
+func (c *pgConn) startup() error {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return err
+		}
+		size := int(binary.BigEndian.Uint32(hdr[:4]))
+		code := binary.BigEndian.Uint32(hdr[4:])
+		if size < 8 || size > pgMaxStartupSize {
+			return errors.New("invalid startup message")
+		}
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			return err
+		}
+		switch code {
+		case 80877103, 80877104: // SSLRequest, GSSENCRequest
+			if _, err := c.conn.Write([]byte{'N'}); err != nil {
+				return err
+			}
+		case 80877102: // CancelRequest
+			if len(body) >= 8 {
+				c.p.cancel(int32(binary.BigEndian.Uint32(body)))
+			}
+			return errors.New("cancel request")
+		case 196608: // protocol 3.0
+			c.message('R', pgInt32(nil, 0))
+			for _, kv := range [][2]string{
+				{"server_version", "14.0"},
+				{"server_encoding", "UTF8"},
+				{"client_encoding", "UTF8"},
+				{"DateStyle", "ISO, MDY"},
+				{"TimeZone", "UTC"},
+				{"integer_datetimes", "on"},
+				{"standard_conforming_strings", "on"},
+			} {
+				c.message('S', pgString(pgString(nil, kv[0]), kv[1]))
+			}
+			c.message('K', pgInt32(pgInt32(nil, c.pid), c.pid))
+			c.readyForQuery()
+			return c.flush()
+		default:
+			return fmt.Errorf("unsupported protocol version %d", code)
+		}
+	}
+}
+
+// cancel interrupts the query of the connection with the given process id
+// left without response by a Timeout fault.
+func (p *PostgresStandIn) cancel(pid int32) {
+	p.mu.Lock()
+	c, ok := p.conns[pid]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case c.canceled <- struct{}{}:
+	default:
+	}
+}
+
+func (c *pgConn) readMessage() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint32(hdr[1:]))
+	if size < 4 || size > pgMaxMessageSize {
+		return 0, nil, errors.New("invalid message length")
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
+
+func (c *pgConn) handle(typ byte, body []byte) error {
+	if c.failed && typ != 'S' {
+		return nil
+	}
+	r := &pgReader{buf: body}
+	switch typ {
+	case 'Q':
+		if err := c.simpleQuery(r.string()); err != nil {
+			return err
+		}
+		c.readyForQuery()
+		return c.flush()
+	case 'P':
+		name, query := r.string(), r.string()
+		oids := make([]uint32, r.count(4))
+		for i := range oids {
+			oids[i] = uint32(r.int32())
+		}
+		if r.err != nil {
+			return c.malformed(r.err)
+		}
+		c.parse(name, query, oids)
+	case 'B':
+		if err := c.bind(r); err != nil {
+			return err
+		}
+	case 'D':
+		kind, name := r.byte(), r.string()
+		if r.err != nil {
+			return c.malformed(r.err)
+		}
+		c.describe(kind, name)
+	case 'E':
+		name := r.string()
+		if r.err != nil {
+			return c.malformed(r.err)
+		}
+		return c.execute(name)
+	case 'C':
+		kind, name := r.byte(), r.string()
+		if kind == 'S' {
+			delete(c.statements, name)
+		} else {
+			delete(c.portals, name)
+		}
+		c.message('3', nil)
+	case 'S':
+		c.failed = false
+		delete(c.portals, "")
+		c.readyForQuery()
+		return c.flush()
+	case 'H':
+		return c.flush()
+	default:
+		c.error(&postgresError{Code: "08P01", Message: fmt.Sprintf("keploy: unsupported message type %q", typ)})
+		return c.flush()
+	}
+	return nil
+}
+
+// simpleQuery answers a query of the simple protocol. It only fails when the
+// connection is dropped by a fault.
+func (c *pgConn) simpleQuery(query string) error {
+	if strings.TrimSpace(query) == "" {
+		c.message('I', nil)
+		return nil
+	}
+	spec, m, ok := c.p.lookupSimple(query)
+	if !ok {
+		spec, ok = builtinPostgres(query)
+	}
+	if !ok {
+		c.error(c.p.noMock(query, nil))
+		return nil
+	}
+	if replied, err := c.injectFault(m, spec.Query); replied || err != nil {
+		return err
+	}
+	if spec.Error != nil {
+		c.error(spec.Error)
+		return nil
+	}
+	if len(spec.Columns) > 0 {
+		c.rowDescription(spec.Columns, nil)
+	}
+	if err := c.dataRows(spec, nil); err != nil {
+		c.error(&postgresError{Code: "XX000", Message: err.Error()})
+		return nil
+	}
+	c.commandComplete(spec)
+	return nil
+}
+
+func (c *pgConn) parse(name, query string, oids []uint32) {
+	stmt := &pgStatement{query: query, paramOIDs: oids}
+	if spec, _, ok := c.p.lookup(query, nil, false); ok {
+		n := pgParamCount(query)
+		if len(oids) < n {
+			stmt.paramOIDs = make([]uint32, n)
+			copy(stmt.paramOIDs, oids)
+		}
+		for i, oid := range spec.ParamOIDs {
+			if i < len(stmt.paramOIDs) && stmt.paramOIDs[i] == 0 {
+				stmt.paramOIDs[i] = oid
+			}
+		}
+	} else if _, ok := builtinPostgres(query); !ok {
+		c.error(c.p.noMock(query, nil))
+		return
+	}
+	c.statements[name] = stmt
+	c.message('1', nil)
+}
+
+func (c *pgConn) bind(r *pgReader) error {
+	portal, name := r.string(), r.string()
+	paramFormats := make([]int16, r.count(2))
+	for i := range paramFormats {
+		paramFormats[i] = r.int16()
+	}
+	raw := make([][]byte, r.count(4))
+	for i := range raw {
+		size := r.int32()
+		if size >= 0 {
+			raw[i] = r.bytes(int(size))
+		}
+	}
+	formats := make([]int16, r.count(2))
+	for i := range formats {
+		formats[i] = r.int16()
+	}
+	if r.err != nil {
+		return c.malformed(r.err)
+	}
+
+	stmt, ok := c.statements[name]
+	if !ok {
+		c.error(&postgresError{Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", name)})
+		return nil
+	}
+	args := make([]*string, len(raw))
+	for i, b := range raw {
+		if b == nil {
+			continue
+		}
+		format := int16(0)
+		if len(paramFormats) == 1 {
+			format = paramFormats[0]
+		} else if i < len(paramFormats) {
+			format = paramFormats[i]
+		}
+		v := string(b)
+		if format == 1 {
+			var oid uint32
+			if i < len(stmt.paramOIDs) {
+				oid = stmt.paramOIDs[i]
+			}
+			var err error
+			if v, err = pgDecodeBinary(oid, b); err != nil {
+				c.error(&postgresError{Code: "22P03", Message: err.Error()})
+				return nil
+			}
+		}
+		args[i] = &v
+	}
+	c.portals[portal] = &pgPortal{stmt: stmt, args: args, formats: formats}
+	c.message('2', nil)
+	return nil
+}
+
+func (c *pgConn) describe(kind byte, name string) {
+	if kind == 'S' {
+		stmt, ok := c.statements[name]
+		if !ok {
+			c.error(&postgresError{Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", name)})
+			return
+		}
+		desc := pgInt16(nil, int16(len(stmt.paramOIDs)))
+		for _, oid := range stmt.paramOIDs {
+			desc = pgInt32(desc, int32(oid))
+		}
+		c.message('t', desc)
+		spec, _, ok := c.p.lookup(stmt.query, nil, false)
+		if !ok {
+			spec, _ = builtinPostgres(stmt.query)
+		}
+		if spec == nil || len(spec.Columns) == 0 {
+			c.message('n', nil)
+			return
+		}
+		c.rowDescription(spec.Columns, nil)
+		return
+	}
+
+	portal, ok := c.portals[name]
+	if !ok {
+		c.error(&postgresError{Code: "34000", Message: fmt.Sprintf("portal %q does not exist", name)})
+		return
+	}
+	spec, _, ok := c.p.lookup(portal.stmt.query, portal.args, false)
+	if !ok {
+		spec, _ = builtinPostgres(portal.stmt.query)
+	}
+	if spec == nil || len(spec.Columns) == 0 {
+		c.message('n', nil)
+		return
+	}
+	c.rowDescription(spec.Columns, portal.formats)
+}
+
+// execute runs a portal. It only fails when the connection is dropped by a
+// fault.
+func (c *pgConn) execute(name string) error {
+	portal, ok := c.portals[name]
+	if !ok {
+		c.error(&postgresError{Code: "34000", Message: fmt.Sprintf("portal %q does not exist", name)})
+		return nil
+	}
+	spec, m, ok := c.p.lookup(portal.stmt.query, portal.args, true)
+	if !ok {
+		spec, ok = builtinPostgres(portal.stmt.query)
+	}
+	if !ok {
+		c.error(c.p.noMock(portal.stmt.query, portal.args))
+		return nil
+	}
+	if replied, err := c.injectFault(m, spec.Query); replied || err != nil {
+		return err
+	}
+	if spec.Error != nil {
+		c.error(spec.Error)
+		return nil
+	}
+	if err := c.dataRows(spec, portal.formats); err != nil {
+		c.error(&postgresError{Code: "XX000", Message: err.Error()})
+		return nil
+	}
+	c.commandComplete(spec)
+	return nil
+}
+
+// injectFault waits for the latency of the mock, when it is replayed, and
+// injects its fault, if any, before its response. It reports whether the fault
+// replied in place of the mock, and returns errConnDropped when the connection
+// has to be dropped.
+func (c *pgConn) injectFault(m *Mock, query string) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	session := activeSession()
+	time.Sleep(session.latency.delay(m.Latency))
+	fault := session.fault(m, query)
+	if fault == nil {
+		return false, nil
+	}
+	if fault.Timeout {
+		time.Sleep(fault.Latency)
+		if !c.hang() {
+			return true, errConnDropped
+		}
+		c.error(&postgresError{Code: "57014", Message: "canceling statement due to user request"})
+		return true, nil
+	}
+	if err := fault.injectConn(c.conn); err != nil {
+		return true, err
+	}
+	if fault.Error != "" {
+		c.error(&postgresError{Code: "XX000", Message: fault.Error})
+		return true, nil
+	}
+	return false, nil
+}
+
+// hang leaves the query without response until the client cancels it, as
+// drivers do when their context is done, or closes the connection. It reports
+// whether the query was canceled.
+func (c *pgConn) hang() bool {
+	select {
+	case <-c.canceled: // a cancel request received before the query
+	default:
+	}
+	// the messages sent in the meantime are peeked to notice the closing of
+	// the connection, and left to the next reads
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for n := c.r.Buffered() + 1; ; n++ {
+			if _, err := c.r.Peek(n); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-closed:
+		return false
+	case <-c.canceled:
+		_ = c.conn.SetReadDeadline(time.Now())
+		<-closed
+		return c.conn.SetReadDeadline(time.Time{}) == nil
+	}
+}
+
+func (c *pgConn) rowDescription(cols []postgresColumn, formats []int16) {
+	desc := pgInt16(nil, int16(len(cols)))
+	for i, col := range cols {
+		desc = pgString(desc, col.Name)
+		desc = pgInt32(desc, 0) // table oid
+		desc = pgInt16(desc, 0) // attribute number
+		desc = pgInt32(desc, int32(columnOID(col)))
+		desc = pgInt16(desc, -1) // type size
+		desc = pgInt32(desc, -1) // type modifier
+		desc = pgInt16(desc, resultFormat(formats, i))
+	}
+	c.message('T', desc)
+}
+
+func (c *pgConn) dataRows(spec *postgresSpec, formats []int16) error {
+	for _, row := range spec.Rows {
+		if len(row) != len(spec.Columns) {
+			return fmt.Errorf("keploy: mock row has %d values for %d columns", len(row), len(spec.Columns))
+		}
+		data := pgInt16(nil, int16(len(row)))
+		for i, v := range row {
+			if v == nil {
+				data = pgInt32(data, -1)
+				continue
+			}
+			b := []byte(*v)
+			if resultFormat(formats, i) == 1 {
+				var err error
+				if b, err = pgEncodeBinary(columnOID(spec.Columns[i]), *v); err != nil {
+					return err
+				}
+			}
+			data = pgInt32(data, int32(len(b)))
+			data = append(data, b...)
+		}
+		c.message('D', data)
+	}
+	return nil
+}
+
+func (c *pgConn) commandComplete(spec *postgresSpec) {
+	tag := spec.Tag
+	if tag == "" {
+		tag = defaultCommandTag(spec)
+	}
+	command := ""
+	if fields := strings.Fields(tag); len(fields) > 0 {
+		command = strings.ToUpper(fields[0])
+	}
+	switch command {
+	case "BEGIN", "START":
+		c.txStatus = 'T'
+	case "COMMIT", "ROLLBACK", "END":
+		c.txStatus = 'I'
+	}
+	c.message('C', pgString(nil, tag))
+}
+
+// isPgDML reports whether query is an INSERT, UPDATE, DELETE or MERGE, whose
+// command tag reports the number of affected rows.
+func isPgDML(query string) bool {
+	if fields := strings.Fields(query); len(fields) > 0 {
+		switch strings.ToUpper(fields[0]) {
+		case "INSERT", "UPDATE", "DELETE", "MERGE":
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCommandTag returns the command tag of a mock recorded without one.
+// The commands reporting a row count get the number of returned rows, the
+// only one known to the mock.
+func defaultCommandTag(spec *postgresSpec) string {
+	command := ""
+	if fields := strings.Fields(spec.Query); len(fields) > 0 {
+		command = strings.ToUpper(fields[0])
+	}
+	switch command {
+	case "INSERT":
+		// the oid of the inserted row is always 0 since postgres 12
+		return fmt.Sprintf("INSERT 0 %d", len(spec.Rows))
+	case "UPDATE", "DELETE", "MERGE", "SELECT", "MOVE", "FETCH", "COPY":
+		return fmt.Sprintf("%s %d", command, len(spec.Rows))
+	}
+	if len(spec.Columns) > 0 {
+		return fmt.Sprintf("SELECT %d", len(spec.Rows))
+	}
+	return command
+}
+
+// malformed answers a malformed message with a fatal protocol violation, the
+// connection being closed after it like postgres does.
+func (c *pgConn) malformed(err error) error {
+	c.error(&postgresError{Severity: "FATAL", Code: "08P01", Message: "keploy: " + err.Error()})
+	if ferr := c.flush(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+func (c *pgConn) error(e *postgresError) {
+	severity := e.Severity
+	if severity == "" {
+		severity = "ERROR"
+	}
+	body := append([]byte{'S'}, pgString(nil, severity)...)
+	body = append(body, 'V')
+	body = pgString(body, severity)
+	body = append(body, 'C')
+	body = pgString(body, e.Code)
+	body = append(body, 'M')
+	body = pgString(body, e.Message)
+	if e.Detail != "" {
+		body = append(body, 'D')
+		body = pgString(body, e.Detail)
+	}
+	body = append(body, 0)
+	c.message('E', body)
+	c.failed = true
+	if c.txStatus == 'T' {
+		c.txStatus = 'E'
+	}
+}
+
+func (c *pgConn) readyForQuery() {
+	c.failed = false
+	c.message('Z', []byte{c.txStatus})
+}
+
+func (c *pgConn) message(typ byte, body []byte) {
+	c.out = append(c.out, typ)
+	c.out = pgInt32(c.out, int32(len(body)+4))
+	c.out = append(c.out, body...)
+}
+
+func (c *pgConn) flush() error {
+	_, err := c.conn.Write(c.out)
+	c.out = c.out[:0]
+	return err
+}
+
+// builtinPostgres answers the transaction and session statements which are
+// rarely worth recording, when the stubs file has no mock for them.
+func builtinPostgres(query string) (*postgresSpec, bool) {
+	fields := strings.Fields(strings.ToUpper(normalizeSQL(query)))
+	if len(fields) == 0 {
+		return nil, false
+	}
+	switch fields[0] {
+	case "BEGIN", "COMMIT", "ROLLBACK", "END", "SAVEPOINT", "RELEASE", "SET", "DISCARD", "DEALLOCATE":
+		return &postgresSpec{Query: query, Tag: fields[0]}, true
+	case "START":
+		return &postgresSpec{Query: query, Tag: "START TRANSACTION"}, true
+	}
+	return nil, false
+}
+
+// noMock returns the error of a query matching no recorded mock, reporting
+// the closest ones.
+func (p *PostgresStandIn) noMock(query string, args []*string) *postgresError {
+	matching := activeSession().match
+	closest := p.mocks.closest(func(m *Mock) ([]mismatch, bool) {
+		spec := p.specs[m]
+		return matching.diffSQL(spec.Query, spec.Args, query, args), true
+	})
+	return &postgresError{Code: "XX000", Message: fmt.Sprintf("keploy: no recorded mock matches query %q%s", normalizeSQL(query), closest)}
+}
+
+func columnOID(col postgresColumn) uint32 {
+	if col.OID == 0 {
+		return oidText
+	}
+	return col.OID
+}
+
+func resultFormat(formats []int16, i int) int16 {
+	switch {
+	case len(formats) == 1:
+		return formats[0]
+	case i < len(formats):
+		return formats[i]
+	}
+	return 0
+}
+
+// pgParamCount returns the highest $n placeholder used in the query.
+func pgParamCount(query string) int {
+	count := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '$' {
+			continue
+		}
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		if n, err := strconv.Atoi(query[i+1 : j]); err == nil && n > count {
+			count = n
+		}
+	}
+	return count
+}
+
+// postgresEpoch is the origin of the binary date and timestamp formats.
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var postgresTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07:00:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+	"2006-01-02",
+}
+
+func parsePostgresTime(v string) (time.Time, error) {
+	for _, layout := range postgresTimeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("keploy: cannot parse %q as a timestamp", v)
+}
+
+// pgEncodeBinary converts a value from the text to the binary format of oid.
+func pgEncodeBinary(oid uint32, v string) ([]byte, error) {
+	switch oid {
+	case oidText, oidVarchar, oidName, oidBPChar, oidJSON:
+		return []byte(v), nil
+	case oidJSONB:
+		return append([]byte{1}, v...), nil
+	case oidBool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case oidInt2:
+		n, err := strconv.ParseInt(v, 10, 16)
+		return pgInt16(nil, int16(n)), err
+	case oidInt4:
+		n, err := strconv.ParseInt(v, 10, 32)
+		return pgInt32(nil, int32(n)), err
+	case oidInt8:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return pgInt64(nil, uint64(n)), err
+	case oidFloat4:
+		f, err := strconv.ParseFloat(v, 32)
+		return pgInt32(nil, int32(math.Float32bits(float32(f)))), err
+	case oidFloat8:
+		f, err := strconv.ParseFloat(v, 64)
+		return pgInt64(nil, math.Float64bits(f)), err
+	case oidBytea:
+		return hex.DecodeString(strings.TrimPrefix(v, `\x`))
+	case oidUUID:
+		return hex.DecodeString(strings.ReplaceAll(v, "-", ""))
+	case oidDate:
+		t, err := parsePostgresTime(v)
+		if err != nil {
+			return nil, err
+		}
+		return pgInt32(nil, int32(t.Sub(postgresEpoch)/(24*time.Hour))), nil
+	case oidTimestamp, oidTimestamptz:
+		t, err := parsePostgresTime(v)
+		if err != nil {
+			return nil, err
+		}
+		return pgInt64(nil, uint64(t.Sub(postgresEpoch).Microseconds())), nil
+	}
+	return nil, fmt.Errorf("keploy: binary format of type oid %d is not supported", oid)
+}
+
+// pgDecodeBinary converts a value from the binary to the text format of oid.
+func pgDecodeBinary(oid uint32, b []byte) (string, error) {
+	size := func(n int) error {
+		if len(b) != n {
+			return fmt.Errorf("keploy: invalid binary value of %d bytes for type oid %d", len(b), oid)
+		}
+		return nil
+	}
+	switch oid {
+	case oidText, oidVarchar, oidName, oidBPChar, oidJSON, 0:
+		return string(b), nil
+	case oidJSONB:
+		if len(b) == 0 {
+			return "", size(1)
+		}
+		return string(b[1:]), nil
+	case oidBool:
+		if err := size(1); err != nil {
+			return "", err
+		}
+		if b[0] != 0 {
+			return "true", nil
+		}
+		return "false", nil
+	case oidInt2:
+		if err := size(2); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.BigEndian.Uint16(b)))), nil
+	case oidInt4:
+		if err := size(4); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.BigEndian.Uint32(b)))), nil
+	case oidInt8:
+		if err := size(8); err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(b)), 10), nil
+	case oidFloat4:
+		if err := size(4); err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(b))), 'g', -1, 32), nil
+	case oidFloat8:
+		if err := size(8); err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(b)), 'g', -1, 64), nil
+	case oidBytea:
+		return `\x` + hex.EncodeToString(b), nil
+	case oidUUID:
+		if err := size(16); err != nil {
+			return "", err
+		}
+		h := hex.EncodeToString(b)
+		return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+	case oidDate:
+		if err := size(4); err != nil {
+			return "", err
+		}
+		days := int(int32(binary.BigEndian.Uint32(b)))
+		return postgresEpoch.AddDate(0, 0, days).Format("2006-01-02"), nil
+	case oidTimestamp, oidTimestamptz:
+		if err := size(8); err != nil {
+			return "", err
+		}
+		t := postgresEpoch.Add(time.Duration(int64(binary.BigEndian.Uint64(b))) * time.Microsecond)
+		if oid == oidTimestamptz {
+			return t.Format("2006-01-02 15:04:05.999999-07"), nil
+		}
+		return t.Format("2006-01-02 15:04:05.999999"), nil
+	}
+	return "", fmt.Errorf("keploy: binary format of type oid %d is not supported", oid)
+}
+
+func pgInt16(b []byte, v int16) []byte {
+	return append(b, byte(uint16(v)>>8), byte(v))
+}
+
+func pgInt32(b []byte, v int32) []byte {
+	return append(b, byte(uint32(v)>>24), byte(uint32(v)>>16), byte(uint32(v)>>8), byte(v))
+}
+
+func pgInt64(b []byte, v uint64) []byte {
+	return pgInt32(pgInt32(b, int32(v>>32)), int32(v))
+}
+
+func pgString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
+
+// pgReader decodes the fields of a frontend message. The first decoding error
+// is kept in err and every later read returns a zero value.
+type pgReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pgReader) fail() {
+	if r.err == nil {
+		r.err = errors.New("malformed postgres message")
+	}
+	r.buf = nil
+}
+
+func (r *pgReader) byte() byte {
+	if len(r.buf) < 1 {
+		r.fail()
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *pgReader) int16() int16 {
+	if len(r.buf) < 2 {
+		r.fail()
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(r.buf))
+	r.buf = r.buf[2:]
+	return v
+}
+
+func (r *pgReader) int32() int32 {
+	if len(r.buf) < 4 {
+		r.fail()
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.buf))
+	r.buf = r.buf[4:]
+	return v
+}
+
+// count reads the number of the items of an array whose items take at least
+// size bytes each, failing on the counts the message cannot hold.
+func (r *pgReader) count(size int) int {
+	n := int(r.int16())
+	if n < 0 || n*size > len(r.buf) {
+		r.fail()
+		return 0
+	}
+	return n
+}
+
+func (r *pgReader) bytes(n int) []byte {
+	if n < 0 || len(r.buf) < n {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *pgReader) string() string {
+	for i, c := range r.buf {
+		if c == 0 {
+			s := string(r.buf[:i])
+			r.buf = r.buf[i+1:]
+			return s
+		}
+	}
+	r.fail()
+	return ""
+}
@@ -0,0 +1,280 @@
+package keploy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const postgresStubs = `version: api.keploy.io/v1beta1
+kind: Postgres
+name: postgres-0
+spec:
+  query: SELECT id, name FROM users WHERE id = $1
+  args: ["1"]
+  columns:
+    - name: id
+      oid: 23
+    - name: name
+  rows:
+    - ["1", "alice"]
+---
+version: api.keploy.io/v1beta1
+kind: Postgres
+name: postgres-1
+spec:
+  query: UPDATE users SET name = 'bob'
+  command_tag: UPDATE 3
+`
+
+// pgMessage is a message of the backend read by pgClient.
+type pgMessage struct {
+	typ  byte
+	body []byte
+}
+
+// pgClient speaks the frontend side of the protocol to a stand-in.
+type pgClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialPostgres(t *testing.T, p *PostgresStandIn) *pgClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &pgClient{conn: conn, r: bufio.NewReader(conn)}
+	body := pgInt32(nil, 196608)
+	body = pgString(pgString(body, "user"), "keploy")
+	body = append(body, 0)
+	if _, err := conn.Write(append(pgInt32(nil, int32(len(body)+4)), body...)); err != nil {
+		t.Fatal(err)
+	}
+	c.until(t, 'Z')
+	return c
+}
+
+func (c *pgClient) send(t *testing.T, typ byte, body []byte) {
+	t.Helper()
+	msg := append([]byte{typ}, pgInt32(nil, int32(len(body)+4))...)
+	if _, err := c.conn.Write(append(msg, body...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *pgClient) receive() (pgMessage, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return pgMessage{}, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[1:])-4)
+	_, err := io.ReadFull(c.r, body)
+	return pgMessage{typ: hdr[0], body: body}, err
+}
+
+// until returns the messages received up to the first one of type typ.
+func (c *pgClient) until(t *testing.T, typ byte) []pgMessage {
+	t.Helper()
+	var out []pgMessage
+	for {
+		msg, err := c.receive()
+		if err != nil {
+			t.Fatalf("failed to receive a %q message after %v %v", typ, out, err)
+		}
+		out = append(out, msg)
+		if msg.typ == typ {
+			return out
+		}
+	}
+}
+
+func startPostgres(t *testing.T) *PostgresStandIn {
+	t.Helper()
+	p, err := StartPostgresStandIn(writeStubs(t, "pg", postgresStubs), "pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPostgresSimpleQuery(t *testing.T) {
+	c := dialPostgres(t, startPostgres(t))
+	c.send(t, 'Q', pgString(nil, "UPDATE users SET name = 'bob'"))
+	msgs := c.until(t, 'Z')
+	if len(msgs) != 2 || msgs[0].typ != 'C' || string(msgs[0].body) != "UPDATE 3\x00" {
+		t.Fatalf("unexpected response %q", msgs)
+	}
+
+	c.send(t, 'Q', pgString(nil, "SELECT nope"))
+	msgs = c.until(t, 'Z')
+	if msgs[0].typ != 'E' || !bytes.Contains(msgs[0].body, []byte("no recorded mock matches")) {
+		t.Fatalf("unexpected response %q", msgs)
+	}
+}
+
+func TestPostgresExtendedQuery(t *testing.T) {
+	c := dialPostgres(t, startPostgres(t))
+	c.send(t, 'P', pgInt16(pgString(pgString(nil, ""), "SELECT id, name FROM users WHERE id = $1"), 0))
+	bind := pgString(pgString(nil, ""), "")
+	bind = pgInt16(bind, 0)
+	bind = pgInt16(bind, 1)
+	bind = append(pgInt32(bind, 1), '1')
+	c.send(t, 'B', pgInt16(bind, 0))
+	c.send(t, 'E', pgInt32(pgString(nil, ""), 0))
+	c.send(t, 'S', nil)
+	var types []byte
+	var row []byte
+	for _, msg := range c.until(t, 'Z') {
+		types = append(types, msg.typ)
+		if msg.typ == 'D' {
+			row = msg.body
+		}
+	}
+	if string(types) != "12DCZ" {
+		t.Fatalf("got messages %q, want 12DCZ", types)
+	}
+	if !bytes.Contains(row, []byte("alice")) {
+		t.Fatalf("got row %q", row)
+	}
+}
+
+func TestPostgresRejectsMalformedCounts(t *testing.T) {
+	p := startPostgres(t)
+	for name, msg := range map[string]pgMessage{
+		"parse with more types than bytes": {'P', pgInt16(pgString(pgString(nil, ""), "SELECT 1"), -1)},
+		"bind with a negative count":       {'B', pgInt16(pgString(pgString(nil, ""), ""), -32768)},
+		"bind with a truncated count":      {'B', pgInt16(pgInt16(pgString(pgString(nil, ""), ""), 0), 1000)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := dialPostgres(t, p)
+			c.send(t, msg.typ, msg.body)
+			resp, err := c.receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.typ != 'E' || !bytes.Contains(resp.body, []byte("08P01")) || !bytes.Contains(resp.body, []byte("FATAL")) {
+				t.Fatalf("got %q, want a fatal protocol violation", resp)
+			}
+			if _, err := c.receive(); err != io.EOF {
+				t.Fatalf("got %v, want the connection to be closed", err)
+			}
+		})
+	}
+	// the stand-in keeps serving the other connections
+	c := dialPostgres(t, p)
+	c.send(t, 'Q', pgString(nil, "UPDATE users SET name = 'bob'"))
+	if msgs := c.until(t, 'Z'); msgs[0].typ != 'C' {
+		t.Fatalf("unexpected response %q", msgs)
+	}
+}
+
+func TestPostgresRejectsOversizedMessages(t *testing.T) {
+	p := startPostgres(t)
+	c := dialPostgres(t, p)
+	// only the header is sent: the body must not be allocated nor awaited
+	if _, err := c.conn.Write(append([]byte{'Q'}, pgInt32(nil, 1<<30)...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.receive(); err != io.EOF {
+		t.Fatalf("got %v, want the connection to be closed", err)
+	}
+
+	conn, err := net.Dial("tcp", p.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(pgInt32(pgInt32(nil, 1<<30), 196608)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want the connection to be closed", err)
+	}
+}
+
+func TestPostgresWarnsOnDefaultedRowCount(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l *zap.Logger) { logger = l }(logger)
+	logger = zap.New(zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.AddSync(&logs), zap.WarnLevel))
+
+	stubs := postgresStubs + `---
+version: api.keploy.io/v1beta1
+kind: Postgres
+name: postgres-2
+spec:
+  query: DELETE FROM users WHERE id = $1
+`
+	p, err := StartPostgresStandIn(writeStubs(t, "pg", stubs), "pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if !strings.Contains(logs.String(), `postgres mock "postgres-2" has no command_tag, reporting "DELETE 0"`) {
+		t.Fatalf("got logs %q, want a warning for postgres-2", logs.String())
+	}
+	if strings.Contains(logs.String(), "postgres-1") {
+		t.Fatalf("got logs %q, want no warning for a mock with a command_tag", logs.String())
+	}
+}
+
+func TestDefaultCommandTag(t *testing.T) {
+	for _, tc := range []struct {
+		spec postgresSpec
+		want string
+	}{
+		{postgresSpec{Query: "insert into users (name) values ($1)"}, "INSERT 0 0"},
+		{postgresSpec{Query: "INSERT INTO users (name) VALUES ($1) RETURNING id", Columns: []postgresColumn{{Name: "id"}}, Rows: [][]*string{{nil}}}, "INSERT 0 1"},
+		{postgresSpec{Query: "DELETE FROM users RETURNING id", Columns: []postgresColumn{{Name: "id"}}, Rows: [][]*string{{nil}, {nil}}}, "DELETE 2"},
+		{postgresSpec{Query: "SELECT 1", Columns: []postgresColumn{{Name: "?column?"}}, Rows: [][]*string{{nil}}}, "SELECT 1"},
+		{postgresSpec{Query: "WITH x AS (SELECT 1) SELECT * FROM x", Columns: []postgresColumn{{Name: "x"}}}, "SELECT 0"},
+		{postgresSpec{Query: "create table users (id int)"}, "CREATE"},
+	} {
+		if got := defaultCommandTag(&tc.spec); got != tc.want {
+			t.Errorf("defaultCommandTag(%q) = %q, want %q", tc.spec.Query, got, tc.want)
+		}
+	}
+}
+
+func TestPostgresTransactionStatus(t *testing.T) {
+	c := dialPostgres(t, startPostgres(t))
+	for _, tc := range []struct {
+		query  string
+		status string
+	}{
+		{"BEGIN", "T"},
+		{"COMMIT", "I"},
+		{"START TRANSACTION", "T"},
+		{"ROLLBACK", "I"},
+	} {
+		c.send(t, 'Q', pgString(nil, tc.query))
+		msgs := c.until(t, 'Z')
+		if got := string(msgs[len(msgs)-1].body); got != tc.status {
+			t.Errorf("status after %s = %q, want %q", tc.query, got, tc.status)
+		}
+	}
+}
+
+func TestPgReaderCount(t *testing.T) {
+	r := &pgReader{buf: pgInt32(pgInt32(pgInt16(nil, 2), 1), 2)}
+	if n := r.count(4); n != 2 || r.err != nil {
+		t.Fatalf("count = %d, %v", n, r.err)
+	}
+	r = &pgReader{buf: pgInt32(pgInt16(nil, 2), 1)}
+	if n := r.count(4); n != 0 || r.err == nil || !strings.Contains(r.err.Error(), "malformed") {
+		t.Fatalf("count = %d, %v, want a malformed message", n, r.err)
+	}
+}
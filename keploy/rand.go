@@ -0,0 +1,135 @@
+package keploy
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// randomKind is the kind of the mocks recorded by the random sources.
+const randomKind = "Random"
+
+// randomSpec is the spec of a Random mock, a value produced by a source.
+type randomSpec struct {
+	Source string `yaml:"source"`
+	Value  string `yaml:"value"`
+}
+
+// randomValue returns the next value of the named source following the mode
+// of the session: gen produces it, and in MODE_RECORD it is recorded, while
+// in MODE_TEST the recorded values are returned in order. gen is used once the
+// recorded values are exhausted.
+func randomValue(source string, gen func() string) string {
+	s := activeSession()
+	switch s.mode {
+	case MODE_RECORD:
+		v := gen()
+		if err := s.record(randomKind, randomSpec{Source: source, Value: v}); err != nil {
+			logger.Error(fmt.Sprintf("failed to record the value of random source %s", source), zap.Error(err))
+		}
+		return v
+	case MODE_TEST:
+		set, err := s.mocks(randomKind)
+		if err == nil {
+			if m, ok := set.next(func(m *Mock) bool {
+				spec := &randomSpec{}
+				return m.decode(spec) == nil && spec.Source == source
+			}); ok {
+				spec := &randomSpec{}
+				if err = m.decode(spec); err == nil {
+					return spec.Value
+				}
+			}
+		}
+		s.warnOnce(fmt.Sprintf("no more recorded values for random source %s, generating new ones", source), zap.Error(err))
+	}
+	return gen()
+}
+
+// Rand is a source of cryptographically secure random bytes, like
+// crypto/rand.Reader, whose reads are recorded in MODE_RECORD and replayed in
+// the same order in MODE_TEST. It can be handed to the libraries accepting a
+// random source, e.g. uuid.SetRand(keploy.Rand).
+var Rand io.Reader = recordedReader{}
+
+type recordedReader struct{}
+
+func (recordedReader) Read(p []byte) (int, error) {
+	var genErr error
+	v := randomValue("rand", func() string {
+		b := make([]byte, len(p))
+		_, genErr = io.ReadFull(crand.Reader, b)
+		return hex.EncodeToString(b)
+	})
+	if genErr != nil {
+		return 0, genErr
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != len(p) {
+		// the code reads differently than when it was recorded
+		activeSession().warnOnce("recorded random bytes do not match the reads of the application, generating new ones")
+		return io.ReadFull(crand.Reader, p)
+	}
+	return copy(p, b), nil
+}
+
+// NewUUID returns a random (version 4) UUID in its canonical string form. The
+// UUIDs are recorded in MODE_RECORD and replayed in the same order in
+// MODE_TEST.
+func NewUUID() string {
+	return randomValue("uuid", randomUUID)
+}
+
+// randomUUID returns a random version 4 UUID, which is never recorded.
+func randomUUID() string {
+	var u [16]byte
+	if _, err := io.ReadFull(crand.Reader, u[:]); err != nil {
+		panic(fmt.Sprintf("keploy: failed to read random bytes %v", err))
+	}
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // variant 10
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// NewRandSource returns a math/rand source whose values are recorded under
+// name in MODE_RECORD and replayed in the same order in MODE_TEST, to be used
+// with rand.New.
+func NewRandSource(name string) rand.Source64 {
+	return &recordedSource{name: name, src: rand.NewSource(rand.Int63()).(rand.Source64)}
+}
+
+type recordedSource struct {
+	name string
+	src  rand.Source64
+}
+
+func (r *recordedSource) Int63() int64 {
+	v := randomValue(r.name, func() string {
+		return strconv.FormatInt(r.src.Int63(), 10)
+	})
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return r.src.Int63()
+	}
+	return n
+}
+
+func (r *recordedSource) Uint64() uint64 {
+	v := randomValue(r.name, func() string {
+		return strconv.FormatUint(r.src.Uint64(), 10)
+	})
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return r.src.Uint64()
+	}
+	return n
+}
+
+// Seed is a no-op, the sequence is driven by the recording.
+func (r *recordedSource) Seed(int64) {}
@@ -0,0 +1,67 @@
+package keploy
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"regexp"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRandomRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	src := NewRandSource("dice")
+
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	uuids := []string{NewUUID(), NewUUID()}
+	token := make([]byte, 16)
+	if _, err := io.ReadFull(Rand, token); err != nil {
+		t.Fatal(err)
+	}
+	rolls := []int{rand.New(src).Intn(6), rand.New(src).Intn(6)}
+	for _, u := range uuids {
+		if !uuidPattern.MatchString(u) {
+			t.Fatalf("%q is not a version 4 UUID", u)
+		}
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	// the sources replay independently of the order they are read in
+	replayedRolls := []int{rand.New(src).Intn(6), rand.New(src).Intn(6)}
+	replayedToken := make([]byte, 16)
+	if _, err := io.ReadFull(Rand, replayedToken); err != nil {
+		t.Fatal(err)
+	}
+	replayedUUIDs := []string{NewUUID(), NewUUID()}
+	if replayedUUIDs[0] != uuids[0] || replayedUUIDs[1] != uuids[1] {
+		t.Errorf("replayed UUIDs %q, want %q", replayedUUIDs, uuids)
+	}
+	if !bytes.Equal(replayedToken, token) {
+		t.Errorf("replayed bytes %x, want %x", replayedToken, token)
+	}
+	if replayedRolls[0] != rolls[0] || replayedRolls[1] != rolls[1] {
+		t.Errorf("replayed rolls %v, want %v", replayedRolls, rolls)
+	}
+
+	// new values are generated once the recorded ones are exhausted
+	if u := NewUUID(); !uuidPattern.MatchString(u) || u == uuids[0] || u == uuids[1] {
+		t.Errorf("got %q after the recorded UUIDs", u)
+	}
+}
+
+func TestRandReadsOfAnotherSize(t *testing.T) {
+	dir := t.TempDir()
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	recorded := make([]byte, 4)
+	if _, err := io.ReadFull(Rand, recorded); err != nil {
+		t.Fatal(err)
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	p := make([]byte, 8)
+	if n, err := Rand.Read(p); n != len(p) || err != nil {
+		t.Fatalf("got %d, %v, want a full read of new bytes", n, err)
+	}
+}
@@ -0,0 +1,608 @@
+package keploy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Redaction replaces the secrets and the personal data of the mocks recorded
+// in MODE_RECORD with placeholders before they are written to the stubs file,
+// so that it can be committed. The placeholders are deterministic, a value
+// always being replaced by the same placeholder, like
+// "redacted-email-5f2c0a9e41b7", and the requests replayed in MODE_TEST by
+// Transport, Func, the keploygen wrappers, the commands and the WebSocket
+// stand-in are redacted the same way before being matched with the recorded
+// ones. The recorded responses are replayed with their placeholders, and the
+// ones of the mocks recorded without redaction as they are.
+type Redaction struct {
+	// Builtin applies the built-in rules: the values of the Authorization,
+	// Proxy-Authorization, Cookie, Set-Cookie, X-Api-Key, Api-Key and
+	// X-Auth-Token headers, the JWTs and the email addresses.
+	Builtin bool
+	// Cards redacts the card numbers, the runs of 13 to 19 digits with a valid
+	// Luhn checksum. It is not a built-in rule, as one numeric id or timestamp
+	// in ten passes the checksum too.
+	Cards bool
+	// Rules are applied after the built-in ones, in order.
+	Rules []RedactionRule
+	// Key is the HMAC key of the placeholders, which keeps the values with
+	// little entropy, like the card numbers, from being found back from their
+	// placeholder by brute force. It must be the same in MODE_RECORD and
+	// MODE_TEST. Default: none
+	Key string
+}
+
+// RedactionRule redacts the values selected by one of Header, Path and
+// Pattern.
+type RedactionRule struct {
+	// Name names the placeholders of the rule, "ssn" giving
+	// "redacted-ssn-1a2b3c4d5e6f". Default: "secret"
+	Name string
+	// Header redacts the values of the header with the given name, or of the
+	// keys with this name in the specs of the mocks.
+	Header string
+	// Path is a JSONPath of the values redacted in the JSON bodies, messages
+	// and payloads, and in the requests and responses of the Func mocks, like
+	// "$.customer.ssn", "$.cards[*].number" or "$..password". Values which are
+	// not strings are replaced by a placeholder string too.
+	Path string
+	// Pattern is a regular expression of the text redacted in every string of
+	// the mocks. With a capture group, like `api_key=([^&]+)`, only the text of
+	// the first group is redacted.
+	Pattern string
+}
+
+// builtinHeaders are the headers redacted by the built-in rules.
+var builtinHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "Api-Key", "X-Auth-Token"}
+
+// The patterns of the built-in rules, the JWTs being redacted before the card
+// numbers for their digits not to be taken for one.
+var (
+	jwtPattern   = patternRule{name: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)}
+	cardPattern  = patternRule{name: "card", re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: luhn}
+	emailPattern = patternRule{name: "email", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)}
+)
+
+// placeholderPattern matches the placeholders, which are never redacted again.
+var placeholderPattern = regexp.MustCompile(`redacted-[a-z0-9_]+-[0-9a-f]{12}`)
+
+type pathRule struct {
+	name  string
+	steps []pathStep
+}
+
+type patternRule struct {
+	name string
+	re   *regexp.Regexp
+	// valid filters the matches, like the card numbers with a valid checksum.
+	valid func(string) bool
+}
+
+// redactor is a Redaction, compiled, or the configured Noise whose values
+// are all replaced by constant. A nil redactor redacts nothing.
+type redactor struct {
+	key      []byte
+	constant string
+	// headers are the placeholder names by lowercase header name.
+	headers  map[string]string
+	paths    []pathRule
+	patterns []patternRule
+}
+
+func compileRedaction(conf Redaction) (*redactor, error) {
+	if !conf.Builtin && !conf.Cards && len(conf.Rules) == 0 {
+		return nil, nil
+	}
+	r := &redactor{key: []byte(conf.Key), headers: map[string]string{}}
+	if conf.Builtin {
+		for _, h := range builtinHeaders {
+			r.headers[strings.ToLower(h)] = placeholderName(h)
+		}
+		r.patterns = append(r.patterns, jwtPattern)
+	}
+	if conf.Cards {
+		r.patterns = append(r.patterns, cardPattern)
+	}
+	if conf.Builtin {
+		r.patterns = append(r.patterns, emailPattern)
+	}
+	for i, rule := range conf.Rules {
+		name := placeholderName(rule.Name)
+		if name == "" {
+			name = "secret"
+		}
+		set := 0
+		for _, field := range []string{rule.Header, rule.Path, rule.Pattern} {
+			if field != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("invalid redaction rule %d, it must set one of Header, Path and Pattern", i)
+		}
+		switch {
+		case rule.Header != "":
+			r.headers[strings.ToLower(rule.Header)] = name
+		case rule.Path != "":
+			steps, err := parsePath(rule.Path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path of redaction rule %d %w", i, err)
+			}
+			r.paths = append(r.paths, pathRule{name: name, steps: steps})
+		default:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern of redaction rule %d %w", i, err)
+			}
+			r.patterns = append(r.patterns, patternRule{name: name, re: re})
+		}
+	}
+	return r, nil
+}
+
+// placeholderName returns name lowercased, with the characters other than
+// letters and digits replaced by underscores.
+func placeholderName(name string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c - 'A' + 'a'
+		}
+		return '_'
+	}, name)
+}
+
+// placeholder returns the placeholder of value for a rule named name.
+func (r *redactor) placeholder(name, value string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return "redacted-" + name + "-" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// replaceValue returns the replacement of value for a rule named name, and
+// whether it differs.
+func (r *redactor) replaceValue(name, value string) (string, bool) {
+	if r.constant != "" {
+		return r.constant, value != r.constant
+	}
+	if isPlaceholder(value) {
+		return value, false
+	}
+	return r.placeholder(name, value), true
+}
+
+func isPlaceholder(s string) bool {
+	loc := placeholderPattern.FindStringIndex(s)
+	return loc != nil && loc[0] == 0 && loc[1] == len(s)
+}
+
+// spec redacts the spec of a mock of kind, as encoded in the stubs file. The
+// requests and responses of the Func mocks are JSON values, whose paths are
+// redacted.
+func (r *redactor) spec(kind string, n *yaml.Node) {
+	if r == nil {
+		return
+	}
+	if n.Kind == yaml.DocumentNode && len(n.Content) == 1 {
+		n = n.Content[0]
+	}
+	if kind != funcKind || n.Kind != yaml.MappingNode {
+		r.node(n)
+		return
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if k := n.Content[i].Value; k == "request" || k == "response" {
+			r.structured(n.Content[i+1])
+		} else {
+			r.node(n.Content[i+1])
+		}
+	}
+}
+
+// request redacts the fields of the spec of a mock of kind which are matched
+// with the replayed requests, leaving the recorded response as it is.
+func (r *redactor) request(kind string, n *yaml.Node) {
+	if r == nil {
+		return
+	}
+	if n.Kind == yaml.DocumentNode && len(n.Content) == 1 {
+		n = n.Content[0]
+	}
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, v := n.Content[i].Value, n.Content[i+1]
+		switch kind {
+		case httpKind:
+			if key == "req" {
+				r.node(v)
+			}
+		case funcKind:
+			if key == "request" {
+				r.structured(v)
+			}
+		case commandKind:
+			if key == "args" || key == "dir" || key == "env" || key == "stdin" {
+				r.node(v)
+			}
+		case webSocketKind:
+			if key == "path" {
+				r.node(v)
+			}
+			if key != "messages" {
+				continue
+			}
+			for _, msg := range v.Content {
+				var m webSocketMessage
+				if msg.Decode(&m) == nil && m.From == "client" {
+					r.node(msg)
+				}
+			}
+		}
+	}
+}
+
+// value redacts v, a spec or a part of it, like the specs of the mocks of kind.
+func (r *redactor) value(kind string, v interface{}) error {
+	if r == nil {
+		return nil
+	}
+	var n yaml.Node
+	if err := n.Encode(v); err != nil {
+		return err
+	}
+	r.spec(kind, &n)
+	out := reflect.New(reflect.TypeOf(v).Elem())
+	if err := n.Decode(out.Interface()); err != nil {
+		return err
+	}
+	reflect.ValueOf(v).Elem().Set(out.Elem())
+	return nil
+}
+
+func (r *redactor) node(n *yaml.Node) {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			r.node(c)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if name, ok := r.headers[strings.ToLower(n.Content[i].Value)]; ok {
+				r.replaceScalars(name, n.Content[i+1])
+				continue
+			}
+			r.node(n.Content[i+1])
+		}
+	case yaml.ScalarNode:
+		if n.ShortTag() == "!!str" {
+			if s := r.text(n.Value); s != n.Value {
+				setString(n, s)
+			}
+		}
+	}
+}
+
+// replaceScalars replaces the scalars of n with their placeholder.
+func (r *redactor) replaceScalars(name string, n *yaml.Node) {
+	if n.Kind != yaml.ScalarNode {
+		for _, c := range n.Content {
+			r.replaceScalars(name, c)
+		}
+		return
+	}
+	if s, ok := r.replaceValue(name, n.Value); n.Value != "" && ok {
+		setString(n, s)
+	}
+}
+
+// setString replaces n with the string s, in the style of the encoded strings.
+func setString(n *yaml.Node, s string) {
+	var out yaml.Node
+	if out.Encode(s) == nil {
+		*n = out
+	}
+}
+
+// structured redacts a node holding a JSON value.
+func (r *redactor) structured(n *yaml.Node) {
+	var v interface{}
+	if n.Decode(&v) != nil {
+		return
+	}
+	if out, changed := r.document(normalizeYAMLValue(v)); changed {
+		_ = n.Encode(out)
+	}
+}
+
+// text redacts a string: the paths and the strings of a JSON document, or the
+// patterns of the text otherwise. A JSON document is encoded again when it is
+// redacted.
+func (r *redactor) text(s string) string {
+	if r == nil {
+		return s
+	}
+	if doc, ok := decodeJSONDocument(s); ok {
+		if out, changed := r.document(doc); changed {
+			if text, ok := encodeJSONDocument(out); ok {
+				return text
+			}
+		}
+		return s
+	}
+	return r.redactPatterns(s)
+}
+
+// encodeJSONDocument encodes a JSON value decoded by decodeJSONDocument.
+func encodeJSONDocument(v interface{}) (string, bool) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(v) != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(b.String(), "\n"), true
+}
+
+// decodeJSONDocument decodes s when it is a JSON object or array, keeping its
+// numbers as they are.
+func decodeJSONDocument(s string) (interface{}, bool) {
+	trimmed := strings.TrimSpace(s)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") || !json.Valid([]byte(trimmed)) {
+		return nil, false
+	}
+	dec := json.NewDecoder(strings.NewReader(trimmed))
+	dec.UseNumber()
+	var v interface{}
+	if dec.Decode(&v) != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// document redacts a decoded JSON value, which may be modified in place, and
+// reports whether it changed.
+func (r *redactor) document(v interface{}) (interface{}, bool) {
+	if r == nil {
+		return v, false
+	}
+	changed := false
+	for _, p := range r.paths {
+		name := p.name
+		var ok bool
+		v, ok = redactPath(v, p.steps, func(v interface{}) (interface{}, bool) {
+			if v == nil {
+				return v, false
+			}
+			s, isString := v.(string)
+			if !isString {
+				b, err := json.Marshal(v)
+				if err != nil {
+					return v, false
+				}
+				s = string(b)
+			}
+			return r.replaceValue(name, s)
+		})
+		changed = changed || ok
+	}
+	v, ok := r.redactStrings(v)
+	return v, changed || ok
+}
+
+// redactStrings redacts the patterns of the strings of a JSON value.
+func (r *redactor) redactStrings(v interface{}) (interface{}, bool) {
+	changed := false
+	switch c := v.(type) {
+	case string:
+		s := r.redactPatterns(c)
+		return s, s != c
+	case map[string]interface{}:
+		for k, item := range c {
+			if out, ok := r.redactStrings(item); ok {
+				c[k] = out
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i, item := range c {
+			if out, ok := r.redactStrings(item); ok {
+				c[i] = out
+				changed = true
+			}
+		}
+	}
+	return v, changed
+}
+
+// redactPatterns replaces the matches of the patterns in s, outside of the
+// placeholders already there.
+func (r *redactor) redactPatterns(s string) string {
+	for _, p := range r.patterns {
+		var b strings.Builder
+		last := 0
+		for _, loc := range placeholderPattern.FindAllStringIndex(s, -1) {
+			b.WriteString(r.replacePattern(p, s[last:loc[0]]))
+			b.WriteString(s[loc[0]:loc[1]])
+			last = loc[1]
+		}
+		b.WriteString(r.replacePattern(p, s[last:]))
+		s = b.String()
+	}
+	return s
+}
+
+func (r *redactor) replacePattern(p patternRule, s string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range p.re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := loc[0], loc[1]
+		if len(loc) >= 4 {
+			start, end = loc[2], loc[3]
+		}
+		if start < 0 || start == end || p.valid != nil && !p.valid(s[start:end]) {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(r.placeholder(p.name, s[start:end]))
+		last = end
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// luhn reports whether the digits of s have a valid Luhn checksum, as card
+// numbers do.
+func luhn(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// pathStep is a step of a JSONPath: a key, an index or a wildcard, applying
+// at any depth when recursive.
+type pathStep struct {
+	key       string
+	index     int
+	wildcard  bool
+	recursive bool
+}
+
+// parsePath parses the JSONPaths made of $, .key, ..key, .*, [n], [*] and
+// ['key'] steps.
+func parsePath(path string) ([]pathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path %q does not start with $", path)
+	}
+	var steps []pathStep
+	rest := path[1:]
+	for rest != "" {
+		step := pathStep{index: -1}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in path %q", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				step.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				step.key = inner[1 : len(inner)-1]
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid index %q in path %q", inner, path)
+				}
+				step.index = n
+			}
+			steps = append(steps, step)
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected %q in path %q", rest, path)
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if rest[:end] == "" {
+			return nil, fmt.Errorf("empty key in path %q", path)
+		}
+		if rest[:end] == "*" {
+			step.wildcard = true
+		} else {
+			step.key = rest[:end]
+		}
+		rest = rest[end:]
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("path %q selects the whole document", path)
+	}
+	return steps, nil
+}
+
+// redactPath replaces the values of v selected by steps, and reports whether
+// any of them changed. The strings holding a JSON document are followed like
+// the decoded document.
+func redactPath(v interface{}, steps []pathStep, replace func(interface{}) (interface{}, bool)) (interface{}, bool) {
+	if len(steps) == 0 {
+		return replace(v)
+	}
+	if s, ok := v.(string); ok {
+		if doc, ok := decodeJSONDocument(s); ok {
+			if out, changed := redactPath(doc, steps, replace); changed {
+				if text, ok := encodeJSONDocument(out); ok {
+					return text, true
+				}
+			}
+		}
+		return v, false
+	}
+	step, rest := steps[0], steps[1:]
+	changed := false
+	apply := func(item interface{}, steps []pathStep) interface{} {
+		out, ok := redactPath(item, steps, replace)
+		changed = changed || ok
+		return out
+	}
+	switch c := v.(type) {
+	case map[string]interface{}:
+		for k, item := range c {
+			if step.recursive {
+				item = apply(item, steps)
+			}
+			if step.wildcard || step.index < 0 && k == step.key {
+				item = apply(item, rest)
+			}
+			c[k] = item
+		}
+	case []interface{}:
+		for i, item := range c {
+			if step.recursive {
+				item = apply(item, steps)
+			}
+			if step.wildcard || step.index == i {
+				item = apply(item, rest)
+			}
+			c[i] = item
+		}
+	}
+	return v, changed
+}
@@ -0,0 +1,87 @@
+package keploy
+
+import "sync"
+
+// scenarioStarted is the state of the scenarios at the start of a test run.
+const scenarioStarted = "started"
+
+// Scenario makes the replay of a mock depend on the state of a named
+// scenario, for the same request to get different responses over time, like
+// polling a job until it is done. It is the scenario annotation of a mock in
+// the stubs file:
+//
+//	kind: Http
+//	name: http-1
+//	scenario:
+//	  name: export-job
+//	  state: running
+//	  next: done
+//	spec:
+//	  ...
+//
+// The scenarios start in the "started" state at every call to New. A mock
+// with a State only matches while its scenario is in that state, and a mock
+// with a Next moves its scenario to that state when it is replayed. The
+// scenarios are shared by the mocks of every kind replayed by the in-process
+// helpers, and the Postgres, MySQL and MongoDB stand-ins track the scenarios
+// of their own mocks.
+type Scenario struct {
+	Name string `yaml:"name"`
+	// State is the state of the scenario required to replay the mock.
+	// Default: any state
+	State string `yaml:"state,omitempty"`
+	// Next is the state of the scenario after the mock is replayed. Default:
+	// the state is left unchanged
+	Next string `yaml:"next,omitempty"`
+}
+
+// scenarioStates holds the states of the scenarios of a test run.
+type scenarioStates struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func newScenarioStates() *scenarioStates {
+	return &scenarioStates{states: map[string]string{}}
+}
+
+// state returns the state of the named scenario.
+func (s *scenarioStates) state(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.states[name]; ok {
+		return state
+	}
+	return scenarioStarted
+}
+
+func (s *scenarioStates) set(name, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[name] = state
+}
+
+// allows reports whether the mock m can be replayed in the current state of
+// its scenario.
+func (s *scenarioStates) allows(m *Mock) bool {
+	return m.Scenario == nil || m.Scenario.State == "" || s.state(m.Scenario.Name) == m.Scenario.State
+}
+
+// advance moves the scenario of m, a replayed mock, to its next state.
+func (s *scenarioStates) advance(m *Mock) {
+	if m.Scenario != nil && m.Scenario.Next != "" {
+		s.set(m.Scenario.Name, m.Scenario.Next)
+	}
+}
+
+// ScenarioState returns the current state of the named scenario of the mocks
+// replayed by the in-process helpers.
+func ScenarioState(name string) string {
+	return activeSession().states.state(name)
+}
+
+// SetScenarioState moves the named scenario of the mocks replayed by the
+// in-process helpers to state, like a test starting in the middle of a flow.
+func SetScenarioState(name, state string) {
+	activeSession().states.set(name, state)
+}
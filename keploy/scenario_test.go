@@ -0,0 +1,135 @@
+package keploy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const scenarioStubs = `version: api.keploy.io/v1beta1
+kind: Http
+name: create
+scenario:
+    name: export-job
+    state: started
+    next: running
+spec:
+    req:
+        method: POST
+        url: http://api.test/jobs
+    resp:
+        status_code: 202
+        body: created
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: poll-running
+scenario:
+    name: export-job
+    state: running
+    next: done
+spec:
+    req:
+        method: GET
+        url: http://api.test/jobs/1
+    resp:
+        status_code: 200
+        body: running
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: poll-done
+scenario:
+    name: export-job
+    state: done
+spec:
+    req:
+        method: GET
+        url: http://api.test/jobs/1
+    resp:
+        status_code: 200
+        body: done
+---
+version: api.keploy.io/v1beta1
+kind: Func
+name: download
+scenario:
+    name: export-job
+    state: done
+spec:
+    name: download
+    request: 1
+    response: report.csv
+`
+
+func TestScenarios(t *testing.T) {
+	dir := writeStubs(t, "TestScenarios", scenarioStubs)
+	c := &http.Client{Transport: &Transport{}}
+	download := Func("download", func(context.Context, int) (string, error) {
+		t.Fatal("the function was called in MODE_TEST")
+		return "", nil
+	})
+	poll := func(t *testing.T) string {
+		t.Helper()
+		_, body, err := send(t, c, "GET", "http://api.test/jobs/1", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	startTestSession(t, MODE_TEST, dir, Config{})
+	_, _, err := send(t, c, "GET", "http://api.test/jobs/1", nil, "")
+	if err == nil || !strings.Contains(err.Error(), "\tpoll-running:\n\t\tscenario \"export-job\" state: recorded \"running\", got \"started\"") {
+		t.Fatalf("got %v, want the poll not to match before the job is created", err)
+	}
+	if _, err := download(context.Background(), 1); err == nil {
+		t.Fatal("the download matched before the job is done")
+	}
+
+	if _, body, err := send(t, c, "POST", "http://api.test/jobs", nil, ""); err != nil || body != "created" {
+		t.Fatalf("got %q %v", body, err)
+	}
+	if state := ScenarioState("export-job"); state != "running" {
+		t.Fatalf("the scenario is %q after the creation, want running", state)
+	}
+	// the last state keeps being replayed
+	if polls := []string{poll(t), poll(t), poll(t)}; strings.Join(polls, ",") != "running,done,done" {
+		t.Fatalf("polled %q", polls)
+	}
+	// the scenarios are shared by the mocks of every kind
+	if name, err := download(context.Background(), 1); err != nil || name != "report.csv" {
+		t.Fatalf("got %q %v", name, err)
+	}
+
+	// the scenarios start over in every test run
+	startTestSession(t, MODE_TEST, dir, Config{})
+	if state := ScenarioState("export-job"); state != "started" {
+		t.Fatalf("the scenario is %q in a new run, want started", state)
+	}
+	SetScenarioState("export-job", "done")
+	if body := poll(t); body != "done" {
+		t.Fatalf("polled %q after setting the state", body)
+	}
+	if state := ScenarioState("other"); state != scenarioStarted {
+		t.Fatalf("an unknown scenario is %q", state)
+	}
+}
+
+func TestScenarioStates(t *testing.T) {
+	s := newScenarioStates()
+	anyState := &Mock{Scenario: &Scenario{Name: "job", Next: "running"}}
+	running := &Mock{Scenario: &Scenario{Name: "job", State: "running"}}
+	if !s.allows(&Mock{}) || !s.allows(anyState) || s.allows(running) {
+		t.Fatal("unexpected mocks allowed in the started state")
+	}
+	s.advance(anyState)
+	if !s.allows(running) || s.state("job") != "running" {
+		t.Fatalf("the scenario is %q", s.state("job"))
+	}
+	s.advance(running)
+	if s.state("job") != "running" {
+		t.Fatalf("a mock without next moved the scenario to %q", s.state("job"))
+	}
+}
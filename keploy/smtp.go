@@ -0,0 +1,360 @@
+package keploy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// emailKind is the kind of the mocks recorded by the SMTP stand-in.
+const emailKind = "Email"
+
+// smtpMaxMessageSize bounds the messages accepted by the SMTP stand-in.
+const smtpMaxMessageSize = 32 << 20
+
+// Email is a message accepted by the SMTP stand-in.
+type Email struct {
+	From   string            `yaml:"from"` // envelope sender
+	To     []string          `yaml:"to"`   // envelope recipients
+	Header map[string]string `yaml:"header"`
+	// Subject is the decoded Subject header.
+	Subject string      `yaml:"subject,omitempty"`
+	Parts   []EmailPart `yaml:"parts"`
+}
+
+// EmailPart is a leaf MIME part of an email, with its transfer encoding
+// decoded.
+type EmailPart struct {
+	ContentType string `yaml:"content_type"`
+	Filename    string `yaml:"filename,omitempty"`
+	Body        string `yaml:"body"`
+}
+
+// Text returns the body of the first text/plain part.
+func (e Email) Text() string {
+	return e.part("text/plain")
+}
+
+// HTML returns the body of the first text/html part.
+func (e Email) HTML() string {
+	return e.part("text/html")
+}
+
+func (e Email) part(mediaType string) string {
+	for _, p := range e.Parts {
+		if t, _, _ := mime.ParseMediaType(p.ContentType); t == mediaType && p.Filename == "" {
+			return p.Body
+		}
+	}
+	return ""
+}
+
+// SMTPStandIn is a localhost SMTP server accepting every message, with any
+// credentials. The messages are kept for the assertions of Emails and, in
+// MODE_RECORD, recorded as Email mocks in the stubs file.
+type SMTPStandIn struct {
+	*standIn
+}
+
+// StartSMTPStandIn starts an SMTP stand-in on a random localhost port.
+func StartSMTPStandIn() (*SMTPStandIn, error) {
+	s := &SMTPStandIn{}
+	var err error
+	s.standIn, err = listenStandIn(s.serveConn)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Host returns the host of the stand-in, to be used with its Port.
+func (s *SMTPStandIn) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+func (s *SMTPStandIn) serveConn(conn net.Conn) {
+	tp := textproto.NewConn(conn)
+	reply := func(code int, msg string) bool {
+		return tp.PrintfLine("%d %s", code, msg) == nil
+	}
+	if !reply(220, "keploy ESMTP stand-in") {
+		return
+	}
+	var from string
+	var to []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		ok := true
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			ok = tp.PrintfLine("250-keploy\r\n250-8BITMIME\r\n250-SMTPUTF8\r\n250-SIZE %d\r\n250 AUTH PLAIN LOGIN", smtpMaxMessageSize) == nil
+		case "HELO":
+			ok = reply(250, "keploy")
+		case "AUTH":
+			ok = s.auth(tp, arg)
+		case "MAIL":
+			from, to = smtpPath(arg, "FROM:"), nil
+			ok = reply(250, "OK")
+		case "RCPT":
+			to = append(to, smtpPath(arg, "TO:"))
+			ok = reply(250, "OK")
+		case "DATA":
+			if len(to) == 0 {
+				ok = reply(503, "no recipients")
+				break
+			}
+			if !reply(354, "end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := io.ReadAll(io.LimitReader(tp.DotReader(), smtpMaxMessageSize))
+			if err != nil {
+				return
+			}
+			if err := s.accept(from, to, data); err != nil {
+				ok = reply(554, fmt.Sprintf("keploy: failed to parse the message %v", err))
+			} else {
+				ok = reply(250, "OK queued")
+			}
+			from, to = "", nil
+		case "RSET":
+			from, to = "", nil
+			ok = reply(250, "OK")
+		case "NOOP":
+			ok = reply(250, "OK")
+		case "VRFY":
+			ok = reply(252, "cannot verify")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			ok = reply(502, "command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// auth accepts any credentials, with the PLAIN or LOGIN mechanisms.
+func (s *SMTPStandIn) auth(tp *textproto.Conn, arg string) bool {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	prompts := 0
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			prompts = 1
+		}
+	case "LOGIN":
+		prompts = 2
+		if initial != "" {
+			prompts = 1
+		}
+	default:
+		return tp.PrintfLine("504 unrecognized authentication mechanism") == nil
+	}
+	challenges := []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"} // Username:, Password:
+	for i := 0; i < prompts; i++ {
+		challenge := ""
+		if strings.ToUpper(mechanism) == "LOGIN" {
+			challenge = challenges[2-prompts+i]
+		}
+		if err := tp.PrintfLine("334 %s", challenge); err != nil {
+			return false
+		}
+		if _, err := tp.ReadLine(); err != nil {
+			return false
+		}
+	}
+	return tp.PrintfLine("235 authentication succeeded") == nil
+}
+
+func (s *SMTPStandIn) accept(from string, to []string, data []byte) error {
+	email, err := parseEmail(data)
+	if err != nil {
+		return err
+	}
+	email.From, email.To = from, to
+	sess := activeSession()
+	sess.capture(emailKind, *email)
+	if sess.mode == MODE_RECORD {
+		if err := sess.record(emailKind, email); err != nil {
+			logger.Error("failed to record the email", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// smtpPath returns the address of a MAIL FROM or RCPT TO argument.
+func smtpPath(arg, prefix string) string {
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = arg[len(prefix):]
+	}
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "<") {
+		if end := strings.Index(arg, ">"); end > 0 {
+			return arg[1:end]
+		}
+	}
+	path, _, _ := strings.Cut(arg, " ")
+	return path
+}
+
+func parseEmail(data []byte) (*Email, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	email := &Email{Header: map[string]string{}}
+	dec := &mime.WordDecoder{}
+	for k, v := range msg.Header {
+		email.Header[k] = strings.Join(v, ", ")
+	}
+	if email.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		email.Subject = msg.Header.Get("Subject")
+	}
+	email.Parts, err = emailParts(textproto.MIMEHeader(msg.Header), msg.Body)
+	return email, err
+}
+
+// emailParts returns the leaf parts of a MIME entity.
+func emailParts(header textproto.MIMEHeader, body io.Reader) ([]EmailPart, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain; charset=us-ascii"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		var parts []EmailPart
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextRawPart()
+			if err == io.EOF {
+				return parts, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			sub, err := emailParts(p.Header, p)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, sub...)
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	part := EmailPart{ContentType: contentType, Body: string(b)}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Filename = params["filename"]
+	}
+	if part.Filename == "" && params != nil {
+		part.Filename = params["name"]
+	}
+	return []EmailPart{part}, nil
+}
+
+// SentEmails is the list of emails checked by a test. The filters return the
+// matching emails, and the assertions fail the test when they do not hold.
+type SentEmails struct {
+	list checkList[Email]
+}
+
+// Emails returns the emails accepted by the SMTP stand-ins since the last call
+// to New, in the order they were sent.
+func Emails(t testing.TB) *SentEmails {
+	t.Helper()
+	var emails []Email
+	for _, v := range activeSession().captured(emailKind) {
+		emails = append(emails, v.(Email))
+	}
+	return &SentEmails{list: checkList[Email]{
+		t:     t,
+		items: emails,
+		what:  "emails were sent",
+		none:  "no email was sent",
+		format: func(m Email) string {
+			return fmt.Sprintf("from %s to %s: %q", m.From, strings.Join(m.To, ", "), m.Subject)
+		},
+	}}
+}
+
+// All returns the emails.
+func (e *SentEmails) All() []Email {
+	return e.list.items
+}
+
+// To returns the emails with addr among their recipients.
+func (e *SentEmails) To(addr string) *SentEmails {
+	return e.filter(func(m Email) bool {
+		for _, to := range m.To {
+			if strings.EqualFold(to, addr) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// From returns the emails sent by addr.
+func (e *SentEmails) From(addr string) *SentEmails {
+	return e.filter(func(m Email) bool { return strings.EqualFold(m.From, addr) })
+}
+
+// WithSubject returns the emails whose subject contains s.
+func (e *SentEmails) WithSubject(s string) *SentEmails {
+	return e.filter(func(m Email) bool { return strings.Contains(m.Subject, s) })
+}
+
+// Containing returns the emails with a part containing s.
+func (e *SentEmails) Containing(s string) *SentEmails {
+	return e.filter(func(m Email) bool {
+		for _, p := range m.Parts {
+			if strings.Contains(p.Body, s) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (e *SentEmails) filter(match func(Email) bool) *SentEmails {
+	return &SentEmails{list: e.list.filter(match)}
+}
+
+// Count asserts that there are n emails.
+func (e *SentEmails) Count(n int) *SentEmails {
+	e.list.t.Helper()
+	e.list.count(n)
+	return e
+}
+
+// First asserts that there is at least one email and returns the first one.
+func (e *SentEmails) First() Email {
+	e.list.t.Helper()
+	return e.list.first()
+}
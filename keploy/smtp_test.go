@@ -0,0 +1,93 @@
+package keploy
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const welcomeEmail = "From: App <app@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: =?UTF-8?Q?Welcome_=C3=A9?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=XX\r\n\r\n" +
+	"--XX\r\n" +
+	"Content-Type: multipart/alternative; boundary=YY\r\n\r\n" +
+	"--YY\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+	"Hello Bob =E2=9C=93\r\n" +
+	".dotline\r\n" +
+	"--YY\r\n" +
+	"Content-Type: text/html\r\n\r\n" +
+	"<p>Hello Bob</p>\r\n" +
+	"--YY--\r\n" +
+	"--XX\r\n" +
+	"Content-Type: application/pdf; name=invoice.pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n\r\n" +
+	"JVBERi0x\r\nLjQK\r\n" +
+	"--XX--\r\n"
+
+func sendEmails(t *testing.T) {
+	t.Helper()
+	s, err := StartSMTPStandIn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := fmt.Sprintf("%s:%d", s.Host(), s.Port())
+	auth := smtp.PlainAuth("", "user", "password", s.Host())
+	if err := smtp.SendMail(addr, auth, "app@example.com", []string{"bob@example.com", "carol@example.com"}, []byte(welcomeEmail)); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com"}, []byte("Subject: disk full\r\n\r\nplain text")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSMTPStandIn(t *testing.T) {
+	startTestSession(t, MODE_TEST, t.TempDir(), Config{})
+	sendEmails(t)
+
+	Emails(t).Count(2)
+	e := Emails(t).To("Carol@example.com").From("app@example.com").WithSubject("Welcome").Count(1).First()
+	if e.Subject != "Welcome é" || e.Header["From"] != "App <app@example.com>" {
+		t.Errorf("got subject %q and header %v", e.Subject, e.Header)
+	}
+	if e.Text() != "Hello Bob ✓\n.dotline" || e.HTML() != "<p>Hello Bob</p>" {
+		t.Errorf("got text %q and html %q", e.Text(), e.HTML())
+	}
+	if len(e.Parts) != 3 || e.Parts[2].Filename != "invoice.pdf" || e.Parts[2].Body != "%PDF-1.4\n" {
+		t.Errorf("got parts %+v", e.Parts)
+	}
+	if got := Emails(t).Containing("plain text").First(); got.To[0] != "ops@example.com" || got.Text() != "plain text\n" {
+		t.Errorf("got %+v", got)
+	}
+
+	tb := &failures{}
+	Emails(tb).From("nobody@example.com").Count(1)
+	Emails(tb).WithSubject("invoice").First()
+	want := []string{"keploy: 0 emails were sent instead of 1", "keploy: no email was sent"}
+	if strings.Join(tb.errors, "|") != strings.Join(want, "|") {
+		t.Errorf("got failures %q, want %q", tb.errors, want)
+	}
+}
+
+func TestSMTPStandInRecord(t *testing.T) {
+	dir := t.TempDir()
+	startTestSession(t, MODE_RECORD, dir, Config{})
+	sendEmails(t)
+	Emails(t).Count(2)
+
+	b, err := os.ReadFile(filepath.Join(dir, "stubs", t.Name()+".yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "kind: Email"); n != 2 || !strings.Contains(string(b), "subject: Welcome é") {
+		t.Fatalf("recorded %d emails\n%s", n, b)
+	}
+}
@@ -0,0 +1,102 @@
+package keploy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// standIn is the localhost listener shared by the protocol stand-in servers.
+// Every accepted connection is served by handle on its own goroutine.
+type standIn struct {
+	ln     net.Listener
+	handle func(net.Conn)
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func listenStandIn(handle func(net.Conn)) (*standIn, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on localhost %w", err)
+	}
+	s := &standIn{ln: ln, handle: handle, conns: map[net.Conn]struct{}{}}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *standIn) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+// Addr returns the host:port the stand-in is listening on.
+func (s *standIn) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Port returns the port the stand-in is listening on.
+func (s *standIn) Port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the stand-in and drops every open client connection.
+func (s *standIn) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.ln.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// appendUint16, appendUint32 and appendUint64 append v in network byte order,
+// the order of the big-endian protocols.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
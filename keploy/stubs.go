@@ -0,0 +1,324 @@
+package keploy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// mockVersion is the api version written in every mock recorded by the SDK.
+const mockVersion = "api.keploy.io/v1beta1"
+
+// Mock is a single document of a keploy stubs file. The Spec is kept as a raw
+// yaml node and is decoded by the replayer that owns the mock's Kind.
+type Mock struct {
+	Version  string        `yaml:"version"`
+	Kind     string        `yaml:"kind"`
+	Name     string        `yaml:"name"`
+	Latency  time.Duration `yaml:"latency,omitempty"`  // duration of the recorded call, replayed with Config.Latency
+	Fault    *Fault        `yaml:"fault,omitempty"`    // annotation injecting a fault in MODE_TEST
+	Noise    []string      `yaml:"noise,omitempty"`    // JSONPaths of the spec ignored by the matching, see Noise
+	Template bool          `yaml:"template,omitempty"` // renders the response of an Http mock in MODE_TEST, see Transport
+	Scenario *Scenario     `yaml:"scenario,omitempty"` // state of a scenario required and set by the replay of the mock
+	Spec     yaml.Node     `yaml:"spec"`
+}
+
+// decode unmarshals the spec of the mock into v.
+func (m *Mock) decode(v interface{}) error {
+	if err := m.Spec.Decode(v); err != nil {
+		return fmt.Errorf("failed to decode spec of %s mock %q %w", m.Kind, m.Name, err)
+	}
+	return nil
+}
+
+// stubsFile returns the location of the stubs file for the given mock name.
+// Relative or empty paths are resolved against the current working directory.
+func stubsFile(path, name string) (string, error) {
+	if name == "" {
+		return "", errors.New("provided mock name is empty")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the absolute path from provided path %w", err)
+	}
+	return filepath.Join(path, "stubs", name+".yaml"), nil
+}
+
+// readMocks returns the mocks of the given kind stored in the stubs file, in
+// the order they were recorded. An empty kind returns the mocks of every kind.
+func readMocks(file, kind string) ([]*Mock, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stubs file %w", err)
+	}
+	defer f.Close()
+
+	var mocks []*Mock
+	dec := yaml.NewDecoder(f)
+	for {
+		m := &Mock{}
+		err := dec.Decode(m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse stubs file %s %w", file, err)
+		}
+		if kind == "" || m.Kind == kind {
+			mocks = append(mocks, m)
+		}
+	}
+	return mocks, nil
+}
+
+// mockSet serves the mocks loaded from a stubs file to a replayer. Mocks are
+// handed out in recording order: an unused mock is always preferred, and an
+// already used one is only returned again when no unused mock matches. The
+// mocks of a scenario are only handed out in their state.
+type mockSet struct {
+	mu     sync.Mutex
+	mocks  []*Mock
+	used   map[*Mock]bool
+	states *scenarioStates
+}
+
+func newMockSet(mocks []*Mock) *mockSet {
+	return &mockSet{mocks: mocks, used: map[*Mock]bool{}, states: newScenarioStates()}
+}
+
+// find returns the first mock accepted by match and marks it as used.
+func (s *mockSet) find(match func(*Mock) bool) (*Mock, bool) {
+	return s.lookup(match, true)
+}
+
+// peek is like find but leaves the returned mock unused.
+func (s *mockSet) peek(match func(*Mock) bool) (*Mock, bool) {
+	return s.lookup(match, false)
+}
+
+// next returns the first unused mock accepted by match and marks it as used.
+// Unlike find it never hands out a mock twice, for the recorded sequences
+// which are replayed in order.
+func (s *mockSet) next(match func(*Mock) bool) (*Mock, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.mocks {
+		if !s.used[m] && s.states.allows(m) && match(m) {
+			s.used[m] = true
+			s.states.advance(m)
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+func (s *mockSet) lookup(match func(*Mock) bool, use bool) (*Mock, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reuse *Mock
+	for _, m := range s.mocks {
+		if !s.states.allows(m) || !match(m) {
+			continue
+		}
+		if !s.used[m] {
+			if use {
+				s.used[m] = true
+				s.states.advance(m)
+			}
+			return m, true
+		}
+		if reuse == nil {
+			reuse = m
+		}
+	}
+	if reuse != nil && use {
+		s.states.advance(reuse)
+	}
+	return reuse, reuse != nil
+}
+
+// session is the record/replay context set up by New, which the in-process
+// helpers of the SDK record into and replay from.
+type session struct {
+	mode Mode
+	file string
+
+	mu      sync.Mutex
+	sets    map[string]*mockSet
+	written map[string]int
+	warned  map[string]bool
+	// states are the states of the scenarios of the replayed mocks
+	states *scenarioStates
+	// values captured by the stand-ins for the assertions of the test, by kind
+	captures map[string][]interface{}
+	*sessionOptions
+}
+
+// sessionOptions are the options of New applying to the session, compiled.
+type sessionOptions struct {
+	match   *matcher
+	faults  []faultRule
+	latency Latency
+	filters Filters
+	redact  *redactor
+	noise   *redactor
+	// detectNoise compares the recorded mocks with previous, the mocks of the
+	// previous recording of the stubs file by name, in MODE_RECORD.
+	detectNoise bool
+	previous    map[string]*Mock
+}
+
+func compileOptions(conf Config) (*sessionOptions, error) {
+	match, err := compileMatching(conf.Matching)
+	if err != nil {
+		return nil, err
+	}
+	faults, err := compileFaults(conf.Faults)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.Latency.validate(); err != nil {
+		return nil, err
+	}
+	redact, err := compileRedaction(conf.Redaction)
+	if err != nil {
+		return nil, err
+	}
+	noise, err := compileNoise(conf.Noise)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionOptions{match: match, faults: faults, latency: conf.Latency, filters: conf.Filters, redact: redact, noise: noise, detectNoise: conf.Noise.Detect}, nil
+}
+
+var (
+	sessionMu sync.Mutex
+	current   = newSession(MODE_OFF, "", &sessionOptions{match: &matcher{}})
+)
+
+func newSession(mode Mode, file string, opts *sessionOptions) *session {
+	return &session{
+		mode:           mode,
+		file:           file,
+		sets:           map[string]*mockSet{},
+		written:        map[string]int{},
+		warned:         map[string]bool{},
+		states:         newScenarioStates(),
+		captures:       map[string][]interface{}{},
+		sessionOptions: opts,
+	}
+}
+
+// startSession makes the stubs file of the given mock name the target of the
+// in-process helpers, replaying with the given options.
+func startSession(mode Mode, path, name string, opts *sessionOptions) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	current = newSession(mode, filepath.Join(path, "stubs", name+".yaml"), opts)
+}
+
+// activeSession returns the session of the last call to New.
+func activeSession() *session {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	return current
+}
+
+// mocks returns the mocks of the given kind recorded in the stubs file. The
+// file is read on first use, so that mocks recorded by other means before the
+// first call are served too.
+func (s *session) mocks(kind string) (*mockSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if set, ok := s.sets[kind]; ok {
+		return set, nil
+	}
+	mocks, err := readMocks(s.file, kind)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNoise(mocks); err != nil {
+		return nil, err
+	}
+	// the requests of the mocks recorded without redaction are redacted like
+	// the replayed ones, to keep matching them, and their responses are
+	// replayed as recorded
+	for _, m := range mocks {
+		s.redact.request(kind, &m.Spec)
+	}
+	set := newMockSet(mocks)
+	set.states = s.states
+	s.sets[kind] = set
+	return set, nil
+}
+
+// warnOnce logs msg the first time it is reported during the session.
+func (s *session) warnOnce(msg string, fields ...zap.Field) {
+	s.mu.Lock()
+	warned := s.warned[msg]
+	s.warned[msg] = true
+	s.mu.Unlock()
+	if !warned {
+		logger.Warn(msg, fields...)
+	}
+}
+
+// capture keeps v for the assertions of the test.
+func (s *session) capture(kind string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captures[kind] = append(s.captures[kind], v)
+}
+
+// captured returns the values captured for kind during the session.
+func (s *session) captured(kind string) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]interface{}{}, s.captures[kind]...)
+}
+
+// record appends a mock with the given spec to the stubs file.
+func (s *session) record(kind string, spec interface{}) error {
+	return s.recordLatency(kind, spec, 0)
+}
+
+// recordLatency is like record for a call which took latency.
+func (s *session) recordLatency(kind string, spec interface{}, latency time.Duration) error {
+	m := &Mock{Version: mockVersion, Kind: kind, Latency: latency.Round(time.Microsecond)}
+	if err := m.Spec.Encode(spec); err != nil {
+		return fmt.Errorf("failed to encode %s mock %w", kind, err)
+	}
+	s.redact.spec(kind, &m.Spec)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.Name = fmt.Sprintf("%s-%d", strings.ToLower(kind), s.written[kind])
+	s.markNoise(m)
+	doc, err := yaml.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s mock %w", kind, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0o755); err != nil {
+		return fmt.Errorf("failed to create the stubs directory %w", err)
+	}
+	f, err := os.OpenFile(s.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open stubs file %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append([]byte("---\n"), doc...)); err != nil {
+		return fmt.Errorf("failed to write %s mock %w", kind, err)
+	}
+	s.written[kind]++
+	return nil
+}
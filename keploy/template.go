@@ -0,0 +1,167 @@
+package keploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateData is the data of the templated mocks: the replayed request and
+// the variables captured by the named groups of the path and query patterns
+// of the matching rule applying to it.
+type templateData struct {
+	Request templateRequest
+	Vars    map[string]string
+}
+
+// templateRequest is the replayed request of a templated mock.
+type templateRequest struct {
+	Method string
+	URL    string
+	Host   string
+	Path   string
+	// Query and Header hold the values of the query parameters and of the
+	// headers, joined with commas.
+	Query  map[string]string
+	Header map[string]string
+	Body   string
+	// JSON is the decoded body when it is JSON, like .Request.JSON.user.id.
+	JSON interface{}
+}
+
+// templateFuncs are the helpers of the templated mocks.
+var templateFuncs = template.FuncMap{
+	"now":       func() time.Time { return time.Now().UTC() },
+	"unix":      func(t time.Time) int64 { return t.Unix() },
+	"unixMilli": func(t time.Time) int64 { return t.UnixMilli() },
+	"uuid":      randomUUID,
+	"randInt": func(min, max int) (int, error) {
+		if max < min {
+			return 0, fmt.Errorf("randInt: max %d is lower than min %d", max, min)
+		}
+		return min + rand.Intn(max-min+1), nil
+	},
+	"int": templateInt,
+	"add": func(a, b interface{}) (int64, error) {
+		x, err := templateInt(a)
+		if err != nil {
+			return 0, err
+		}
+		y, err := templateInt(b)
+		return x + y, err
+	},
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+}
+
+// templateInt converts a number, or a string holding one, to an integer.
+func templateInt(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	case json.Number:
+		return v.Int64()
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("int: %v is not a number", v)
+}
+
+// newTemplateData returns the data of the templated mocks replayed for req.
+func (s *session) newTemplateData(req *http.Request, body []byte) *templateData {
+	r := templateRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Host:   req.URL.Host,
+		Path:   req.URL.Path,
+		Query:  map[string]string{},
+		Header: flattenHeader(req.Header),
+		Body:   string(body),
+	}
+	for k, v := range req.URL.Query() {
+		r.Query[k] = strings.Join(v, ",")
+	}
+	var v interface{}
+	if decodeJSON(body, &v) == nil {
+		r.JSON = v
+	}
+	return &templateData{Request: r, Vars: s.match.templateVars(req)}
+}
+
+// templateVars returns the named groups of the path and query patterns of the
+// HTTP matching rule applying to req.
+func (m *matcher) templateVars(req *http.Request) map[string]string {
+	vars := map[string]string{}
+	rule := m.httpRule(req)
+	if rule == nil {
+		return vars
+	}
+	capture := func(re *regexp.Regexp, s string) {
+		match := re.FindStringSubmatch(s)
+		for i, name := range re.SubexpNames() {
+			if name != "" && match != nil {
+				vars[name] = match[i]
+			}
+		}
+	}
+	if rule.path != nil {
+		capture(rule.path, req.URL.Path)
+	}
+	query := req.URL.Query()
+	for k, re := range rule.query {
+		capture(re, strings.Join(query[k], ","))
+	}
+	return vars
+}
+
+// renderResponse renders the headers and the body of the response of m, a
+// templated HTTP mock, for the replayed request.
+func renderResponse(m *Mock, resp *httpResponse, data *templateData) error {
+	render := func(text string) (string, error) {
+		if !strings.Contains(text, "{{") {
+			return text, nil
+		}
+		t, err := template.New(m.Name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return "", fmt.Errorf("keploy: failed to parse the template of mock %s %w", m.Name, err)
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("keploy: failed to render the template of mock %s %w", m.Name, err)
+		}
+		return b.String(), nil
+	}
+	var err error
+	for k, v := range resp.Header {
+		if resp.Header[k], err = render(v); err != nil {
+			return err
+		}
+	}
+	for i := range resp.Chunks {
+		if resp.Chunks[i].Data, err = render(resp.Chunks[i].Data); err != nil {
+			return err
+		}
+	}
+	resp.Body, err = render(resp.Body)
+	return err
+}
@@ -0,0 +1,138 @@
+package keploy
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const templateStubs = `version: api.keploy.io/v1beta1
+kind: Http
+name: user
+template: true
+spec:
+    req:
+        method: POST
+        url: http://api.test/users/1
+        body: '{"name":"ann"}'
+    resp:
+        status_code: 200
+        header:
+            X-Trace: '{{ index .Request.Header "X-Trace" }}'
+        body: '{"id":{{ .Vars.id }},"next":{{ add .Vars.id 1 }},"name":"{{ .Request.JSON.name | upper }}","q":"{{ index .Request.Query "q" | default "none" }}","at":{{ now | unix }},"request":"{{ uuid }}"}'
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: events
+template: true
+spec:
+    req:
+        method: GET
+        url: http://api.test/events/1
+    resp:
+        status_code: 200
+        header:
+            Content-Type: text/event-stream
+        chunks:
+            - data: "data: {{ .Request.Path }}\n\n"
+            - data: "data: done\n\n"
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: broken
+template: true
+spec:
+    req:
+        method: GET
+        url: http://api.test/broken
+    resp:
+        status_code: 200
+        body: '{{ .Request.Missing }}'
+---
+version: api.keploy.io/v1beta1
+kind: Http
+name: literal
+spec:
+    req:
+        method: GET
+        url: http://api.test/literal
+    resp:
+        status_code: 200
+        body: '{{ not rendered }}'
+`
+
+func TestTemplatedMocks(t *testing.T) {
+	dir := writeStubs(t, "TestTemplatedMocks", templateStubs)
+	c := &http.Client{Transport: &Transport{}}
+	startTestSession(t, MODE_TEST, dir, Config{Matching: Matching{HTTP: []HTTPRule{
+		{Path: `/users/(?P<id>\d+)`, Query: map[string]string{"q": ".*"}, Body: BodyJSONSubset},
+		{Path: `/events/\d+`},
+	}}})
+
+	start := time.Now().Unix()
+	status, body, err := send(t, c, "POST", "http://api.test/users/42", map[string]string{"X-Trace": "t1"}, `{"name":"ann","age":3}`)
+	if err != nil || status != 200 {
+		t.Fatalf("got %d %q %v", status, body, err)
+	}
+	var got struct {
+		ID      int    `json:"id"`
+		Next    int    `json:"next"`
+		Name    string `json:"name"`
+		Q       string `json:"q"`
+		At      int64  `json:"at"`
+		Request string `json:"request"`
+	}
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatalf("rendered %q %v", body, err)
+	}
+	if got.ID != 42 || got.Next != 43 || got.Name != "ANN" || got.Q != "none" || got.At < start || got.At > time.Now().Unix() {
+		t.Fatalf("rendered %q", body)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(got.Request) {
+		t.Fatalf("rendered the uuid %q", got.Request)
+	}
+
+	req, _ := http.NewRequest("POST", "http://api.test/users/7?q=go", strings.NewReader(`{"name":"ann"}`))
+	req.Header.Set("X-Trace", "t2")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Trace") != "t2" {
+		t.Fatalf("rendered the headers %v", resp.Header)
+	}
+
+	if events := readEvents(t, c, "http://api.test/events/9"); strings.Join(events, "|") != "data: /events/9|data: done" {
+		t.Fatalf("rendered the events %q", events)
+	}
+	if _, _, err := send(t, c, "GET", "http://api.test/broken", nil, ""); err == nil || !strings.Contains(err.Error(), "failed to render the template of mock broken") {
+		t.Fatalf("got %v, want the template error", err)
+	}
+	if _, body, err := send(t, c, "GET", "http://api.test/literal", nil, ""); err != nil || body != "{{ not rendered }}" {
+		t.Fatalf("got %q %v, want the body of the mock without template as is", body, err)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	randInt := templateFuncs["randInt"].(func(int, int) (int, error))
+	for i := 0; i < 100; i++ {
+		if n, err := randInt(3, 5); err != nil || n < 3 || n > 5 {
+			t.Fatalf("randInt(3, 5) = %d %v", n, err)
+		}
+	}
+	if _, err := randInt(5, 3); err == nil {
+		t.Error("randInt(5, 3) did not fail")
+	}
+	for _, v := range []interface{}{3, int64(3), 3.0, json.Number("3"), "3"} {
+		if n, err := templateInt(v); err != nil || n != 3 {
+			t.Errorf("templateInt(%#v) = %d %v", v, n, err)
+		}
+	}
+	if _, err := templateInt(true); err == nil {
+		t.Error("templateInt(true) did not fail")
+	}
+}
@@ -0,0 +1,509 @@
+package keploy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// webSocketKind is the kind of the mocks recorded by the WebSocket stand-in.
+const webSocketKind = "WebSocket"
+
+// webSocketSpec is the spec of a WebSocket mock, a whole connection: the
+// upgrade request and the ordered messages exchanged over it.
+type webSocketSpec struct {
+	Metadata map[string]string  `yaml:"metadata,omitempty"`
+	Path     string             `yaml:"path"`
+	Protocol string             `yaml:"protocol,omitempty"`
+	Messages []webSocketMessage `yaml:"messages"`
+}
+
+// webSocketMessage is a message sent by the client or the server. Close
+// messages carry the close code and the reason in Data.
+type webSocketMessage struct {
+	From  string        `yaml:"from"`
+	Type  string        `yaml:"type"`
+	Data  string        `yaml:"data,omitempty"`
+	Code  int           `yaml:"code,omitempty"`
+	Delay time.Duration `yaml:"delay,omitempty"` // since the previous message
+}
+
+// frame opcodes of RFC 6455
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const (
+	wsCloseNoStatus     = 1005
+	wsClosePolicy       = 1008
+	wsMaxMessageSize    = 64 << 20
+	wsHandshakeGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsCloseReplyTimeout = time.Second
+)
+
+var wsTypes = map[byte]string{wsText: "text", wsBinary: "binary", wsClose: "close"}
+
+// WebSocketStandIn is a localhost WebSocket server following the mode of the
+// last call to New. In MODE_RECORD it proxies the connections to the upstream
+// server and records the upgrade and every message in the stubs file, with
+// its delay since the previous one. In MODE_TEST it answers the connections
+// from the recorded messages: the messages of the client are expected in the
+// recorded order and the ones of the server are sent after them. In MODE_OFF
+// it only proxies, as it does in every mode for the connections left out by
+// Config.Filters, filtered by the upstream URL and the requested path.
+//
+// Clients connect to URL with the path of the upstream server, e.g.
+// URL()+"/v1/stream?token=x" for wss://api.example.com/v1/stream?token=x.
+type WebSocketStandIn struct {
+	*standIn
+	upstream *url.URL
+	// Timing makes MODE_TEST wait for the recorded delay before sending each
+	// message of the server, instead of sending it right away.
+	Timing bool
+}
+
+// StartWebSocketStandIn starts a WebSocket stand-in of the upstream server,
+// a ws:// or wss:// URL which is only used in MODE_RECORD and MODE_OFF, on a
+// random localhost port.
+func StartWebSocketStandIn(upstream string) (*WebSocketStandIn, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the upstream url %w", err)
+	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https":
+	default:
+		if upstream != "" {
+			return nil, fmt.Errorf("unsupported scheme of the upstream url %s", upstream)
+		}
+	}
+	w := &WebSocketStandIn{upstream: u}
+	w.standIn, err = listenStandIn(w.serveConn)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// URL returns the ws:// URL of the stand-in.
+func (w *WebSocketStandIn) URL() string {
+	return "ws://" + w.Addr()
+}
+
+func (w *WebSocketStandIn) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || req.Header.Get("Sec-WebSocket-Key") == "" {
+		writeHTTPError(conn, http.StatusBadRequest, "keploy: not a websocket upgrade request")
+		return
+	}
+	s := activeSession()
+	t := urlTarget(w.upstream)
+	t.protocol = strings.Replace(t.protocol, "http", "ws", 1)
+	t.path = req.URL.Path
+	mode := s.modeFor(t)
+	if mode == MODE_TEST {
+		w.replay(s, conn, r, req)
+		return
+	}
+	if err := w.proxy(s, mode, conn, r, req); err != nil {
+		logger.Error(fmt.Sprintf("failed to proxy the websocket connection to %s", w.upstream.Host), zap.Error(err))
+	}
+}
+
+func (w *WebSocketStandIn) proxy(s *session, mode Mode, conn net.Conn, r *bufio.Reader, req *http.Request) error {
+	up, err := w.dialUpstream()
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadGateway, err.Error())
+		return err
+	}
+	defer up.Close()
+
+	req.Host = w.upstream.Host
+	// the messages are recorded as sent by the application, uncompressed
+	req.Header.Del("Sec-WebSocket-Extensions")
+	if err := req.Write(up); err != nil {
+		return err
+	}
+	upR := bufio.NewReader(up)
+	resp, err := http.ReadResponse(upR, req)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadGateway, err.Error())
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp.Write(conn)
+	}
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		return err
+	}
+
+	rec := &wsRecorder{last: time.Now()}
+	var wg sync.WaitGroup
+	pump := func(from string, src *bufio.Reader, dst net.Conn) {
+		defer wg.Done()
+		// unblock the other direction once this one is over
+		defer conn.Close()
+		defer up.Close()
+		var msg wsMessageReader
+		for {
+			f, err := readWSFrame(src)
+			if err != nil {
+				return
+			}
+			if _, err := dst.Write(f.raw); err != nil {
+				return
+			}
+			if op, data, ok := msg.add(f); ok {
+				rec.add(from, op, data)
+			}
+		}
+	}
+	wg.Add(2)
+	go pump("client", r, up)
+	go pump("server", upR, conn)
+	wg.Wait()
+
+	if mode != MODE_RECORD {
+		return nil
+	}
+	spec := webSocketSpec{Path: req.URL.RequestURI(), Protocol: resp.Header.Get("Sec-WebSocket-Protocol"), Messages: rec.messages}
+	return s.record(webSocketKind, spec)
+}
+
+func (w *WebSocketStandIn) dialUpstream() (net.Conn, error) {
+	if w.upstream.Host == "" {
+		return nil, errors.New("keploy: no upstream websocket server")
+	}
+	secure := w.upstream.Scheme == "wss" || w.upstream.Scheme == "https"
+	addr := w.upstream.Host
+	if w.upstream.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(w.upstream.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(w.upstream.Hostname(), "80")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil || !secure {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: w.upstream.Hostname()})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (w *WebSocketStandIn) replay(s *session, conn net.Conn, r *bufio.Reader, req *http.Request) {
+	path := req.URL.RequestURI()
+	target := path
+	set, err := s.mocks(webSocketKind)
+	spec := &webSocketSpec{}
+	var mock *Mock
+	if err == nil {
+		path = s.redact.text(path)
+		var ok bool
+		if mock, ok = set.find(func(m *Mock) bool {
+			recorded := &webSocketSpec{}
+			return m.decode(recorded) == nil && recorded.Path == path
+		}); ok {
+			err = mock.decode(spec)
+		} else {
+			err = fmt.Errorf("keploy: no recorded mock matches the websocket connection to %s", path)
+		}
+	}
+	if err != nil {
+		logger.Warn("failed to replay the websocket connection", zap.Error(err))
+		writeHTTPError(conn, http.StatusNotFound, err.Error())
+		return
+	}
+	s.called(mock, target, "")
+
+	sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + wsHandshakeGUID))
+	var head bytes.Buffer
+	head.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&head, "Sec-WebSocket-Accept: %s\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if spec.Protocol != "" {
+		fmt.Fprintf(&head, "Sec-WebSocket-Protocol: %s\r\n", spec.Protocol)
+	}
+	head.WriteString("\r\n")
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		return
+	}
+
+	c := &wsServerConn{conn: conn, r: r}
+	for i, m := range spec.Messages {
+		if m.From == "server" {
+			if w.Timing {
+				time.Sleep(m.Delay)
+			}
+			if err := c.send(m); err != nil || m.Type == "close" {
+				c.awaitClose()
+				return
+			}
+			continue
+		}
+		op, data, err := c.receive()
+		if err != nil {
+			return
+		}
+		if op == wsClose {
+			c.closeReply(data)
+			return
+		}
+		if wsTypes[op] != m.Type || !s.sameMessage(mock, spec, i, s.redact.text(string(data))) {
+			logger.Warn(fmt.Sprintf("keploy: no recorded mock matches the %s message sent on the websocket connection to %s", wsTypes[op], path), zap.String("message", string(data)))
+			c.close(wsClosePolicy, "keploy: no recorded mock matches the message")
+			return
+		}
+	}
+	// the recording is over, only a close is expected
+	op, data, err := c.receive()
+	if err != nil {
+		return
+	}
+	if op == wsClose {
+		c.closeReply(data)
+		return
+	}
+	c.close(wsClosePolicy, "keploy: no recorded mock matches the message")
+}
+
+// sameMessage reports whether data, received from the client, matches the
+// message i of spec, the spec of mock, without their noise fields.
+func (s *session) sameMessage(mock *Mock, spec *webSocketSpec, i int, data string) bool {
+	want, got := spec.Messages[i].Data, data
+	if s.noise != nil || len(mock.Noise) > 0 {
+		recorded := webSocketSpec{Messages: make([]webSocketMessage, i+1)}
+		received := webSocketSpec{Messages: make([]webSocketMessage, i+1)}
+		recorded.Messages[i].Data, received.Messages[i].Data = want, got
+		if s.normalizeNoise(mock, &recorded) != nil || s.normalizeNoise(mock, &received) != nil {
+			return false
+		}
+		want, got = recorded.Messages[i].Data, received.Messages[i].Data
+	}
+	return want == got
+}
+
+// wsServerConn is the server side of a replayed connection.
+type wsServerConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	msg  wsMessageReader
+}
+
+func (c *wsServerConn) send(m webSocketMessage) error {
+	switch m.Type {
+	case "text":
+		return writeWSFrame(c.conn, wsText, []byte(m.Data))
+	case "binary":
+		return writeWSFrame(c.conn, wsBinary, []byte(m.Data))
+	case "close":
+		return writeWSFrame(c.conn, wsClose, wsClosePayload(m.Code, m.Data))
+	}
+	return fmt.Errorf("unknown websocket message type %s", m.Type)
+}
+
+// receive returns the next message of the client, answering its pings.
+func (c *wsServerConn) receive() (byte, []byte, error) {
+	for {
+		f, err := readWSFrame(c.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if f.op == wsPing {
+			if err := writeWSFrame(c.conn, wsPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if op, data, ok := c.msg.add(f); ok {
+			return op, data, nil
+		}
+	}
+}
+
+func (c *wsServerConn) close(code int, reason string) {
+	if writeWSFrame(c.conn, wsClose, wsClosePayload(code, reason)) == nil {
+		c.awaitClose()
+	}
+}
+
+// closeReply echoes the close frame of the client.
+func (c *wsServerConn) closeReply(payload []byte) {
+	if len(payload) >= 2 {
+		payload = payload[:2]
+	}
+	writeWSFrame(c.conn, wsClose, payload)
+}
+
+// awaitClose waits for the client to answer the close frame of the server.
+func (c *wsServerConn) awaitClose() {
+	c.conn.SetReadDeadline(time.Now().Add(wsCloseReplyTimeout))
+	for {
+		op, _, err := c.receive()
+		if err != nil || op == wsClose {
+			return
+		}
+	}
+}
+
+// wsRecorder collects the messages of a proxied connection.
+type wsRecorder struct {
+	mu       sync.Mutex
+	last     time.Time
+	messages []webSocketMessage
+}
+
+func (r *wsRecorder) add(from string, op byte, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	m := webSocketMessage{From: from, Type: wsTypes[op], Data: string(data), Delay: now.Sub(r.last)}
+	if op == wsClose {
+		m.Code, m.Data = wsCloseCode(data)
+	}
+	r.last = now
+	r.messages = append(r.messages, m)
+}
+
+// wsMessageReader reassembles the fragmented messages.
+type wsMessageReader struct {
+	op   byte
+	data []byte
+}
+
+// add returns the message completed by f, if any. Pings and pongs are not
+// messages.
+func (r *wsMessageReader) add(f *wsFrame) (byte, []byte, bool) {
+	switch f.op {
+	case wsClose:
+		return wsClose, f.payload, true
+	case wsPing, wsPong:
+		return 0, nil, false
+	case wsContinuation:
+		r.data = append(r.data, f.payload...)
+	default:
+		r.op, r.data = f.op, append([]byte{}, f.payload...)
+	}
+	if !f.fin {
+		return 0, nil, false
+	}
+	data := r.data
+	r.data = nil
+	return r.op, data, true
+}
+
+type wsFrame struct {
+	fin     bool
+	op      byte
+	payload []byte
+	raw     []byte // the frame as read, masked by the clients
+}
+
+func readWSFrame(r *bufio.Reader) (*wsFrame, error) {
+	raw := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	f := &wsFrame{fin: raw[0]&0x80 != 0, op: raw[0] & 0x0f}
+	masked := raw[1]&0x80 != 0
+	size := uint64(raw[1] & 0x7f)
+	ext := 0
+	switch size {
+	case 126:
+		ext = 2
+	case 127:
+		ext = 8
+	}
+	if masked {
+		ext += 4
+	}
+	raw = raw[:2+ext]
+	if _, err := io.ReadFull(r, raw[2:]); err != nil {
+		return nil, err
+	}
+	switch size {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(raw[2:]))
+	case 127:
+		size = binary.BigEndian.Uint64(raw[2:])
+	}
+	if size > wsMaxMessageSize {
+		return nil, fmt.Errorf("websocket frame of %d bytes is too large", size)
+	}
+	f.raw = make([]byte, len(raw)+int(size))
+	copy(f.raw, raw)
+	if _, err := io.ReadFull(r, f.raw[len(raw):]); err != nil {
+		return nil, err
+	}
+	f.payload = append([]byte{}, f.raw[len(raw):]...)
+	if masked {
+		key := raw[len(raw)-4:]
+		for i := range f.payload {
+			f.payload[i] ^= key[i%4]
+		}
+	}
+	return f, nil
+}
+
+// writeWSFrame writes a single unmasked frame, as the servers do.
+func writeWSFrame(w io.Writer, op byte, payload []byte) error {
+	b := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, byte(n))
+	case n <= 0xffff:
+		b = appendUint16(append(b, 126), uint16(n))
+	default:
+		b = appendUint64(append(b, 127), uint64(n))
+	}
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+func wsClosePayload(code int, reason string) []byte {
+	if code == 0 || code == wsCloseNoStatus {
+		return nil
+	}
+	return append(appendUint16(nil, uint16(code)), reason...)
+}
+
+func wsCloseCode(payload []byte) (int, string) {
+	if len(payload) < 2 {
+		return wsCloseNoStatus, ""
+	}
+	return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+}
+
+func writeHTTPError(conn net.Conn, status int, msg string) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", status, http.StatusText(status), len(msg), msg)
+}
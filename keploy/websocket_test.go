@@ -0,0 +1,125 @@
+package keploy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const webSocketStubs = `version: api.keploy.io/v1beta1
+kind: WebSocket
+name: websocket-0
+spec:
+  path: /feed
+  messages:
+    - {from: server, type: text, data: first}
+    - {from: client, type: text, data: ack}
+---
+version: api.keploy.io/v1beta1
+kind: WebSocket
+name: websocket-1
+spec:
+  path: /feed
+  messages:
+    - {from: server, type: text, data: second}
+    - {from: client, type: text, data: ack}
+`
+
+// dialWebSocket opens a connection to the path of a stand-in, and returns it
+// with the response to the upgrade.
+func dialWebSocket(t *testing.T, addr, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", path, addr)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+func TestWebSocketReplaysTheReusedMock(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), webSocketStubs), Config{})
+	w, err := StartWebSocketStandIn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		conn, r, resp := dialWebSocket(t, w.Addr(), "/feed")
+		if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Fatalf("got %s %v, want the upgrade", resp.Status, resp.Header)
+		}
+		f, err := readWSFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(f.payload))
+		if err := writeWSFrame(conn, wsText, []byte("ack")); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeWSFrame(conn, wsClose, wsClosePayload(1000, "")); err != nil {
+			t.Fatal(err)
+		}
+		if f, err := readWSFrame(r); err != nil || f.op != wsClose {
+			t.Fatalf("got %v %v, want the close to be echoed", f, err)
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"first", "second", "first"}) {
+		t.Fatalf("got %q, want the first recording to be reused", got)
+	}
+}
+
+func TestWebSocketUnexpectedMessage(t *testing.T) {
+	startTestSession(t, MODE_TEST, writeStubs(t, t.Name(), webSocketStubs), Config{})
+	w, err := StartWebSocketStandIn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	conn, r, _ := dialWebSocket(t, w.Addr(), "/feed")
+	if _, err := readWSFrame(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWSFrame(conn, wsText, []byte("nack")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readWSFrame(r)
+	if err != nil || f.op != wsClose {
+		t.Fatalf("got %v %v, want a close", f, err)
+	}
+	if code, _ := wsCloseCode(f.payload); code != wsClosePolicy {
+		t.Fatalf("closed with %d, want %d", code, wsClosePolicy)
+	}
+}
+
+func TestWebSocketFrameLengths(t *testing.T) {
+	for _, n := range []int{5, 300, 70000} {
+		var buf bytes.Buffer
+		payload := bytes.Repeat([]byte{'x'}, n)
+		if err := writeWSFrame(&buf, wsBinary, payload); err != nil {
+			t.Fatal(err)
+		}
+		f, err := readWSFrame(bufio.NewReader(&buf))
+		if err != nil || !f.fin || f.op != wsBinary || !bytes.Equal(f.payload, payload) {
+			t.Fatalf("frame of %d bytes read back as %v, %v", n, f, err)
+		}
+	}
+	if code, reason := wsCloseCode(wsClosePayload(4001, "bye")); code != 4001 || reason != "bye" {
+		t.Fatalf("got close %d %q", code, reason)
+	}
+}